@@ -70,6 +70,9 @@ func getBazaarPackageREAME(c *gin.Context) {
 	repoURL := arg["repoURL"].(string)
 	repoHash := arg["repoHash"].(string)
 	packageType := arg["packageType"].(string)
+	if refresh, _ := arg["refresh"].(bool); refresh {
+		model.InvalidatePackageREADME(repoURL, repoHash, packageType)
+	}
 	ret.Data = map[string]interface{}{
 		"html": model.GetPackageREADME(repoURL, repoHash, packageType),
 	}
@@ -127,7 +130,7 @@ func installBazaarPlugin(c *gin.Context) {
 	repoURL := arg["repoURL"].(string)
 	repoHash := arg["repoHash"].(string)
 	packageName := arg["packageName"].(string)
-	err := model.InstallBazaarPlugin(repoURL, repoHash, packageName)
+	restartRequired, err := model.InstallBazaarPlugin(repoURL, repoHash, packageName)
 	if nil != err {
 		ret.Code = 1
 		ret.Msg = err.Error()
@@ -138,7 +141,8 @@ func installBazaarPlugin(c *gin.Context) {
 
 	util.PushMsg(model.Conf.Language(69), 3000)
 	ret.Data = map[string]interface{}{
-		"packages": model.BazaarPlugins(frontend, ""),
+		"packages":        model.BazaarPlugins(frontend, ""),
+		"restartRequired": restartRequired,
 	}
 }
 
@@ -147,7 +147,13 @@ func setBazaar(c *gin.Context) {
 		return
 	}
 
+	// 在当前配置的副本上修改，请求中没有的字段（比如只修改信任状态时的其他集市设置）保持不变
 	bazaar := &conf.Bazaar{}
+	*bazaar = *model.Conf.Bazaar
+	if nil != bazaar.Freshness {
+		freshness := *bazaar.Freshness
+		bazaar.Freshness = &freshness
+	}
 	if err = gulu.JSON.UnmarshalJSON(param, bazaar); nil != err {
 		ret.Code = -1
 		ret.Msg = err.Error()
@@ -155,6 +161,7 @@ func setBazaar(c *gin.Context) {
 	}
 
 	model.Conf.Bazaar = bazaar
+	model.InitBazaar()
 	model.Conf.Save()
 
 	ret.Data = bazaar
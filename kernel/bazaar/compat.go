@@ -0,0 +1,150 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// defaultMinAppVersion 如果集市包中缺失 minAppVersion 项，则使用该值作为最低支持的版本号，小于该版本号时不显示集市包
+// Add marketplace package config item `minAppVersion` https://github.com/siyuan-note/siyuan/issues/8330
+const defaultMinAppVersion = "2.9.0"
+
+func disallowDisplayBazaarPackage(pkg *Package) bool {
+	return isUnsupportedAppVersion(pkg.MinAppVersion, currentAppVersion) || isAboveMaxAppVersion(pkg.MaxAppVersion, currentAppVersion) || isExcludedPrerelease(pkg.Version)
+}
+
+// isAboveMaxAppVersion 判断 appVersion 是否高于集市包支持的最高版本 maxAppVersion，maxAppVersion 为空时没有上限。
+func isAboveMaxAppVersion(maxAppVersion, appVersion string) bool {
+	if "" == maxAppVersion {
+		return false
+	}
+	return 0 < semver.Compare("v"+appVersion, "v"+maxAppVersion)
+}
+
+// CheckCompatibilityAgainst 返回指定类型的已安装包中在 appVersion 版本下不兼容（minAppVersion 高于 appVersion）的包，用于评估降级等场景的影响。
+func CheckCompatibilityAgainst(packageType, appVersion string) (ret []*Package, err error) {
+	if "" == packageInstallDir(packageType) {
+		err = fmt.Errorf("invalid package type [%s]", packageType)
+		return
+	}
+	if !semver.IsValid("v" + appVersion) {
+		err = fmt.Errorf("invalid app version [%s]", appVersion)
+		return
+	}
+
+	ret = incompatiblePackagesAgainst(installedPackages(packageType), appVersion)
+	return
+}
+
+func incompatiblePackagesAgainst(installed map[string]*Package, appVersion string) (ret []*Package) {
+	ret = []*Package{}
+	for _, pkg := range installed {
+		if isUnsupportedAppVersion(pkg.MinAppVersion, appVersion) {
+			ret = append(ret, pkg)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return
+}
+
+// isUnsupportedAppVersion 判断集市包要求的最低版本 minAppVersion 是否高于 appVersion。
+func isUnsupportedAppVersion(minAppVersion, appVersion string) bool {
+	if "" == minAppVersion { // TODO: 目前暂时放过所有不带 minAppVersion 的集市包，后续版本会使用 defaultMinAppVersion
+		return false
+	}
+	if 0 < semver.Compare("v"+minAppVersion, "v"+appVersion) {
+		return true
+	}
+	return false
+}
+
+func isCompatibleBackend(backends []string) bool {
+	if 1 > len(backends) {
+		return true
+	}
+
+	for _, backend := range backends {
+		if backend == currentBackend() || "all" == backend {
+			return true
+		}
+	}
+	return false
+}
+
+func isCompatibleFrontend(frontends []string, currentFrontend string) bool {
+	for _, frontend := range frontends {
+		if frontend == currentFrontend || "all" == frontend {
+			return true
+		}
+	}
+	return false
+}
+
+type CompatRow struct {
+	Repo          string   `json:"repo"`
+	Version       string   `json:"version"`
+	MinAppVersion string   `json:"minAppVersion"`
+	Backends      []string `json:"backends"`
+	Frontends     []string `json:"frontends"`
+	Compatible    bool     `json:"compatible"`
+}
+
+// ExportCompatibilityMatrix 导出集市包的兼容性矩阵，用于文档和问题排查。
+//
+// 前端由客户端决定，这里使用当前运行环境的默认前端计算是否兼容，未声明 frontends 的包视为兼容。
+func ExportCompatibilityMatrix(packageType string) (ret []CompatRow, err error) {
+	ret = []CompatRow{}
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+
+	frontend := currentFrontend()
+	for _, repo := range stageIndex.Repos {
+		if nil == repo.Package {
+			continue
+		}
+
+		pkg := repo.Package
+		ret = append(ret, CompatRow{
+			Repo:          strings.Split(repo.URL, "@")[0],
+			Version:       pkg.Version,
+			MinAppVersion: pkg.MinAppVersion,
+			Backends:      pkg.Backends,
+			Frontends:     pkg.Frontends,
+			Compatible:    isCompatibleStagePackage(pkg, frontend),
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Repo < ret[j].Repo })
+	return
+}
+
+// isCompatibleStagePackage 判断集市包是否兼容当前版本、后端和指定前端，未声明 frontends 的包视为兼容。
+func isCompatibleStagePackage(pkg *StagePackage, frontend string) bool {
+	return !isUnsupportedAppVersion(pkg.MinAppVersion, currentAppVersion) && isCompatiblePlatform(pkg.Backends, pkg.Frontends, frontend)
+}
+
+// isCompatiblePlatform 判断声明的 backends/frontends 是否支持当前后端和指定前端，未声明视为支持。
+func isCompatiblePlatform(backends, frontends []string, frontend string) bool {
+	return isCompatibleBackend(backends) && (1 > len(frontends) || isCompatibleFrontend(frontends, frontend))
+}
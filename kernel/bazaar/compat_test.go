@@ -0,0 +1,173 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"testing"
+
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestExportCompatibilityMatrix(t *testing.T) {
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/compatible@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "1.0.0", MinAppVersion: "2.9.0", Backends: []string{"all"}, Frontends: []string{"all"}}},
+		{URL: "siyuan-note/too-new@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "1.0.0", MinAppVersion: "99.0.0"}},
+	}})
+
+	matrix, err := ExportCompatibilityMatrix("plugins")
+	if nil != err {
+		t.Fatalf("export compatibility matrix failed: %s", err)
+	}
+	if 2 != len(matrix) {
+		t.Fatalf("expected 2 rows, got %d", len(matrix))
+	}
+	if "siyuan-note/compatible" != matrix[0].Repo || !matrix[0].Compatible {
+		t.Fatalf("expected [siyuan-note/compatible] to be compatible: %+v", matrix[0])
+	}
+	if "siyuan-note/too-new" != matrix[1].Repo || matrix[1].Compatible {
+		t.Fatalf("expected [siyuan-note/too-new] to be incompatible: %+v", matrix[1])
+	}
+}
+
+func TestDisallowDisplayBazaarPackageAppVersionRange(t *testing.T) {
+	setTestAppVersion(t, currentAppVersion)
+
+	pkg := &Package{Version: "1.0.0", MinAppVersion: "3.0.0", MaxAppVersion: "3.2.0"}
+	for appVersion, disallowed := range map[string]bool{
+		"2.9.9":  true, // 低于最低版本
+		"3.0.0":  false,
+		"3.1.5":  false,
+		"3.2.0":  false,
+		"3.2.1":  true, // 高于最高版本
+		"3.10.0": true,
+	} {
+		currentAppVersion = appVersion
+		if disallowed != disallowDisplayBazaarPackage(pkg) {
+			t.Fatalf("expected disallowed [%v] on app version [%s]", disallowed, appVersion)
+		}
+	}
+
+	// 没有最高版本时不限制
+	pkg.MaxAppVersion = ""
+	if currentAppVersion = "99.0.0"; disallowDisplayBazaarPackage(pkg) {
+		t.Fatalf("expected package without max app version to be displayed")
+	}
+}
+
+func TestCurrentBackendFrontend(t *testing.T) {
+	getRuntime := getRuntimeDescriptor
+	defer func() { getRuntimeDescriptor = getRuntime }()
+
+	cases := []struct {
+		rt       runtimeDescriptor
+		backend  string
+		frontend string
+	}{
+		{runtimeDescriptor{OS: "windows", Container: util.ContainerStd}, "windows", "desktop"},
+		{runtimeDescriptor{OS: "darwin", Container: util.ContainerStd}, "darwin", "desktop"},
+		{runtimeDescriptor{OS: "linux", Container: util.ContainerStd}, "linux", "desktop"},
+		{runtimeDescriptor{OS: "linux", Container: util.ContainerDocker}, "docker", "browser-desktop"},
+		{runtimeDescriptor{OS: "android", Container: util.ContainerAndroid}, "android", "mobile"},
+		{runtimeDescriptor{OS: "ios", Container: util.ContainerIOS}, "ios", "mobile"},
+	}
+	for _, c := range cases {
+		rt := c.rt
+		getRuntimeDescriptor = func() *runtimeDescriptor { return &rt }
+		if backend := currentBackend(); c.backend != backend {
+			t.Fatalf("expected backend [%s] for %+v, got [%s]", c.backend, rt, backend)
+		}
+		if frontend := currentFrontend(); c.frontend != frontend {
+			t.Fatalf("expected frontend [%s] for %+v, got [%s]", c.frontend, rt, frontend)
+		}
+	}
+
+	getRuntimeDescriptor = func() *runtimeDescriptor {
+		return &runtimeDescriptor{OS: "linux", Container: util.ContainerDocker}
+	}
+	plugin := &Plugin{Package: &Package{Backends: []string{"docker"}, Frontends: []string{"desktop"}}}
+	if !isIncompatiblePlugin(plugin, "") {
+		t.Fatalf("expected desktop only plugin to be incompatible in docker")
+	}
+	if isIncompatiblePlugin(plugin, "desktop") {
+		t.Fatalf("expected explicit frontend to take precedence")
+	}
+	plugin.Backends = []string{"windows", "darwin"}
+	if !isIncompatiblePlugin(plugin, "desktop") {
+		t.Fatalf("expected windows/darwin only plugin to be incompatible in docker")
+	}
+}
+
+func TestCheckCompatibilityAgainst(t *testing.T) {
+	installed := map[string]*Package{
+		"new-plugin":    {Name: "new-plugin", MinAppVersion: "3.0.0"},
+		"old-plugin":    {Name: "old-plugin", MinAppVersion: "2.9.0"},
+		"legacy-plugin": {Name: "legacy-plugin"},
+	}
+
+	if incompatible := incompatiblePackagesAgainst(installed, "3.1.0"); 0 != len(incompatible) {
+		t.Fatalf("expected all packages to be compatible with 3.1.0, got %d", len(incompatible))
+	}
+	incompatible := incompatiblePackagesAgainst(installed, "2.10.0")
+	if 1 != len(incompatible) || "new-plugin" != incompatible[0].Name {
+		t.Fatalf("expected only new-plugin to be incompatible with 2.10.0, got %v", incompatible)
+	}
+	if incompatible = incompatiblePackagesAgainst(installed, "2.8.0"); 2 != len(incompatible) || "new-plugin" != incompatible[0].Name || "old-plugin" != incompatible[1].Name {
+		t.Fatalf("expected new-plugin and old-plugin to be incompatible with 2.8.0, got %v", incompatible)
+	}
+
+	if _, err := CheckCompatibilityAgainst("plugins", "not a version"); nil == err {
+		t.Fatalf("expected error for invalid app version")
+	}
+	if _, err := CheckCompatibilityAgainst("unknown", "3.0.0"); nil == err {
+		t.Fatalf("expected error for invalid package type")
+	}
+}
+
+func TestPlatformDropped(t *testing.T) {
+	getRuntime := getRuntimeDescriptor
+	defer func() { getRuntimeDescriptor = getRuntime }()
+	getRuntimeDescriptor = func() *runtimeDescriptor {
+		return &runtimeDescriptor{OS: "android", Container: util.ContainerAndroid}
+	}
+
+	installed := &Plugin{Package: &Package{Name: "p", Author: "siyuan", URL: "https://github.com/siyuan-note/p", Version: "1.0.0",
+		Backends: []string{"all"}, Frontends: []string{"desktop", "mobile"}}}
+	latest := &Plugin{Package: &Package{Name: "p", Author: "siyuan", URL: "https://github.com/siyuan-note/p", Version: "1.1.0", RepoHash: "6286912c",
+		Backends: []string{"all"}, Frontends: []string{"desktop"}}}
+	if !isOutdatedPlugin(installed, []*Plugin{latest}, "") || !installed.PlatformDropped {
+		t.Fatalf("expected mobile support drop to be flagged")
+	}
+
+	installed.PlatformDropped = false
+	latest.Frontends = []string{"desktop", "mobile"}
+	if !isOutdatedPlugin(installed, []*Plugin{latest}, "") || installed.PlatformDropped {
+		t.Fatalf("expected plain update when mobile is still supported")
+	}
+
+	// 已安装版本本来就不支持当前平台时不算放弃支持
+	installed.Frontends = []string{"desktop"}
+	latest.Frontends = []string{"desktop"}
+	if isOutdatedPlugin(installed, []*Plugin{latest}, ""); installed.PlatformDropped {
+		t.Fatalf("expected no platform drop for already unsupported platform")
+	}
+
+	// 按调用方指定的前端判断，而不是当前运行环境
+	installed.Frontends = []string{"desktop", "mobile"}
+	if !isOutdatedPlugin(installed, []*Plugin{latest}, "desktop") || installed.PlatformDropped {
+		t.Fatalf("expected no platform drop for desktop frontend")
+	}
+}
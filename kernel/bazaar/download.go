@@ -0,0 +1,495 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+	ants "github.com/panjf2000/ants/v2"
+	gcache "github.com/patrickmn/go-cache"
+	"github.com/siyuan-note/httpclient"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+var (
+	packageLocks     = map[string]chan struct{}{} // 容量为 1 的通道作为锁，等待时可以被 ctx 取消
+	packageLocksLock = sync.Mutex{}
+)
+
+// getPackageLock 返回 repoURLHash 对应的下载锁，packageLocksLock 只在查找时持有。
+func getPackageLock(repoURLHash string) chan struct{} {
+	packageLocksLock.Lock()
+	defer packageLocksLock.Unlock()
+
+	lock, ok := packageLocks[repoURLHash]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		packageLocks[repoURLHash] = lock
+	}
+	return lock
+}
+
+// ErrInvalidRepoHash 表示 repoURLHash 缺少 @ 分隔符或者哈希不是 40 位十六进制的 Git SHA。
+var ErrInvalidRepoHash = errors.New("invalid repo hash")
+
+// validateRepoURLHash 校验 repoURLHash 的哈希部分，repoURLHash 后面可以带有包内文件路径，比如 README。
+func validateRepoURLHash(repoURLHash string) error {
+	_, hash, found := strings.Cut(repoURLHash, "@")
+	if !found {
+		return fmt.Errorf("%w: missing @ in [%s]", ErrInvalidRepoHash, repoURLHash)
+	}
+
+	hash, _, _ = strings.Cut(hash, "/")
+	if 40 != len(hash) {
+		return fmt.Errorf("%w: [%s]", ErrInvalidRepoHash, hash)
+	}
+	for _, r := range hash {
+		if !('0' <= r && '9' >= r) && !('a' <= r && 'f' >= r) && !('A' <= r && 'F' >= r) {
+			return fmt.Errorf("%w: [%s]", ErrInvalidRepoHash, hash)
+		}
+	}
+	return nil
+}
+
+// ErrChecksumMismatch 表示下载的集市包和集市索引中的 SHA-256 不一致，比如下载被截断或者内容损坏。
+var ErrChecksumMismatch = errors.New("package checksum mismatch")
+
+// downloadPackage 下载集市包，checksum 不为空时校验下载内容的 SHA-256。
+func downloadPackage(repoURLHash string, pushProgress bool, systemID, checksum string) (data []byte, err error) {
+	return downloadPackageWithContext(context.Background(), repoURLHash, pushProgress, systemID, checksum)
+}
+
+// downloadPackageWithContext 和 downloadPackage 相同，ctx 被取消时中断下载，丢弃已下载的内容并返回 ctx.Err()。
+func downloadPackageWithContext(ctx context.Context, repoURLHash string, pushProgress bool, systemID, checksum string) (data []byte, err error) {
+	if err = validateRepoURLHash(repoURLHash); nil != err {
+		logging.LogWarnf("download bazaar package failed: %s", err)
+		return
+	}
+
+	requestTime := time.Now()
+	// repoURLHash: https://github.com/88250/Comfortably-Numb@6286912c381ef3f83e455d06ba4d369c498238dc
+	repoURL := repoURLHash[:strings.LastIndex(repoURLHash, "@")]
+	// 锁和下载结果缓存使用相同的键，带不带 https://github.com/ 前缀的同一个包共用一把锁，
+	// 只锁同一个包的下载，重试等待和网络超时不会阻塞其他包的下载
+	repoURLHash = strings.TrimPrefix(repoURLHash, "https://github.com/")
+	lock := getPackageLock(repoURLHash)
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		// 等待其他请求下载同一个包时也可以取消
+		return nil, ctx.Err()
+	}
+	defer func() { <-lock }()
+
+	if recent := getRecentDownload(repoURLHash, requestTime); nil != recent {
+		// 等待锁期间其他请求（比如同一个仓库被索引到了多种包类型）已经下载完成，直接复用
+		if err = verifyPackageChecksum(repoURLHash, recent, checksum); nil != err {
+			return
+		}
+		data = recent
+		return
+	}
+
+	u := packageURL(repoURLHash)
+	buf := &bytes.Buffer{}
+	cached := getPackageETag(repoURLHash)
+	var pushedProgress float32
+	var resp *req.Response
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if 0 < attempt {
+			delay := downloadRetryBaseDelay << (attempt - 1)
+			logging.LogWarnf("get bazaar package [%s] failed, retry in [%s]", u, delay)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		buf.Reset()
+		request := bazaarRequest(httpclient.NewCloudFileRequest2m())
+		if isPackageFile(repoURLHash) {
+			request = bazaarRequest(newRawFileRequest())
+		}
+		request.SetContext(ctx)
+		if nil != cached {
+			request.SetHeader("If-None-Match", cached.etag)
+		}
+		rate := &downloadRate{}
+		resp, err = request.SetOutput(buf).SetDownloadCallback(func(info req.DownloadInfo) {
+			if pushProgress && 0 < info.Response.ContentLength {
+				progress := float32(info.DownloadedSize) / float32(info.Response.ContentLength)
+				// 重试时从头下载，进度追上之前推送的进度后才继续推送，避免进度条倒退
+				if progress < pushedProgress {
+					return
+				}
+				pushedProgress = progress
+				//logging.LogDebugf("downloading bazaar package [%f]", progress)
+				pushDownloadProgress(repoURL, progress, rate, info)
+			}
+		}).Get(u)
+		if nil != ctx.Err() {
+			logging.LogInfof("download bazaar package [%s] canceled", u)
+			return nil, ctx.Err()
+		}
+		if !isRetryableDownload(resp, err) {
+			break
+		}
+	}
+	if nil != err {
+		logging.LogErrorf("get bazaar package [%s] failed: %s", u, err)
+		return nil, errors.New("get bazaar package failed, please check your network")
+	}
+	if 304 == resp.StatusCode && nil != cached {
+		// 缓存的内容可能是在没有校验和时下载的，复用前也需要校验
+		if err = verifyPackageChecksum(repoURLHash, cached.data, checksum); nil != err {
+			return
+		}
+		data = cached.data
+		goIncPackageDownloads(repoURLHash, systemID)
+		return
+	}
+	if 200 != resp.StatusCode {
+		logging.LogErrorf("get bazaar package [%s] failed: %d", u, resp.StatusCode)
+		return nil, errors.New("get bazaar package failed: " + resp.Status)
+	}
+	data = buf.Bytes()
+	if err = verifyPackageChecksum(repoURLHash, data, checksum); nil != err {
+		return nil, err
+	}
+	setPackageETag(repoURLHash, resp.GetHeader("ETag"), data)
+	setRecentDownload(repoURLHash, data)
+
+	goIncPackageDownloads(repoURLHash, systemID)
+	return
+}
+
+// verifyPackageChecksum 校验集市包内容的 SHA-256，checksum 为空时不校验。
+func verifyPackageChecksum(repoURLHash string, data []byte, checksum string) error {
+	if "" == checksum {
+		return nil
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(data)); !strings.EqualFold(checksum, sum) {
+		logging.LogErrorf("bazaar package [%s] checksum mismatch, expected [%s], got [%s]", repoURLHash, checksum, sum)
+		return fmt.Errorf("%w: [%s]", ErrChecksumMismatch, repoURLHash)
+	}
+	return nil
+}
+
+// isPackageFile 判断 repoURLHash 是否指向包内的文件，比如 owner/repo@hash/README.md。
+func isPackageFile(repoURLHash string) bool {
+	_, hash, _ := strings.Cut(repoURLHash, "@")
+	return strings.Contains(hash, "/")
+}
+
+var (
+	rawFileClient     *req.Client
+	rawFileClientOnce = sync.Once{}
+)
+
+// newRawFileRequest 返回不自动转换响应编码的请求。
+//
+// 下载包内的文本文件（比如 README）时需要原始字节，由 decodeREADME 识别 UTF-16 等编码，
+// 否则 req 会按嗅探到的 charset 先转换为 UTF-8，BOM 和代理项都会被破坏。
+func newRawFileRequest() *req.Request {
+	rawFileClientOnce.Do(func() {
+		rawFileClient = req.C().
+			EnableForceHTTP1().
+			SetTimeout(2 * time.Minute).
+			DisableAutoDecode().
+			DisableInsecureSkipVerify().
+			SetProxy(httpclient.ProxyFromEnvironment)
+	})
+	return rawFileClient.R()
+}
+
+// downloadAttempts 下载集市包的最大尝试次数，移动网络不稳定时经常偶发失败
+const downloadAttempts = 3
+
+// downloadRetryBaseDelay 第一次重试前的等待时间，之后每次翻倍
+var downloadRetryBaseDelay = time.Second
+
+// isRetryableDownload 判断下载是否需要重试，只有网络错误和 5xx 响应重试，404 等其他响应直接返回。
+func isRetryableDownload(resp *req.Response, err error) bool {
+	if nil != err {
+		return true
+	}
+	return nil != resp && 500 <= resp.StatusCode
+}
+
+// downloadRateWindow 是计算下载速度的滑动窗口，窗口越大速度越平滑，但对网速变化的反应越慢。
+const downloadRateWindow = 3 * time.Second
+
+type downloadRateSample struct {
+	time time.Time
+	size int64
+}
+
+// downloadRate 根据滑动窗口内的下载进度采样估算下载速度和剩余时间。
+type downloadRate struct {
+	samples []downloadRateSample
+}
+
+// add 添加一个采样，返回平滑后的下载速度（字节/秒）和预计剩余时间，响应未给出内容长度或者速度无法估算时 ok 为 false。
+func (rate *downloadRate) add(info req.DownloadInfo, now time.Time) (speed float64, eta time.Duration, ok bool) {
+	rate.samples = append(rate.samples, downloadRateSample{time: now, size: info.DownloadedSize})
+	// 保留一个落在窗口起点之前的采样，保证窗口内始终有两个以上的采样
+	for 2 < len(rate.samples) && !rate.samples[1].time.After(now.Add(-downloadRateWindow)) {
+		rate.samples = rate.samples[1:]
+	}
+
+	first, last := rate.samples[0], rate.samples[len(rate.samples)-1]
+	elapsed := last.time.Sub(first.time).Seconds()
+	if 0 >= elapsed {
+		return
+	}
+	speed = float64(last.size-first.size) / elapsed
+	if 0 >= speed || nil == info.Response || nil == info.Response.Response || 0 >= info.Response.ContentLength {
+		return
+	}
+
+	remaining := max(info.Response.ContentLength-info.DownloadedSize, 0)
+	eta = time.Duration(float64(remaining) / speed * float64(time.Second))
+	ok = true
+	return
+}
+
+func pushDownloadProgress(repoURL string, progress float32, rate *downloadRate, info req.DownloadInfo) {
+	speed, eta, ok := rate.add(info, time.Now())
+	etaSeconds := int64(-1)
+	if ok {
+		etaSeconds = int64(math.Ceil(eta.Seconds()))
+	}
+	util.PushDownloadProgressWithRate(repoURL, progress, int64(speed), etaSeconds)
+}
+
+type packageETag struct {
+	etag string
+	data []byte
+}
+
+// packageETagCache 缓存集市包的 ETag 和数据，重装或修复同一版本时通过条件请求避免重复下载
+var packageETagCache = newPackageETagCache() // [repoURLHash]*packageETag
+
+const (
+	maxPackageETagSize      = 16 * 1024 * 1024 // 单个集市包超过该大小时不缓存
+	maxPackageETagCacheSize = 64 * 1024 * 1024 // 缓存的数据总量上限
+)
+
+var (
+	packageETagCacheSize     int64 // 已缓存的数据总量，移除缓存项时在 OnEvicted 中扣减
+	packageETagCacheSizeLock = sync.Mutex{}
+)
+
+func newPackageETagCache() (ret *gcache.Cache) {
+	ret = gcache.New(30*time.Minute, 10*time.Minute)
+	ret.OnEvicted(func(repoURLHash string, cached interface{}) {
+		packageETagCacheSizeLock.Lock()
+		defer packageETagCacheSizeLock.Unlock()
+		packageETagCacheSize -= int64(len(cached.(*packageETag).data))
+	})
+	return
+}
+
+func getPackageETag(repoURLHash string) *packageETag {
+	if cached, ok := packageETagCache.Get(repoURLHash); ok {
+		return cached.(*packageETag)
+	}
+	return nil
+}
+
+func setPackageETag(repoURLHash, etag string, data []byte) {
+	if "" == etag || maxPackageETagSize < len(data) {
+		return
+	}
+
+	// 覆盖不会触发 OnEvicted，先删除旧的缓存项和过期项再计算总量，同一个包的下载由仓库锁串行
+	packageETagCache.Delete(repoURLHash)
+	packageETagCache.DeleteExpired()
+
+	packageETagCacheSizeLock.Lock()
+	defer packageETagCacheSizeLock.Unlock()
+	if maxPackageETagCacheSize < packageETagCacheSize+int64(len(data)) {
+		return
+	}
+	packageETagCache.SetDefault(repoURLHash, &packageETag{etag: etag, data: data})
+	packageETagCacheSize += int64(len(data))
+}
+
+type recentDownload struct {
+	time time.Time
+	data []byte
+}
+
+// recentDownloadCache 缓存刚刚下载完成的集市包，同时发起的相同下载请求复用第一个请求的数据
+var recentDownloadCache = gcache.New(30*time.Second, 10*time.Second) // [repoURLHash]*recentDownload
+
+const maxRecentDownloadCount = 8
+
+// getRecentDownload 返回在 requestTime 之后下载完成的数据，也就是请求发起时正在进行中的下载结果。
+func getRecentDownload(repoURLHash string, requestTime time.Time) []byte {
+	if cached, ok := recentDownloadCache.Get(repoURLHash); ok {
+		if recent := cached.(*recentDownload); recent.time.After(requestTime) {
+			return recent.data
+		}
+	}
+	return nil
+}
+
+func setRecentDownload(repoURLHash string, data []byte) {
+	if _, ok := recentDownloadCache.Get(repoURLHash); !ok && maxRecentDownloadCount <= recentDownloadCache.ItemCount() {
+		// ItemCount 包含还没有被清理的过期项，先清理再判断，避免缓存被过期项占满后不再去重
+		recentDownloadCache.DeleteExpired()
+		if maxRecentDownloadCount <= recentDownloadCache.ItemCount() {
+			return
+		}
+	}
+	recentDownloadCache.SetDefault(repoURLHash, &recentDownload{time: time.Now(), data: data})
+}
+
+// CheckPackageAssets 对集市包在 CDN 上的资源逐个发起 HEAD 请求，返回 [path]是否可访问。
+//
+// 集市可访问时个别包的资源仍可能因为作者删除文件而 404，界面打开详情前可以先用它校验预览图和 README。
+func CheckPackageAssets(repoURL, repoHash string, paths []string) (ret map[string]bool, err error) {
+	ret = map[string]bool{}
+	if _, ok := NormalizeRepoURL(repoURL); !ok {
+		err = fmt.Errorf("%w [%s]", ErrUnsupportedRepoHost, repoURL)
+		return
+	}
+	// OSS 上的路径区分大小写，使用原始大小写的仓库地址，不使用规范化后的小写地址
+	repo := repoWebURL(repoURL)
+	if "" == repoHash {
+		err = errors.New("repo hash is empty")
+		return
+	}
+	if 1 > len(paths) {
+		return
+	}
+
+	type asset struct {
+		path    string
+		request *req.Request
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	lock := &sync.Mutex{}
+	p, err := ants.NewPoolWithFunc(4, func(arg interface{}) {
+		defer waitGroup.Done()
+
+		a := arg.(*asset)
+		u := packageURL(repo+"@"+repoHash, a.path)
+		reachable := false
+		resp, headErr := a.request.Head(u)
+		if nil != headErr {
+			logging.LogWarnf("check bazaar package asset [%s] failed: %s", u, headErr)
+		} else {
+			reachable = 200 == resp.StatusCode
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		ret[a.path] = reachable
+	})
+	if nil != err {
+		return
+	}
+	for _, assetPath := range paths {
+		// 请求在提交前创建，httpclient 延迟初始化客户端，在多个协程中同时创建请求会产生数据竞争
+		a := &asset{path: assetPath, request: bazaarRequest(httpclient.NewCloudRequest30s())}
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(a); nil != invokeErr {
+			logging.LogWarnf("check bazaar package asset [%s] failed: %s", assetPath, invokeErr)
+			waitGroup.Done()
+			lock.Lock()
+			ret[assetPath] = false
+			lock.Unlock()
+		}
+	}
+	waitGroup.Wait()
+	p.Release()
+	return
+}
+
+var (
+	getCloudServer = util.GetCloudServer
+
+	packageDownloadsWaitGroup                      sync.WaitGroup
+	packageDownloadsClosing                        bool // WaitPackageDownloads 开始等待后不再发起上报，避免 Add 和 Wait 并发
+	packageDownloadsLock                           = sync.Mutex{}
+	packageDownloadsCtx, cancelPackageDownloadsCtx = context.WithCancel(context.Background())
+)
+
+// goIncPackageDownloads 异步上报集市包下载次数，内核退出时通过 WaitPackageDownloads 等待上报完成。
+func goIncPackageDownloads(repoURLHash, systemID string) {
+	packageDownloadsLock.Lock()
+	defer packageDownloadsLock.Unlock()
+	if packageDownloadsClosing {
+		logging.LogWarnf("kernel is closing, skip bazaar package [%s] download count", repoURLHash)
+		return
+	}
+
+	packageDownloadsWaitGroup.Add(1)
+	go func() {
+		defer packageDownloadsWaitGroup.Done()
+		incPackageDownloads(repoURLHash, systemID)
+	}()
+}
+
+// WaitPackageDownloads 等待正在上报的集市包下载次数请求完成，超时后取消未完成的请求。
+func WaitPackageDownloads(timeout time.Duration) {
+	packageDownloadsLock.Lock()
+	packageDownloadsClosing = true
+	packageDownloadsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		packageDownloadsWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logging.LogWarnf("wait for bazaar package download count requests timeout [%s]", timeout)
+		cancelPackageDownloadsCtx()
+		<-done
+	}
+}
+
+func incPackageDownloads(repoURLHash, systemID string) {
+	if strings.Contains(repoURLHash, ".md") || "" == systemID {
+		return
+	}
+
+	repo := strings.Split(repoURLHash, "@")[0]
+	u := getCloudServer() + "/apis/siyuan/bazaar/addBazaarPackageDownloadCount"
+	bazaarRequest(httpclient.NewCloudRequest30s()).SetContext(packageDownloadsCtx).SetBody(
+		map[string]interface{}{
+			"systemID": systemID,
+			"repo":     repo,
+		}).Post(u)
+}
@@ -0,0 +1,524 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imroc/req/v3"
+	"github.com/siyuan-note/httpclient"
+)
+
+func TestDownloadPackageETag(t *testing.T) {
+	const etag = `"6286912c"`
+	requests, transfers := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if etag == r.Header.Get("If-None-Match") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		transfers++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	repoURLHash := "https://github.com/siyuan-note/etag-test@6286912c381ef3f83e455d06ba4d369c498238dc"
+	for i := 0; i < 2; i++ {
+		data, err := downloadPackage(repoURLHash, false, "", "")
+		if nil != err {
+			t.Fatalf("download package failed: %s", err)
+		}
+		if "package data" != string(data) {
+			t.Fatalf("unexpected package data [%s]", data)
+		}
+	}
+	if 2 != requests || 1 != transfers {
+		t.Fatalf("expected 2 requests and 1 body transfer, got %d requests and %d transfers", requests, transfers)
+	}
+}
+
+func TestPackageETagCacheSize(t *testing.T) {
+	flushTestDownloadCaches()
+	t.Cleanup(flushTestDownloadCaches)
+
+	// 超过单个包的大小上限时不缓存
+	if setPackageETag("siyuan-note/huge@6286912c", `"huge"`, make([]byte, maxPackageETagSize+1)); nil != getPackageETag("siyuan-note/huge@6286912c") {
+		t.Fatalf("expected oversized package not to be cached")
+	}
+
+	// 缓存的数据总量不超过上限
+	data := make([]byte, maxPackageETagSize)
+	count := maxPackageETagCacheSize / maxPackageETagSize
+	for i := 0; i <= count; i++ {
+		setPackageETag(fmt.Sprintf("siyuan-note/etag-%d@6286912c", i), `"etag"`, data)
+	}
+	if count != packageETagCache.ItemCount() || maxPackageETagCacheSize != packageETagCacheSize {
+		t.Fatalf("expected %d cached packages, got %d with %d bytes", count, packageETagCache.ItemCount(), packageETagCacheSize)
+	}
+
+	// 覆盖同一个包和移除缓存项时更新总量
+	setPackageETag("siyuan-note/etag-0@6286912c", `"etag-2"`, data[:1024])
+	packageETagCache.Delete("siyuan-note/etag-1@6286912c")
+	if expected := int64(maxPackageETagCacheSize - 2*maxPackageETagSize + 1024); expected != packageETagCacheSize {
+		t.Fatalf("expected %d cached bytes, got %d", expected, packageETagCacheSize)
+	}
+}
+
+func TestDownloadPackageRetry(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if strings.Contains(r.URL.Path, "retry-not-found") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if 3 > requests {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	delay := downloadRetryBaseDelay
+	downloadRetryBaseDelay = time.Millisecond
+	defer func() { downloadRetryBaseDelay = delay }()
+
+	data, err := downloadPackage("https://github.com/siyuan-note/retry-test@6286912c381ef3f83e455d06ba4d369c498238dc", false, "", "")
+	if nil != err || "package data" != string(data) || 3 != requests {
+		t.Fatalf("expected package after 3 requests, got [%s] after %d requests: %v", data, requests, err)
+	}
+
+	// 404 不重试
+	requests = 0
+	if _, err = downloadPackage("https://github.com/siyuan-note/retry-not-found@6286912c381ef3f83e455d06ba4d369c498238dc", false, "", ""); nil == err || 1 != requests {
+		t.Fatalf("expected a single request for 404, got %d requests: %v", requests, err)
+	}
+}
+
+func TestDownloadPackageLockPerRepo(t *testing.T) {
+	slowStarted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "lock-slow") {
+			select {
+			case slowStarted <- struct{}{}:
+			default:
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	delay := downloadRetryBaseDelay
+	downloadRetryBaseDelay = 10 * time.Second
+	t.Cleanup(func() { downloadRetryBaseDelay = delay })
+
+	// 一个包在重试等待时不影响其他包的下载
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		downloadPackageWithContext(ctx, "https://github.com/siyuan-note/lock-slow@6286912c381ef3f83e455d06ba4d369c498238dc", false, "", "")
+	}()
+	<-slowStarted
+
+	start := time.Now()
+	data, err := downloadPackage("https://github.com/siyuan-note/lock-fast@6286912c381ef3f83e455d06ba4d369c498238dc", false, "", "")
+	if nil != err || "package data" != string(data) {
+		t.Fatalf("download package failed: %v", err)
+	}
+	if elapsed := time.Since(start); 5*time.Second < elapsed {
+		t.Fatalf("expected download not to wait for the retrying package, took %s", elapsed)
+	}
+	cancel()
+	<-done
+}
+
+func TestDownloadPackageWithContextCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	requests := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if 1 < requests.Add(1) {
+			w.Write([]byte("package data"))
+			return
+		}
+
+		w.Header().Set("Content-Length", "1048576")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	repoURLHash := "https://github.com/siyuan-note/cancel-test@6286912c381ef3f83e455d06ba4d369c498238dc"
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	start := time.Now()
+	data, err := downloadPackageWithContext(ctx, repoURLHash, false, "", "")
+	if !errors.Is(err, context.Canceled) || nil != data {
+		t.Fatalf("expected canceled download without data, got [%s]: %v", data, err)
+	}
+	if 5*time.Second < time.Since(start) {
+		t.Fatalf("expected download to return promptly after cancel")
+	}
+
+	// 取消后仓库锁已释放，下载内容也没有被缓存
+	done := make(chan error, 1)
+	go func() {
+		_, downloadErr := downloadPackage(repoURLHash, false, "", "")
+		done <- downloadErr
+	}()
+	select {
+	case err = <-done:
+		if nil != err {
+			t.Fatalf("download package failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected package locks to be released after cancel")
+	}
+	if 2 != requests.Load() {
+		t.Fatalf("expected partial download to be discarded, got %d requests", requests.Load())
+	}
+}
+
+func TestDownloadPackageWithContextCancelWhileWaiting(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	requests := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	repoURLHash := "https://github.com/siyuan-note/cancel-wait-test@6286912c381ef3f83e455d06ba4d369c498238dc"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		downloadPackage(repoURLHash, false, "", "")
+	}()
+	<-started
+
+	// 同一个包正在下载时，等待仓库锁的请求也可以被取消
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := downloadPackageWithContext(ctx, repoURLHash, false, "", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded while waiting for the package lock, got %v", err)
+	}
+	if 5*time.Second < time.Since(start) || 1 != requests.Load() {
+		t.Fatalf("expected waiting download to return promptly without a request, got %d requests", requests.Load())
+	}
+	close(release)
+	<-done
+}
+
+func TestDownloadPackageChecksum(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("package data")))
+	data, err := downloadPackage("https://github.com/siyuan-note/checksum-test@6286912c381ef3f83e455d06ba4d369c498238dc", false, "", strings.ToUpper(checksum))
+	if nil != err || "package data" != string(data) {
+		t.Fatalf("download package with matching checksum failed: %v", err)
+	}
+
+	repoURLHash := "https://github.com/siyuan-note/checksum-mismatch@6286912c381ef3f83e455d06ba4d369c498238dc"
+	badChecksum := fmt.Sprintf("%x", sha256.Sum256([]byte("truncated")))
+	if data, err = downloadPackage(repoURLHash, false, "", badChecksum); !errors.Is(err, ErrChecksumMismatch) || nil != data {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+
+	// 校验失败的内容不会被缓存
+	if data, err = downloadPackage(repoURLHash, false, "", checksum); nil != err || "package data" != string(data) || 3 != requests {
+		t.Fatalf("expected package to be downloaded again, got %d requests: %v", requests, err)
+	}
+}
+
+func TestDownloadPackageChecksumCached(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if `"v1"` == r.Header.Get("If-None-Match") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	// 先在没有校验和时下载并缓存
+	repoURLHash := "https://github.com/siyuan-note/checksum-cached@6286912c381ef3f83e455d06ba4d369c498238dc"
+	if _, err := downloadPackage(repoURLHash, false, "", ""); nil != err {
+		t.Fatalf("download package failed: %s", err)
+	}
+
+	// 304 时复用 ETag 缓存的内容也要校验
+	badChecksum := fmt.Sprintf("%x", sha256.Sum256([]byte("truncated")))
+	if data, err := downloadPackage(repoURLHash, false, "", badChecksum); !errors.Is(err, ErrChecksumMismatch) || nil != data || 2 != requests {
+		t.Fatalf("expected checksum mismatch for not modified package, got %d requests: %v", requests, err)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte("package data")))
+	if data, err := downloadPackage(repoURLHash, false, "", checksum); nil != err || "package data" != string(data) || 3 != requests {
+		t.Fatalf("expected cached package with matching checksum, got %d requests: %v", requests, err)
+	}
+
+	// 复用等待锁期间其他请求下载完成的内容时也要校验
+	recentDownloadCache.SetDefault(strings.TrimPrefix(repoURLHash, "https://github.com/"), &recentDownload{time: time.Now().Add(time.Minute), data: []byte("package data")})
+	if data, err := downloadPackage(repoURLHash, false, "", badChecksum); !errors.Is(err, ErrChecksumMismatch) || nil != data || 3 != requests {
+		t.Fatalf("expected checksum mismatch for recent download, got %d requests: %v", requests, err)
+	}
+}
+
+func TestDownloadRate(t *testing.T) {
+	resp := &req.Response{Response: &http.Response{ContentLength: 10 * 1000 * 1000}}
+	rate := &downloadRate{}
+	now := time.Now()
+	var speed float64
+	var eta time.Duration
+	var ok bool
+	// 每 100ms 下载 100kB，即 1MB/s
+	for i := 0; i <= 20; i++ {
+		speed, eta, ok = rate.add(req.DownloadInfo{Response: resp, DownloadedSize: int64(i) * 100 * 1000}, now.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	if !ok || 1000*1000 != int64(speed) || 7900*time.Millisecond > eta || 8100*time.Millisecond < eta {
+		t.Fatalf("unexpected rate [%f, %s, %v]", speed, eta, ok)
+	}
+
+	// 速度降到 500kB/s，窗口滑过后估算跟随变化
+	size := int64(2 * 1000 * 1000)
+	for i := 1; i <= 40; i++ {
+		size += 50 * 1000
+		speed, eta, ok = rate.add(req.DownloadInfo{Response: resp, DownloadedSize: size}, now.Add(2*time.Second+time.Duration(i)*100*time.Millisecond))
+	}
+	if !ok || 500*1000 != int64(speed) || 11900*time.Millisecond > eta || 12100*time.Millisecond < eta {
+		t.Fatalf("unexpected rate after slowdown [%f, %s, %v]", speed, eta, ok)
+	}
+	if downloadRateWindow+100*time.Millisecond < rate.samples[len(rate.samples)-1].time.Sub(rate.samples[0].time) {
+		t.Fatalf("expected old samples to be dropped, got %d samples", len(rate.samples))
+	}
+
+	// 未知内容长度时只估算速度
+	rate = &downloadRate{}
+	unknown := &req.Response{Response: &http.Response{ContentLength: -1}}
+	rate.add(req.DownloadInfo{Response: unknown, DownloadedSize: 0}, now)
+	speed, _, ok = rate.add(req.DownloadInfo{Response: unknown, DownloadedSize: 1000}, now.Add(time.Second))
+	if ok || 1000 != int64(speed) {
+		t.Fatalf("expected speed without ETA, got [%f, %v]", speed, ok)
+	}
+}
+
+func TestDownloadPackageDedup(t *testing.T) {
+	requests := 0
+	lock := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	// 过期但还没有被清理的项不影响去重
+	for i := 0; i < maxRecentDownloadCount; i++ {
+		recentDownloadCache.Set(fmt.Sprintf("siyuan-note/expired-%d@6286912c381ef3f83e455d06ba4d369c498238dc", i), &recentDownload{time: time.Now()}, time.Nanosecond)
+	}
+
+	// 同一个包可能以不同的地址形式被请求，比如集市索引中的 owner/repo 和完整的仓库地址
+	repoURLHashes := []string{
+		"https://github.com/siyuan-note/dedup-test@6286912c381ef3f83e455d06ba4d369c498238dc",
+		"siyuan-note/dedup-test@6286912c381ef3f83e455d06ba4d369c498238dc",
+	}
+	waitGroup := sync.WaitGroup{}
+	results := make([][]byte, 2)
+	for i := range results {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			data, err := downloadPackage(repoURLHashes[i], false, "", "")
+			if nil != err {
+				t.Errorf("download package failed: %s", err)
+			}
+			results[i] = data
+		}(i)
+	}
+	waitGroup.Wait()
+
+	if 1 != requests {
+		t.Fatalf("expected 1 network fetch, got %d", requests)
+	}
+	for _, data := range results {
+		if "package data" != string(data) {
+			t.Fatalf("unexpected package data [%s]", data)
+		}
+	}
+}
+
+func TestWaitPackageDownloads(t *testing.T) {
+	var counts []string
+	lock := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/apis/siyuan/bazaar/addBazaarPackageDownloadCount" == r.URL.Path {
+			time.Sleep(100 * time.Millisecond)
+			body, _ := io.ReadAll(r.Body)
+			lock.Lock()
+			counts = append(counts, string(body))
+			lock.Unlock()
+			return
+		}
+		w.Write([]byte("package data"))
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	cloudServer := getCloudServer
+	getCloudServer = func() string { return server.URL }
+	defer func() {
+		getCloudServer = cloudServer
+	}()
+
+	t.Cleanup(func() {
+		packageDownloadsLock.Lock()
+		packageDownloadsClosing = false
+		packageDownloadsLock.Unlock()
+	})
+
+	if _, err := downloadPackage("https://github.com/siyuan-note/download-count-test@6286912c381ef3f83e455d06ba4d369c498238dc", false, "test-system-id", ""); nil != err {
+		t.Fatalf("download package failed: %s", err)
+	}
+	WaitPackageDownloads(10 * time.Second)
+
+	// 开始等待后完成的下载不再上报
+	if _, err := downloadPackage("https://github.com/siyuan-note/download-count-closing@6286912c381ef3f83e455d06ba4d369c498238dc", false, "test-system-id", ""); nil != err {
+		t.Fatalf("download package failed: %s", err)
+	}
+	packageDownloadsWaitGroup.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if 1 != len(counts) || !strings.Contains(counts[0], "siyuan-note/download-count-test") || !strings.Contains(counts[0], "test-system-id") {
+		t.Fatalf("unexpected download count requests %v", counts)
+	}
+}
+
+func TestValidateRepoURLHash(t *testing.T) {
+	if err := validateRepoURLHash("https://github.com/siyuan-note/test"); !errors.Is(err, ErrInvalidRepoHash) {
+		t.Fatalf("expected invalid repo hash error for missing @, got %v", err)
+	}
+	if err := validateRepoURLHash("https://github.com/siyuan-note/test@6286912c381ef3f83e455d06ba4d369c498238zz"); !errors.Is(err, ErrInvalidRepoHash) {
+		t.Fatalf("expected invalid repo hash error for non-hex hash, got %v", err)
+	}
+	if err := validateRepoURLHash("https://github.com/siyuan-note/test@main"); !errors.Is(err, ErrInvalidRepoHash) {
+		t.Fatalf("expected invalid repo hash error for branch name, got %v", err)
+	}
+	if err := validateRepoURLHash("https://github.com/siyuan-note/test@6286912c381ef3f83e455d06ba4d369c498238dc"); nil != err {
+		t.Fatalf("expected valid repo hash, got %v", err)
+	}
+	if err := validateRepoURLHash("https://github.com/siyuan-note/test@6286912c381ef3f83e455d06ba4d369c498238dc/README.md"); nil != err {
+		t.Fatalf("expected valid repo hash with file path, got %v", err)
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	if _, err := downloadPackage("https://github.com/siyuan-note/test", false, "", ""); !errors.Is(err, ErrInvalidRepoHash) || 0 != requests {
+		t.Fatalf("expected invalid repo hash error without request, got %v and %d requests", err, requests)
+	}
+}
+
+func TestCheckPackageAssets(t *testing.T) {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if http.MethodHead != r.Method {
+			t.Errorf("expected HEAD request, got %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/package/Siyuan-Note/Plugin-Sample@" + repoHash + "/README.md", "/package/Siyuan-Note/Plugin-Sample@" + repoHash + "/icon.png",
+			"/package/gitlab.com/Siyuan-Note/Plugin-Sample@" + repoHash + "/README.md":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	// 关闭客户端的空闲连接，否则保持连接时 server.Close 会一直等待
+	defer httpclient.CloseIdleConnections()
+
+	// OSS 路径使用仓库地址的原始大小写
+	ret, err := CheckPackageAssets("https://github.com/Siyuan-Note/Plugin-Sample", repoHash, []string{"README.md", "preview.png", "icon.png"})
+	if nil != err {
+		t.Fatalf("check package assets failed: %s", err)
+	}
+	if 3 != len(ret) || !ret["README.md"] || ret["preview.png"] || !ret["icon.png"] {
+		t.Fatalf("unexpected reachability: %v", ret)
+	}
+	if ret, err = CheckPackageAssets("https://gitlab.com/Siyuan-Note/Plugin-Sample.git", repoHash, []string{"README.md"}); nil != err || !ret["README.md"] {
+		t.Fatalf("expected GitLab asset to be reachable, got %v: %v", ret, err)
+	}
+
+	if _, err = CheckPackageAssets("https://bitbucket.org/siyuan-note/plugin-sample", repoHash, []string{"README.md"}); !errors.Is(err, ErrUnsupportedRepoHost) {
+		t.Fatalf("expected unsupported repo host error, got %v", err)
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/88250/go-humanize"
 	ants "github.com/panjf2000/ants/v2"
 	"github.com/siyuan-note/httpclient"
 	"github.com/siyuan-note/logging"
@@ -37,6 +36,7 @@ type Icon struct {
 func Icons() (icons []*Icon) {
 	icons = []*Icon{}
 
+	generation := getPackageCacheGeneration()
 	stageIndex, err := getStageIndex("icons")
 	if nil != err {
 		return
@@ -50,7 +50,7 @@ func Icons() (icons []*Icon) {
 		repo := arg.(*StageRepo)
 		repoURL := repo.URL
 
-		if pkg, found := packageCache.Get(repoURL); found {
+		if pkg, found := packageCache.Get(packageCacheKey("icons", repoURL)); found {
 			lock.Lock()
 			icons = append(icons, pkg.(*Icon))
 			lock.Unlock()
@@ -58,8 +58,8 @@ func Icons() (icons []*Icon) {
 		}
 
 		icon := &Icon{}
-		innerU := util.BazaarOSSServer + "/package/" + repoURL + "/icon.json"
-		innerResp, innerErr := httpclient.NewBrowserRequest().SetSuccessResult(icon).Get(innerU)
+		innerU := packageURL(repoURL, "icon.json")
+		innerResp, innerErr := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(icon).Get(innerU)
 		if nil != innerErr {
 			logging.LogErrorf("get bazaar package [%s] failed: %s", repoURL, innerErr)
 			return
@@ -75,35 +75,40 @@ func Icons() (icons []*Icon) {
 
 		icon.URL = strings.TrimSuffix(icon.URL, "/")
 		repoURLHash := strings.Split(repoURL, "@")
-		icon.RepoURL = "https://github.com/" + repoURLHash[0]
+		icon.RepoURL = repoWebURL(repoURLHash[0])
 		icon.RepoHash = repoURLHash[1]
-		icon.PreviewURL = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageslim"
-		icon.PreviewURLThumb = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageView2/2/w/436/h/232"
-		icon.IconURL = util.BazaarOSSServer + "/package/" + repoURL + "/icon.png"
+		icon.PreviewURL = packageURL(repoURL, "preview.png?imageslim")
+		icon.PreviewURLThumb = packageURL(repoURL, "preview.png?imageView2/2/w/436/h/232")
+		icon.ScreenshotURLs, icon.ScreenshotURLThumbs = getScreenshotURLs(icon.Package, packageURL(repoURL), true)
+		icon.IconURL = packageURL(repoURL, "icon.png")
 		icon.Funding = repo.Package.Funding
-		icon.PreferredFunding = getPreferredFunding(icon.Funding)
-		icon.PreferredName = GetPreferredName(icon.Package)
-		icon.PreferredDesc = getPreferredDesc(icon.Description)
+		if 0 == len(icon.Previews) {
+			icon.Previews = repo.Package.Previews
+		}
+		icon.ResolvePreferred()
 		icon.Updated = repo.Updated
 		icon.Stars = repo.Stars
 		icon.OpenIssues = repo.OpenIssues
+		icon.Featured = repo.Featured
+		icon.Archived = repo.Archived
+		icon.FeaturedRank = repo.FeaturedRank
+		icon.License = repo.Package.License
+		icon.Deprecated, icon.Replacement = getDeprecation(repo.Package)
 		icon.Size = repo.Size
-		icon.HSize = humanize.BytesCustomCeil(uint64(icon.Size), 2)
 		icon.InstallSize = repo.InstallSize
-		icon.HInstallSize = humanize.BytesCustomCeil(uint64(icon.InstallSize), 2)
-		packageInstallSizeCache.SetDefault(icon.RepoURL, icon.InstallSize)
-		icon.HUpdated = formatUpdated(icon.Updated)
+		cacheStageInstallSize(icon.RepoURL, icon.RepoHash, icon.InstallSize)
 		pkg := bazaarIndex[strings.Split(repoURL, "@")[0]]
 		if nil != pkg {
 			icon.Downloads = pkg.Downloads
 		}
+		icon.ComputeHumanSizes()
 		lock.Lock()
 		icons = append(icons, icon)
 		lock.Unlock()
 
-		packageCache.SetDefault(repoURL, icon)
+		setPackageCache(packageCacheKey("icons", repoURL), icon, generation)
 	})
-	for _, repo := range stageIndex.Repos {
+	for _, repo := range visibleStageRepos(stageIndex.Repos) {
 		waitGroup.Add(1)
 		p.Invoke(repo)
 	}
@@ -128,6 +133,7 @@ func InstalledIcons() (ret []*Icon) {
 	}
 
 	bazaarIcons := Icons()
+	stageIndex, _ := getStageIndex("icons")
 
 	for _, iconDir := range iconDirs {
 		if !util.IsDirRegularOrSymlink(iconDir) {
@@ -149,16 +155,15 @@ func InstalledIcons() (ret []*Icon) {
 		icon.RepoURL = icon.URL
 		icon.PreviewURL = "/appearance/icons/" + dirName + "/preview.png"
 		icon.PreviewURLThumb = "/appearance/icons/" + dirName + "/preview.png"
+		icon.ScreenshotURLs, icon.ScreenshotURLThumbs = getScreenshotURLs(icon.Package, "/appearance/icons/"+dirName, false)
 		icon.IconURL = "/appearance/icons/" + dirName + "/icon.png"
-		icon.PreferredFunding = getPreferredFunding(icon.Funding)
-		icon.PreferredName = GetPreferredName(icon.Package)
-		icon.PreferredDesc = getPreferredDesc(icon.Description)
+		icon.ResolvePreferred()
 		info, statErr := os.Stat(filepath.Join(installPath, "README.md"))
 		if nil != statErr {
 			logging.LogWarnf("stat install theme README.md failed: %s", statErr)
 			continue
 		}
-		icon.HInstallDate = info.ModTime().Format("2006-01-02")
+		icon.InstallDate = info.ModTime().UnixMilli()
 		if installSize, ok := packageInstallSizeCache.Get(icon.RepoURL); ok {
 			icon.InstallSize = installSize.(int64)
 		} else {
@@ -166,7 +171,7 @@ func InstalledIcons() (ret []*Icon) {
 			icon.InstallSize = is
 			packageInstallSizeCache.SetDefault(icon.RepoURL, is)
 		}
-		icon.HInstallSize = humanize.BytesCustomCeil(uint64(icon.InstallSize), 2)
+		icon.ComputeHumanSizes()
 		readmeFilename := getPreferredReadme(icon.Readme)
 		readme, readErr := os.ReadFile(filepath.Join(installPath, readmeFilename))
 		if nil != readErr {
@@ -176,6 +181,10 @@ func InstalledIcons() (ret []*Icon) {
 
 		icon.PreferredReadme, _ = renderREADME(icon.URL, readme)
 		icon.Outdated = isOutdatedIcon(icon, bazaarIcons)
+		if !icon.Outdated {
+			icon.UpdateBlockedByAppVersion = updateBlockedByAppVersion(icon.Package, stageIndex)
+		}
+		icon.Deprecated, icon.Replacement = getInstalledDeprecation("icons", icon.Package)
 		ret = append(ret, icon)
 	}
 	return
@@ -185,13 +194,10 @@ func isBuiltInIcon(dirName string) bool {
 	return "ant" == dirName || "material" == dirName
 }
 
+// InstallIcon 安装图标，目录名使用 CanonicalInstallDir 的返回值，installPath 只决定安装到哪个目录下，为空时使用默认的图标目录。
 func InstallIcon(repoURL, repoHash, installPath string, systemID string) error {
-	repoURLHash := repoURL + "@" + repoHash
-	data, err := downloadPackage(repoURLHash, true, systemID)
-	if nil != err {
-		return err
-	}
-	return installPackage(data, installPath, repoURLHash)
+	_, err := installBazaarPackage("icons", repoURL, repoHash, installPath, systemID, false)
+	return err
 }
 
 func UninstallIcon(installPath string) error {
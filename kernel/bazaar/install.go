@@ -0,0 +1,845 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/88250/go-humanize"
+	"github.com/88250/gulu"
+	"github.com/imroc/req/v3"
+	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/httpclient"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/util"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+func uninstallPackage(installPath string) (err error) {
+	if err = os.RemoveAll(installPath); nil != err {
+		logging.LogErrorf("remove [%s] failed: %s", installPath, err)
+		return fmt.Errorf("remove community package [%s] failed", filepath.Base(installPath))
+	}
+	flushPackageCache()
+	uncacheInstallSize(installPath)
+	return
+}
+
+type githubRelease struct {
+	TagName string                `json:"tag_name"`
+	Assets  []*githubReleaseAsset `json:"assets"`
+}
+
+type githubReleaseAsset struct {
+	Name               string `json:"name"`
+	Size               int64  `json:"size"`
+	Digest             string `json:"digest"` // sha256:<hex>，旧的发布可能没有
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+const maxReleaseAssetSize = 64 * 1024 * 1024
+
+// InstallFromRelease 从 GitHub Release 的附件安装集市包，tag 为 latest 或空时使用最新发布的版本。
+func InstallFromRelease(repoURL, tag, assetName, packageType, systemID string) (err error) {
+	repo, ok := normalizeGitHubRepoURL(repoURL)
+	if !ok {
+		return fmt.Errorf("%w [%s]", ErrUnsupportedRepoHost, repoURL)
+	}
+	installDir := packageInstallDir(packageType)
+	if "" == installDir {
+		return fmt.Errorf("invalid package type [%s]", packageType)
+	}
+	systemID = checkSystemID(repoURL, systemID)
+
+	if !IsTrustedAuthor(repoURL) {
+		return fmt.Errorf("%w [%s]", ErrUntrustedAuthor, repoURL)
+	}
+
+	asset, release, err := getReleaseAsset(repo, tag, assetName)
+	if nil != err {
+		return
+	}
+
+	data, err := downloadReleaseAsset(repoURL, asset)
+	if nil != err {
+		return
+	}
+
+	// 安装目录名和从集市安装时一样：已经安装过时沿用已有目录，否则使用清单中的包名
+	manifest := strings.TrimSuffix(packageType, "s") + ".json"
+	if _, err = zipManifestName(data, manifest); nil != err {
+		return
+	}
+	dirName := manifestInstallDir(data, packageType, repoURL, CanonicalInstallDir(packageType, repoURL))
+	if "" == dirName {
+		return fmt.Errorf("can't determine install path of [%s] for package type [%s]", repoURL, packageType)
+	}
+
+	repoURLHash := "https://github.com/" + repo + "@" + release.TagName
+	tracker := newInstallTracker(repoURL, release.TagName)
+	tracker.downloaded(int64(len(data)))
+	if _, err = installPackage(data, filepath.Join(installDir, dirName), repoURLHash, false, tracker); nil != err {
+		return
+	}
+	goIncPackageDownloads(repo, systemID)
+	return
+}
+
+func getReleaseAsset(repo, tag, assetName string) (asset *githubReleaseAsset, release *githubRelease, err error) {
+	u := githubAPIServer + "/repos/" + repo + "/releases/latest"
+	if "" != tag && "latest" != tag {
+		u = githubAPIServer + "/repos/" + repo + "/releases/tags/" + url.PathEscape(tag)
+	}
+
+	if err = githubAPILimiter.Wait(context.Background()); nil != err {
+		return
+	}
+
+	release = &githubRelease{}
+	resp, err := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(release).Get(u)
+	if nil != err {
+		logging.LogErrorf("get release [%s] failed: %s", u, err)
+		return
+	}
+	if 200 != resp.StatusCode {
+		logging.LogErrorf("get release [%s] failed: %d", u, resp.StatusCode)
+		err = fmt.Errorf("get release [%s] of [%s] failed: %s", tag, repo, resp.Status)
+		return
+	}
+
+	for _, a := range release.Assets {
+		if nil != a && assetName == a.Name {
+			asset = a
+			return
+		}
+	}
+	err = fmt.Errorf("asset [%s] not found in release [%s] of [%s]", assetName, release.TagName, repo)
+	return
+}
+
+// downloadReleaseAsset 下载 Release 附件，并校验大小和 SHA-256 摘要（如果有）。
+func downloadReleaseAsset(repoURL string, asset *githubReleaseAsset) (data []byte, err error) {
+	if maxReleaseAssetSize < asset.Size {
+		return nil, fmt.Errorf("release asset [%s] is too large [%s]", asset.Name, humanize.BytesCustomCeil(uint64(asset.Size), 2))
+	}
+
+	buf := &bytes.Buffer{}
+	rate := &downloadRate{}
+	resp, err := bazaarRequest(httpclient.NewCloudFileRequest2m()).SetOutput(buf).SetDownloadCallback(func(info req.DownloadInfo) {
+		if 0 < info.Response.ContentLength {
+			pushDownloadProgress(repoURL, float32(info.DownloadedSize)/float32(info.Response.ContentLength), rate, info)
+		}
+	}).Get(asset.BrowserDownloadURL)
+	if nil != err {
+		logging.LogErrorf("get release asset [%s] failed: %s", asset.BrowserDownloadURL, err)
+		return nil, errors.New("get release asset failed, please check your network")
+	}
+	if 200 != resp.StatusCode {
+		logging.LogErrorf("get release asset [%s] failed: %d", asset.BrowserDownloadURL, resp.StatusCode)
+		return nil, errors.New("get release asset failed: " + resp.Status)
+	}
+
+	data = buf.Bytes()
+	if int64(len(data)) != asset.Size {
+		return nil, fmt.Errorf("release asset [%s] size mismatch, expected [%d], got [%d]", asset.Name, asset.Size, len(data))
+	}
+	if digest, found := strings.CutPrefix(asset.Digest, "sha256:"); found {
+		if sum := fmt.Sprintf("%x", sha256.Sum256(data)); !strings.EqualFold(digest, sum) {
+			return nil, fmt.Errorf("release asset [%s] checksum mismatch", asset.Name)
+		}
+	}
+	return
+}
+
+// zipManifestName 读取集市包压缩包中清单文件的 name 字段，清单可以在根目录或者唯一的顶层目录中。
+func zipManifestName(data []byte, manifest string) (ret string, err error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if nil != err {
+		return
+	}
+
+	for _, f := range reader.File {
+		if manifest != path.Base(f.Name) || 1 < strings.Count(f.Name, "/") {
+			continue
+		}
+
+		rc, openErr := f.Open()
+		if nil != openErr {
+			return "", openErr
+		}
+		content, readErr := io.ReadAll(io.LimitReader(rc, 1024*1024))
+		rc.Close()
+		if nil != readErr {
+			return "", readErr
+		}
+
+		pkg := &Package{}
+		if err = gulu.JSON.UnmarshalJSON(content, pkg); nil != err {
+			return
+		}
+		if name := strings.TrimSpace(pkg.Name); isValidDirName(name) {
+			return name, nil
+		}
+		return "", fmt.Errorf("invalid package name [%s] in [%s]", pkg.Name, f.Name)
+	}
+	return "", fmt.Errorf("[%s] not found in package", manifest)
+}
+
+// ForceInstallPackage 安装集市包，即使安装目录中已经存在其他仓库的包也会覆盖。
+func ForceInstallPackage(repoURL, repoHash, installPath string, systemID string) error {
+	_, err := installBazaarPackage("", repoURL, repoHash, installPath, systemID, true)
+	return err
+}
+
+// CanonicalInstallDir 返回集市包的安装目录名。
+//
+// 已经安装过同一仓库的包时返回已有的目录名，保证重装和更新覆盖原来的目录；否则使用集市中的包名，
+// 和界面、加载、卸载时使用的包名保持一致；集市中找不到时才使用仓库名。不依赖压缩包内的顶层目录名。
+func CanonicalInstallDir(packageType, repoURL string) string {
+	if _, ok := NormalizeRepoURL(repoURL); !ok {
+		return ""
+	}
+
+	if dirName := installedDirName(packageType, repoURL); "" != dirName {
+		return dirName
+	}
+	if repo := lookupStageRepo(packageType, repoURL); nil != repo && nil != repo.Package && isValidDirName(repo.Package.Name) {
+		return repo.Package.Name
+	}
+
+	name := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(repoURL), "/"), ".git")
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// installedDirName 返回已经安装的同一仓库的包的目录名，没有安装时返回空。
+func installedDirName(packageType, repoURL string) string {
+	var dirNames []string
+	for dirName, pkg := range installedPackages(packageType) {
+		if isSameRepo(pkg.URL, repoURL) {
+			dirNames = append(dirNames, dirName)
+		}
+	}
+	if 1 > len(dirNames) {
+		return ""
+	}
+	sort.Strings(dirNames)
+	return dirNames[0]
+}
+
+// manifestInstallDir 返回首次安装时应该使用的目录名：压缩包清单中的包名可用时使用包名，否则返回 dirName。
+//
+// 已经安装过同一仓库的包时沿用已有目录，不会因为包名变化而安装到新目录。
+func manifestInstallDir(data []byte, packageType, repoURL, dirName string) string {
+	if "" != installedDirName(packageType, repoURL) {
+		return dirName
+	}
+	if name, err := zipManifestName(data, strings.TrimSuffix(packageType, "s")+".json"); nil == err {
+		return name
+	}
+	return dirName
+}
+
+func isValidDirName(name string) bool {
+	return "" != name && !strings.ContainsAny(name, `/\`) && "." != name && ".." != name
+}
+
+// installBazaarPackage 从集市下载并安装包，packageType 用于查找版本号和安装目录名，可以为空。
+//
+// packageType 不为空时目录名总是使用 CanonicalInstallDir 的返回值，下载后优先使用压缩包清单中的包名，
+// installPath 只决定安装到哪个目录下，为空时使用该类型包的默认目录；packageType 为空时直接安装到 installPath。
+func installBazaarPackage(packageType, repoURL, repoHash, installPath, systemID string, force bool) (ret *InstallResult, err error) {
+	byName := "" == installPath || "" != packageType
+	if byName {
+		installDir, dirName := packageInstallDir(packageType), CanonicalInstallDir(packageType, repoURL)
+		if "" != installPath {
+			installDir = filepath.Dir(installPath)
+		}
+		if "" == installDir || "" == dirName {
+			err = fmt.Errorf("can't determine install path of [%s] for package type [%s]", repoURL, packageType)
+			return
+		}
+		installPath = filepath.Join(installDir, dirName)
+	}
+	systemID = checkSystemID(repoURL, systemID)
+
+	checksum := ""
+	if repo := lookupStageRepo(packageType, repoURL); nil != repo && strings.HasSuffix(repo.URL, "@"+repoHash) {
+		checksum = repo.Checksum
+	}
+	if !IsTrustedAuthor(repoURL) {
+		err = fmt.Errorf("%w [%s]", ErrUntrustedAuthor, repoURL)
+		return
+	}
+
+	repoURLHash := repoURL + "@" + repoHash
+	tracker := newInstallTracker(repoURL, getInstallVersion(packageType, repoURL, repoHash))
+	// 下载期间也可以通过 CancelInstallPackage 取消安装
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerInstallCancel(installPath, cancel)
+	defer unregisterInstallCancel(installPath)
+	data, err := downloadPackageWithContext(ctx, repoURLHash, true, systemID, checksum)
+	if nil != err {
+		tracker.fail(err)
+		return
+	}
+	tracker.downloaded(int64(len(data)))
+	if byName && "" != packageType {
+		installPath = filepath.Join(filepath.Dir(installPath), manifestInstallDir(data, packageType, repoURL, filepath.Base(installPath)))
+	}
+	return installPackage(data, installPath, repoURLHash, force, tracker)
+}
+
+// checkSystemID 检查安装入口传入的 systemID，为空时记录警告，否则下载次数没有上报时难以排查。
+func checkSystemID(repoURL, systemID string) string {
+	systemID = strings.TrimSpace(systemID)
+	if "" == systemID {
+		logging.LogWarnf("system ID is empty, download count of bazaar package [%s] will not be reported", repoURL)
+	}
+	return systemID
+}
+
+// getInstallVersion 返回集市中 repoHash 对应的版本号，找不到时返回 repoHash。
+func getInstallVersion(packageType, repoURL, repoHash string) string {
+	if "" == packageType {
+		return repoHash
+	}
+
+	repo := lookupStageRepo(packageType, repoURL)
+	if nil == repo || nil == repo.Package || !strings.HasSuffix(repo.URL, "@"+repoHash) {
+		return repoHash
+	}
+	return repo.Package.Version
+}
+
+// InstallResult 安装结果。
+type InstallResult struct {
+	RestartRequired bool `json:"restartRequired"` // 安装或更新后需要重启才能生效
+}
+
+func installPackage(data []byte, installPath, repoURLHash string, force bool, tracker *installTracker) (ret *InstallResult, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerInstallCancel(installPath, cancel)
+	defer unregisterInstallCancel(installPath)
+
+	ctx = context.WithValue(ctx, installTrackerKey{}, tracker)
+	err = installPackage0(ctx, data, installPath, force)
+	if nil != err {
+		tracker.fail(err)
+		return
+	}
+
+	for _, packageType := range packageTypes {
+		packageCache.Delete(packageCacheKey(packageType, repoURLHash))
+	}
+	cacheInstallSize(installPath, repoURLHash)
+	tracker.complete()
+	ret = &InstallResult{RestartRequired: isRestartRequired(installPath)}
+	return
+}
+
+// InstallEventType 安装事件类型。
+type InstallEventType string
+
+const (
+	InstallEventStart            InstallEventType = "start"
+	InstallEventDownloadComplete InstallEventType = "download-complete"
+	InstallEventUnzipComplete    InstallEventType = "unzip-complete"
+	InstallEventInstallComplete  InstallEventType = "install-complete"
+	InstallEventFailed           InstallEventType = "failed"
+)
+
+// InstallEvent 安装过程中的结构化事件，用于统计安装成功率等。
+type InstallEvent struct {
+	Type     InstallEventType `json:"type"`
+	RepoURL  string           `json:"repoURL"`
+	Version  string           `json:"version"`
+	Duration time.Duration    `json:"duration"` // 从开始安装到当前事件的耗时
+	Size     int64            `json:"size"`     // 下载的包大小，下载完成前为 0
+	Reason   string           `json:"reason"`   // 失败原因，仅 InstallEventFailed 时有值
+}
+
+// InstallEventSink 接收安装事件，不应阻塞。
+type InstallEventSink func(evt *InstallEvent)
+
+var (
+	installEventSinks     []InstallEventSink
+	installEventSinksLock = sync.Mutex{}
+)
+
+// RegisterInstallEventSink 注册安装事件接收器。内核本身不会发送这些事件到网络，由接收器自行处理。
+func RegisterInstallEventSink(sink InstallEventSink) {
+	installEventSinksLock.Lock()
+	defer installEventSinksLock.Unlock()
+	installEventSinks = append(installEventSinks, sink)
+}
+
+func emitInstallEvent(evt *InstallEvent) {
+	installEventSinksLock.Lock()
+	sinks := installEventSinks
+	installEventSinksLock.Unlock()
+
+	for _, sink := range sinks {
+		sink(evt)
+	}
+}
+
+type installTrackerKey struct{}
+
+// installTracker 记录一次安装的状态并发出安装事件，为 nil 时所有方法都不执行任何操作。
+type installTracker struct {
+	repoURL string
+	version string
+	start   time.Time
+	size    int64
+}
+
+func newInstallTracker(repoURL, version string) (ret *installTracker) {
+	ret = &installTracker{repoURL: repoURL, version: version, start: time.Now()}
+	ret.emit(InstallEventStart, "")
+	return
+}
+
+func installTrackerFromContext(ctx context.Context) *installTracker {
+	tracker, _ := ctx.Value(installTrackerKey{}).(*installTracker)
+	return tracker
+}
+
+func (tracker *installTracker) downloaded(size int64) {
+	if nil == tracker {
+		return
+	}
+	tracker.size = size
+	tracker.emit(InstallEventDownloadComplete, "")
+}
+
+func (tracker *installTracker) unzipped() {
+	tracker.emit(InstallEventUnzipComplete, "")
+}
+
+func (tracker *installTracker) complete() {
+	tracker.emit(InstallEventInstallComplete, "")
+}
+
+func (tracker *installTracker) fail(err error) {
+	tracker.emit(InstallEventFailed, err.Error())
+}
+
+func (tracker *installTracker) emit(typ InstallEventType, reason string) {
+	if nil == tracker {
+		return
+	}
+	emitInstallEvent(&InstallEvent{
+		Type:     typ,
+		RepoURL:  tracker.repoURL,
+		Version:  tracker.version,
+		Duration: time.Since(tracker.start),
+		Size:     tracker.size,
+		Reason:   reason,
+	})
+}
+
+var (
+	installCancels     = map[string]context.CancelFunc{}
+	installCancelsLock = sync.Mutex{}
+)
+
+func registerInstallCancel(installPath string, cancel context.CancelFunc) {
+	installCancelsLock.Lock()
+	defer installCancelsLock.Unlock()
+	installCancels[installPath] = cancel
+}
+
+func unregisterInstallCancel(installPath string) {
+	installCancelsLock.Lock()
+	defer installCancelsLock.Unlock()
+	delete(installCancels, installPath)
+}
+
+// CancelInstallPackage 取消正在安装到 installPath 的集市包，已安装的旧版本保持不变。没有正在进行的安装时返回 false。
+func CancelInstallPackage(installPath string) bool {
+	installCancelsLock.Lock()
+	defer installCancelsLock.Unlock()
+
+	cancel, ok := installCancels[installPath]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// ErrInsufficientInodes 表示安装目录所在文件系统的可用 inode 不足以解压集市包中的所有文件。
+var ErrInsufficientInodes = errors.New("insufficient inodes to install package")
+
+// inodeCheckMinEntries 压缩包条目数达到该值时才检查可用 inode，图标包等可能包含上千个小文件。
+const inodeCheckMinEntries = 1000
+
+// diskInodesFree 获取可用 inode 数量，测试时替换
+var diskInodesFree = util.DiskInodesFree
+
+// checkInodeHeadroom 检查 dir 所在文件系统的可用 inode 是否足够创建 entries 个文件和目录，
+// 避免解压到一半时失败。条目较少或者操作系统不提供 inode 信息时跳过检查。
+func checkInodeHeadroom(dir string, entries int) error {
+	if inodeCheckMinEntries > entries {
+		return nil
+	}
+
+	free, ok := diskInodesFree(dir)
+	if !ok || free >= uint64(entries) {
+		return nil
+	}
+	return fmt.Errorf("%w: [%d] entries in package but only [%d] inodes available", ErrInsufficientInodes, entries, free)
+}
+
+var ErrInstallPathConflict = errors.New("install path is occupied by another package")
+
+// checkInstallPathConflict 检查安装目录中已有的包是否来自同一个仓库，避免同名目录的其他包被覆盖。
+func checkInstallPathConflict(srcPath, installPath string) error {
+	for _, manifest := range []string{"plugin.json", "widget.json", "template.json", "theme.json", "icon.json"} {
+		incoming, existing := readManifestURL(filepath.Join(srcPath, manifest)), readManifestURL(filepath.Join(installPath, manifest))
+		if "" == incoming || "" == existing {
+			continue
+		}
+
+		if isSameRepo(incoming, existing) || strings.EqualFold(strings.TrimSuffix(incoming, "/"), strings.TrimSuffix(existing, "/")) {
+			continue
+		}
+		return fmt.Errorf("%w: [%s] is installed from [%s]", ErrInstallPathConflict, filepath.Base(installPath), existing)
+	}
+	return nil
+}
+
+// ErrNoManifestInPackage 表示解压后的集市包中没有对应类型的清单文件，比如插件包中没有 plugin.json。
+var ErrNoManifestInPackage = errors.New("no manifest in package")
+
+// checkPackageManifest 检查复制到 stagingPath 的包中是否存在 installPath 对应类型的清单文件，
+// 类型根据安装目录的上级目录（plugins、themes 等）判断，无法判断时存在任意一种清单文件即可。
+func checkPackageManifest(stagingPath, installPath string) error {
+	manifests := []string{"plugin.json", "widget.json", "template.json", "theme.json", "icon.json"}
+	switch packageType := filepath.Base(filepath.Dir(installPath)); packageType {
+	case "plugins", "widgets", "templates", "themes", "icons":
+		manifests = []string{strings.TrimSuffix(packageType, "s") + ".json"}
+	}
+
+	for _, manifest := range manifests {
+		if gulu.File.IsExist(filepath.Join(stagingPath, manifest)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: [%s] requires [%s]", ErrNoManifestInPackage, filepath.Base(installPath), strings.Join(manifests, ", "))
+}
+
+func readManifestURL(manifestPath string) string {
+	data, err := os.ReadFile(manifestPath)
+	if nil != err {
+		return ""
+	}
+
+	manifest := &struct {
+		URL string `json:"url"`
+	}{}
+	if err = gulu.JSON.UnmarshalJSON(data, manifest); nil != err {
+		return ""
+	}
+	return strings.TrimSpace(manifest.URL)
+}
+
+// installPackage0 解压集市包并安装到 installPath。
+//
+// 先复制到 installPath 同级的临时目录，完成后再通过重命名替换，复制过程中取消或出错时已安装的旧版本保持不变。
+// 和直接覆盖复制到安装目录一样，已安装目录中新版本包里没有的文件会被保留。
+// 安装目录中已有其他仓库的包时返回 ErrInstallPathConflict，除非 force 为 true。
+func installPackage0(ctx context.Context, data []byte, installPath string, force bool) (err error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if nil != err {
+		logging.LogErrorf("open package [%s] failed: %s", installPath, err)
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(installPath), 0755); nil != err {
+		return
+	}
+	if err = checkInodeHeadroom(filepath.Dir(installPath), len(reader.File)); nil != err {
+		logging.LogErrorf("install package to [%s] failed: %s", installPath, err)
+		return
+	}
+	// 直接解压到安装目录的同级临时目录，校验通过后再原子重命名，避免先解压到临时目录再复制一遍
+	stagingPath := filepath.Join(filepath.Dir(installPath), "."+filepath.Base(installPath)+"-"+gulu.Rand.String(7))
+	defer os.RemoveAll(stagingPath)
+	if err = unzipPackage(ctx, reader, stagingPath); nil != err {
+		if nil == ctx.Err() {
+			logging.LogErrorf("write file [%s] failed: %s", installPath, err)
+		}
+		return
+	}
+	installTrackerFromContext(ctx).unzipped()
+
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	if !force {
+		if err = checkInstallPathConflict(stagingPath, installPath); nil != err {
+			logging.LogWarnf("install package to [%s] failed: %s", installPath, err)
+			return
+		}
+	}
+
+	if err = checkPackageManifest(stagingPath, installPath); nil != err {
+		logging.LogWarnf("install package to [%s] failed: %s", installPath, err)
+		return
+	}
+
+	if err = mergeInstalledFiles(ctx, installPath, stagingPath); nil != err {
+		if nil == ctx.Err() {
+			logging.LogErrorf("merge installed files of [%s] failed: %s", installPath, err)
+		}
+		return
+	}
+
+	backupPath := ""
+	if gulu.File.IsExist(installPath) {
+		backupPath = stagingPath + "-old"
+		if err = filelock.Rename(installPath, backupPath); nil != err {
+			logging.LogErrorf("move [%s] to [%s] failed: %s", installPath, backupPath, err)
+			return
+		}
+	}
+	if err = filelock.Rename(stagingPath, installPath); nil != err {
+		logging.LogErrorf("move [%s] to [%s] failed: %s", stagingPath, installPath, err)
+		if "" != backupPath {
+			if restoreErr := filelock.Rename(backupPath, installPath); nil != restoreErr {
+				logging.LogErrorf("restore [%s] failed: %s", installPath, restoreErr)
+			}
+		}
+		return
+	}
+	if "" != backupPath {
+		if removeErr := filelock.Remove(backupPath); nil != removeErr {
+			logging.LogWarnf("remove [%s] failed: %s", backupPath, removeErr)
+		}
+	}
+	return
+}
+
+// mergeInstalledFiles 将已安装目录中新版本包里没有的文件复制到 stagingPath，比如用户在主题目录中添加的自定义文件。
+//
+// 同名文件使用新版本包中的，每个文件之间检查 ctx 是否已被取消。
+func mergeInstalledFiles(ctx context.Context, installPath, stagingPath string) error {
+	if !gulu.File.IsDir(installPath) {
+		return nil
+	}
+
+	return filepath.WalkDir(installPath, func(p string, d os.DirEntry, err error) error {
+		if nil != err {
+			return err
+		}
+		if err = ctx.Err(); nil != err {
+			return err
+		}
+
+		rel, err := filepath.Rel(installPath, p)
+		if nil != err {
+			return err
+		}
+		target := filepath.Join(stagingPath, rel)
+		if d.IsDir() {
+			if gulu.File.IsExist(target) && !gulu.File.IsDir(target) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() || gulu.File.IsExist(target) {
+			return nil
+		}
+		return filelock.Copy(p, target)
+	})
+}
+
+// unzipPackage 将集市包解压到 dest，压缩包中只有一个顶层目录时解压该目录下的内容。
+//
+// 每个文件以及每个数据块之间检查 ctx 是否已被取消，跳过符号链接等非常规文件，有条目路径越过 dest 时不写入任何文件并返回错误。
+// 解压完成后通过 applyZipFileModes 应用 zip 中记录的文件权限。
+func unzipPackage(ctx context.Context, reader *zip.Reader, dest string) (err error) {
+	topDir := zipTopLevelDir(reader.File)
+	if err = checkZipEntries(reader.File, topDir); nil != err {
+		return
+	}
+	if err = os.MkdirAll(dest, 0755); nil != err {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for _, f := range reader.File {
+		if err = ctx.Err(); nil != err {
+			return
+		}
+
+		name := strings.TrimPrefix(zipEntryName(f), topDir)
+		if "" == strings.Trim(name, "/") {
+			continue
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		if f.FileInfo().IsDir() {
+			if err = os.MkdirAll(target, 0755); nil != err {
+				return
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); nil != err {
+			return
+		}
+		if err = unzipFileContext(ctx, f, target, buf); nil != err {
+			return
+		}
+	}
+
+	applyZipFileModes(reader.File, topDir, dest)
+	return
+}
+
+// ErrUnsafeZipEntry 表示集市包中有条目的路径越过解压目录，比如 ../../conf/conf.json。
+var ErrUnsafeZipEntry = errors.New("unsafe zip entry path")
+
+// checkZipEntries 在解压前检查所有条目的路径，去掉顶层目录后必须位于解压目录内。
+//
+// 反斜杠也按路径分隔符处理，避免在 Windows 上解压时越过解压目录。
+func checkZipEntries(files []*zip.File, topDir string) error {
+	for _, f := range files {
+		name := strings.TrimPrefix(zipEntryName(f), topDir)
+		if "" == strings.Trim(name, "/") {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) || !filepath.IsLocal(filepath.FromSlash(strings.ReplaceAll(name, "\\", "/"))) {
+			return fmt.Errorf("%w: [%s]", ErrUnsafeZipEntry, f.Name)
+		}
+	}
+	return nil
+}
+
+// zipTopLevelDir 返回压缩包中唯一的顶层目录（带 / 后缀），顶层有多个条目或者有文件时返回空字符串。
+func zipTopLevelDir(files []*zip.File) (ret string) {
+	for _, f := range files {
+		top, _, found := strings.Cut(zipEntryName(f), "/")
+		if !found || "" == top || ("" != ret && top+"/" != ret) {
+			return ""
+		}
+		ret = top + "/"
+	}
+	return
+}
+
+// zipEntryName 返回压缩包条目的文件名，非 UTF-8 编码的文件名按 GB18030 解码。
+func zipEntryName(f *zip.File) string {
+	if utf8.ValidString(f.Name) {
+		return f.Name
+	}
+
+	data, err := io.ReadAll(transform.NewReader(strings.NewReader(f.Name), simplifiedchinese.GB18030.NewDecoder()))
+	if nil != err {
+		logging.LogWarnf("decode zip entry name [%s] failed: %s", f.Name, err)
+		return f.Name
+	}
+	return string(data)
+}
+
+// unzipFileContext 解压单个文件，每个数据块之间检查 ctx 是否已被取消。
+func unzipFileContext(ctx context.Context, f *zip.File, dest string, buf []byte) (err error) {
+	src, err := f.Open()
+	if nil != err {
+		return
+	}
+	defer src.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if nil != err {
+		return
+	}
+	defer func() {
+		if closeErr := destFile.Close(); nil == err {
+			err = closeErr
+		}
+	}()
+
+	for {
+		if err = ctx.Err(); nil != err {
+			return
+		}
+
+		n, readErr := src.Read(buf)
+		if 0 < n {
+			if _, err = destFile.Write(buf[:n]); nil != err {
+				return
+			}
+		}
+		if io.EOF == readErr {
+			return nil
+		}
+		if nil != readErr {
+			return readErr
+		}
+	}
+}
+
+// applyZipFileModes 将 zip 中记录的文件权限应用到解压后的文件上，比如辅助脚本的可执行权限，topDir 为解压时去掉的顶层目录。
+//
+// 为了安全，会去掉 setuid/setgid 等特殊位以及组和其他用户的写权限。
+func applyZipFileModes(files []*zip.File, topDir, dest string) {
+	if "windows" == runtime.GOOS {
+		return
+	}
+
+	for _, f := range files {
+		mode := f.Mode()
+		if !mode.IsRegular() {
+			continue
+		}
+
+		name := strings.TrimPrefix(zipEntryName(f), topDir)
+		if "" == strings.Trim(name, "/") || !filepath.IsLocal(filepath.FromSlash(name)) {
+			continue
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		perm := mode.Perm()&0755 | 0600
+		if chmodErr := os.Chmod(target, perm); nil != chmodErr {
+			logging.LogWarnf("chmod [%s] failed: %s", target, chmodErr)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestInstallPackageSystemID(t *testing.T) {
+	var counts []string
+	lock := sync.Mutex{}
+	pluginZip := newTestZip(t, map[string]string{"plugin.json": `{"name":"system-id-test"}`})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/apis/siyuan/bazaar/addBazaarPackageDownloadCount" == r.URL.Path {
+			body, _ := io.ReadAll(r.Body)
+			lock.Lock()
+			counts = append(counts, string(body))
+			lock.Unlock()
+			return
+		}
+		w.Write(pluginZip)
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	cloudServer := getCloudServer
+	getCloudServer = func() string { return server.URL }
+	logPath := logging.LogPath
+	logging.SetLogPath(filepath.Join(t.TempDir(), "siyuan.log"))
+	defer func() {
+		getCloudServer = cloudServer
+		logging.SetLogPath(logPath)
+	}()
+
+	installDir := filepath.Join(t.TempDir(), "plugins")
+	if _, err := installBazaarPackage("", "https://github.com/siyuan-note/system-id-test", "6286912c381ef3f83e455d06ba4d369c498238dc", filepath.Join(installDir, "system-id-test"), "test-system-id", false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	packageDownloadsWaitGroup.Wait()
+	lock.Lock()
+	if 1 != len(counts) || !strings.Contains(counts[0], "test-system-id") {
+		t.Fatalf("unexpected download count requests %v", counts)
+	}
+	lock.Unlock()
+
+	// systemID 为空时不上报下载次数，并记录警告
+	if _, err := installBazaarPackage("", "https://github.com/siyuan-note/system-id-empty", "6286912c381ef3f83e455d06ba4d369c498238dc", filepath.Join(installDir, "system-id-empty"), " ", false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	packageDownloadsWaitGroup.Wait()
+	lock.Lock()
+	if 1 != len(counts) {
+		t.Fatalf("expected no download count request for empty system ID, got %v", counts)
+	}
+	lock.Unlock()
+	if data, _ := os.ReadFile(logging.LogPath); !strings.Contains(string(data), "system ID is empty") || !strings.Contains(string(data), "siyuan-note/system-id-empty") {
+		t.Fatalf("expected warning for empty system ID, got %s", data)
+	}
+}
+
+func TestInstallPackagePreservesFileModes(t *testing.T) {
+	if "windows" == runtime.GOOS {
+		t.Skip("file modes are not supported on Windows")
+	}
+
+	buf := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(buf)
+	for name, mode := range map[string]os.FileMode{
+		"test-plugin/plugin.json": 0644,
+		"test-plugin/run.sh":      0755,
+		"test-plugin/setuid.sh":   0777 | os.ModeSetuid,
+	} {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(mode)
+		writer, err := zipWriter.CreateHeader(header)
+		if nil != err {
+			t.Fatalf("create zip entry [%s] failed: %s", name, err)
+		}
+		writer.Write([]byte("#!/bin/sh\n"))
+	}
+	zipWriter.Close()
+
+	setTestTempDir(t)
+	installPath := filepath.Join(t.TempDir(), "test-plugin")
+	if err := installPackage0(context.Background(), buf.Bytes(), installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+
+	for name, expected := range map[string]os.FileMode{"plugin.json": 0644, "run.sh": 0755, "setuid.sh": 0755} {
+		info, err := os.Stat(filepath.Join(installPath, name))
+		if nil != err {
+			t.Fatalf("stat [%s] failed: %s", name, err)
+		}
+		if expected != info.Mode() {
+			t.Fatalf("expected mode [%s] for [%s], got [%s]", expected, name, info.Mode())
+		}
+	}
+}
+
+// countdownContext 在 Err 被调用指定次数后返回 context.Canceled，用于在复制过程中确定性地取消。
+type countdownContext struct {
+	context.Context
+	remaining int
+}
+
+func (ctx *countdownContext) Err() error {
+	if 0 >= ctx.remaining {
+		return context.Canceled
+	}
+	ctx.remaining--
+	return nil
+}
+
+func TestInstallPackageCancel(t *testing.T) {
+	setTestTempDir(t)
+	parent := t.TempDir()
+	installPath := filepath.Join(parent, "test-plugin")
+	if err := os.MkdirAll(installPath, 0755); nil != err {
+		t.Fatalf("create install path failed: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(installPath, "plugin.json"), []byte("old"), 0644); nil != err {
+		t.Fatalf("write plugin.json failed: %s", err)
+	}
+
+	files := map[string]string{"test-plugin/plugin.json": "new"}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("test-plugin/asset-%d.js", i)] = strings.Repeat("x", 64*1024)
+	}
+	data := newTestZip(t, files)
+
+	ctx := &countdownContext{Context: context.Background(), remaining: 10}
+	if err := installPackage0(ctx, data, installPath, false); context.Canceled != err {
+		t.Fatalf("expected install to be canceled, got %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(installPath, "plugin.json"))
+	if nil != err || "old" != string(content) {
+		t.Fatalf("expected prior install to be untouched, got [%s]: %v", content, err)
+	}
+	entries, _ := os.ReadDir(installPath)
+	if 1 != len(entries) {
+		t.Fatalf("expected no partial files in install path, got %d entries", len(entries))
+	}
+	if entries, _ = os.ReadDir(parent); 1 != len(entries) {
+		t.Fatalf("expected staging dir to be cleaned up, got %d entries", len(entries))
+	}
+	if entries, _ = os.ReadDir(filepath.Join(util.TempDir, "bazaar", "package")); 0 != len(entries) {
+		t.Fatalf("expected temp artifacts to be cleaned up, got %d entries", len(entries))
+	}
+
+	if err = installPackage0(context.Background(), data, installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	if content, _ = os.ReadFile(filepath.Join(installPath, "plugin.json")); "new" != string(content) {
+		t.Fatalf("expected new install, got [%s]", content)
+	}
+}
+
+func TestInstallPackageKeepsUserFiles(t *testing.T) {
+	setTestTempDir(t)
+	installPath := filepath.Join(t.TempDir(), "themes", "test-theme")
+	for name, content := range map[string]string{"theme.json": `{"name":"test-theme"}`, "theme.css": "old", "custom/user.css": "user"} {
+		p := filepath.Join(installPath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); nil != err {
+			t.Fatalf("create dir failed: %s", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); nil != err {
+			t.Fatalf("write [%s] failed: %s", name, err)
+		}
+	}
+
+	data := newTestZip(t, map[string]string{"test-theme/theme.json": `{"name":"test-theme"}`, "test-theme/theme.css": "new"})
+	if err := installPackage0(context.Background(), data, installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+
+	// 新版本包中的文件覆盖旧文件，包中没有的用户文件保留
+	if content, _ := os.ReadFile(filepath.Join(installPath, "theme.css")); "new" != string(content) {
+		t.Fatalf("expected theme.css to be updated, got [%s]", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(installPath, "custom", "user.css")); "user" != string(content) {
+		t.Fatalf("expected user file to be kept, got [%s]", content)
+	}
+}
+
+func TestInstallPackageInodeHeadroom(t *testing.T) {
+	inodesFree := diskInodesFree
+	defer func() { diskInodesFree = inodesFree }()
+	free, ok := uint64(10), true
+	diskInodesFree = func(string) (uint64, bool) { return free, ok }
+
+	files := map[string]string{"icon.json": `{"name":"huge-icon"}`}
+	for i := 0; i < inodeCheckMinEntries; i++ {
+		files[fmt.Sprintf("icons/%d.svg", i)] = "<svg/>"
+	}
+	data := newTestZip(t, files)
+	installPath := filepath.Join(t.TempDir(), "icons", "huge-icon")
+	if err := installPackage0(context.Background(), data, installPath, false); !errors.Is(err, ErrInsufficientInodes) {
+		t.Fatalf("expected insufficient inodes error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(installPath)); 0 != len(entries) {
+		t.Fatalf("expected nothing to be unzipped, got %d entries", len(entries))
+	}
+
+	// 包中条目较少时不检查
+	small := filepath.Join(filepath.Dir(installPath), "small-icon")
+	if err := installPackage0(context.Background(), newTestZip(t, map[string]string{"icon.json": `{"name":"small-icon"}`}), small, false); nil != err {
+		t.Fatalf("install small package failed: %s", err)
+	}
+
+	// 无法获取 inode 信息时跳过检查
+	ok = false
+	if err := installPackage0(context.Background(), data, installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+
+	// 可用 inode 足够时正常安装
+	free, ok = uint64(len(files)), true
+	if err := installPackage0(context.Background(), data, installPath, true); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+}
+
+func TestUnzipPackageZipSlip(t *testing.T) {
+	for _, evil := range []string{"../../conf/conf.json", "dist/../../evil.js", "..\\evil.js", "/etc/evil"} {
+		data := newTestZip(t, map[string]string{"plugin.json": `{"name":"evil-plugin"}`, "index.js": "console.log('ok')", evil: "evil"})
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if nil != err {
+			t.Fatalf("open zip failed: %s", err)
+		}
+
+		root := t.TempDir()
+		dest := filepath.Join(root, "plugins", "evil-plugin")
+		if err = unzipPackage(context.Background(), reader, dest); !errors.Is(err, ErrUnsafeZipEntry) {
+			t.Fatalf("expected unsafe zip entry error for [%s], got %v", evil, err)
+		}
+		if entries, _ := os.ReadDir(root); 0 != len(entries) {
+			t.Fatalf("expected nothing to be written for [%s], got %d entries", evil, len(entries))
+		}
+
+		installPath := filepath.Join(root, "plugins", "evil-plugin")
+		if err = installPackage0(context.Background(), data, installPath, false); !errors.Is(err, ErrUnsafeZipEntry) {
+			t.Fatalf("expected install to fail for [%s], got %v", evil, err)
+		}
+		if gulu.File.IsExist(installPath) || gulu.File.IsExist(filepath.Join(root, "conf")) || gulu.File.IsExist(filepath.Join(root, "evil.js")) {
+			t.Fatalf("expected nothing to be installed for [%s]", evil)
+		}
+	}
+}
+
+func TestInstallPackageStreaming(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "plugins")
+
+	// 只有一个顶层目录时解压该目录下的内容
+	installPath := filepath.Join(parent, "test-plugin")
+	data := newTestZip(t, map[string]string{
+		"test-plugin-main/plugin.json":     `{"name":"test-plugin"}`,
+		"test-plugin-main/i18n/en_US.json": "{}",
+	})
+	if err := installPackage0(context.Background(), data, installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	if !gulu.File.IsExist(filepath.Join(installPath, "plugin.json")) || !gulu.File.IsExist(filepath.Join(installPath, "i18n", "en_US.json")) {
+		t.Fatalf("expected top-level directory to be flattened")
+	}
+
+	// 顶层有多个条目时原样解压
+	installPath = filepath.Join(parent, "flat-plugin")
+	data = newTestZip(t, map[string]string{"plugin.json": `{"name":"flat-plugin"}`, "dist/index.js": "console.log('ok')"})
+	if err := installPackage0(context.Background(), data, installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	if !gulu.File.IsExist(filepath.Join(installPath, "plugin.json")) || !gulu.File.IsExist(filepath.Join(installPath, "dist", "index.js")) {
+		t.Fatalf("expected package to be unzipped as is")
+	}
+
+	// 路径越过安装目录时拒绝安装
+	installPath = filepath.Join(parent, "evil-plugin")
+	data = newTestZip(t, map[string]string{"plugin.json": `{"name":"evil-plugin"}`, "../evil.js": "alert(1)"})
+	if err := installPackage0(context.Background(), data, installPath, false); nil == err {
+		t.Fatalf("expected install to fail for path traversal")
+	}
+	if gulu.File.IsExist(installPath) || gulu.File.IsExist(filepath.Join(parent, "evil.js")) {
+		t.Fatalf("expected nothing to be written for path traversal")
+	}
+	if entries, _ := os.ReadDir(parent); 2 != len(entries) {
+		t.Fatalf("expected staging dirs to be cleaned up, got %d entries", len(entries))
+	}
+}
+
+// installPackageThreePass 先写入临时压缩包文件，再解压到临时目录，最后复制到安装目录，用于和流式安装对比性能。
+func installPackageThreePass(data []byte, installPath string) (err error) {
+	tmpDir := packageTempDir()
+	if err = os.MkdirAll(tmpDir, 0755); nil != err {
+		return
+	}
+	name := gulu.Rand.String(7)
+	tmp := filepath.Join(tmpDir, name+".zip")
+	if err = os.WriteFile(tmp, data, 0644); nil != err {
+		return
+	}
+	defer os.Remove(tmp)
+
+	unzipPath := filepath.Join(tmpDir, name)
+	defer os.RemoveAll(unzipPath)
+	if err = gulu.Zip.Unzip(tmp, unzipPath); nil != err {
+		return
+	}
+
+	srcPath := unzipPath
+	if dirs, _ := os.ReadDir(unzipPath); 1 == len(dirs) && dirs[0].IsDir() {
+		srcPath = filepath.Join(unzipPath, dirs[0].Name())
+	}
+	stagingPath := filepath.Join(filepath.Dir(installPath), "."+filepath.Base(installPath)+"-"+name)
+	defer os.RemoveAll(stagingPath)
+	if err = filepath.WalkDir(srcPath, func(p string, d os.DirEntry, walkErr error) error {
+		if nil != walkErr {
+			return walkErr
+		}
+		rel, _ := filepath.Rel(srcPath, p)
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(stagingPath, rel), 0755)
+		}
+		content, readErr := os.ReadFile(p)
+		if nil != readErr {
+			return readErr
+		}
+		return os.WriteFile(filepath.Join(stagingPath, rel), content, 0644)
+	}); nil != err {
+		return
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if nil != err {
+		return
+	}
+	applyZipFileModes(reader.File, zipTopLevelDir(reader.File), stagingPath)
+
+	if err = os.RemoveAll(installPath); nil != err {
+		return
+	}
+	return os.Rename(stagingPath, installPath)
+}
+
+func BenchmarkInstallPackage(b *testing.B) {
+	setTestTempDir(b)
+	files := map[string]string{"test-plugin/plugin.json": `{"name":"test-plugin"}`}
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("test-plugin/assets/asset-%d.js", i)] = strings.Repeat(fmt.Sprintf("console.log(%d);", i), 4*1024)
+	}
+	data := newTestZip(b, files)
+	installPath := filepath.Join(b.TempDir(), "plugins", "test-plugin")
+
+	b.Run("streaming", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := installPackage0(context.Background(), data, installPath, true); nil != err {
+				b.Fatalf("install package failed: %s", err)
+			}
+		}
+	})
+	b.Run("three-pass", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := installPackageThreePass(data, installPath); nil != err {
+				b.Fatalf("install package failed: %s", err)
+			}
+		}
+	})
+}
+
+func TestInstallPackageManifest(t *testing.T) {
+	setTestTempDir(t)
+	pluginsPath := filepath.Join(t.TempDir(), "plugins")
+
+	installPath := filepath.Join(pluginsPath, "test-plugin")
+	data := newTestZip(t, map[string]string{"test-plugin/plugin.json": `{"name":"test-plugin"}`, "test-plugin/index.js": "console.log('ok')"})
+	if err := installPackage0(context.Background(), data, installPath, false); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	if !gulu.File.IsExist(filepath.Join(installPath, "index.js")) {
+		t.Fatalf("expected package to be installed")
+	}
+
+	// 没有清单的包不能覆盖已安装的版本
+	data = newTestZip(t, map[string]string{"test-plugin/readme.txt": "unrelated"})
+	if err := installPackage0(context.Background(), data, installPath, false); !errors.Is(err, ErrNoManifestInPackage) {
+		t.Fatalf("expected no manifest error, got %v", err)
+	}
+	if !gulu.File.IsExist(filepath.Join(installPath, "index.js")) || gulu.File.IsExist(filepath.Join(installPath, "readme.txt")) {
+		t.Fatalf("expected prior install to be untouched")
+	}
+
+	// 清单类型不匹配
+	installPath = filepath.Join(pluginsPath, "test-theme")
+	data = newTestZip(t, map[string]string{"test-theme/theme.json": `{"name":"test-theme"}`})
+	if err := installPackage0(context.Background(), data, installPath, false); !errors.Is(err, ErrNoManifestInPackage) {
+		t.Fatalf("expected no manifest error, got %v", err)
+	}
+	if gulu.File.IsExist(installPath) {
+		t.Fatalf("expected failed install to be rolled back")
+	}
+	if entries, _ := os.ReadDir(pluginsPath); 1 != len(entries) {
+		t.Fatalf("expected staging dirs to be cleaned up, got %d entries", len(entries))
+	}
+}
+
+func TestCanonicalInstallDir(t *testing.T) {
+	setTestTempDir(t)
+	setTestDataDir(t)
+
+	const repoURL = "https://github.com/siyuan-note/Canonical-Plugin"
+	if dirName := CanonicalInstallDir("plugins", repoURL+".git/"); "Canonical-Plugin" != dirName {
+		t.Fatalf("expected repo name as install dir, got [%s]", dirName)
+	}
+	if dirName := CanonicalInstallDir("plugins", "not a repo"); "" != dirName {
+		t.Fatalf("expected empty install dir for invalid repo, got [%s]", dirName)
+	}
+
+	// 集市中有包名时使用包名
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/Canonical-Plugin@0000000000000000000000000000000000000001", Package: &StagePackage{Name: "canonical-plugin"}},
+	}})
+	if dirName := CanonicalInstallDir("plugins", repoURL); "canonical-plugin" != dirName {
+		t.Fatalf("expected package name as install dir, got [%s]", dirName)
+	}
+	setTestStageIndex("plugins", nil)
+
+	zips := map[string][]byte{
+		"0000000000000000000000000000000000000001": newTestZip(t, map[string]string{
+			"canonical-plugin-1.0.0/plugin.json": `{"name":"canonical-plugin","url":"` + repoURL + `","version":"1.0.0"}`,
+		}),
+		"0000000000000000000000000000000000000002": newTestZip(t, map[string]string{
+			"Canonical-Plugin-main/plugin.json": `{"name":"canonical-plugin-renamed","url":"` + repoURL + `","version":"1.1.0"}`,
+		}),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zips[r.URL.Path[strings.LastIndex(r.URL.Path, "@")+1:]])
+	}))
+	defer server.Close()
+	setTestBazaarOSSServer(t, server.URL)
+
+	// 首次安装使用清单中的包名，压缩包内的顶层目录名和包名变化后仍然更新同一个目录
+	for _, repoHash := range []string{"0000000000000000000000000000000000000001", "0000000000000000000000000000000000000002"} {
+		if _, err := installBazaarPackage("plugins", repoURL, repoHash, "", "", false); nil != err {
+			t.Fatalf("install package failed: %s", err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(util.DataDir, "plugins"))
+	if nil != err || 1 != len(entries) || "canonical-plugin" != entries[0].Name() {
+		t.Fatalf("expected a single install dir, got %v: %v", entries, err)
+	}
+	if plugin, _ := PluginJSON("canonical-plugin"); nil == plugin || "1.1.0" != plugin.Version {
+		t.Fatalf("expected package to be updated in place")
+	}
+
+	// 已经安装在其他目录时沿用已有目录
+	if err = os.Rename(filepath.Join(util.DataDir, "plugins", "canonical-plugin"), filepath.Join(util.DataDir, "plugins", "Canonical-Plugin")); nil != err {
+		t.Fatalf("rename install dir failed: %s", err)
+	}
+	if dirName := CanonicalInstallDir("plugins", repoURL); "Canonical-Plugin" != dirName {
+		t.Fatalf("expected existing install dir, got [%s]", dirName)
+	}
+
+	// 指定安装路径时也使用规范的目录名，比如界面按包名传入的路径
+	if _, err = InstallPlugin(repoURL, "0000000000000000000000000000000000000001", filepath.Join(util.DataDir, "plugins", "Canonical Plugin"), ""); nil != err {
+		t.Fatalf("install plugin failed: %s", err)
+	}
+	if entries, err = os.ReadDir(filepath.Join(util.DataDir, "plugins")); nil != err || 1 != len(entries) || "Canonical-Plugin" != entries[0].Name() {
+		t.Fatalf("expected install path to be canonicalized, got %v: %v", entries, err)
+	}
+}
+
+func TestInstallEvents(t *testing.T) {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	repoURL := "https://github.com/siyuan-note/event-plugin"
+	data := newTestZip(t, map[string]string{
+		"event-plugin/plugin.json": `{"name":"event-plugin","version":"1.2.0"}`,
+		"event-plugin/index.js":    "console.log('event-plugin')",
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/package/siyuan-note/event-plugin@"+repoHash != r.URL.Path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	setTestBazaarOSSServer(t, server.URL)
+	setTestTempDir(t)
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/event-plugin@" + repoHash, Package: &StagePackage{Version: "1.2.0"}},
+	}})
+
+	var events []*InstallEvent
+	lock := sync.Mutex{}
+	RegisterInstallEventSink(func(evt *InstallEvent) {
+		if repoURL != evt.RepoURL {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, evt)
+	})
+
+	installPath := filepath.Join(t.TempDir(), "event-plugin")
+	if _, err := InstallPlugin(repoURL, repoHash, installPath, ""); nil != err {
+		t.Fatalf("install plugin failed: %s", err)
+	}
+
+	expected := []InstallEventType{InstallEventStart, InstallEventDownloadComplete, InstallEventUnzipComplete, InstallEventInstallComplete}
+	if len(expected) != len(events) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, evt := range events {
+		if expected[i] != evt.Type || "1.2.0" != evt.Version {
+			t.Fatalf("unexpected event [%d]: %+v", i, evt)
+		}
+		if 0 < i && evt.Duration < events[i-1].Duration {
+			t.Fatalf("expected non-decreasing durations: %+v", events)
+		}
+		if 0 < i && int64(len(data)) != evt.Size {
+			t.Fatalf("expected size [%d], got [%d]", len(data), evt.Size)
+		}
+	}
+
+	events = nil
+	if _, err := InstallPlugin(repoURL, "0000000000000000000000000000000000000000", installPath, ""); nil == err {
+		t.Fatalf("expected install to fail")
+	}
+	if 2 != len(events) || InstallEventFailed != events[1].Type || "" == events[1].Reason {
+		t.Fatalf("expected failed event, got %+v", events)
+	}
+}
+
+func TestInstallPathConflict(t *testing.T) {
+	setTestTempDir(t)
+	installPath := filepath.Join(t.TempDir(), "test-plugin")
+	if err := os.MkdirAll(installPath, 0755); nil != err {
+		t.Fatalf("create install path failed: %s", err)
+	}
+	existing := `{"name": "test-plugin", "url": "https://github.com/siyuan-note/plugin-a", "version": "1.0.0"}`
+	if err := os.WriteFile(filepath.Join(installPath, "plugin.json"), []byte(existing), 0644); nil != err {
+		t.Fatalf("write plugin.json failed: %s", err)
+	}
+
+	// 同一个仓库允许覆盖升级
+	upgrade := newTestZip(t, map[string]string{"test-plugin/plugin.json": `{"name": "test-plugin", "url": "https://github.com/Siyuan-Note/plugin-a/", "version": "1.1.0"}`})
+	if err := installPackage0(context.Background(), upgrade, installPath, false); nil != err {
+		t.Fatalf("upgrade package failed: %s", err)
+	}
+	if url := readManifestURL(filepath.Join(installPath, "plugin.json")); "https://github.com/Siyuan-Note/plugin-a/" != url {
+		t.Fatalf("expected upgraded manifest, got [%s]", url)
+	}
+
+	// 其他仓库的包不能覆盖
+	other := newTestZip(t, map[string]string{"test-plugin/plugin.json": `{"name": "test-plugin", "url": "https://github.com/someone/plugin-b", "version": "2.0.0"}`})
+	if err := installPackage0(context.Background(), other, installPath, false); !errors.Is(err, ErrInstallPathConflict) {
+		t.Fatalf("expected install path conflict, got %v", err)
+	}
+	if url := readManifestURL(filepath.Join(installPath, "plugin.json")); "https://github.com/Siyuan-Note/plugin-a/" != url {
+		t.Fatalf("expected existing package to be untouched, got [%s]", url)
+	}
+
+	if err := installPackage0(context.Background(), other, installPath, true); nil != err {
+		t.Fatalf("force install package failed: %s", err)
+	}
+	if url := readManifestURL(filepath.Join(installPath, "plugin.json")); "https://github.com/someone/plugin-b" != url {
+		t.Fatalf("expected forced install to overwrite, got [%s]", url)
+	}
+}
+
+func TestInstallFromRelease(t *testing.T) {
+	setTestDataDir(t)
+	setTestTempDir(t)
+
+	data := newTestZip(t, map[string]string{
+		"release-plugin/plugin.json": `{"name": "release", "url": "https://github.com/siyuan-note/release-plugin", "version": "1.0.0"}`,
+		"release-plugin/index.js":    "console.log('hello')",
+	})
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release := func(tag, digest string) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"tag_name": "%s", "assets": [{"name": "package.zip", "size": %d, "digest": "%s", "browser_download_url": "%s/download/package.zip"}]}`,
+				tag, len(data), digest, server.URL)
+		}
+
+		switch r.URL.Path {
+		case "/repos/siyuan-note/release-plugin/releases/latest":
+			release("v1.0.0", digest)
+		case "/repos/siyuan-note/release-plugin/releases/tags/v0.9.0":
+			release("v0.9.0", "sha256:0000")
+		case "/download/package.zip":
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	setTestGitHubAPIServer(t, server.URL)
+
+	if err := InstallFromRelease("https://github.com/siyuan-note/release-plugin", "latest", "package.zip", "plugins", ""); nil != err {
+		t.Fatalf("install from release failed: %s", err)
+	}
+	// 安装目录使用清单中的包名
+	plugin, err := PluginJSON("release")
+	if nil != err || "1.0.0" != plugin.Version {
+		t.Fatalf("expected installed plugin, got %+v: %v", plugin, err)
+	}
+
+	if err = InstallFromRelease("https://github.com/siyuan-note/release-plugin", "latest", "missing.zip", "plugins", ""); nil == err {
+		t.Fatalf("expected error for missing asset")
+	}
+	if err = InstallFromRelease("https://github.com/siyuan-note/release-plugin", "v0.9.0", "package.zip", "plugins", ""); nil == err || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
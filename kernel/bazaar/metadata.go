@@ -0,0 +1,204 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+var (
+	preferEnglishMetadata     bool
+	preferEnglishMetadataLock = sync.Mutex{}
+)
+
+// SetPreferEnglishMetadata 设置是否无视界面语言，总是优先使用集市包的英文名称、描述和 README。
+func SetPreferEnglishMetadata(preferEnglish bool) {
+	preferEnglishMetadataLock.Lock()
+	defer preferEnglishMetadataLock.Unlock()
+	preferEnglishMetadata = preferEnglish
+}
+
+func isPreferEnglishMetadata() bool {
+	preferEnglishMetadataLock.Lock()
+	defer preferEnglishMetadataLock.Unlock()
+	return preferEnglishMetadata
+}
+
+// MetadataFallbackPolicy 表示界面语言没有对应的本地化元数据时的回退策略。
+type MetadataFallbackPolicy int
+
+const (
+	PreferEnglish MetadataFallbackPolicy = iota // 优先使用英文，英文为空时使用默认
+	PreferDefault                               // 优先使用作者声明的默认，默认为空时使用英文
+)
+
+var (
+	metadataFallbackPolicy     = PreferEnglish
+	metadataFallbackPolicyLock = sync.Mutex{}
+)
+
+// SetMetadataFallbackPolicy 设置集市包名称、描述、README 和赞助信息在未知语言下的回退策略。
+//
+// 有些包主要使用其他语言编写，默认值才是准确的，英文为空或者是质量很差的机翻。
+func SetMetadataFallbackPolicy(policy MetadataFallbackPolicy) {
+	metadataFallbackPolicyLock.Lock()
+	defer metadataFallbackPolicyLock.Unlock()
+	metadataFallbackPolicy = policy
+}
+
+func getMetadataFallbackPolicy() MetadataFallbackPolicy {
+	metadataFallbackPolicyLock.Lock()
+	defer metadataFallbackPolicyLock.Unlock()
+	return metadataFallbackPolicy
+}
+
+// SupportedLanguages 返回本地化元数据（名称、描述、README 等）能够识别的界面语言，其他语言按回退策略使用默认或英文。
+func SupportedLanguages() (ret []string) {
+	for lang := range localeFallbacks {
+		ret = append(ret, lang)
+	}
+	sort.Strings(ret)
+	return
+}
+
+func getMetadataLang() string {
+	if isPreferEnglishMetadata() {
+		return "en_US"
+	}
+	return util.Lang
+}
+
+// localeFallbacks 界面语言依次使用的本地化字符串，都为空时使用默认，新增语言只需要在这里添加一行。
+var localeFallbacks = map[string][]string{
+	"en_US":  {"en_US"},
+	"pt_BR":  {"pt_BR"},
+	"zh_CHT": {"zh_CHT", "zh_CN"},
+	"zh_CN":  {"zh_CN"},
+}
+
+// preferredLocaleString 返回界面语言对应的本地化字符串，都为空时返回 fallback。
+func preferredLocaleString(m map[string]string, fallback string) (ret string) {
+	if ret = preferredLocale(m, func(s string) bool { return "" == s }); "" == ret {
+		ret = fallback
+	}
+	return
+}
+
+// preferredLocale 返回界面语言对应的本地化值，isEmpty 返回 true 的值视为没有本地化。
+//
+// 回退顺序：本地化 -> 默认 -> 英文，未知语言的默认和英文之间按回退策略选择。
+func preferredLocale[T any](m map[string]T, isEmpty func(T) bool) (ret T) {
+	langs, ok := localeFallbacks[getMetadataLang()]
+	if !ok && PreferDefault != getMetadataFallbackPolicy() {
+		langs = []string{"en_US"}
+	}
+
+	for _, lang := range append(append([]string{}, langs...), "default", "en_US") {
+		if ret = m[lang]; !isEmpty(ret) {
+			return
+		}
+	}
+	return
+}
+
+func getPreferredReadme(readme Readme) string {
+	return preferredLocaleString(readme, "README.md")
+}
+
+func GetPreferredName(pkg *Package) string {
+	return preferredLocaleString(pkg.DisplayName, pkg.Name)
+}
+
+func getPreferredDesc(desc Description) string {
+	return preferredLocaleString(desc, "")
+}
+
+// getPreferredKeywords 返回界面语言对应的关键字用于展示，没有本地化关键字时返回 Keywords。
+func getPreferredKeywords(pkg *Package) (ret []string) {
+	if ret = preferredLocale(pkg.LocalizedKeywords, func(keywords []string) bool { return 1 > len(keywords) }); 1 > len(ret) {
+		ret = pkg.Keywords
+	}
+	return
+}
+
+// MatchKeyword 判断集市包的关键字是否包含 keyword（忽略大小写），匹配所有语言的关键字，
+// 这样中文用户搜索“主题”也能匹配到关键字为 theme 且本地化了中文关键字的包。
+func MatchKeyword(pkg *Package, keyword string) bool {
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+	if "" == keyword {
+		return false
+	}
+
+	keywordsList := [][]string{pkg.Keywords}
+	for _, keywords := range pkg.LocalizedKeywords {
+		keywordsList = append(keywordsList, keywords)
+	}
+	for _, keywords := range keywordsList {
+		for _, k := range keywords {
+			if strings.Contains(strings.ToLower(k), keyword) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getPreferredFunding(funding *Funding) (url, message string) {
+	if nil == funding {
+		return
+	}
+
+	message = getPreferredFundingMessage(funding.Message)
+	if "" != funding.OpenCollective {
+		url = "https://opencollective.com/" + funding.OpenCollective
+	} else if "" != funding.Patreon {
+		url = "https://www.patreon.com/" + funding.Patreon
+	} else if "" != funding.GitHub {
+		url = "https://github.com/sponsors/" + funding.GitHub
+	} else if 0 < len(funding.Custom) {
+		url = funding.Custom[0]
+	}
+	return
+}
+
+func getPreferredFundingMessage(message FundingMessage) string {
+	return preferredLocaleString(message, "")
+}
+
+// ResolvePreferred 按当前界面语言填充包的 Preferred* 字段（名称、描述、关键字和赞助信息）。
+//
+// PreferredReadme 需要读取并渲染 README 内容，不在这里填充。
+func (pkg *Package) ResolvePreferred() {
+	pkg.PreferredFunding, pkg.PreferredFundingMessage = getPreferredFunding(pkg.Funding)
+	pkg.PreferredName = GetPreferredName(pkg)
+	pkg.PreferredDesc = getPreferredDesc(pkg.Description)
+	pkg.PreferredKeywords = getPreferredKeywords(pkg)
+}
+
+// ResolvePreferredBatch 批量填充包的 Preferred* 字段，前端渲染列表时可以直接使用预先计算好的字符串。
+func ResolvePreferredBatch(pkgs []*Package) {
+	for _, pkg := range pkgs {
+		if nil == pkg {
+			continue
+		}
+		pkg.ResolvePreferred()
+	}
+}
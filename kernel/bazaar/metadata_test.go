@@ -0,0 +1,256 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestPreferredFunding(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	funding := &Funding{
+		GitHub: "88250",
+		Message: FundingMessage{
+			"default": "Buy me a coffee",
+			"zh_CN":   "请我喝杯咖啡",
+			"zh_CHT":  "請我喝杯咖啡",
+			"pt_BR":   "Me pague um café",
+		},
+	}
+	cases := map[string]string{
+		"zh_CN":  "请我喝杯咖啡",
+		"zh_CHT": "請我喝杯咖啡",
+		"en_US":  "Buy me a coffee",
+		"pt_BR":  "Me pague um café",
+		"ja_JP":  "Buy me a coffee",
+	}
+	for lang, expected := range cases {
+		util.Lang = lang
+		url, message := getPreferredFunding(funding)
+		if "https://github.com/sponsors/88250" != url {
+			t.Fatalf("unexpected funding URL [%s]", url)
+		}
+		if expected != message {
+			t.Fatalf("expected funding message [%s] for [%s], got [%s]", expected, lang, message)
+		}
+	}
+
+	url, message := getPreferredFunding(&Funding{Patreon: "88250"})
+	if "https://www.patreon.com/88250" != url || "" != message {
+		t.Fatalf("unexpected funding [%s, %s]", url, message)
+	}
+}
+
+func TestPreferredReadmeFallback(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	for _, lang := range []string{"zh_CN", "zh_CHT", "en_US", "ja_JP"} {
+		util.Lang = lang
+		if readme := getPreferredReadme(Readme{"en_US": "README_en_US.md"}); "README_en_US.md" != readme {
+			t.Fatalf("expected [README_en_US.md] for [%s], got [%s]", lang, readme)
+		}
+		if readme := getPreferredReadme(Readme{}); "README.md" != readme {
+			t.Fatalf("expected [README.md] for [%s], got [%s]", lang, readme)
+		}
+		if readme := getPreferredReadme(nil); "README.md" != readme {
+			t.Fatalf("expected [README.md] for [%s], got [%s]", lang, readme)
+		}
+	}
+
+	util.Lang = "zh_CN"
+	if readme := getPreferredReadme(Readme{"default": "README.md", "en_US": "README_en_US.md"}); "README.md" != readme {
+		t.Fatalf("expected default README, got [%s]", readme)
+	}
+}
+
+func TestPreferEnglishMetadata(t *testing.T) {
+	setTestLang(t, "zh_CN")
+
+	pkg := &Package{
+		Name:        "test",
+		DisplayName: DisplayName{"default": "Default", "zh_CN": "中文名称", "en_US": "English Name"},
+		Description: Description{"default": "Default description", "zh_CN": "中文描述"},
+		Readme:      Readme{"default": "README.md", "zh_CN": "README_zh_CN.md", "en_US": "README_en_US.md"},
+	}
+	if "中文名称" != GetPreferredName(pkg) {
+		t.Fatalf("expected Chinese name, got [%s]", GetPreferredName(pkg))
+	}
+
+	SetPreferEnglishMetadata(true)
+	t.Cleanup(func() { SetPreferEnglishMetadata(false) })
+	if name := GetPreferredName(pkg); "English Name" != name {
+		t.Fatalf("expected English name, got [%s]", name)
+	}
+	if desc := getPreferredDesc(pkg.Description); "Default description" != desc {
+		t.Fatalf("expected default description, got [%s]", desc)
+	}
+	if readme := getPreferredReadme(pkg.Readme); "README_en_US.md" != readme {
+		t.Fatalf("expected English README, got [%s]", readme)
+	}
+}
+
+func TestMetadataFallbackPolicy(t *testing.T) {
+	setTestLang(t, "ja_JP")
+	t.Cleanup(func() { SetMetadataFallbackPolicy(PreferEnglish) })
+
+	rich := &Package{
+		Name:        "rich-default",
+		DisplayName: DisplayName{"default": "デフォルト名"},
+		Description: Description{"default": "作者が書いた詳しい説明"},
+		Readme:      Readme{"default": "README_ja_JP.md"},
+	}
+	translated := &Package{
+		Name:        "translated",
+		DisplayName: DisplayName{"default": "デフォルト名", "en_US": "Default Name"},
+		Description: Description{"default": "作者が書いた詳しい説明", "en_US": "Description written by the author"},
+		Readme:      Readme{"default": "README_ja_JP.md", "en_US": "README_en_US.md"},
+	}
+
+	// 默认策略优先英文，英文为空时使用默认
+	if name, desc, readme := GetPreferredName(rich), getPreferredDesc(rich.Description), getPreferredReadme(rich.Readme); "デフォルト名" != name || "作者が書いた詳しい説明" != desc || "README_ja_JP.md" != readme {
+		t.Fatalf("expected default metadata, got [%s, %s, %s]", name, desc, readme)
+	}
+	if name, desc, readme := GetPreferredName(translated), getPreferredDesc(translated.Description), getPreferredReadme(translated.Readme); "Default Name" != name || "Description written by the author" != desc || "README_en_US.md" != readme {
+		t.Fatalf("expected English metadata, got [%s, %s, %s]", name, desc, readme)
+	}
+
+	SetMetadataFallbackPolicy(PreferDefault)
+	if name, desc, readme := GetPreferredName(rich), getPreferredDesc(rich.Description), getPreferredReadme(rich.Readme); "デフォルト名" != name || "作者が書いた詳しい説明" != desc || "README_ja_JP.md" != readme {
+		t.Fatalf("expected default metadata, got [%s, %s, %s]", name, desc, readme)
+	}
+	if name, desc, readme := GetPreferredName(translated), getPreferredDesc(translated.Description), getPreferredReadme(translated.Readme); "デフォルト名" != name || "作者が書いた詳しい説明" != desc || "README_ja_JP.md" != readme {
+		t.Fatalf("expected default metadata, got [%s, %s, %s]", name, desc, readme)
+	}
+
+	// 默认为空时仍回退到英文
+	if desc := getPreferredDesc(Description{"en_US": "English only"}); "English only" != desc {
+		t.Fatalf("expected English fallback, got [%s]", desc)
+	}
+}
+
+func TestPreferredPtBR(t *testing.T) {
+	setTestLang(t, "pt_BR")
+
+	data := []byte(`{"name":"test","displayName":{"default":"Default","pt_BR":"Nome"},"description":{"default":"Default","pt_BR":"Descrição"},"readme":{"default":"README.md","pt_BR":"README_pt_BR.md"}}`)
+	pkg := &Package{}
+	if err := gulu.JSON.UnmarshalJSON(data, pkg); nil != err {
+		t.Fatalf("unmarshal package failed: %s", err)
+	}
+	if name, desc, readme := GetPreferredName(pkg), getPreferredDesc(pkg.Description), getPreferredReadme(pkg.Readme); "Nome" != name || "Descrição" != desc || "README_pt_BR.md" != readme {
+		t.Fatalf("expected Brazilian Portuguese metadata, got [%s, %s, %s]", name, desc, readme)
+	}
+}
+
+func TestSupportedLanguages(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	localized := map[string]string{"en_US": "English", "pt_BR": "Português", "zh_CHT": "繁體中文", "zh_CN": "简体中文"}
+	pkg := &Package{DisplayName: DisplayName{"default": "Default"}, Description: Description{"default": "Default"}, Readme: Readme{"default": "Default"}}
+	for lang, value := range localized {
+		pkg.DisplayName[lang], pkg.Description[lang], pkg.Readme[lang] = value, value, value
+	}
+
+	langs := SupportedLanguages()
+	if len(localized) != len(langs) {
+		t.Fatalf("unexpected supported languages %v", langs)
+	}
+	for _, supported := range langs {
+		util.Lang = supported
+		expected, ok := localized[supported]
+		if !ok {
+			t.Fatalf("unexpected supported language [%s]", util.Lang)
+		}
+		if name, desc, readme := GetPreferredName(pkg), getPreferredDesc(pkg.Description), getPreferredReadme(pkg.Readme); expected != name || expected != desc || expected != readme {
+			t.Fatalf("expected [%s] to be resolved for [%s], got [%s, %s, %s]", expected, util.Lang, name, desc, readme)
+		}
+	}
+}
+
+func TestResolvePreferredBatch(t *testing.T) {
+	setTestLang(t, "zh_CN")
+
+	pkgs := []*Package{
+		{
+			Name:              "plugin-a",
+			DisplayName:       DisplayName{"default": "Plugin A", "zh_CN": "插件 A"},
+			Description:       Description{"default": "Desc A", "zh_CN": "描述 A"},
+			Keywords:          []string{"a"},
+			LocalizedKeywords: LocalizedKeywords{"zh_CN": {"甲"}},
+			Funding:           &Funding{GitHub: "siyuan-note", Message: FundingMessage{"default": "Thanks", "zh_CN": "感谢"}},
+		},
+		nil,
+		{Name: "plugin-b", Description: Description{"default": "Desc B"}, Keywords: []string{"b"}},
+	}
+	ResolvePreferredBatch(pkgs)
+
+	a := pkgs[0]
+	if "插件 A" != a.PreferredName || "描述 A" != a.PreferredDesc || "甲" != strings.Join(a.PreferredKeywords, ",") ||
+		"https://github.com/sponsors/siyuan-note" != a.PreferredFunding || "感谢" != a.PreferredFundingMessage {
+		t.Fatalf("unexpected preferred fields [%s, %s, %v, %s, %s]", a.PreferredName, a.PreferredDesc, a.PreferredKeywords, a.PreferredFunding, a.PreferredFundingMessage)
+	}
+	b := pkgs[2]
+	if "plugin-b" != b.PreferredName || "Desc B" != b.PreferredDesc || "b" != strings.Join(b.PreferredKeywords, ",") || "" != b.PreferredFunding {
+		t.Fatalf("unexpected preferred fields [%s, %s, %v, %s]", b.PreferredName, b.PreferredDesc, b.PreferredKeywords, b.PreferredFunding)
+	}
+}
+
+func TestLocalizedKeywords(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	plain := &Package{Keywords: []string{"theme", "dark"}}
+	localized := &Package{
+		Keywords:          []string{"theme", "dark"},
+		LocalizedKeywords: LocalizedKeywords{"zh_CN": {"主题", "暗色"}, "en_US": {"theme", "dark mode"}, "pt_BR": {"tema", "modo escuro"}},
+	}
+
+	util.Lang = "zh_CN"
+	if keywords := getPreferredKeywords(localized); "主题,暗色" != strings.Join(keywords, ",") {
+		t.Fatalf("expected Chinese keywords, got %v", keywords)
+	}
+	if keywords := getPreferredKeywords(plain); "theme,dark" != strings.Join(keywords, ",") {
+		t.Fatalf("expected plain keywords, got %v", keywords)
+	}
+	util.Lang = "zh_CHT"
+	if keywords := getPreferredKeywords(localized); "主题,暗色" != strings.Join(keywords, ",") {
+		t.Fatalf("expected Simplified Chinese fallback, got %v", keywords)
+	}
+	util.Lang = "pt_BR"
+	if keywords := getPreferredKeywords(localized); "tema,modo escuro" != strings.Join(keywords, ",") {
+		t.Fatalf("expected Portuguese keywords, got %v", keywords)
+	}
+	util.Lang = "fr_FR"
+	if keywords := getPreferredKeywords(localized); "theme,dark mode" != strings.Join(keywords, ",") {
+		t.Fatalf("expected English keywords, got %v", keywords)
+	}
+	util.Lang = "en_US"
+	if keywords := getPreferredKeywords(&Package{Keywords: []string{"theme"}, LocalizedKeywords: LocalizedKeywords{"zh_CN": {"主题"}}}); "theme" != strings.Join(keywords, ",") {
+		t.Fatalf("expected fallback to plain keywords, got %v", keywords)
+	}
+
+	// 搜索时匹配所有语言的关键字
+	if !MatchKeyword(localized, "主题") || !MatchKeyword(localized, "Theme") || !MatchKeyword(localized, "MODE") || !MatchKeyword(localized, "escuro") {
+		t.Fatalf("expected cross-language keyword match")
+	}
+	if MatchKeyword(plain, "主题") || MatchKeyword(localized, "light") || MatchKeyword(localized, " ") {
+		t.Fatalf("unexpected keyword match")
+	}
+}
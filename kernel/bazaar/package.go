@@ -17,74 +17,93 @@
 package bazaar
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/88250/go-humanize"
 	"github.com/88250/gulu"
-	"github.com/88250/lute"
-	"github.com/araddon/dateparse"
 	"github.com/imroc/req/v3"
+	ants "github.com/panjf2000/ants/v2"
 	gcache "github.com/patrickmn/go-cache"
 	"github.com/siyuan-note/filelock"
-	"github.com/siyuan-note/httpclient"
 	"github.com/siyuan-note/logging"
 	"github.com/siyuan-note/siyuan/kernel/util"
 	"golang.org/x/mod/semver"
-	textUnicode "golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/transform"
 )
 
-type DisplayName struct {
-	Default string `json:"default"`
-	ZhCN    string `json:"zh_CN"`
-	EnUS    string `json:"en_US"`
-	ZhCHT   string `json:"zh_CHT"`
-}
+// LocalizedStrings 按语言标记存储的本地化字符串，键为 default、en_US、zh_CN 等，和清单文件中的 JSON 结构一致。
+type LocalizedStrings map[string]string
 
-type Description struct {
-	Default string `json:"default"`
-	ZhCN    string `json:"zh_CN"`
-	EnUS    string `json:"en_US"`
-	ZhCHT   string `json:"zh_CHT"`
-}
+// UnmarshalJSON 解析 {"default": "", "zh_CN": "", ...} 结构，忽略值不是字符串的语言，避免个别字段写错导致整个清单无法解析。
+func (l *LocalizedStrings) UnmarshalJSON(data []byte) (err error) {
+	var raw map[string]any
+	if err = gulu.JSON.UnmarshalJSON(data, &raw); nil != err {
+		return
+	}
+	if nil == raw {
+		*l = nil
+		return
+	}
 
-type Readme struct {
-	Default string `json:"default"`
-	ZhCN    string `json:"zh_CN"`
-	EnUS    string `json:"en_US"`
-	ZhCHT   string `json:"zh_CHT"`
+	ret := LocalizedStrings{}
+	for lang, value := range raw {
+		if str, ok := value.(string); ok {
+			ret[lang] = str
+		}
+	}
+	*l = ret
+	return
 }
 
+type DisplayName = LocalizedStrings
+
+type Description = LocalizedStrings
+
+type Readme = LocalizedStrings
+
+type FundingMessage = LocalizedStrings
+
+// LocalizedKeywords 本地化的关键字，用于展示和跨语言搜索，键和 LocalizedStrings 相同。
+type LocalizedKeywords map[string][]string
+
 type Funding struct {
-	OpenCollective string   `json:"openCollective"`
-	Patreon        string   `json:"patreon"`
-	GitHub         string   `json:"github"`
-	Custom         []string `json:"custom"`
+	OpenCollective string         `json:"openCollective"`
+	Patreon        string         `json:"patreon"`
+	GitHub         string         `json:"github"`
+	Custom         []string       `json:"custom"`
+	Message        FundingMessage `json:"message"`
 }
 
 type Package struct {
-	Author        string       `json:"author"`
-	URL           string       `json:"url"`
-	Version       string       `json:"version"`
-	MinAppVersion string       `json:"minAppVersion"`
-	Backends      []string     `json:"backends"`
-	Frontends     []string     `json:"frontends"`
-	DisplayName   *DisplayName `json:"displayName"`
-	Description   *Description `json:"description"`
-	Readme        *Readme      `json:"readme"`
-	Funding       *Funding     `json:"funding"`
-	Keywords      []string     `json:"keywords"`
-
-	PreferredFunding string `json:"preferredFunding"`
-	PreferredName    string `json:"preferredName"`
-	PreferredDesc    string `json:"preferredDesc"`
-	PreferredReadme  string `json:"preferredReadme"`
+	Author        string      `json:"author"`
+	URL           string      `json:"url"`
+	Version       string      `json:"version"`
+	MinAppVersion string      `json:"minAppVersion"`
+	MaxAppVersion string      `json:"maxAppVersion"` // 可选，支持的最高思源版本，为空时没有上限
+	Backends      []string    `json:"backends"`
+	Frontends     []string    `json:"frontends"`
+	DisplayName   DisplayName `json:"displayName"`
+	Description   Description `json:"description"`
+	Readme        Readme      `json:"readme"`
+	Funding       *Funding    `json:"funding"`
+	Keywords      []string    `json:"keywords"`
+	License       string      `json:"license"` // SPDX 许可证标识符
+
+	LocalizedKeywords LocalizedKeywords `json:"localizedKeywords"` // 可选，没有时使用 Keywords
+	PreferredKeywords []string          `json:"preferredKeywords"`
+
+	PreferredFunding        string `json:"preferredFunding"`
+	PreferredFundingMessage string `json:"preferredFundingMessage"`
+	PreferredName           string `json:"preferredName"`
+	PreferredDesc           string `json:"preferredDesc"`
+	PreferredReadme         string `json:"preferredReadme"`
 
 	Name            string `json:"name"`
 	RepoURL         string `json:"repoURL"`
@@ -93,8 +112,15 @@ type Package struct {
 	PreviewURLThumb string `json:"previewURLThumb"`
 	IconURL         string `json:"iconURL"`
 
+	Previews LocalizedStrings `json:"previews"` // 可选，[语言]包内本地化预览图的相对路径
+
+	Screenshots         []string `json:"screenshots"`         // 包内截图的相对路径
+	ScreenshotURLs      []string `json:"screenshotURLs"`      // 截图地址，没有截图时为预览图
+	ScreenshotURLThumbs []string `json:"screenshotURLThumbs"` // 截图缩略图地址，和 ScreenshotURLs 一一对应
+
 	Installed    bool   `json:"installed"`
 	Outdated     bool   `json:"outdated"`
+	Ahead        bool   `json:"ahead"` // 已安装的版本比集市上的新，属于开发版本
 	Current      bool   `json:"current"`
 	Updated      string `json:"updated"`
 	Stars        int    `json:"stars"`
@@ -104,29 +130,58 @@ type Package struct {
 	InstallSize  int64  `json:"installSize"`
 	HInstallSize string `json:"hInstallSize"`
 	HInstallDate string `json:"hInstallDate"`
+	InstallDate  int64  `json:"installDate"` // 安装时间（毫秒时间戳）
 	HUpdated     string `json:"hUpdated"`
 	Downloads    int    `json:"downloads"`
+	Featured     bool   `json:"featured"`
+	FeaturedRank int    `json:"featuredRank"`
+	Archived     bool   `json:"archived"` // 仓库已归档，不会再更新
+	Deprecated   bool   `json:"deprecated"`
+	Replacement  string `json:"replacement"` // 替代包的仓库地址
 
-	Incompatible bool `json:"incompatible"`
+	UpdateSeverity  Severity `json:"updateSeverity"`  // 更新级别，仅在 Outdated 时有效
+	PlatformDropped bool     `json:"platformDropped"` // 最新版本不再支持当前平台，更新后将无法使用，仅在 Outdated 时有效
+
+	UpdateBlockedByAppVersion string `json:"updateBlockedByAppVersion"` // 最新版本要求的最低思源版本，高于当前版本时无法更新，为空表示没有被阻止
+
+	Incompatible       bool   `json:"incompatible"`
+	IncompatibleReason string `json:"incompatibleReason"`
 }
 
 type StagePackage struct {
-	Author      string       `json:"author"`
-	URL         string       `json:"url"`
-	Version     string       `json:"version"`
-	Description *Description `json:"description"`
-	Readme      *Readme      `json:"readme"`
-	I18N        []string     `json:"i18n"`
-	Funding     *Funding     `json:"funding"`
+	Name          string      `json:"name"`
+	DisplayName   DisplayName `json:"displayName"`
+	Author        string      `json:"author"`
+	URL           string      `json:"url"`
+	Version       string      `json:"version"`
+	MinAppVersion string      `json:"minAppVersion"`
+	Backends      []string    `json:"backends"`
+	Frontends     []string    `json:"frontends"`
+	Description   Description `json:"description"`
+	Readme        Readme      `json:"readme"`
+	I18N          []string    `json:"i18n"`
+	Funding       *Funding    `json:"funding"`
+	Screenshots   []string    `json:"screenshots"`
+	License       string      `json:"license"` // SPDX 许可证标识符
+	Keywords      []string    `json:"keywords"`
+
+	Previews LocalizedStrings `json:"previews"` // [语言]包内本地化预览图的相对路径
+
+	Deprecated          bool   `json:"deprecated"`          // 作者是否已弃用该包
+	DeprecatedInFavorOf string `json:"deprecatedInFavorOf"` // 推荐替代包的仓库地址
 }
 
 type StageRepo struct {
-	URL         string `json:"url"`
-	Updated     string `json:"updated"`
-	Stars       int    `json:"stars"`
-	OpenIssues  int    `json:"openIssues"`
-	Size        int64  `json:"size"`
-	InstallSize int64  `json:"installSize"`
+	URL          string `json:"url"`
+	Updated      string `json:"updated"`
+	Stars        int    `json:"stars"`
+	OpenIssues   int    `json:"openIssues"`
+	Size         int64  `json:"size"`
+	InstallSize  int64  `json:"installSize"`
+	Featured     bool   `json:"featured"`     // 是否为编辑推荐的集市包
+	FeaturedRank int    `json:"featuredRank"` // 推荐排序，越小越靠前
+	Checksum     string `json:"checksum"`     // 包的 SHA-256（十六进制），可选，用于校验下载是否完整
+	Archived     bool   `json:"archived"`     // 仓库是否已在 GitHub 上归档
 
 	Package *StagePackage `json:"package"`
 }
@@ -135,111 +190,120 @@ type StageIndex struct {
 	Repos []*StageRepo `json:"repos"`
 }
 
-func getPreferredReadme(readme *Readme) string {
-	if nil == readme {
-		return "README.md"
-	}
+// 集市包的地址和本地文件路径需要分开构造：地址总是使用 /，文件路径使用 filepath，
+// 不要对地址片段使用 filepath.Join，否则在 Windows 上会混入 \。
 
-	ret := readme.Default
-	switch util.Lang {
-	case "zh_CN":
-		if "" != readme.ZhCN {
-			ret = readme.ZhCN
-		}
-	case "zh_CHT":
-		if "" != readme.ZhCHT {
-			ret = readme.ZhCHT
-		} else if "" != readme.ZhCN {
-			ret = readme.ZhCN
-		}
-	case "en_US":
-		if "" != readme.EnUS {
-			ret = readme.EnUS
-		}
-	default:
-		if "" != readme.EnUS {
-			ret = readme.EnUS
+// currentAppVersion 为当前思源版本，测试时替换
+var currentAppVersion = util.Ver
+
+// packageURL 返回集市包在 OSS 上的地址，repoURLHash 形如 https://github.com/owner/repo@hash 或者 owner/repo@hash，
+// GitLab 和 Gitee 仓库保留托管平台，比如 gitlab.com/owner/repo@hash，
+// elems 为包内的相对路径，可以带有查询参数。
+func packageURL(repoURLHash string, elems ...string) string {
+	repoURLHash = strings.TrimPrefix(strings.TrimPrefix(repoURLHash, "https://"), "github.com/")
+	return util.BazaarOSSServer + "/package/" + joinURLPath(append([]string{repoURLHash}, elems...)...)
+}
+
+// joinURLPath 使用 / 拼接地址片段，片段中的 \ 会被转换为 /。
+func joinURLPath(elems ...string) string {
+	var parts []string
+	for _, elem := range elems {
+		elem = strings.Trim(strings.ReplaceAll(elem, "\\", "/"), "/")
+		if "" != elem {
+			parts = append(parts, elem)
 		}
 	}
-	return ret
+	return strings.Join(parts, "/")
 }
 
-func GetPreferredName(pkg *Package) string {
-	if nil == pkg.DisplayName {
-		return pkg.Name
-	}
+// packageTempDir 返回下载和解压集市包使用的临时目录。
+func packageTempDir() string {
+	return filepath.Join(util.TempDir, "bazaar", "package")
+}
 
-	ret := pkg.DisplayName.Default
-	switch util.Lang {
-	case "zh_CN":
-		if "" != pkg.DisplayName.ZhCN {
-			ret = pkg.DisplayName.ZhCN
-		}
-	case "zh_CHT":
-		if "" != pkg.DisplayName.ZhCHT {
-			ret = pkg.DisplayName.ZhCHT
-		} else if "" != pkg.DisplayName.ZhCN {
-			ret = pkg.DisplayName.ZhCN
-		}
-	case "en_US":
-		if "" != pkg.DisplayName.EnUS {
-			ret = pkg.DisplayName.EnUS
+// getScreenshotURLs 将包内截图的相对路径解析为地址，没有有效截图时回退到单张预览图。
+//
+// oss 为 true 时 baseURL 为集市 OSS 地址，使用图片处理参数生成缩略图，否则缩略图和原图相同。
+func getScreenshotURLs(pkg *Package, baseURL string, oss bool) (urls, thumbs []string) {
+	for _, screenshot := range pkg.Screenshots {
+		screenshot, ok := cleanPackageRelPath(screenshot)
+		if !ok {
+			continue
 		}
-	default:
-		if "" != pkg.DisplayName.EnUS {
-			ret = pkg.DisplayName.EnUS
+
+		u := baseURL + "/" + screenshot
+		if oss {
+			urls = append(urls, u+"?imageslim")
+			thumbs = append(thumbs, u+"?imageView2/2/w/436/h/232")
+		} else {
+			urls = append(urls, u)
+			thumbs = append(thumbs, u)
 		}
 	}
-	return ret
+
+	if 1 > len(urls) {
+		urls = []string{pkg.PreviewURL}
+		thumbs = []string{pkg.PreviewURLThumb}
+	}
+	return
 }
 
-func getPreferredDesc(desc *Description) string {
-	if nil == desc {
-		return ""
+// cleanPackageRelPath 规范化包内文件的相对路径，路径为空、绝对路径、越过包目录或者是完整地址时 ok 为 false。
+func cleanPackageRelPath(relPath string) (ret string, ok bool) {
+	ret = strings.TrimPrefix(strings.ReplaceAll(strings.TrimSpace(relPath), "\\", "/"), "./")
+	if "" == ret || strings.Contains(ret, "..") || strings.Contains(ret, "://") || path.IsAbs(ret) {
+		return "", false
 	}
+	return ret, true
+}
 
-	ret := desc.Default
-	switch util.Lang {
-	case "zh_CN":
-		if "" != desc.ZhCN {
-			ret = desc.ZhCN
-		}
-	case "zh_CHT":
-		if "" != desc.ZhCHT {
-			ret = desc.ZhCHT
-		} else if "" != desc.ZhCN {
-			ret = desc.ZhCN
-		}
-	case "en_US":
-		if "" != desc.EnUS {
-			ret = desc.EnUS
-		}
-	default:
-		if "" != desc.EnUS {
-			ret = desc.EnUS
-		}
+// PreferredPreview 返回界面语言对应的预览图地址，包没有提供本地化预览图时返回 PreviewURL。
+//
+// 本地化预览图和 preview.png 位于同一目录，沿用 PreviewURL 的图片处理参数。
+func PreferredPreview(pkg *Package) string {
+	preview, ok := cleanPackageRelPath(preferredLocaleString(pkg.Previews, ""))
+	if !ok {
+		return pkg.PreviewURL
+	}
+
+	base, query, hasQuery := strings.Cut(pkg.PreviewURL, "?")
+	idx := strings.LastIndex(base, "/")
+	if 0 > idx {
+		return pkg.PreviewURL
+	}
+	ret := base[:idx+1] + preview
+	if hasQuery {
+		ret += "?" + query
 	}
 	return ret
 }
 
-func getPreferredFunding(funding *Funding) string {
-	if nil == funding {
-		return ""
+// getDeprecation 返回集市包是否已弃用以及替代包的仓库地址，替代包地址无效时仅标记为弃用。
+func getDeprecation(pkg *StagePackage) (deprecated bool, replacement string) {
+	if nil == pkg || !pkg.Deprecated {
+		return
 	}
 
-	if "" != funding.OpenCollective {
-		return "https://opencollective.com/" + funding.OpenCollective
+	deprecated = true
+	if repo, ok := NormalizeRepoURL(pkg.DeprecatedInFavorOf); ok {
+		replacement = normalizedRepoURL(repo)
 	}
-	if "" != funding.Patreon {
-		return "https://www.patreon.com/" + funding.Patreon
-	}
-	if "" != funding.GitHub {
-		return "https://github.com/sponsors/" + funding.GitHub
+	return
+}
+
+// getInstalledDeprecation 根据已缓存的集市索引返回已安装包的弃用信息，不会发起网络请求。
+func getInstalledDeprecation(packageType string, pkg *Package) (deprecated bool, replacement string) {
+	stageIndexLock.Lock()
+	stageIndex := cachedStageIndex[packageType]
+	stageIndexLock.Unlock()
+	if nil == stageIndex {
+		return
 	}
-	if 0 < len(funding.Custom) {
-		return funding.Custom[0]
+
+	if repo := getLatestStageRepo(pkg, stageIndex); nil != repo {
+		deprecated, replacement = getDeprecation(repo.Package)
 	}
-	return ""
+	return
 }
 
 func PluginJSON(pluginDirName string) (ret *Plugin, err error) {
@@ -344,324 +408,284 @@ func ThemeJSON(themeDirName string) (ret *Theme, err error) {
 	return
 }
 
-var cachedStageIndex = map[string]*StageIndex{}
-var stageIndexCacheTime int64
-var stageIndexLock = sync.Mutex{}
-
-func getStageIndex(pkgType string) (ret *StageIndex, err error) {
-	rhyRet, err := util.GetRhyResult(false)
-	if nil != err {
-		return
-	}
-
-	stageIndexLock.Lock()
-	defer stageIndexLock.Unlock()
-
-	now := time.Now().Unix()
-	if 3600 >= now-stageIndexCacheTime && nil != cachedStageIndex[pkgType] {
-		ret = cachedStageIndex[pkgType]
-		return
-	}
-
-	bazaarHash := rhyRet["bazaar"].(string)
-	ret = &StageIndex{}
-	request := httpclient.NewBrowserRequest()
-	u := util.BazaarOSSServer + "/bazaar@" + bazaarHash + "/stage/" + pkgType + ".json"
-	resp, reqErr := request.SetSuccessResult(ret).Get(u)
-	if nil != reqErr {
-		logging.LogErrorf("get community stage index [%s] failed: %s", u, reqErr)
-		return
-	}
-	if 200 != resp.StatusCode {
-		logging.LogErrorf("get community stage index [%s] failed: %d", u, resp.StatusCode)
-		return
-	}
+var (
+	userAgent     string
+	userAgentLock = sync.RWMutex{}
+)
 
-	stageIndexCacheTime = now
-	cachedStageIndex[pkgType] = ret
-	return
+// SetUserAgent 设置集市请求使用的 User-Agent，传入空字符串时恢复为默认值 `SiYuan/<version> bazaar`。
+func SetUserAgent(ua string) {
+	userAgentLock.Lock()
+	defer userAgentLock.Unlock()
+	userAgent = strings.TrimSpace(ua)
 }
 
-func isOutdatedTheme(theme *Theme, bazaarThemes []*Theme) bool {
-	if !strings.HasPrefix(theme.URL, "https://github.com/") {
-		return false
-	}
-
-	repo := strings.TrimPrefix(theme.URL, "https://github.com/")
-	parts := strings.Split(repo, "/")
-	if 2 != len(parts) || "" == strings.TrimSpace(parts[1]) {
-		return false
-	}
-
-	for _, pkg := range bazaarThemes {
-		if theme.URL == pkg.URL && theme.Name == pkg.Name && theme.Author == pkg.Author && 0 > semver.Compare("v"+theme.Version, "v"+pkg.Version) {
-			theme.RepoHash = pkg.RepoHash
-			return true
-		}
+func getUserAgent() string {
+	userAgentLock.RLock()
+	defer userAgentLock.RUnlock()
+	if "" != userAgent {
+		return userAgent
 	}
-	return false
+	return "SiYuan/" + currentAppVersion + " bazaar"
 }
 
-func isOutdatedIcon(icon *Icon, bazaarIcons []*Icon) bool {
-	if !strings.HasPrefix(icon.URL, "https://github.com/") {
-		return false
-	}
-
-	repo := strings.TrimPrefix(icon.URL, "https://github.com/")
-	parts := strings.Split(repo, "/")
-	if 2 != len(parts) || "" == strings.TrimSpace(parts[1]) {
-		return false
-	}
-
-	for _, pkg := range bazaarIcons {
-		if icon.URL == pkg.URL && icon.Name == pkg.Name && icon.Author == pkg.Author && 0 > semver.Compare("v"+icon.Version, "v"+pkg.Version) {
-			icon.RepoHash = pkg.RepoHash
-			return true
-		}
-	}
-	return false
+// bazaarRequest 为集市请求设置统一的 User-Agent，便于自建镜像在访问日志中区分客户端版本。
+func bazaarRequest(request *req.Request) *req.Request {
+	return request.SetHeader("User-Agent", getUserAgent())
 }
 
-func isOutdatedPlugin(plugin *Plugin, bazaarPlugins []*Plugin) bool {
-	if !strings.HasPrefix(plugin.URL, "https://github.com/") {
-		return false
-	}
-
-	repo := strings.TrimPrefix(plugin.URL, "https://github.com/")
-	parts := strings.Split(repo, "/")
-	if 2 != len(parts) || "" == strings.TrimSpace(parts[1]) {
-		return false
+func packageInstallDir(packageType string) string {
+	switch packageType {
+	case "plugins":
+		return filepath.Join(util.DataDir, "plugins")
+	case "widgets":
+		return filepath.Join(util.DataDir, "widgets")
+	case "templates":
+		return filepath.Join(util.DataDir, "templates")
+	case "themes":
+		return util.ThemesPath
+	case "icons":
+		return util.IconsPath
 	}
-
-	for _, pkg := range bazaarPlugins {
-		if plugin.URL == pkg.URL && plugin.Name == pkg.Name && plugin.Author == pkg.Author && 0 > semver.Compare("v"+plugin.Version, "v"+pkg.Version) {
-			plugin.RepoHash = pkg.RepoHash
-			return true
-		}
-	}
-	return false
+	return ""
 }
 
-func isOutdatedWidget(widget *Widget, bazaarWidgets []*Widget) bool {
-	if !strings.HasPrefix(widget.URL, "https://github.com/") {
-		return false
-	}
-
-	repo := strings.TrimPrefix(widget.URL, "https://github.com/")
-	parts := strings.Split(repo, "/")
-	if 2 != len(parts) || "" == strings.TrimSpace(parts[1]) {
-		return false
+func packageJSON(packageType, dirName string) (ret *Package, err error) {
+	manifest, err := manifestJSON(packageType, dirName)
+	if nil != err {
+		return
 	}
 
-	for _, pkg := range bazaarWidgets {
-		if widget.URL == pkg.URL && widget.Name == pkg.Name && widget.Author == pkg.Author && 0 > semver.Compare("v"+widget.Version, "v"+pkg.Version) {
-			widget.RepoHash = pkg.RepoHash
-			return true
-		}
+	if ret = manifestPackage(manifest); nil == ret {
+		err = fmt.Errorf("invalid package [%s/%s]", packageType, dirName)
 	}
-	return false
+	return
 }
 
-func isOutdatedTemplate(template *Template, bazaarTemplates []*Template) bool {
-	if !strings.HasPrefix(template.URL, "https://github.com/") {
-		return false
-	}
-
-	repo := strings.TrimPrefix(template.URL, "https://github.com/")
-	parts := strings.Split(repo, "/")
-	if 2 != len(parts) || "" == strings.TrimSpace(parts[1]) {
-		return false
-	}
-
-	for _, pkg := range bazaarTemplates {
-		if template.URL == pkg.URL && template.Name == pkg.Name && template.Author == pkg.Author && 0 > semver.Compare("v"+template.Version, "v"+pkg.Version) {
-			template.RepoHash = pkg.RepoHash
-			return true
-		}
+func manifestPackage(manifest any) *Package {
+	switch m := manifest.(type) {
+	case *Plugin:
+		return m.Package
+	case *Widget:
+		return m.Package
+	case *Template:
+		return m.Package
+	case *Theme:
+		return m.Package
+	case *Icon:
+		return m.Package
+	}
+	return nil
+}
+
+// manifestJSON 读取指定类型的已安装集市包清单，返回 *Plugin、*Widget、*Template、*Theme 或 *Icon。
+func manifestJSON(packageType, dirName string) (ret any, err error) {
+	switch packageType {
+	case "plugins":
+		ret, err = PluginJSON(dirName)
+	case "widgets":
+		ret, err = WidgetJSON(dirName)
+	case "templates":
+		ret, err = TemplateJSON(dirName)
+	case "themes":
+		ret, err = ThemeJSON(dirName)
+	case "icons":
+		ret, err = IconJSON(dirName)
+	default:
+		err = fmt.Errorf("invalid package type [%s]", packageType)
 	}
-	return false
+	return
 }
 
-func GetPackageREADME(repoURL, repoHash, packageType string) (ret string) {
-	repoURLHash := repoURL + "@" + repoHash
-
-	stageIndex := cachedStageIndex[packageType]
-	if nil == stageIndex {
-		return
-	}
-
-	url := strings.TrimPrefix(repoURLHash, "https://github.com/")
-	var repo *StageRepo
-	for _, r := range stageIndex.Repos {
-		if r.URL == url {
-			repo = r
-			break
-		}
-	}
-	if nil == repo {
+// ReadManifests 并发读取指定类型的多个已安装集市包清单，返回 [dirName]manifest。
+//
+// 无法读取或解析的清单会被跳过，对应的错误合并后通过 err 返回。
+func ReadManifests(packageType string, dirNames []string) (ret map[string]any, err error) {
+	ret = map[string]any{}
+	if 1 > len(dirNames) {
 		return
 	}
 
-	readme := getPreferredReadme(repo.Package.Readme)
+	var errs []error
+	waitGroup := &sync.WaitGroup{}
+	lock := &sync.Mutex{}
+	p, err := ants.NewPoolWithFunc(8, func(arg interface{}) {
+		defer waitGroup.Done()
 
-	data, err := downloadPackage(repoURLHash+"/"+readme, false, "")
-	if nil != err {
-		ret = fmt.Sprintf("Load bazaar package's README.md(%s) failed: %s", readme, err.Error())
-		if readme == repo.Package.Readme.Default || "" == strings.TrimSpace(repo.Package.Readme.Default) {
-			return
-		}
-		readme = repo.Package.Readme.Default
-		data, err = downloadPackage(repoURLHash+"/"+readme, false, "")
-		if nil != err {
-			ret += fmt.Sprintf("<br>Load bazaar package's README.md(%s) failed: %s", readme, err.Error())
+		dirName := arg.(string)
+		manifest, readErr := manifestJSON(packageType, dirName)
+		lock.Lock()
+		defer lock.Unlock()
+		if nil != readErr {
+			errs = append(errs, fmt.Errorf("read manifest [%s/%s] failed: %w", packageType, dirName, readErr))
 			return
 		}
+		ret[dirName] = manifest
+	})
+	if nil != err {
+		return
 	}
-
-	if 2 < len(data) {
-		if 255 == data[0] && 254 == data[1] {
-			data, _, err = transform.Bytes(textUnicode.UTF16(textUnicode.LittleEndian, textUnicode.ExpectBOM).NewDecoder(), data)
-		} else if 254 == data[0] && 255 == data[1] {
-			data, _, err = transform.Bytes(textUnicode.UTF16(textUnicode.BigEndian, textUnicode.ExpectBOM).NewDecoder(), data)
+	for _, dirName := range dirNames {
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(dirName); nil != invokeErr {
+			waitGroup.Done()
+			lock.Lock()
+			errs = append(errs, fmt.Errorf("read manifest [%s/%s] failed: %w", packageType, dirName, invokeErr))
+			lock.Unlock()
 		}
 	}
+	waitGroup.Wait()
+	p.Release()
 
-	ret, err = renderREADME(repoURL, data)
+	err = errors.Join(errs...)
 	return
 }
 
-func renderREADME(repoURL string, mdData []byte) (ret string, err error) {
-	luteEngine := lute.New()
-	luteEngine.SetSoftBreak2HardBreak(false)
-	luteEngine.SetCodeSyntaxHighlight(false)
-	linkBase := "https://cdn.jsdelivr.net/gh/" + strings.TrimPrefix(repoURL, "https://github.com/")
-	luteEngine.SetLinkBase(linkBase)
-	ret = luteEngine.Md2HTML(string(mdData))
-	ret = util.LinkTarget(ret, linkBase)
-	return
-}
+var disabledPackagesLock = sync.Mutex{}
 
-var (
-	packageLocks     = map[string]*sync.Mutex{}
-	packageLocksLock = sync.Mutex{}
-)
+func disabledPackagesPath() string {
+	return filepath.Join(util.DataDir, "storage", "bazaar", "disabled.json")
+}
 
-func downloadPackage(repoURLHash string, pushProgress bool, systemID string) (data []byte, err error) {
-	packageLocksLock.Lock()
-	defer packageLocksLock.Unlock()
+// readDisabledPackages 读取被临时禁用的已安装集市包，返回 [packageType][]dirName。
+func readDisabledPackages() (ret map[string][]string) {
+	ret = map[string][]string{}
+	p := disabledPackagesPath()
+	if !filelock.IsExist(p) {
+		return
+	}
 
-	// repoURLHash: https://github.com/88250/Comfortably-Numb@6286912c381ef3f83e455d06ba4d369c498238dc
-	repoURL := repoURLHash[:strings.LastIndex(repoURLHash, "@")]
-	lock, ok := packageLocks[repoURLHash]
-	if !ok {
-		lock = &sync.Mutex{}
-		packageLocks[repoURLHash] = lock
-	}
-	lock.Lock()
-	defer lock.Unlock()
-
-	repoURLHash = strings.TrimPrefix(repoURLHash, "https://github.com/")
-	u := util.BazaarOSSServer + "/package/" + repoURLHash
-	buf := &bytes.Buffer{}
-	resp, err := httpclient.NewCloudFileRequest2m().SetOutput(buf).SetDownloadCallback(func(info req.DownloadInfo) {
-		if pushProgress {
-			progress := float32(info.DownloadedSize) / float32(info.Response.ContentLength)
-			//logging.LogDebugf("downloading bazaar package [%f]", progress)
-			util.PushDownloadProgress(repoURL, progress)
-		}
-	}).Get(u)
+	data, err := filelock.ReadFile(p)
 	if nil != err {
-		logging.LogErrorf("get bazaar package [%s] failed: %s", u, err)
-		return nil, errors.New("get bazaar package failed, please check your network")
+		logging.LogErrorf("read disabled packages [%s] failed: %s", p, err)
+		return
 	}
-	if 200 != resp.StatusCode {
-		logging.LogErrorf("get bazaar package [%s] failed: %d", u, resp.StatusCode)
-		return nil, errors.New("get bazaar package failed: " + resp.Status)
+	if err = gulu.JSON.UnmarshalJSON(data, &ret); nil != err {
+		logging.LogErrorf("parse disabled packages [%s] failed: %s", p, err)
+		ret = map[string][]string{}
 	}
-	data = buf.Bytes()
-
-	go incPackageDownloads(repoURLHash, systemID)
 	return
 }
 
-func incPackageDownloads(repoURLHash, systemID string) {
-	if strings.Contains(repoURLHash, ".md") || "" == systemID {
-		return
+// SetPackageEnabled 临时启用或禁用已安装的集市包，禁用不会删除包文件和设置。
+func SetPackageEnabled(packageType, dirName string, enabled bool) (err error) {
+	if "" == packageInstallDir(packageType) {
+		return fmt.Errorf("invalid package type [%s]", packageType)
+	}
+	if !gulu.File.IsDir(filepath.Join(packageInstallDir(packageType), dirName)) {
+		return fmt.Errorf("package [%s/%s] not found", packageType, dirName)
 	}
 
-	repo := strings.Split(repoURLHash, "@")[0]
-	u := util.GetCloudServer() + "/apis/siyuan/bazaar/addBazaarPackageDownloadCount"
-	httpclient.NewCloudRequest30s().SetBody(
-		map[string]interface{}{
-			"systemID": systemID,
-			"repo":     repo,
-		}).Post(u)
-}
+	disabledPackagesLock.Lock()
+	defer disabledPackagesLock.Unlock()
 
-func uninstallPackage(installPath string) (err error) {
-	if err = os.RemoveAll(installPath); nil != err {
-		logging.LogErrorf("remove [%s] failed: %s", installPath, err)
-		return fmt.Errorf("remove community package [%s] failed", filepath.Base(installPath))
+	disabled := readDisabledPackages()
+	var dirNames []string
+	for _, name := range disabled[packageType] {
+		if name != dirName {
+			dirNames = append(dirNames, name)
+		}
+	}
+	if !enabled {
+		dirNames = append(dirNames, dirName)
+	}
+	if 1 > len(dirNames) {
+		delete(disabled, packageType)
+	} else {
+		disabled[packageType] = dirNames
 	}
-	packageCache.Flush()
-	return
-}
 
-func installPackage(data []byte, installPath, repoURLHash string) (err error) {
-	err = installPackage0(data, installPath)
+	data, err := gulu.JSON.MarshalIndentJSON(disabled, "", "\t")
 	if nil != err {
 		return
 	}
-
-	packageCache.Delete(strings.TrimPrefix(repoURLHash, "https://github.com/"))
-	return
-}
-
-func installPackage0(data []byte, installPath string) (err error) {
-	tmpPackage := filepath.Join(util.TempDir, "bazaar", "package")
-	if err = os.MkdirAll(tmpPackage, 0755); nil != err {
+	p := disabledPackagesPath()
+	if err = os.MkdirAll(filepath.Dir(p), 0755); nil != err {
 		return
 	}
-	name := gulu.Rand.String(7)
-	tmp := filepath.Join(tmpPackage, name+".zip")
-	if err = os.WriteFile(tmp, data, 0644); nil != err {
-		return
+	if err = filelock.WriteFile(p, data); nil != err {
+		logging.LogErrorf("write disabled packages [%s] failed: %s", p, err)
 	}
+	return
+}
+
+// IsPackageEnabled 判断已安装的集市包是否启用，默认启用。
+func IsPackageEnabled(packageType, dirName string) bool {
+	disabledPackagesLock.Lock()
+	defer disabledPackagesLock.Unlock()
+
+	return !gulu.Str.Contains(dirName, readDisabledPackages()[packageType])
+}
+
+// installedPackages 读取指定类型的已安装集市包，返回 [dirName]*Package。
+func installedPackages(packageType string) (ret map[string]*Package) {
+	ret = map[string]*Package{}
 
-	unzipPath := filepath.Join(tmpPackage, name)
-	if err = gulu.Zip.Unzip(tmp, unzipPath); nil != err {
-		logging.LogErrorf("write file [%s] failed: %s", installPath, err)
+	installDir := packageInstallDir(packageType)
+	if "" == installDir || !util.IsPathRegularDirOrSymlinkDir(installDir) {
 		return
 	}
 
-	dirs, err := os.ReadDir(unzipPath)
+	dirs, err := os.ReadDir(installDir)
 	if nil != err {
+		logging.LogWarnf("read %s folder failed: %s", packageType, err)
 		return
 	}
 
-	srcPath := unzipPath
-	if 1 == len(dirs) && dirs[0].IsDir() {
-		srcPath = filepath.Join(unzipPath, dirs[0].Name())
+	var dirNames []string
+	for _, dir := range dirs {
+		if !util.IsDirRegularOrSymlink(dir) {
+			continue
+		}
+		dirName := dir.Name()
+		if ("themes" == packageType && isBuiltInTheme(dirName)) || ("icons" == packageType && isBuiltInIcon(dirName)) {
+			continue
+		}
+		dirNames = append(dirNames, dirName)
 	}
 
-	if err = filelock.Copy(srcPath, installPath); nil != err {
-		return
+	manifests, _ := ReadManifests(packageType, dirNames)
+	for dirName, manifest := range manifests {
+		if pkg := manifestPackage(manifest); nil != pkg {
+			ret[dirName] = pkg
+		}
 	}
 	return
 }
 
-func formatUpdated(updated string) (ret string) {
-	t, e := dateparse.ParseIn(updated, time.Now().Location())
-	if nil == e {
-		ret = t.Format("2006-01-02")
-	} else {
-		if strings.Contains(updated, "T") {
-			ret = updated[:strings.Index(updated, "T")]
-		} else {
-			ret = strings.ReplaceAll(strings.ReplaceAll(updated, "T", ""), "Z", "")
+// getLatestStageRepo 在集市索引中查找已安装集市包对应的最新版本。
+func getLatestStageRepo(pkg *Package, stageIndex *StageIndex) *StageRepo {
+	if nil == stageIndex {
+		return nil
+	}
+
+	for _, repo := range stageIndex.Repos {
+		if nil == repo.Package {
+			continue
+		}
+		if isSameRepo(repo.Package.URL, pkg.URL) && repo.Package.Author == pkg.Author {
+			return repo
 		}
 	}
-	return
+	return nil
+}
+
+// ComputeHumanSizes 根据 Size、InstallSize、Updated 和 InstallDate 计算对应的 HSize、HInstallSize、HUpdated 和 HInstallDate，
+// 保证展示字段和原始字段一致，大小为 0 时展示为 0 B，时间为空时对应的展示字段也为空。多次调用结果相同。
+func (pkg *Package) ComputeHumanSizes() {
+	pkg.HSize, pkg.HInstallSize, pkg.HUpdated, pkg.HInstallDate = "", "", "", ""
+	if 0 <= pkg.Size {
+		pkg.HSize = humanize.BytesCustomCeil(uint64(pkg.Size), 2)
+	}
+	if 0 <= pkg.InstallSize {
+		pkg.HInstallSize = humanize.BytesCustomCeil(uint64(pkg.InstallSize), 2)
+	}
+	if "" != pkg.Updated {
+		pkg.HUpdated = formatUpdated(pkg.Updated)
+	}
+	if 0 < pkg.InstallDate {
+		pkg.HInstallDate = time.UnixMilli(pkg.InstallDate).Format("2006-01-02")
+	}
 }
 
 type bazaarPackage struct {
@@ -673,18 +697,21 @@ var cachedBazaarIndex = map[string]*bazaarPackage{}
 var bazaarIndexCacheTime int64
 var bazaarIndexLock = sync.Mutex{}
 
+// getBazaarIndex 返回集市包下载量索引的快照。
+//
+// 刷新时会替换整个 map 而不是原地修改，所以调用方可以在锁外安全地遍历返回值，但不能修改它。
 func getBazaarIndex() map[string]*bazaarPackage {
 	bazaarIndexLock.Lock()
 	defer bazaarIndexLock.Unlock()
 
 	now := time.Now().Unix()
-	if 3600 >= now-bazaarIndexCacheTime {
+	if isIndexCacheValid(bazaarIndexCacheTime) {
 		return cachedBazaarIndex
 	}
 
-	request := httpclient.NewBrowserRequest()
+	index := map[string]*bazaarPackage{}
 	u := util.BazaarStatServer + "/bazaar/index.json"
-	resp, reqErr := request.SetSuccessResult(&cachedBazaarIndex).Get(u)
+	resp, reqErr := getCompressedJSON(u, &index)
 	if nil != reqErr {
 		logging.LogErrorf("get bazaar index [%s] failed: %s", u, reqErr)
 		return cachedBazaarIndex
@@ -693,24 +720,186 @@ func getBazaarIndex() map[string]*bazaarPackage {
 		logging.LogErrorf("get bazaar index [%s] failed: %d", u, resp.StatusCode)
 		return cachedBazaarIndex
 	}
+	cachedBazaarIndex = index
 	bazaarIndexCacheTime = now
 	return cachedBazaarIndex
 }
 
-// defaultMinAppVersion 如果集市包中缺失 minAppVersion 项，则使用该值作为最低支持的版本号，小于该版本号时不显示集市包
-// Add marketplace package config item `minAppVersion` https://github.com/siyuan-note/siyuan/issues/8330
-const defaultMinAppVersion = "2.9.0"
+// DumpPackageInfo 汇总内核已知的某个集市包的所有信息，用于问题排查。
+func DumpPackageInfo(packageType, repoURL string) (ret map[string]any, err error) {
+	repo, ok := NormalizeRepoURL(repoURL)
+	if !ok {
+		err = fmt.Errorf("invalid repo URL [%s]", repoURL)
+		return
+	}
+
+	if _, err = getStageIndex(packageType); nil != err {
+		return
+	}
+
+	stageRepo := lookupStageRepo(packageType, repo)
+	if nil != stageRepo && nil == stageRepo.Package {
+		stageRepo = nil
+	}
+
+	var installedDirName string
+	var installed *Package
+	for dirName, pkg := range installedPackages(packageType) {
+		if isSameRepo(pkg.URL, repo) {
+			installedDirName, installed = dirName, pkg
+			break
+		}
+	}
+
+	if nil == stageRepo && nil == installed {
+		err = fmt.Errorf("package [%s] not found in %s", repo, packageType)
+		return
+	}
+
+	ret = map[string]any{
+		"packageType": packageType,
+		"repo":        repo,
+		"installed":   nil != installed,
+	}
+
+	stageIndexLock.Lock()
+	ret["stageIndexAge"] = time.Now().Unix() - stageIndexCacheTime
+	stageIndexLock.Unlock()
+
+	if nil != stageRepo {
+		pkg := stageRepo.Package
+		ret["stageRepo"] = stageRepo
+		ret["latestVersion"] = pkg.Version
+		ret["preferredDesc"] = getPreferredDesc(pkg.Description)
+		ret["preferredReadme"] = getPreferredReadme(pkg.Readme)
+		ret["preferredFunding"], ret["preferredFundingMessage"] = getPreferredFunding(pkg.Funding)
+		ret["compatible"] = isCompatibleStagePackage(pkg, currentFrontend())
+
+		downloads := 0
+		if bazaarPkg := getBazaarIndex()[strings.Split(stageRepo.URL, "@")[0]]; nil != bazaarPkg {
+			downloads = bazaarPkg.Downloads
+		}
+		ret["downloads"] = downloads
+
+		bazaarIndexLock.Lock()
+		ret["bazaarIndexAge"] = time.Now().Unix() - bazaarIndexCacheTime
+		bazaarIndexLock.Unlock()
+	}
+
+	if nil != installed {
+		ret["installedDirName"] = installedDirName
+		ret["installedVersion"] = installed.Version
+		ret["preferredName"] = GetPreferredName(installed)
+		if nil != stageRepo {
+			ret["outdated"] = 0 > semver.Compare("v"+installed.Version, "v"+stageRepo.Package.Version)
+			ret["ahead"] = 0 < semver.Compare("v"+installed.Version, "v"+stageRepo.Package.Version)
+		}
+	}
+	return
+}
+
+var packageCache = gcache.New(6*time.Hour, 30*time.Minute) // [packageCacheKey]*Plugin/*Theme/...
+
+var (
+	packageCacheGeneration     uint64
+	packageCacheGenerationLock = sync.RWMutex{}
+)
+
+// CleanBazaarPackageCache 清空集市列表缓存，下次获取列表时重新构建。
+func CleanBazaarPackageCache() {
+	flushPackageCache()
+}
 
-func disallowDisplayBazaarPackage(pkg *Package) bool {
-	if "" == pkg.MinAppVersion { // TODO: 目前暂时放过所有不带 minAppVersion 的集市包，后续版本会使用 defaultMinAppVersion
-		return false
+// flushPackageCache 清空集市列表缓存并递增缓存代数，清空前开始构建的列表项不会再写入缓存。
+func flushPackageCache() {
+	packageCacheGenerationLock.Lock()
+	defer packageCacheGenerationLock.Unlock()
+	packageCacheGeneration++
+	packageCache.Flush()
+}
+
+// getPackageCacheGeneration 返回当前的缓存代数，构建列表前获取，写入缓存时传给 setPackageCache。
+func getPackageCacheGeneration() uint64 {
+	packageCacheGenerationLock.RLock()
+	defer packageCacheGenerationLock.RUnlock()
+	return packageCacheGeneration
+}
+
+// setPackageCache 缓存列表项，构建期间缓存被清空过（generation 已过期）时丢弃，避免清空后残留旧的列表项。
+func setPackageCache(key string, pkg any, generation uint64) {
+	packageCacheGenerationLock.RLock()
+	defer packageCacheGenerationLock.RUnlock()
+	if generation != packageCacheGeneration {
+		return
 	}
-	if 0 < semver.Compare("v"+pkg.MinAppVersion, "v"+util.Ver) {
-		return true
+	packageCache.SetDefault(key, pkg)
+}
+
+// PackageID 返回集市包的稳定标识，用于缓存键、去重和统计。
+//
+// 标识是包类型和规范化仓库地址的 SHA-256，仓库地址的大小写、协议、.git 后缀等写法不影响结果，
+// 同一个仓库被索引为多种包类型时标识不同。
+func PackageID(packageType, repoURL string) string {
+	normalized := strings.ToLower(strings.TrimSpace(repoURL))
+	if host, owner, name, ok := parseRepoOwnerName(repoURL); ok {
+		normalized = strings.ToLower(host + "/" + owner + "/" + name)
 	}
-	return false
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(packageType+"|"+normalized)))
+}
+
+// packageCacheKey 返回集市列表项的缓存键，repoURLHash 形如 owner/repo@hash。
+func packageCacheKey(packageType, repoURLHash string) string {
+	repoURL, repoHash, _ := strings.Cut(repoURLHash, "@")
+	return PackageID(packageType, repoURL) + "@" + repoHash
 }
 
-var packageCache = gcache.New(6*time.Hour, 30*time.Minute) // [repoURL]*Package
+var packageInstallSizeCache = gcache.New(48*time.Hour, 6*time.Hour) // [repoURL 或 repoURL@repoHash]int64
+
+var (
+	installedRepoURLHashes     = map[string]string{} // [installPath]repoURLHash
+	installedRepoURLHashesLock = sync.Mutex{}
+)
+
+// GetInstallSizeCached 获取指定版本（repoURL@repoHash）集市包的安装大小缓存。
+func GetInstallSizeCached(repoURLHash string) (int64, bool) {
+	if installSize, ok := packageInstallSizeCache.Get(repoURLHash); ok {
+		return installSize.(int64), true
+	}
+	return 0, false
+}
 
-var packageInstallSizeCache = gcache.New(48*time.Hour, 6*time.Hour) // [repoURL]*int64
+func cacheStageInstallSize(repoURL, repoHash string, installSize int64) {
+	packageInstallSizeCache.SetDefault(repoURL, installSize)
+	if 0 < installSize {
+		packageInstallSizeCache.SetDefault(repoURL+"@"+repoHash, installSize)
+	}
+}
+
+func cacheInstallSize(installPath, repoURLHash string) {
+	installSize, err := util.SizeOfDirectory(installPath)
+	if nil != err {
+		logging.LogWarnf("compute install size of [%s] failed: %s", installPath, err)
+		return
+	}
+
+	packageInstallSizeCache.SetDefault(repoURLHash, installSize)
+	installedRepoURLHashesLock.Lock()
+	installedRepoURLHashes[installPath] = repoURLHash
+	installedRepoURLHashesLock.Unlock()
+}
+
+func uncacheInstallSize(installPath string) {
+	installedRepoURLHashesLock.Lock()
+	defer installedRepoURLHashesLock.Unlock()
+
+	repoURLHash, ok := installedRepoURLHashes[installPath]
+	if !ok {
+		return
+	}
+
+	packageInstallSizeCache.Delete(repoURLHash)
+	if idx := strings.LastIndex(repoURLHash, "@"); 0 < idx {
+		packageInstallSizeCache.Delete(repoURLHash[:idx])
+	}
+	delete(installedRepoURLHashes, installPath)
+}
@@ -0,0 +1,636 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+// 测试日志写入临时目录，避免在源码目录中生成 logging.log
+func TestMain(m *testing.M) {
+	logDir, err := os.MkdirTemp("", "bazaar-test-")
+	if nil != err {
+		panic(err)
+	}
+	logging.SetLogPath(filepath.Join(logDir, "logging.log"))
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+func TestStageIndexUserAgent(t *testing.T) {
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"repos":[]}`))
+	}))
+	defer server.Close()
+
+	if _, err := fetchStageIndex(server.URL + "/stage/plugins.json"); nil != err {
+		t.Fatalf("fetch stage index failed: %s", err)
+	}
+
+	SetUserAgent("SiYuan-Mirror/1.0")
+	t.Cleanup(func() { SetUserAgent("") })
+	if _, err := fetchStageIndex(server.URL + "/stage/plugins.json"); nil != err {
+		t.Fatalf("fetch stage index failed: %s", err)
+	}
+
+	if 2 != len(userAgents) {
+		t.Fatalf("expected 2 requests, got %d", len(userAgents))
+	}
+	if expected := "SiYuan/" + currentAppVersion + " bazaar"; expected != userAgents[0] {
+		t.Fatalf("expected user agent [%s], got [%s]", expected, userAgents[0])
+	}
+	if "SiYuan-Mirror/1.0" != userAgents[1] {
+		t.Fatalf("expected user agent [SiYuan-Mirror/1.0], got [%s]", userAgents[1])
+	}
+}
+
+// setTestBazaarOSSServer 替换集市 OSS 地址，并清空从 OSS 下载的集市包缓存
+func setTestBazaarOSSServer(t *testing.T, server string) {
+	ossServer := util.BazaarOSSServer
+	util.BazaarOSSServer = server
+	flushTestDownloadCaches()
+	t.Cleanup(func() {
+		util.BazaarOSSServer = ossServer
+		flushTestDownloadCaches()
+	})
+}
+
+func flushTestDownloadCaches() {
+	packageETagCache.Flush()
+	packageETagCacheSizeLock.Lock()
+	packageETagCacheSize = 0
+	packageETagCacheSizeLock.Unlock()
+	recentDownloadCache.Flush()
+}
+
+// setTestGitHubAPIServer 替换 GitHub API 地址，并清空仓库别名和通过 API 获取的仓库转移关系、贡献者缓存
+func setTestGitHubAPIServer(t *testing.T, server string) {
+	apiServer := githubAPIServer
+	githubAPIServer = server
+	resetTestGitHubAPICaches()
+	t.Cleanup(func() {
+		githubAPIServer = apiServer
+		resetTestGitHubAPICaches()
+	})
+}
+
+func resetTestGitHubAPICaches() {
+	repoAliasesLock.Lock()
+	repoAliases = map[string]string{}
+	repoAliasesLock.Unlock()
+	canonicalRepoCache.Flush()
+	packageContributorsCache.Flush()
+}
+
+func setTestBazaarStatServer(t *testing.T, server string) {
+	statServer := util.BazaarStatServer
+	util.BazaarStatServer = server
+	t.Cleanup(func() { util.BazaarStatServer = statServer })
+}
+
+func setTestAppVersion(t *testing.T, ver string) {
+	appVersion := currentAppVersion
+	currentAppVersion = ver
+	t.Cleanup(func() { currentAppVersion = appVersion })
+}
+
+func setTestLang(t testing.TB, lang string) {
+	prevLang := util.Lang
+	util.Lang = lang
+	t.Cleanup(func() { util.Lang = prevLang })
+}
+
+// setTestTempDir 为测试设置独立的临时目录，并清空依赖该目录的 README 缓存
+func setTestTempDir(t testing.TB) {
+	tempDir := util.TempDir
+	util.TempDir = t.TempDir()
+	resetTestREADMECaches(t)
+	t.Cleanup(func() { util.TempDir = tempDir })
+}
+
+func setTestDataDir(t testing.TB) {
+	dataDir := util.DataDir
+	util.DataDir = t.TempDir()
+	t.Cleanup(func() { util.DataDir = dataDir })
+}
+
+func resetTestREADMECaches(t testing.TB) {
+	reset := func() {
+		readmeMemCache.Flush()
+		readmeProbeCache.Flush()
+		readmeDiskCachePruneLock.Lock()
+		readmeDiskCachePruneTime = time.Time{}
+		readmeDiskCachePruneLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func setTestStageIndex(pkgType string, stageIndex *StageIndex) {
+	stageIndexLock.Lock()
+	defer stageIndexLock.Unlock()
+
+	setCachedStageIndex(pkgType, stageIndex)
+	stageIndexCacheTime = time.Now().Unix()
+}
+
+func newTestZip(t testing.TB, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(buf)
+	for name, content := range files {
+		writer, err := zipWriter.Create(name)
+		if nil != err {
+			t.Fatalf("create zip entry [%s] failed: %s", name, err)
+		}
+		if _, err = writer.Write([]byte(content)); nil != err {
+			t.Fatalf("write zip entry [%s] failed: %s", name, err)
+		}
+	}
+	if err := zipWriter.Close(); nil != err {
+		t.Fatalf("close zip failed: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestInstallSizeCache(t *testing.T) {
+	setTestTempDir(t)
+	installPath := filepath.Join(t.TempDir(), "test-plugin")
+	repoURLHash := "https://github.com/siyuan-note/test-plugin@6286912c381ef3f83e455d06ba4d369c498238dc"
+	data := newTestZip(t, map[string]string{
+		"test-plugin/plugin.json": `{"name":"test-plugin"}`,
+		"test-plugin/index.js":    "console.log('test-plugin')",
+	})
+
+	if _, err := installPackage(data, installPath, repoURLHash, false, nil); nil != err {
+		t.Fatalf("install package failed: %s", err)
+	}
+	expected, _ := util.SizeOfDirectory(installPath)
+	if installSize, ok := GetInstallSizeCached(repoURLHash); !ok || expected != installSize {
+		t.Fatalf("expected cached install size [%d], got [%d, %v]", expected, installSize, ok)
+	}
+
+	if err := uninstallPackage(installPath); nil != err {
+		t.Fatalf("uninstall package failed: %s", err)
+	}
+	if _, ok := GetInstallSizeCached(repoURLHash); ok {
+		t.Fatalf("expected install size cache to be invalidated after uninstall")
+	}
+
+	packageInstallSizeCache.Set(repoURLHash, int64(1024), 10*time.Millisecond)
+	if installSize, ok := GetInstallSizeCached(repoURLHash); !ok || 1024 != installSize {
+		t.Fatalf("expected cached install size [1024], got [%d, %v]", installSize, ok)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := GetInstallSizeCached(repoURLHash); ok {
+		t.Fatalf("expected install size cache to expire")
+	}
+}
+
+func TestPackageURLWithWindowsPath(t *testing.T) {
+	setTestBazaarOSSServer(t, "https://oss.example.com")
+
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	screenshot := filepath.Join("images", "screenshots", "dark.png") // Windows 上为 images\screenshots\dark.png
+	for _, elem := range []string{screenshot, `images\screenshots\dark.png`} {
+		u := packageURL("https://github.com/siyuan-note/test@"+repoHash, elem)
+		if strings.Contains(u, `\`) || "https://oss.example.com/package/siyuan-note/test@"+repoHash+"/images/screenshots/dark.png" != u {
+			t.Fatalf("unexpected package URL [%s]", u)
+		}
+
+		urls, thumbs := getScreenshotURLs(&Package{Screenshots: []string{elem}}, packageURL("siyuan-note/test@"+repoHash), true)
+		if 1 != len(urls) || strings.Contains(urls[0], `\`) || strings.Contains(thumbs[0], `\`) {
+			t.Fatalf("unexpected screenshot URLs %v, %v", urls, thumbs)
+		}
+	}
+
+	if u := packageURL("siyuan-note/test@"+repoHash, "preview.png?imageView2/2/w/436/h/232"); "https://oss.example.com/package/siyuan-note/test@"+repoHash+"/preview.png?imageView2/2/w/436/h/232" != u {
+		t.Fatalf("unexpected preview URL [%s]", u)
+	}
+	if _, thumbs := getScreenshotURLs(&Package{Screenshots: []string{`..\secret.png`}, PreviewURLThumb: "preview"}, packageURL("siyuan-note/test@"+repoHash), true); "preview" != thumbs[0] {
+		t.Fatalf("expected parent path to be rejected, got %v", thumbs)
+	}
+}
+
+func stageRepoURLs(repos []*StageRepo) (ret []string) {
+	for _, repo := range repos {
+		ret = append(ret, repo.URL)
+	}
+	return
+}
+
+func TestCleanBazaarPackageCacheDuringFetch(t *testing.T) {
+	CleanBazaarPackageCache()
+	defer CleanBazaarPackageCache()
+
+	// 模拟清空缓存前开始构建、清空期间仍在写入的列表
+	generation := getPackageCacheGeneration()
+	start := make(chan struct{})
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			<-start
+			for j := 0; j < 100; j++ {
+				setPackageCache(fmt.Sprintf("stale-%d-%d", i, j), &Package{}, generation)
+			}
+		}(i)
+	}
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		<-start
+		CleanBazaarPackageCache()
+	}()
+	close(start)
+	waitGroup.Wait()
+
+	if n := packageCache.ItemCount(); 0 != n {
+		t.Fatalf("expected no stale entries after flush, got %d", n)
+	}
+	setPackageCache("fresh", &Package{}, getPackageCacheGeneration())
+	if _, ok := packageCache.Get("fresh"); !ok {
+		t.Fatalf("expected entry of current generation to be cached")
+	}
+}
+
+func TestPackageID(t *testing.T) {
+	id := PackageID("plugins", "siyuan-note/plugin-sample")
+	for _, repoURL := range []string{"https://github.com/siyuan-note/plugin-sample", "https://github.com/SiYuan-Note/Plugin-Sample.git", " http://www.github.com/siyuan-note/plugin-sample/ "} {
+		if other := PackageID("plugins", repoURL); id != other {
+			t.Fatalf("expected same ID for [%s], got [%s] and [%s]", repoURL, id, other)
+		}
+	}
+	if 64 != len(id) {
+		t.Fatalf("unexpected ID [%s]", id)
+	}
+	if id == PackageID("widgets", "siyuan-note/plugin-sample") || id == PackageID("plugins", "https://gitlab.com/siyuan-note/plugin-sample") {
+		t.Fatalf("expected different IDs for different package types or hosts")
+	}
+
+	if packageCacheKey("plugins", "siyuan-note/plugin-sample@6286912c381ef3f83e455d06ba4d369c498238dc") != id+"@6286912c381ef3f83e455d06ba4d369c498238dc" {
+		t.Fatalf("unexpected package cache key")
+	}
+	if readmeCacheKey("plugins", "https://github.com/SiYuan-Note/plugin-sample", "6286912c381ef3f83e455d06ba4d369c498238dc", "README.md") != readmeCacheKey("plugins", "siyuan-note/plugin-sample.git", "6286912c381ef3f83e455d06ba4d369c498238dc", "README.md") {
+		t.Fatalf("expected same README cache key for repo URL variants")
+	}
+}
+
+func TestLocalizedStringsUnmarshalJSON(t *testing.T) {
+	setTestLang(t, "zh_CHT")
+
+	data := []byte(`{"name":"test","displayName":{"default":"Default","zh_CN":"中文名称","en_US":null},"description":{"default":"Default description","zh_CHT":"繁體描述"},"readme":null}`)
+	pkg := &Package{}
+	if err := gulu.JSON.UnmarshalJSON(data, pkg); nil != err {
+		t.Fatalf("unmarshal package failed: %s", err)
+	}
+	if "Default" != pkg.DisplayName["default"] || "中文名称" != pkg.DisplayName["zh_CN"] {
+		t.Fatalf("unexpected display name %v", pkg.DisplayName)
+	}
+	if _, ok := pkg.DisplayName["en_US"]; ok {
+		t.Fatalf("expected non-string value to be skipped, got %v", pkg.DisplayName)
+	}
+	if nil != pkg.Readme {
+		t.Fatalf("expected nil readme, got %v", pkg.Readme)
+	}
+	if name, desc, readme := GetPreferredName(pkg), getPreferredDesc(pkg.Description), getPreferredReadme(pkg.Readme); "中文名称" != name || "繁體描述" != desc || "README.md" != readme {
+		t.Fatalf("unexpected preferred metadata [%s, %s, %s]", name, desc, readme)
+	}
+}
+
+func TestPreferredPreview(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	pkg := &Package{
+		PreviewURL: "https://oss.example.com/package/siyuan-note/test@6286912c381ef3f83e455d06ba4d369c498238dc/preview.png?imageslim",
+		Previews:   LocalizedStrings{"zh_CN": "./images/preview_zh_CN.png"},
+	}
+	util.Lang = "zh_CN"
+	if preview := PreferredPreview(pkg); "https://oss.example.com/package/siyuan-note/test@6286912c381ef3f83e455d06ba4d369c498238dc/images/preview_zh_CN.png?imageslim" != preview {
+		t.Fatalf("unexpected localized preview [%s]", preview)
+	}
+
+	// 没有对应语言的预览图时使用默认预览图
+	util.Lang = "en_US"
+	if preview := PreferredPreview(pkg); pkg.PreviewURL != preview {
+		t.Fatalf("expected default preview, got [%s]", preview)
+	}
+
+	util.Lang = "zh_CN"
+	installed := &Package{PreviewURL: "/plugins/test/preview.png", Previews: LocalizedStrings{"zh_CN": "preview_zh_CN.png"}}
+	if preview := PreferredPreview(installed); "/plugins/test/preview_zh_CN.png" != preview {
+		t.Fatalf("unexpected installed localized preview [%s]", preview)
+	}
+	installed.Previews["zh_CN"] = "../../evil.png"
+	if preview := PreferredPreview(installed); installed.PreviewURL != preview {
+		t.Fatalf("expected invalid localized preview to be ignored, got [%s]", preview)
+	}
+}
+
+func writeTestPluginManifests(tb testing.TB, count int) (dirNames []string) {
+	setTestDataDir(tb)
+	for i := 0; i < count; i++ {
+		dirName := fmt.Sprintf("plugin-%d", i)
+		dir := filepath.Join(util.DataDir, "plugins", dirName)
+		if err := os.MkdirAll(dir, 0755); nil != err {
+			tb.Fatalf("create plugin dir failed: %s", err)
+		}
+		manifest := fmt.Sprintf(`{"name": "%s", "author": "siyuan", "url": "https://github.com/siyuan-note/%s/", "version": "1.0.0"}`, dirName, dirName)
+		if err := os.WriteFile(filepath.Join(dir, "plugin.json"), []byte(manifest), 0644); nil != err {
+			tb.Fatalf("write plugin.json failed: %s", err)
+		}
+		dirNames = append(dirNames, dirName)
+	}
+	return
+}
+
+func TestReadManifests(t *testing.T) {
+	dirNames := writeTestPluginManifests(t, 20)
+	if err := os.WriteFile(filepath.Join(util.DataDir, "plugins", "plugin-3", "plugin.json"), []byte("{"), 0644); nil != err {
+		t.Fatalf("write plugin.json failed: %s", err)
+	}
+	dirNames = append(dirNames, "missing")
+
+	manifests, err := ReadManifests("plugins", dirNames)
+	if nil == err {
+		t.Fatalf("expected errors for unreadable manifests")
+	}
+	if 19 != len(manifests) {
+		t.Fatalf("expected 19 manifests, got %d", len(manifests))
+	}
+	if _, ok := manifests["plugin-3"]; ok {
+		t.Fatalf("expected broken manifest to be skipped")
+	}
+	plugin, ok := manifests["plugin-7"].(*Plugin)
+	if !ok || "plugin-7" != plugin.Name || "https://github.com/siyuan-note/plugin-7" != plugin.URL {
+		t.Fatalf("unexpected manifest %+v", manifests["plugin-7"])
+	}
+
+	if _, err = ReadManifests("unknown", []string{"a"}); nil == err {
+		t.Fatalf("expected error for unknown package type")
+	}
+}
+
+func BenchmarkReadManifestsSequential(b *testing.B) {
+	dirNames := writeTestPluginManifests(b, 200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, dirName := range dirNames {
+			if _, err := PluginJSON(dirName); nil != err {
+				b.Fatalf("read plugin.json failed: %s", err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadManifestsBatched(b *testing.B) {
+	dirNames := writeTestPluginManifests(b, 200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadManifests("plugins", dirNames); nil != err {
+			b.Fatalf("read manifests failed: %s", err)
+		}
+	}
+}
+
+func setTestBazaarIndex(bazaarIndex map[string]*bazaarPackage) {
+	bazaarIndexLock.Lock()
+	defer bazaarIndexLock.Unlock()
+
+	cachedBazaarIndex = bazaarIndex
+	bazaarIndexCacheTime = time.Now().Unix()
+}
+
+func TestDumpPackageInfo(t *testing.T) {
+	setTestDataDir(t)
+	dir := filepath.Join(util.DataDir, "plugins", "dump")
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		t.Fatalf("create plugin dir failed: %s", err)
+	}
+	manifest := `{"name": "dump", "author": "siyuan", "url": "https://github.com/siyuan-note/dump", "version": "1.0.0", "displayName": {"default": "Dump"}}`
+	if err := os.WriteFile(filepath.Join(dir, "plugin.json"), []byte(manifest), 0644); nil != err {
+		t.Fatalf("write plugin.json failed: %s", err)
+	}
+
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/dump@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{
+			Author:      "siyuan",
+			URL:         "https://github.com/siyuan-note/dump",
+			Version:     "1.1.0",
+			Description: Description{"default": "Dump package"},
+			Readme:      Readme{"default": "README.md"},
+			Funding:     &Funding{GitHub: "88250"},
+		}},
+	}})
+	setTestBazaarIndex(map[string]*bazaarPackage{"siyuan-note/dump": {Name: "dump", Downloads: 42}})
+
+	info, err := DumpPackageInfo("plugins", "https://github.com/Siyuan-Note/Dump.git")
+	if nil != err {
+		t.Fatalf("dump package info failed: %s", err)
+	}
+	for _, key := range []string{"packageType", "repo", "stageRepo", "preferredName", "preferredDesc", "preferredReadme",
+		"preferredFunding", "preferredFundingMessage", "downloads", "installed", "installedDirName", "installedVersion",
+		"latestVersion", "outdated", "compatible", "stageIndexAge", "bazaarIndexAge"} {
+		if _, ok := info[key]; !ok {
+			t.Fatalf("expected key [%s] in dump: %v", key, info)
+		}
+	}
+	if true != info["installed"] || true != info["outdated"] || 42 != info["downloads"] || "1.0.0" != info["installedVersion"] || "Dump" != info["preferredName"] {
+		t.Fatalf("unexpected dump %v", info)
+	}
+
+	if _, err = DumpPackageInfo("plugins", "siyuan-note/missing"); nil == err {
+		t.Fatalf("expected error for unknown package")
+	}
+}
+
+func TestComputeHumanSizes(t *testing.T) {
+	installDate := time.Date(2024, 5, 20, 10, 30, 0, 0, time.Local)
+	pkg := &Package{Size: 1024 * 1024, InstallSize: 1536, Updated: "2024-05-18T08:00:00Z", InstallDate: installDate.UnixMilli()}
+	pkg.ComputeHumanSizes()
+	if "1.05 MB" != pkg.HSize || "1.54 kB" != pkg.HInstallSize || "2024-05-18" != pkg.HUpdated || "2024-05-20" != pkg.HInstallDate {
+		t.Fatalf("unexpected human fields [%s, %s, %s, %s]", pkg.HSize, pkg.HInstallSize, pkg.HUpdated, pkg.HInstallDate)
+	}
+
+	hSize, hInstallSize, hUpdated, hInstallDate := pkg.HSize, pkg.HInstallSize, pkg.HUpdated, pkg.HInstallDate
+	pkg.ComputeHumanSizes()
+	if hSize != pkg.HSize || hInstallSize != pkg.HInstallSize || hUpdated != pkg.HUpdated || hInstallDate != pkg.HInstallDate {
+		t.Fatalf("expected ComputeHumanSizes to be idempotent")
+	}
+
+	pkg.Size, pkg.InstallSize, pkg.Updated, pkg.InstallDate = 0, 0, "", 0
+	pkg.ComputeHumanSizes()
+	if "0 B" != pkg.HSize || "0 B" != pkg.HInstallSize || "" != pkg.HUpdated || "" != pkg.HInstallDate {
+		t.Fatalf("expected zero sizes and empty dates, got [%s, %s, %s, %s]", pkg.HSize, pkg.HInstallSize, pkg.HUpdated, pkg.HInstallDate)
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	deprecated, replacement := getDeprecation(&StagePackage{Deprecated: true, DeprecatedInFavorOf: "https://github.com/Siyuan-Note/New-Plugin/"})
+	if !deprecated || "https://github.com/siyuan-note/new-plugin" != replacement {
+		t.Fatalf("expected deprecated package with replacement, got [%v, %s]", deprecated, replacement)
+	}
+
+	if deprecated, replacement = getDeprecation(&StagePackage{Deprecated: true, DeprecatedInFavorOf: "not a repo"}); !deprecated || "" != replacement {
+		t.Fatalf("expected deprecated package without replacement, got [%v, %s]", deprecated, replacement)
+	}
+
+	if deprecated, replacement = getDeprecation(&StagePackage{DeprecatedInFavorOf: "siyuan-note/new-plugin"}); deprecated || "" != replacement {
+		t.Fatalf("expected normal package, got [%v, %s]", deprecated, replacement)
+	}
+
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/old-plugin@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/old-plugin", Deprecated: true, DeprecatedInFavorOf: "siyuan-note/new-plugin"}},
+		{URL: "siyuan-note/new-plugin@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/new-plugin"}},
+	}})
+	deprecated, replacement = getInstalledDeprecation("plugins", &Package{Author: "siyuan", URL: "https://github.com/siyuan-note/old-plugin"})
+	if !deprecated || "https://github.com/siyuan-note/new-plugin" != replacement {
+		t.Fatalf("expected installed package to be deprecated, got [%v, %s]", deprecated, replacement)
+	}
+	if deprecated, _ = getInstalledDeprecation("plugins", &Package{Author: "siyuan", URL: "https://github.com/siyuan-note/new-plugin"}); deprecated {
+		t.Fatalf("expected installed package not to be deprecated")
+	}
+}
+
+func TestBazaarIndexSnapshot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"siyuan-note/a": {"name": "a", "downloads": 1}, "siyuan-note/b": {"name": "b", "downloads": 2}}`))
+	}))
+	defer server.Close()
+
+	setTestBazaarStatServer(t, server.URL)
+	setTestBazaarIndex(map[string]*bazaarPackage{"siyuan-note/a": {Name: "a", Downloads: 1}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			bazaarIndexLock.Lock()
+			bazaarIndexCacheTime = 0 // 强制刷新
+			bazaarIndexLock.Unlock()
+			getBazaarIndex()
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		downloads := 0
+		for _, pkg := range getBazaarIndex() {
+			downloads += pkg.Downloads
+		}
+		if 1 != downloads && 3 != downloads {
+			t.Fatalf("unexpected downloads [%d]", downloads)
+		}
+	}
+	<-done
+
+	if 2 != len(getBazaarIndex()) {
+		t.Fatalf("expected refreshed index")
+	}
+}
+
+func TestScreenshotURLs(t *testing.T) {
+	const base = "https://oss.b3logfile.com/package/siyuan-note/theme@6286912c381ef3f83e455d06ba4d369c498238dc"
+	pkg := &Package{
+		PreviewURL:      base + "/preview.png?imageslim",
+		PreviewURLThumb: base + "/preview.png?imageView2/2/w/436/h/232",
+		Screenshots:     []string{"screenshots/light.png", "./screenshots/dark.png", "screenshots/mobile.png"},
+	}
+	urls, thumbs := getScreenshotURLs(pkg, base, true)
+	if 3 != len(urls) || 3 != len(thumbs) {
+		t.Fatalf("expected 3 screenshots, got %v, %v", urls, thumbs)
+	}
+	if base+"/screenshots/dark.png?imageslim" != urls[1] || base+"/screenshots/dark.png?imageView2/2/w/436/h/232" != thumbs[1] {
+		t.Fatalf("unexpected screenshot [%s], thumb [%s]", urls[1], thumbs[1])
+	}
+
+	urls, thumbs = getScreenshotURLs(&Package{Screenshots: []string{"a.png"}}, "/appearance/themes/theme", false)
+	if "/appearance/themes/theme/a.png" != urls[0] || urls[0] != thumbs[0] {
+		t.Fatalf("unexpected installed screenshot [%s], thumb [%s]", urls[0], thumbs[0])
+	}
+
+	// 没有截图或者截图无效时回退到单张预览图
+	pkg.Screenshots = nil
+	urls, thumbs = getScreenshotURLs(pkg, base, true)
+	if 1 != len(urls) || pkg.PreviewURL != urls[0] || pkg.PreviewURLThumb != thumbs[0] {
+		t.Fatalf("expected legacy preview, got %v, %v", urls, thumbs)
+	}
+	pkg.Screenshots = []string{"../../secret.png", "https://example.com/a.png", ""}
+	if urls, _ = getScreenshotURLs(pkg, base, true); 1 != len(urls) || pkg.PreviewURL != urls[0] {
+		t.Fatalf("expected invalid screenshots to be skipped, got %v", urls)
+	}
+}
+
+func TestSetPackageEnabled(t *testing.T) {
+	setTestDataDir(t)
+	for _, dirName := range []string{"foo", "bar"} {
+		if err := os.MkdirAll(filepath.Join(util.DataDir, "plugins", dirName), 0755); nil != err {
+			t.Fatalf("create plugin dir failed: %s", err)
+		}
+	}
+
+	if !IsPackageEnabled("plugins", "foo") {
+		t.Fatalf("expected package to be enabled by default")
+	}
+	if err := SetPackageEnabled("plugins", "foo", false); nil != err {
+		t.Fatalf("disable package failed: %s", err)
+	}
+	if err := SetPackageEnabled("plugins", "bar", false); nil != err {
+		t.Fatalf("disable package failed: %s", err)
+	}
+
+	// 状态保存在磁盘上，重启后读取
+	data, err := os.ReadFile(disabledPackagesPath())
+	if nil != err || !strings.Contains(string(data), "foo") {
+		t.Fatalf("expected disabled state to be persisted, got [%s]: %v", data, err)
+	}
+	if IsPackageEnabled("plugins", "foo") || IsPackageEnabled("plugins", "bar") || !IsPackageEnabled("widgets", "foo") {
+		t.Fatalf("unexpected enabled state after restart")
+	}
+
+	if err = SetPackageEnabled("plugins", "foo", true); nil != err {
+		t.Fatalf("enable package failed: %s", err)
+	}
+	if !IsPackageEnabled("plugins", "foo") || IsPackageEnabled("plugins", "bar") {
+		t.Fatalf("unexpected enabled state after re-enabling")
+	}
+
+	if err = SetPackageEnabled("plugins", "missing", false); nil == err {
+		t.Fatalf("expected error for missing package")
+	}
+	if err = SetPackageEnabled("unknown", "foo", false); nil == err {
+		t.Fatalf("expected error for unknown package type")
+	}
+}
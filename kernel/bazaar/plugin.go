@@ -17,14 +17,18 @@
 package bazaar
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/88250/go-humanize"
+	"github.com/88250/gulu"
 	ants "github.com/panjf2000/ants/v2"
 	"github.com/siyuan-note/httpclient"
 	"github.com/siyuan-note/logging"
@@ -33,12 +37,127 @@ import (
 
 type Plugin struct {
 	*Package
-	Enabled bool `json:"enabled"`
+	RequiredFeatures []string `json:"requiredFeatures"` // 插件依赖的内核特性，比 minAppVersion 更细粒度
+	ReloadMode       string   `json:"reloadMode"`       // 更新后的生效方式，PluginReloadHot 或 PluginReloadRestart，为空时为 PluginReloadHot
+	SettingsSchema   string   `json:"settingsSchema"`   // 可选，包内设置项 JSON Schema 文件的相对路径，用于在集市中预览可配置项
+	Enabled          bool     `json:"enabled"`
+}
+
+const (
+	PluginReloadHot     = "hot"     // 更新后重新加载插件即可生效
+	PluginReloadRestart = "restart" // 更新后需要重启才能生效
+)
+
+// GetPluginReloadMode 返回插件更新后的生效方式，未声明或者声明无效时为 PluginReloadHot。
+func GetPluginReloadMode(plugin *Plugin) string {
+	if nil != plugin && PluginReloadRestart == strings.ToLower(strings.TrimSpace(plugin.ReloadMode)) {
+		return PluginReloadRestart
+	}
+	return PluginReloadHot
+}
+
+// ErrNoSettingsSchema 表示插件没有声明设置项 schema，或者声明的 schema 文件不存在。
+var ErrNoSettingsSchema = errors.New("no settings schema in package")
+
+// settingsSchemaTimeout 获取设置项 schema（包括 plugin.json）的总超时时间
+var settingsSchemaTimeout = 30 * time.Second
+
+// GetPackageSettingsSchema 从 CDN 获取插件在 plugin.json 中声明的设置项 JSON Schema，用于在安装前预览可配置项。
+//
+// 支持 GitHub、GitLab 和 Gitee 仓库。
+func GetPackageSettingsSchema(repoURL, repoHash string) (ret []byte, err error) {
+	repo, ok := NormalizeRepoURL(repoURL)
+	if !ok {
+		err = fmt.Errorf("%w [%s]", ErrUnsupportedRepoHost, repoURL)
+		return
+	}
+	repoURLHash := repo + "@" + repoHash
+	if err = validateRepoURLHash(repoURLHash); nil != err {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settingsSchemaTimeout)
+	defer cancel()
+
+	plugin := &Plugin{}
+	u := packageURL(repoURLHash, "plugin.json")
+	resp, err := bazaarRequest(httpclient.NewCloudRequest30s()).SetContext(ctx).SetSuccessResult(plugin).Get(u)
+	if nil != err {
+		return
+	}
+	if 200 != resp.StatusCode {
+		err = fmt.Errorf("get plugin manifest [%s] failed: %d", u, resp.StatusCode)
+		return
+	}
+	if "" == strings.TrimSpace(plugin.SettingsSchema) {
+		err = fmt.Errorf("%w [%s]", ErrNoSettingsSchema, repoURLHash)
+		return
+	}
+	schemaPath, ok := cleanPackageRelPath(plugin.SettingsSchema)
+	if !ok {
+		err = fmt.Errorf("invalid settings schema path [%s] in [%s]", plugin.SettingsSchema, repoURLHash)
+		return
+	}
+
+	u = packageURL(repoURLHash, schemaPath)
+	resp, err = bazaarRequest(httpclient.NewCloudRequest30s()).SetContext(ctx).Get(u)
+	if nil != err {
+		return
+	}
+	if 404 == resp.StatusCode {
+		err = fmt.Errorf("%w [%s]", ErrNoSettingsSchema, u)
+		return
+	}
+	if 200 != resp.StatusCode {
+		err = fmt.Errorf("get settings schema [%s] failed: %d", u, resp.StatusCode)
+		return
+	}
+
+	ret = resp.Bytes()
+	schema := map[string]interface{}{}
+	if err = gulu.JSON.UnmarshalJSON(ret, &schema); nil != err {
+		ret = nil
+		err = fmt.Errorf("parse settings schema [%s] failed: %s", u, err)
+	}
+	return
+}
+
+// isRestartRequired 判断安装到 installPath 的包是否需要重启才能生效，目前只有插件可以声明。
+func isRestartRequired(installPath string) bool {
+	data, err := os.ReadFile(filepath.Join(installPath, "plugin.json"))
+	if nil != err {
+		return false
+	}
+
+	plugin := &Plugin{}
+	if err = gulu.JSON.UnmarshalJSON(data, plugin); nil != err {
+		return false
+	}
+	return PluginReloadRestart == GetPluginReloadMode(plugin)
+}
+
+// kernelFeatures 为当前内核支持的特性，插件可通过 requiredFeatures 声明依赖。
+var kernelFeatures = map[string]bool{
+	"attribute-view": true,
+	"flashcard":      true,
+	"sql":            true,
+	"sync":           true,
+	"ai":             true,
+}
+
+func missingKernelFeatures(requiredFeatures []string) (ret []string) {
+	for _, feature := range requiredFeatures {
+		if !kernelFeatures[feature] {
+			ret = append(ret, feature)
+		}
+	}
+	return
 }
 
 func Plugins(frontend string) (plugins []*Plugin) {
 	plugins = []*Plugin{}
 
+	generation := getPackageCacheGeneration()
 	stageIndex, err := getStageIndex("plugins")
 	if nil != err {
 		return
@@ -53,7 +172,7 @@ func Plugins(frontend string) (plugins []*Plugin) {
 		repo := arg.(*StageRepo)
 		repoURL := repo.URL
 
-		if pkg, found := packageCache.Get(repoURL); found {
+		if pkg, found := packageCache.Get(packageCacheKey("plugins", repoURL)); found {
 			lock.Lock()
 			plugins = append(plugins, pkg.(*Plugin))
 			lock.Unlock()
@@ -61,8 +180,8 @@ func Plugins(frontend string) (plugins []*Plugin) {
 		}
 
 		plugin := &Plugin{}
-		innerU := util.BazaarOSSServer + "/package/" + repoURL + "/plugin.json"
-		innerResp, innerErr := httpclient.NewBrowserRequest().SetSuccessResult(plugin).Get(innerU)
+		innerU := packageURL(repoURL, "plugin.json")
+		innerResp, innerErr := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(plugin).Get(innerU)
 		if nil != innerErr {
 			logging.LogErrorf("get bazaar package [%s] failed: %s", repoURL, innerErr)
 			return
@@ -76,39 +195,45 @@ func Plugins(frontend string) (plugins []*Plugin) {
 			return
 		}
 
-		plugin.Incompatible = isIncompatiblePlugin(plugin, frontend)
+		plugin.IncompatibleReason = getPluginIncompatibleReason(plugin, frontend)
+		plugin.Incompatible = "" != plugin.IncompatibleReason
 
 		plugin.URL = strings.TrimSuffix(plugin.URL, "/")
 		repoURLHash := strings.Split(repoURL, "@")
-		plugin.RepoURL = "https://github.com/" + repoURLHash[0]
+		plugin.RepoURL = repoWebURL(repoURLHash[0])
 		plugin.RepoHash = repoURLHash[1]
-		plugin.PreviewURL = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageslim"
-		plugin.PreviewURLThumb = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageView2/2/w/436/h/232"
-		plugin.IconURL = util.BazaarOSSServer + "/package/" + repoURL + "/icon.png"
+		plugin.PreviewURL = packageURL(repoURL, "preview.png?imageslim")
+		plugin.PreviewURLThumb = packageURL(repoURL, "preview.png?imageView2/2/w/436/h/232")
+		plugin.ScreenshotURLs, plugin.ScreenshotURLThumbs = getScreenshotURLs(plugin.Package, packageURL(repoURL), true)
+		plugin.IconURL = packageURL(repoURL, "icon.png")
 		plugin.Funding = repo.Package.Funding
-		plugin.PreferredFunding = getPreferredFunding(plugin.Funding)
-		plugin.PreferredName = GetPreferredName(plugin.Package)
-		plugin.PreferredDesc = getPreferredDesc(plugin.Description)
+		if 0 == len(plugin.Previews) {
+			plugin.Previews = repo.Package.Previews
+		}
+		plugin.ResolvePreferred()
 		plugin.Updated = repo.Updated
 		plugin.Stars = repo.Stars
 		plugin.OpenIssues = repo.OpenIssues
+		plugin.Featured = repo.Featured
+		plugin.Archived = repo.Archived
+		plugin.FeaturedRank = repo.FeaturedRank
+		plugin.License = repo.Package.License
+		plugin.Deprecated, plugin.Replacement = getDeprecation(repo.Package)
 		plugin.Size = repo.Size
-		plugin.HSize = humanize.BytesCustomCeil(uint64(plugin.Size), 2)
 		plugin.InstallSize = repo.InstallSize
-		plugin.HInstallSize = humanize.BytesCustomCeil(uint64(plugin.InstallSize), 2)
-		packageInstallSizeCache.SetDefault(plugin.RepoURL, plugin.InstallSize)
-		plugin.HUpdated = formatUpdated(plugin.Updated)
+		cacheStageInstallSize(plugin.RepoURL, plugin.RepoHash, plugin.InstallSize)
 		pkg := bazaarIndex[strings.Split(repoURL, "@")[0]]
 		if nil != pkg {
 			plugin.Downloads = pkg.Downloads
 		}
+		plugin.ComputeHumanSizes()
 		lock.Lock()
 		plugins = append(plugins, plugin)
 		lock.Unlock()
 
-		packageCache.SetDefault(repoURL, plugin)
+		setPackageCache(packageCacheKey("plugins", repoURL), plugin, generation)
 	})
-	for _, repo := range stageIndex.Repos {
+	for _, repo := range visibleStageRepos(stageIndex.Repos) {
 		waitGroup.Add(1)
 		p.Invoke(repo)
 	}
@@ -167,8 +292,10 @@ func InstalledPlugins(frontend string, checkUpdate bool) (ret []*Plugin) {
 	}
 
 	var bazaarPlugins []*Plugin
+	var stageIndex *StageIndex
 	if checkUpdate {
 		bazaarPlugins = Plugins(frontend)
+		stageIndex, _ = getStageIndex("plugins")
 	}
 
 	for _, pluginDir := range pluginDirs {
@@ -187,16 +314,15 @@ func InstalledPlugins(frontend string, checkUpdate bool) (ret []*Plugin) {
 		plugin.RepoURL = plugin.URL
 		plugin.PreviewURL = "/plugins/" + dirName + "/preview.png"
 		plugin.PreviewURLThumb = "/plugins/" + dirName + "/preview.png"
+		plugin.ScreenshotURLs, plugin.ScreenshotURLThumbs = getScreenshotURLs(plugin.Package, "/plugins/"+dirName, false)
 		plugin.IconURL = "/plugins/" + dirName + "/icon.png"
-		plugin.PreferredFunding = getPreferredFunding(plugin.Funding)
-		plugin.PreferredName = GetPreferredName(plugin.Package)
-		plugin.PreferredDesc = getPreferredDesc(plugin.Description)
+		plugin.ResolvePreferred()
 		info, statErr := os.Stat(filepath.Join(installPath, "README.md"))
 		if nil != statErr {
 			logging.LogWarnf("stat install theme README.md failed: %s", statErr)
 			continue
 		}
-		plugin.HInstallDate = info.ModTime().Format("2006-01-02")
+		plugin.InstallDate = info.ModTime().UnixMilli()
 		if installSize, ok := packageInstallSizeCache.Get(plugin.RepoURL); ok {
 			plugin.InstallSize = installSize.(int64)
 		} else {
@@ -204,7 +330,7 @@ func InstalledPlugins(frontend string, checkUpdate bool) (ret []*Plugin) {
 			plugin.InstallSize = is
 			packageInstallSizeCache.SetDefault(plugin.RepoURL, is)
 		}
-		plugin.HInstallSize = humanize.BytesCustomCeil(uint64(plugin.InstallSize), 2)
+		plugin.ComputeHumanSizes()
 		readmeFilename := getPreferredReadme(plugin.Readme)
 		readme, readErr := os.ReadFile(filepath.Join(installPath, readmeFilename))
 		if nil != readErr {
@@ -213,51 +339,70 @@ func InstalledPlugins(frontend string, checkUpdate bool) (ret []*Plugin) {
 		}
 
 		plugin.PreferredReadme, _ = renderREADME(plugin.URL, readme)
-		plugin.Outdated = isOutdatedPlugin(plugin, bazaarPlugins)
-		plugin.Incompatible = isIncompatiblePlugin(plugin, frontend)
+		plugin.Outdated = isOutdatedPlugin(plugin, bazaarPlugins, frontend)
+		if !plugin.Outdated {
+			plugin.UpdateBlockedByAppVersion = updateBlockedByAppVersion(plugin.Package, stageIndex)
+		}
+		plugin.Deprecated, plugin.Replacement = getInstalledDeprecation("plugins", plugin.Package)
+		plugin.IncompatibleReason = getPluginIncompatibleReason(plugin, frontend)
+		plugin.Incompatible = "" != plugin.IncompatibleReason
 		ret = append(ret, plugin)
 	}
 	return
 }
 
-func InstallPlugin(repoURL, repoHash, installPath string, systemID string) error {
-	repoURLHash := repoURL + "@" + repoHash
-	data, err := downloadPackage(repoURLHash, true, systemID)
-	if nil != err {
-		return err
-	}
-	return installPackage(data, installPath, repoURLHash)
+// InstallPlugin 安装插件，返回的结果中标记了是否需要重启才能生效。
+//
+// 目录名使用 CanonicalInstallDir 的返回值，installPath 只决定安装到哪个目录下，为空时使用默认的插件目录。
+func InstallPlugin(repoURL, repoHash, installPath string, systemID string) (*InstallResult, error) {
+	return installBazaarPackage("plugins", repoURL, repoHash, installPath, systemID, false)
 }
 
 func UninstallPlugin(installPath string) error {
 	return uninstallPackage(installPath)
 }
 
-func isIncompatiblePlugin(plugin *Plugin, currentFrontend string) bool {
-	if 1 > len(plugin.Backends) {
-		return false
+func isIncompatiblePlugin(plugin *Plugin, frontend string) bool {
+	return "" != getPluginIncompatibleReason(plugin, frontend)
+}
+
+// getPluginIncompatibleReason 返回插件与当前运行环境不兼容的原因，兼容时返回空字符串。
+func getPluginIncompatibleReason(plugin *Plugin, frontend string) string {
+	if missing := missingKernelFeatures(plugin.RequiredFeatures); 0 < len(missing) {
+		return fmt.Sprintf("missing required features [%s]", strings.Join(missing, ", "))
 	}
 
-	backendOk := false
-	for _, backend := range plugin.Backends {
-		if backend == getCurrentBackend() || "all" == backend {
-			backendOk = true
-			break
-		}
+	if 1 > len(plugin.Backends) {
+		return ""
 	}
 
-	frontendOk := false
-	for _, frontend := range plugin.Frontends {
-		if frontend == currentFrontend || "all" == frontend {
-			frontendOk = true
-			break
-		}
+	if "" == frontend {
+		frontend = currentFrontend()
+	}
+	if !isCompatibleBackend(plugin.Backends) {
+		return fmt.Sprintf("unsupported backend [%s]", currentBackend())
 	}
-	return !backendOk || !frontendOk
+	if !isCompatibleFrontend(plugin.Frontends, frontend) {
+		return fmt.Sprintf("unsupported frontend [%s]", frontend)
+	}
+	return ""
+}
+
+// runtimeDescriptor 描述内核的运行环境，用于判断集市包的兼容性。
+type runtimeDescriptor struct {
+	OS        string // runtime.GOOS
+	Container string // util.Container
+}
+
+// getRuntimeDescriptor 获取当前运行环境，测试时可替换。
+var getRuntimeDescriptor = func() *runtimeDescriptor {
+	return &runtimeDescriptor{OS: runtime.GOOS, Container: util.Container}
 }
 
-func getCurrentBackend() string {
-	switch util.Container {
+// currentBackend 返回集市包 backends 中对应当前运行环境的取值：windows、linux、darwin、docker、android 或 ios。
+func currentBackend() string {
+	rt := getRuntimeDescriptor()
+	switch rt.Container {
 	case util.ContainerDocker:
 		return "docker"
 	case util.ContainerIOS:
@@ -265,6 +410,21 @@ func getCurrentBackend() string {
 	case util.ContainerAndroid:
 		return "android"
 	default:
-		return runtime.GOOS
+		return rt.OS
+	}
+}
+
+// currentFrontend 返回集市包 frontends 中对应当前运行环境的默认取值：desktop、browser-desktop 或 mobile。
+//
+// 客户端请求时带有的 frontend 参数更准确（比如通过浏览器访问桌面端内核），仅在未提供时使用该值。
+func currentFrontend() string {
+	rt := getRuntimeDescriptor()
+	switch rt.Container {
+	case util.ContainerDocker:
+		return "browser-desktop"
+	case util.ContainerIOS, util.ContainerAndroid:
+		return "mobile"
+	default:
+		return "desktop"
 	}
 }
@@ -0,0 +1,126 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siyuan-note/httpclient"
+)
+
+func TestPluginRequiredFeatures(t *testing.T) {
+	plugin := &Plugin{Package: &Package{}, RequiredFeatures: []string{"sql", "attribute-view"}}
+	if reason := getPluginIncompatibleReason(plugin, "desktop"); "" != reason || isIncompatiblePlugin(plugin, "desktop") {
+		t.Fatalf("expected plugin requiring known features to be compatible, got [%s]", reason)
+	}
+
+	plugin.RequiredFeatures = append(plugin.RequiredFeatures, "teleport")
+	reason := getPluginIncompatibleReason(plugin, "desktop")
+	if !strings.Contains(reason, "teleport") || !isIncompatiblePlugin(plugin, "desktop") {
+		t.Fatalf("expected plugin requiring unknown feature to be incompatible, got [%s]", reason)
+	}
+}
+
+func TestPluginReloadMode(t *testing.T) {
+	setTestTempDir(t)
+	repoURLHash := "https://github.com/siyuan-note/reload-plugin@6286912c381ef3f83e455d06ba4d369c498238dc"
+	for manifest, expected := range map[string]bool{
+		`{"name":"reload-plugin"}`:                        false,
+		`{"name":"reload-plugin","reloadMode":"hot"}`:     false,
+		`{"name":"reload-plugin","reloadMode":"Restart"}`: true,
+	} {
+		installPath := filepath.Join(t.TempDir(), "reload-plugin")
+		data := newTestZip(t, map[string]string{"reload-plugin/plugin.json": manifest})
+		result, err := installPackage(data, installPath, repoURLHash, false, nil)
+		if nil != err {
+			t.Fatalf("install package failed: %s", err)
+		}
+		if expected != result.RestartRequired {
+			t.Fatalf("expected restart required [%v] for %s", expected, manifest)
+		}
+	}
+
+	if PluginReloadHot != GetPluginReloadMode(&Plugin{Package: &Package{}}) || PluginReloadHot != GetPluginReloadMode(&Plugin{ReloadMode: "unknown"}) {
+		t.Fatalf("expected hot reload by default")
+	}
+}
+
+func TestGetPackageSettingsSchema(t *testing.T) {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	const schema = `{"type":"object","properties":{"fontSize":{"type":"number","default":14}}}`
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/package/siyuan-note/schema-plugin@" + repoHash + "/plugin.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"schema-plugin","settingsSchema":"./schemas/settings.json"}`))
+		case "/package/siyuan-note/schema-plugin@" + repoHash + "/schemas/settings.json":
+			w.Write([]byte(schema))
+		case "/package/gitlab.com/siyuan-note/gitlab-plugin@" + repoHash + "/plugin.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"gitlab-plugin","settingsSchema":"settings.json"}`))
+		case "/package/gitlab.com/siyuan-note/gitlab-plugin@" + repoHash + "/settings.json":
+			w.Write([]byte(schema))
+		case "/package/siyuan-note/plain-plugin@" + repoHash + "/plugin.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"plain-plugin"}`))
+		case "/package/siyuan-note/missing-plugin@" + repoHash + "/plugin.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"missing-plugin","settingsSchema":"settings.json"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	// 服务端和客户端都设置期限，请求挂起时尽快失败而不是等到测试超时
+	server.Config.ReadTimeout, server.Config.WriteTimeout = 5*time.Second, 5*time.Second
+	server.Start()
+	t.Cleanup(func() {
+		httpclient.CloseIdleConnections()
+		server.Close()
+	})
+	timeout := settingsSchemaTimeout
+	settingsSchemaTimeout = 5 * time.Second
+	t.Cleanup(func() { settingsSchemaTimeout = timeout })
+
+	setTestBazaarOSSServer(t, server.URL)
+
+	data, err := GetPackageSettingsSchema("https://github.com/siyuan-note/schema-plugin", repoHash)
+	if nil != err {
+		t.Fatalf("get settings schema failed: %s", err)
+	}
+	if schema != string(data) {
+		t.Fatalf("unexpected settings schema: %s", data)
+	}
+
+	if data, err = GetPackageSettingsSchema("https://gitlab.com/siyuan-note/gitlab-plugin", repoHash); nil != err || schema != string(data) {
+		t.Fatalf("get GitLab settings schema failed: %v, %s", err, data)
+	}
+
+	for _, repoURL := range []string{"https://github.com/siyuan-note/plain-plugin", "https://github.com/siyuan-note/missing-plugin"} {
+		if data, err = GetPackageSettingsSchema(repoURL, repoHash); !errors.Is(err, ErrNoSettingsSchema) || nil != data {
+			t.Fatalf("expected no settings schema for [%s], got %v", repoURL, err)
+		}
+	}
+	if _, err = GetPackageSettingsSchema("https://github.com/siyuan-note/schema-plugin", "main"); !errors.Is(err, ErrInvalidRepoHash) {
+		t.Fatalf("expected invalid repo hash error, got %v", err)
+	}
+}
@@ -0,0 +1,645 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/88250/gulu"
+	"github.com/88250/lute"
+	"github.com/88250/lute/render"
+	"github.com/PuerkitoBio/goquery"
+	gcache "github.com/patrickmn/go-cache"
+	"github.com/siyuan-note/httpclient"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/util"
+	textUnicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+func GetPackageREADME(repoURL, repoHash, packageType string) (ret string) {
+	repo, repoURL := lookupREADMERepo(packageType, repoURL)
+	if nil == repo || nil == repo.Package || !strings.HasSuffix(repo.URL, "@"+repoHash) {
+		return
+	}
+	repoURLHash := repoURL + "@" + repoHash
+
+	localized := probeLocalizedReadme(repoURLHash, repo.Package.Readme)
+	preferred := localized
+	if "" == preferred {
+		preferred = getPreferredReadme(repo.Package.Readme)
+	}
+	cacheKey := readmeCacheKey(packageType, repoURL, repoHash, preferred)
+	if cached, ok := getCachedREADME(cacheKey); ok {
+		ret = cached
+		return
+	}
+
+	var readme string
+	var data []byte
+	var err error
+	var errMsgs []string
+	for _, readme = range getReadmeCandidates(repo.Package.Readme, localized) {
+		if data, err = downloadPackage(repoURLHash+"/"+readme, false, "", ""); nil == err {
+			break
+		}
+		errMsgs = append(errMsgs, fmt.Sprintf("Load bazaar package's README.md(%s) failed: %s", readme, err.Error()))
+	}
+	if nil != err {
+		ret = strings.Join(errMsgs, "<br>")
+		return
+	}
+
+	if data, err = decodeREADME(data); nil != err {
+		ret = fmt.Sprintf("Decode bazaar package's README.md(%s) failed: %s", readme, err.Error())
+		return
+	}
+
+	isHTML := isHTMLReadme(readme, data)
+	if maxSize := getMaxREADMESize(); 0 < maxSize && len(data) > maxSize {
+		fullURL := repoURL + "/blob/" + repoHash + "/" + readme
+		fullLink := "\n\n---\n\n[View full README on GitHub](" + fullURL + ")\n"
+		if isHTML {
+			fullLink = "\n<hr><p><a href=\"" + fullURL + "\">View full README on GitHub</a></p>\n"
+		}
+		// 截断时为完整 README 的链接预留空间，渲染时不会再次截断
+		truncated, _ := truncateREADME(data, maxSize-len(fullLink))
+		data = append(truncated, []byte(fullLink)...)
+	}
+
+	if isHTML {
+		ret = renderHTMLREADME(repoURL, data)
+		cacheREADME(cacheKey, ret)
+		return
+	}
+
+	ret, err = renderREADME(repoURL, data)
+	if nil != err {
+		ret = fmt.Sprintf("Render bazaar package's README.md(%s) failed: %s", readme, err.Error())
+		return
+	}
+	cacheREADME(cacheKey, ret)
+	return
+}
+
+var (
+	maxREADMESize     = 2 * 1024 * 1024
+	maxREADMESizeLock = sync.Mutex{}
+)
+
+// SetMaxREADMESize 设置渲染 README 的最大字节数，超过时截断并附上 GitHub 上完整 README 的链接。
+func SetMaxREADMESize(size int) {
+	maxREADMESizeLock.Lock()
+	defer maxREADMESizeLock.Unlock()
+	maxREADMESize = size
+}
+
+func getMaxREADMESize() int {
+	maxREADMESizeLock.Lock()
+	defer maxREADMESizeLock.Unlock()
+	return maxREADMESize
+}
+
+// truncateREADME 将超过 maxSize 的 README 截断到最后一个完整的行，避免渲染巨大的 README（比如内嵌 base64 图片）占用大量内存。
+func truncateREADME(data []byte, maxSize int) (ret []byte, truncated bool) {
+	if 0 >= maxSize || len(data) <= maxSize {
+		return data, false
+	}
+
+	ret = data[:maxSize]
+	if idx := bytes.LastIndexByte(ret, '\n'); 0 < idx {
+		ret = ret[:idx]
+	}
+	for 0 < len(ret) && !utf8.Valid(ret) {
+		ret = ret[:len(ret)-1]
+	}
+	return append([]byte{}, ret...), true
+}
+
+// readmeCacheKey 返回 README 缓存键。
+//
+// 键包含包标识、仓库哈希和按语言解析出的 README 文件名，切换界面语言后不会命中其他语言的缓存。
+func readmeCacheKey(packageType, repoURL, repoHash, readme string) string {
+	return PackageID(packageType, repoURL) + "@" + repoHash + "/" + readme
+}
+
+func readmeCachePath(cacheKey string) string {
+	return filepath.Join(getBazaarCacheDir(), "readme", fmt.Sprintf("%x.html", sha256.Sum256([]byte(cacheKey))))
+}
+
+var (
+	bazaarCacheDir     string
+	bazaarCacheDirLock = sync.RWMutex{}
+)
+
+// SetBazaarCacheDir 设置集市缓存文件（README 缓存等）的根目录，传入空字符串时恢复为默认的 util.TempDir/bazaar。
+//
+// 临时目录是容量很小的 tmpfs 时可以指向其他磁盘。安装包时直接解压到安装目录旁边再重命名，不受该设置影响。
+func SetBazaarCacheDir(dir string) (err error) {
+	dir = strings.TrimSpace(dir)
+	if "" != dir {
+		if err = checkDirWritable(dir); nil != err {
+			logging.LogErrorf("bazaar cache dir [%s] is not writable: %s", dir, err)
+			return
+		}
+	}
+
+	bazaarCacheDirLock.Lock()
+	defer bazaarCacheDirLock.Unlock()
+	bazaarCacheDir = dir
+	return
+}
+
+func getBazaarCacheDir() string {
+	bazaarCacheDirLock.RLock()
+	defer bazaarCacheDirLock.RUnlock()
+	if "" != bazaarCacheDir {
+		return bazaarCacheDir
+	}
+	return filepath.Join(util.TempDir, "bazaar")
+}
+
+// checkDirWritable 创建 dir 并尝试在其中写入一个临时文件。
+func checkDirWritable(dir string) (err error) {
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+
+	f, err := os.CreateTemp(dir, ".writable-*")
+	if nil != err {
+		return
+	}
+	f.Close()
+	err = os.Remove(f.Name())
+	return
+}
+
+// readmeMemCache 在内存中缓存渲染后的 README，重复打开同一个包的详情时不需要再读取磁盘缓存或者重新下载渲染
+var readmeMemCache = gcache.New(30*time.Minute, 10*time.Minute) // [repoURL@repoHash/readme]string
+
+// readmeDiskCacheTTL README 磁盘缓存的有效期。
+//
+// 磁盘缓存是 readmeMemCache 的二级缓存，两者使用相同的缓存键：内存缓存未命中时读取磁盘缓存并回填内存缓存，重启后也能使用。
+// 缓存键包含仓库哈希，包更新后旧版本的缓存文件不会再被读取，需要按有效期清理，否则会一直占用磁盘。
+const readmeDiskCacheTTL = 7 * 24 * time.Hour
+
+var (
+	readmeDiskCachePruneTime time.Time
+	readmeDiskCachePruneLock = sync.Mutex{}
+)
+
+func getCachedREADME(cacheKey string) (ret string, ok bool) {
+	if cached, found := readmeMemCache.Get(cacheKey); found {
+		return cached.(string), true
+	}
+
+	p := readmeCachePath(cacheKey)
+	info, err := os.Stat(p)
+	if nil != err {
+		return
+	}
+	if readmeDiskCacheTTL < time.Since(info.ModTime()) {
+		os.Remove(p)
+		return
+	}
+	data, err := os.ReadFile(p)
+	if nil != err {
+		return
+	}
+	ret, ok = string(data), true
+	readmeMemCache.SetDefault(cacheKey, ret)
+	return
+}
+
+// pruneREADMEDiskCache 删除超过有效期的 README 磁盘缓存文件，每小时最多清理一次。
+func pruneREADMEDiskCache() {
+	readmeDiskCachePruneLock.Lock()
+	if time.Hour > time.Since(readmeDiskCachePruneTime) {
+		readmeDiskCachePruneLock.Unlock()
+		return
+	}
+	readmeDiskCachePruneTime = time.Now()
+	readmeDiskCachePruneLock.Unlock()
+
+	dir := filepath.Join(getBazaarCacheDir(), "readme")
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		return
+	}
+	for _, entry := range entries {
+		info, infoErr := entry.Info()
+		if nil != infoErr || info.IsDir() || readmeDiskCacheTTL >= time.Since(info.ModTime()) {
+			continue
+		}
+		if removeErr := os.Remove(filepath.Join(dir, entry.Name())); nil != removeErr && !os.IsNotExist(removeErr) {
+			logging.LogWarnf("remove expired README cache [%s] failed: %s", entry.Name(), removeErr)
+		}
+	}
+}
+
+// InvalidatePackageREADME 清理集市包 README 的内存缓存和磁盘缓存，用户显式刷新详情时调用。
+func InvalidatePackageREADME(repoURL, repoHash, packageType string) {
+	repo, canonicalURL := lookupREADMERepo(packageType, repoURL)
+	if nil != repo {
+		repoURL = canonicalURL
+	}
+	prefix := readmeCacheKey(packageType, repoURL, repoHash, "")
+	keys := map[string]bool{}
+	for key := range readmeMemCache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			keys[key] = true
+		}
+	}
+	names := []string{"README.md"}
+	if nil != repo && nil != repo.Package && nil != repo.Package.Readme {
+		readme := repo.Package.Readme
+		for _, name := range readme {
+			names = append(names, name)
+		}
+	}
+	probeKey := repoURL + "@" + repoHash + "/" + getMetadataLang()
+	if cached, ok := readmeProbeCache.Get(probeKey); ok {
+		names = append(names, cached.(string))
+		readmeProbeCache.Delete(probeKey)
+	}
+	for _, name := range names {
+		if "" != name {
+			keys[prefix+name] = true
+		}
+	}
+
+	for key := range keys {
+		readmeMemCache.Delete(key)
+		if err := os.Remove(readmeCachePath(key)); nil != err && !os.IsNotExist(err) {
+			logging.LogWarnf("remove README cache [%s] failed: %s", key, err)
+		}
+	}
+}
+
+func cacheREADME(cacheKey, content string) {
+	readmeMemCache.SetDefault(cacheKey, content)
+	p := readmeCachePath(cacheKey)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); nil != err {
+		logging.LogWarnf("create README cache dir failed: %s", err)
+		return
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); nil != err {
+		logging.LogWarnf("write README cache [%s] failed: %s", cacheKey, err)
+	}
+	pruneREADMEDiskCache()
+}
+
+// decodeREADME 将带 BOM 的 UTF-16 README 转换为 UTF-8。
+//
+// 解码失败时如果去掉 BOM 后是合法的 UTF-8 则按 UTF-8 处理，否则返回错误，避免渲染出乱码。
+func decodeREADME(data []byte) (ret []byte, err error) {
+	ret = data
+	if 2 >= len(data) {
+		return
+	}
+
+	var endianness textUnicode.Endianness
+	if 255 == data[0] && 254 == data[1] {
+		endianness = textUnicode.LittleEndian
+	} else if 254 == data[0] && 255 == data[1] {
+		endianness = textUnicode.BigEndian
+	} else {
+		return
+	}
+
+	decoded, _, decodeErr := transform.Bytes(textUnicode.UTF16(endianness, textUnicode.ExpectBOM).NewDecoder(), data)
+	if nil == decodeErr && !bytes.ContainsRune(decoded, utf8.RuneError) {
+		ret = decoded
+		return
+	}
+
+	if body := data[2:]; utf8.Valid(body) {
+		ret = body
+		return
+	}
+
+	if nil == decodeErr {
+		decodeErr = errors.New("invalid UTF-16 sequence")
+	}
+	err = decodeErr
+	return
+}
+
+// readmeLangFallbacks 界面语言对应的 README 回退语言链，比如繁体中文用户可以阅读简体中文的 README。
+var readmeLangFallbacks = map[string][]string{
+	"zh_CHT": {"zh_CN"},
+	"zh_CN":  {"zh_CHT"},
+}
+
+// getReadmeCandidates 返回依次尝试下载的 README 文件名：按约定探测到的本地化 README、首选语言、回退语言链、默认、英文、README.md，跳过空值和重复项。
+func getReadmeCandidates(readme Readme, localized string) (ret []string) {
+	if "" != localized {
+		ret = append(ret, localized)
+	}
+	candidates := []string{getPreferredReadme(readme), "README.md"}
+	if nil != readme {
+		candidates = candidates[:1]
+		for _, lang := range readmeLangFallbacks[getMetadataLang()] {
+			candidates = append(candidates, readme[lang])
+		}
+		candidates = append(candidates, readme["default"], readme["en_US"], "README.md")
+	}
+
+	for _, candidate := range candidates {
+		candidate = strings.TrimSpace(candidate)
+		if "" != candidate && !gulu.Str.Contains(candidate, ret) {
+			ret = append(ret, candidate)
+		}
+	}
+	return
+}
+
+var (
+	readmePatternProbeEnabled     = false
+	readmePatternProbeEnabledLock = sync.Mutex{}
+)
+
+// SetREADMEPatternProbe 设置 manifest 未声明当前语言的 README 时，是否按 README_{lang}.md、README.{lang}.md 约定探测仓库中的本地化 README。
+func SetREADMEPatternProbe(enabled bool) {
+	readmePatternProbeEnabledLock.Lock()
+	defer readmePatternProbeEnabledLock.Unlock()
+	readmePatternProbeEnabled = enabled
+}
+
+func isREADMEPatternProbeEnabled() bool {
+	readmePatternProbeEnabledLock.Lock()
+	defer readmePatternProbeEnabledLock.Unlock()
+	return readmePatternProbeEnabled
+}
+
+// readmeProbeCache 缓存按约定探测到的本地化 README 文件名，没有探测到时缓存空字符串
+var readmeProbeCache = gcache.New(6*time.Hour, 30*time.Minute) // [repoURLHash/lang]string
+
+// probeLocalizedReadme 通过 HEAD 请求探测 README_{lang}.md 和 README.{lang}.md，返回存在的文件名。
+//
+// manifest 已经声明了当前语言的 README 时不探测。
+func probeLocalizedReadme(repoURLHash string, readme Readme) (ret string) {
+	lang := getMetadataLang()
+	if !isREADMEPatternProbeEnabled() || "" == lang || "" != readme[lang] {
+		return
+	}
+
+	key := repoURLHash + "/" + lang
+	if cached, ok := readmeProbeCache.Get(key); ok {
+		return cached.(string)
+	}
+
+	for _, name := range []string{"README_" + lang + ".md", "README." + lang + ".md"} {
+		u := packageURL(strings.TrimPrefix(repoURLHash, "https://github.com/"), name)
+		resp, err := bazaarRequest(httpclient.NewCloudRequest30s()).Head(u)
+		if nil != err {
+			// 网络错误时不缓存，下次再探测
+			logging.LogWarnf("probe bazaar package README [%s] failed: %s", u, err)
+			return
+		}
+		if 200 == resp.StatusCode {
+			ret = name
+			break
+		}
+	}
+	readmeProbeCache.SetDefault(key, ret)
+	return
+}
+
+// isHTMLReadme 判断 README 是否是 HTML 文件，HTML 不需要再经过 Markdown 引擎转换，否则会导致内容错乱。
+func isHTMLReadme(readmeName string, data []byte) bool {
+	switch strings.ToLower(path.Ext(readmeName)) {
+	case ".html", ".htm":
+		return true
+	}
+
+	content := strings.ToLower(strings.TrimSpace(string(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")))))
+	return strings.HasPrefix(content, "<!doctype html") || strings.HasPrefix(content, "<html")
+}
+
+func renderHTMLREADME(repoURL string, htmlData []byte) (ret string) {
+	ret = render.Sanitize(string(htmlData))
+	linkBase := readmeLinkBase(repoURL)
+	if "" != linkBase {
+		linkBase += "/"
+	}
+	ret = util.LinkTarget(ret, linkBase)
+	ret = readmeImageFallback(ret)
+	return
+}
+
+var (
+	ErrRenderTimeout    = errors.New("render README timeout")
+	ErrREADMETooComplex = errors.New("README is too complex to render")
+)
+
+// maxREADMENestingDepth 为 README 中一行内引用和列表标记嵌套的最大层数
+const maxREADMENestingDepth = 32
+
+var (
+	renderREADMETimeout     = 5 * time.Second
+	renderREADMETimeoutLock = sync.Mutex{}
+)
+
+// SetRenderREADMETimeout 设置渲染 README 的超时时间，避免作者编写的异常 Markdown 导致渲染长时间阻塞。
+func SetRenderREADMETimeout(timeout time.Duration) {
+	renderREADMETimeoutLock.Lock()
+	defer renderREADMETimeoutLock.Unlock()
+	renderREADMETimeout = timeout
+}
+
+func getRenderREADMETimeout() time.Duration {
+	renderREADMETimeoutLock.Lock()
+	defer renderREADMETimeoutLock.Unlock()
+	return renderREADMETimeout
+}
+
+// renderREADME 渲染 README，超时返回 ErrRenderTimeout。
+//
+// lute 的渲染无法取消，超时后后台的渲染仍会继续，所以渲染前先限制输入的大小和嵌套深度，保证后台的渲染也能很快结束。
+func renderREADME(repoURL string, mdData []byte) (ret string, err error) {
+	mdData, _ = truncateREADME(mdData, getMaxREADMESize())
+	if depth := readmeNestingDepth(mdData); maxREADMENestingDepth < depth {
+		logging.LogWarnf("render README of [%s] failed: nesting depth [%d] exceeds [%d]", repoURL, depth, maxREADMENestingDepth)
+		err = fmt.Errorf("%w: nesting depth [%d] exceeds [%d]", ErrREADMETooComplex, depth, maxREADMENestingDepth)
+		return
+	}
+
+	timeout := getRenderREADMETimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rendered := make(chan string, 1)
+	go func() {
+		luteEngine := lute.New()
+		luteEngine.SetSoftBreak2HardBreak(false)
+		luteEngine.SetCodeSyntaxHighlight(false)
+		linkBase := readmeLinkBase(repoURL)
+		if "" != linkBase {
+			luteEngine.SetLinkBase(linkBase)
+		}
+		html := luteEngine.Md2HTML(string(mdData))
+		rendered <- readmeImageFallback(util.LinkTarget(html, linkBase))
+	}()
+
+	select {
+	case ret = <-rendered:
+	case <-ctx.Done():
+		logging.LogWarnf("render README of [%s] timeout [%s]", repoURL, timeout)
+		err = ErrRenderTimeout
+	}
+	return
+}
+
+// readmeNestingDepth 返回 README 中一行开头连续的引用（>）和列表标记（-、*、+、1.）的最大层数。
+func readmeNestingDepth(mdData []byte) (ret int) {
+	for _, line := range bytes.Split(mdData, []byte("\n")) {
+		depth := 0
+	markers:
+		for i := 0; i < len(line); i++ {
+			switch c := line[i]; {
+			case ' ' == c || '\t' == c:
+				continue
+			case '>' == c:
+				depth++
+				continue
+			case ('-' == c || '*' == c || '+' == c) && i+1 < len(line) && (' ' == line[i+1] || '\t' == line[i+1]):
+				depth++
+				continue
+			case '0' <= c && '9' >= c:
+				j := i
+				for j < len(line) && '0' <= line[j] && '9' >= line[j] {
+					j++
+				}
+				if j+1 < len(line) && ('.' == line[j] || ')' == line[j]) && (' ' == line[j+1] || '\t' == line[j+1]) {
+					depth++
+					i = j
+					continue
+				}
+			}
+			break markers
+		}
+		ret = max(ret, depth)
+	}
+	return
+}
+
+// readmeLinkBase 返回 README 中相对链接的基础路径，repoURL 可以带上 @hash。
+//
+// GitHub 仓库走 jsDelivr，GitLab 和 Gitee 使用仓库的 raw 地址，其他托管平台（Gitea 等自建仓库）直接使用仓库地址，
+// 无法解析时返回空字符串，不改写相对链接。
+func readmeLinkBase(repoURL string) string {
+	if strings.HasPrefix(repoURL, "https://github.com/") {
+		return "https://cdn.jsdelivr.net/gh/" + strings.TrimPrefix(repoURL, "https://github.com/")
+	}
+
+	repo, ref, _ := strings.Cut(repoURL, "@")
+	if "" == ref {
+		ref = "HEAD"
+	}
+	if host, owner, name, ok := parseRepoOwnerName(repo); ok {
+		switch host {
+		case "gitlab.com":
+			return "https://gitlab.com/" + owner + "/" + name + "/-/raw/" + ref
+		case "gitee.com":
+			return "https://gitee.com/" + owner + "/" + name + "/raw/" + ref
+		}
+	}
+
+	u, err := url.Parse(strings.TrimSpace(repoURL))
+	if nil != err || ("https" != u.Scheme && "http" != u.Scheme) || "" == u.Host {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + strings.TrimSuffix(u.EscapedPath(), "/")
+}
+
+var (
+	readmeImageFallbackEnabled     = true
+	readmeImageFallbackEnabledLock = sync.Mutex{}
+)
+
+// SetREADMEImageFallback 设置渲染 README 时是否为图片启用懒加载，并在 jsDelivr 限流加载失败时回退到 raw.githubusercontent.com。
+func SetREADMEImageFallback(enabled bool) {
+	readmeImageFallbackEnabledLock.Lock()
+	defer readmeImageFallbackEnabledLock.Unlock()
+	readmeImageFallbackEnabled = enabled
+}
+
+func isREADMEImageFallbackEnabled() bool {
+	readmeImageFallbackEnabledLock.Lock()
+	defer readmeImageFallbackEnabledLock.Unlock()
+	return readmeImageFallbackEnabled
+}
+
+func readmeImageFallback(htmlStr string) (ret string) {
+	ret = htmlStr
+	if !isREADMEImageFallbackEnabled() || !strings.Contains(htmlStr, "<img") {
+		return
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlStr))
+	if nil != err {
+		logging.LogErrorf("parse README HTML failed: %s", err)
+		return
+	}
+
+	doc.Find("img").Each(func(i int, selection *goquery.Selection) {
+		if _, ok := selection.Attr("loading"); !ok {
+			selection.SetAttr("loading", "lazy")
+		}
+
+		src, _ := selection.Attr("src")
+		if rawURL := jsDelivrToRawURL(src); "" != rawURL {
+			selection.SetAttr("onerror", "this.onerror=null;this.src='"+rawURL+"'")
+		}
+	})
+	ret, _ = doc.Find("body").Html()
+	return
+}
+
+// jsDelivrToRawURL 将 https://cdn.jsdelivr.net/gh/owner/repo[@ref]/path 转换为 https://raw.githubusercontent.com/owner/repo/ref/path，无法转换时返回空字符串。
+func jsDelivrToRawURL(src string) string {
+	if !strings.HasPrefix(src, "https://cdn.jsdelivr.net/gh/") || strings.ContainsAny(src, "'\\\"<> ") {
+		return ""
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(src, "https://cdn.jsdelivr.net/gh/"), "/", 3)
+	if 3 != len(parts) || "" == parts[0] || "" == parts[1] || "" == parts[2] {
+		return ""
+	}
+
+	repo, ref := parts[1], "HEAD"
+	if idx := strings.Index(repo, "@"); 0 <= idx {
+		repo, ref = repo[:idx], repo[idx+1:]
+		if "" == ref {
+			ref = "HEAD"
+		}
+	}
+	return "https://raw.githubusercontent.com/" + parts[0] + "/" + repo + "/" + ref + "/" + parts[2]
+}
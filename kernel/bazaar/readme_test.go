@@ -0,0 +1,541 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestHTMLReadme(t *testing.T) {
+	data := []byte("<!DOCTYPE html>\n<html><body><h1>Title</h1><p>Hello <b>world</b></p><a href=\"docs/guide.md\">Guide</a><script>alert(1)</script></body></html>")
+	if !isHTMLReadme("README.md", data) {
+		t.Fatalf("expected HTML content to be detected")
+	}
+	if !isHTMLReadme("README.html", []byte("# Title")) {
+		t.Fatalf("expected .html README to be detected")
+	}
+	if isHTMLReadme("README.md", []byte("<p align=\"center\"><img src=\"icon.png\"></p>\n\n# Title")) {
+		t.Fatalf("expected markdown with inline HTML not to be detected as HTML")
+	}
+
+	ret := renderHTMLREADME("https://github.com/siyuan-note/siyuan", data)
+	if !strings.Contains(ret, "<h1>Title</h1>") || !strings.Contains(ret, "<p>Hello <b>world</b></p>") {
+		t.Fatalf("unexpected rendered HTML README: %s", ret)
+	}
+	if strings.Contains(ret, "&lt;") {
+		t.Fatalf("HTML README was escaped: %s", ret)
+	}
+	if strings.Contains(ret, "<script>") {
+		t.Fatalf("HTML README was not sanitized: %s", ret)
+	}
+	if !strings.Contains(ret, `href="https://cdn.jsdelivr.net/gh/siyuan-note/siyuan/docs/guide.md"`) {
+		t.Fatalf("relative link was not rewritten: %s", ret)
+	}
+}
+
+func TestRenderREADMETimeout(t *testing.T) {
+	ret, err := renderREADME("https://github.com/siyuan-note/siyuan", []byte("# Title"))
+	if nil != err || !strings.Contains(ret, "Title") {
+		t.Fatalf("render README failed: %v, %s", err, ret)
+	}
+
+	// 嵌套过深时不渲染
+	if _, err = renderREADME("https://github.com/siyuan-note/siyuan", []byte(strings.Repeat("> - ", 100)+"quote")); !errors.Is(err, ErrREADMETooComplex) {
+		t.Fatalf("expected too complex error, got %v", err)
+	}
+	if depth := readmeNestingDepth([]byte("> quote\n  - item\n1. > - nested\n---\n-1 * 2\n")); 3 != depth {
+		t.Fatalf("expected nesting depth 3, got %d", depth)
+	}
+
+	// 超过大小限制的部分不渲染，超时后后台的渲染也会很快结束
+	SetMaxREADMESize(64 * 1024)
+	SetRenderREADMETimeout(time.Nanosecond)
+	t.Cleanup(func() {
+		SetMaxREADMESize(2 * 1024 * 1024)
+		SetRenderREADMETimeout(5 * time.Second)
+	})
+	large := strings.Repeat("- [link](docs/a.md) **bold** _italic_ `code`\n", 100000)
+	if _, err = renderREADME("https://github.com/siyuan-note/siyuan", []byte(large)); ErrRenderTimeout != err {
+		t.Fatalf("expected render timeout, got %v", err)
+	}
+	SetRenderREADMETimeout(5 * time.Second)
+	if ret, err = renderREADME("https://github.com/siyuan-note/siyuan", []byte(large)); nil != err || 1 > strings.Count(ret, "<li>") || 64*1024/45 < strings.Count(ret, "<li>") {
+		t.Fatalf("expected truncated README, got %d items: %v", strings.Count(ret, "<li>"), err)
+	}
+}
+
+func TestREADMESettingsConcurrent(t *testing.T) {
+	t.Cleanup(func() {
+		SetRenderREADMETimeout(5 * time.Second)
+		SetMaxREADMESize(2 * 1024 * 1024)
+		SetREADMEImageFallback(true)
+		SetREADMEPatternProbe(false)
+		SetPreferEnglishMetadata(false)
+		SetMetadataFallbackPolicy(PreferEnglish)
+	})
+
+	// 在 -race 下运行时检查设置和读取之间没有数据竞争
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		waitGroup.Add(2)
+		go func() {
+			defer waitGroup.Done()
+			SetRenderREADMETimeout(time.Minute)
+			SetMaxREADMESize(64 * 1024)
+			SetREADMEImageFallback(false)
+			SetREADMEPatternProbe(true)
+			SetPreferEnglishMetadata(true)
+			SetMetadataFallbackPolicy(PreferDefault)
+		}()
+		go func() {
+			defer waitGroup.Done()
+			renderREADME("https://github.com/siyuan-note/siyuan", []byte("# Title"))
+			truncateREADME([]byte("# Title"), getMaxREADMESize())
+			getMetadataLang()
+			preferredLocaleString(LocalizedStrings{"default": "default", "en_US": "en"}, "")
+		}()
+	}
+	waitGroup.Wait()
+}
+
+func newTestReadmeServer(t *testing.T, readmes map[string]string) (requested *[]string) {
+	requested = &[]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		*requested = append(*requested, name)
+		if content, ok := readmes[name]; ok {
+			w.Write([]byte(content))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	setTestTempDir(t)
+
+	setTestBazaarOSSServer(t, server.URL)
+	return
+}
+
+func getTestPackageREADME(t *testing.T, name string, readme Readme) string {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/" + name + "@" + repoHash, Package: &StagePackage{Readme: readme}},
+	}})
+	return GetPackageREADME("https://github.com/siyuan-note/"+name, repoHash, "plugins")
+}
+
+func TestGetPackageREADMEFallback(t *testing.T) {
+	setTestLang(t, "zh_CN")
+
+	// 首选和默认相同时不重复请求
+	requested := newTestReadmeServer(t, map[string]string{})
+	ret := getTestPackageREADME(t, "readme-same", Readme{"default": "README.md"})
+	if 1 != len(*requested) || !strings.Contains(ret, "README.md") {
+		t.Fatalf("expected a single request, got %v: %s", *requested, ret)
+	}
+
+	// 首选失败时使用默认
+	requested = newTestReadmeServer(t, map[string]string{"README.md": "# Default README"})
+	ret = getTestPackageREADME(t, "readme-default", Readme{"default": "README.md", "zh_CN": "README_zh_CN.md"})
+	if 2 != len(*requested) || !strings.Contains(ret, "Default README") {
+		t.Fatalf("expected default README, got %v: %s", *requested, ret)
+	}
+
+	// 首选和默认都失败时使用英文
+	requested = newTestReadmeServer(t, map[string]string{"README_en_US.md": "# English README"})
+	ret = getTestPackageREADME(t, "readme-english", Readme{"default": "README.md", "zh_CN": "README_zh_CN.md", "en_US": "README_en_US.md"})
+	if 3 != len(*requested) || !strings.Contains(ret, "English README") {
+		t.Fatalf("expected English README, got %v: %s", *requested, ret)
+	}
+
+	// 繁体中文缺失时按回退语言链使用简体中文
+	util.Lang = "zh_CHT"
+	requested = newTestReadmeServer(t, map[string]string{"README_zh_CN.md": "# 简体中文 README"})
+	ret = getTestPackageREADME(t, "readme-chain", Readme{"default": "README_default.md", "zh_CN": "README_zh_CN.md", "zh_CHT": "README_zh_CHT.md", "en_US": "README_en_US.md"})
+	if "README_zh_CHT.md,README_zh_CN.md" != strings.Join(*requested, ",") || !strings.Contains(ret, "简体中文 README") {
+		t.Fatalf("expected Simplified Chinese README, got %v: %s", *requested, ret)
+	}
+
+	// 最后尝试 README.md，全部失败时汇总错误
+	requested = newTestReadmeServer(t, map[string]string{})
+	ret = getTestPackageREADME(t, "readme-none", Readme{"default": "README_default.md", "en_US": "README_en_US.md"})
+	if "README_default.md,README_en_US.md,README.md" != strings.Join(*requested, ",") || 3 != strings.Count(ret, "Load bazaar package's README.md(") {
+		t.Fatalf("expected all candidates to be tried, got %v: %s", *requested, ret)
+	}
+}
+
+func TestGetPackageREADMETransferredRepo(t *testing.T) {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	apiRequests := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiRequests++
+		if "/repos/old-owner/transferred-plugin" != r.URL.Path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"full_name":"New-Owner/transferred-plugin"}`))
+	}))
+	defer apiServer.Close()
+	setTestGitHubAPIServer(t, apiServer.URL)
+
+	// 集市索引中只有新地址
+	requested := newTestReadmeServer(t, map[string]string{"README.md": "# Transferred README"})
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "New-Owner/transferred-plugin@" + repoHash, Package: &StagePackage{Readme: Readme{"default": "README.md"}}},
+	}})
+
+	// 获取 README 时不请求 GitHub API，转移关系未知时找不到
+	if ret := GetPackageREADME("https://github.com/old-owner/transferred-plugin", repoHash, "plugins"); "" != ret || 0 != apiRequests || 0 != len(*requested) {
+		t.Fatalf("expected README lookup to stay offline, got %d API requests: %s", apiRequests, ret)
+	}
+
+	if repo := GetStageRepo("plugins", "https://github.com/old-owner/transferred-plugin"); nil == repo || 1 != apiRequests {
+		t.Fatalf("expected canonical repo to be resolved, got %d API requests", apiRequests)
+	}
+	ret := GetPackageREADME("https://github.com/old-owner/transferred-plugin", repoHash, "plugins")
+	if !strings.Contains(ret, "Transferred README") || 1 != len(*requested) || 1 != apiRequests {
+		t.Fatalf("expected README to be resolved by the cached transferred repo, got %v: %s", *requested, ret)
+	}
+
+	// 使用转移后的地址清理缓存，之后重新下载
+	InvalidatePackageREADME("https://github.com/old-owner/transferred-plugin", repoHash, "plugins")
+	if ret = GetPackageREADME("https://github.com/old-owner/transferred-plugin", repoHash, "plugins"); !strings.Contains(ret, "Transferred README") || 2 != len(*requested) {
+		t.Fatalf("expected README cache to be invalidated, got %v", *requested)
+	}
+
+	// 添加的别名优先于 GitHub API
+	AddRepoAlias("https://github.com/alias-owner/alias-plugin", "https://github.com/new-owner/transferred-plugin")
+	if repo := lookupStageRepoCanonical("plugins", "https://github.com/alias-owner/alias-plugin", true); nil == repo || 1 != apiRequests {
+		t.Fatalf("expected alias to resolve without API requests, got %d API requests", apiRequests)
+	}
+
+	// 没有转移的仓库找不到
+	if repo := lookupStageRepoCanonical("plugins", "https://github.com/someone/unknown-plugin", true); nil != repo || 2 != apiRequests {
+		t.Fatalf("expected unknown repo not to be found, got %d API requests", apiRequests)
+	}
+}
+
+func TestGetPackageREADMEPatternProbe(t *testing.T) {
+	setTestLang(t, util.Lang)
+	SetREADMEPatternProbe(true)
+	t.Cleanup(func() { SetREADMEPatternProbe(false) })
+
+	// manifest 未声明简体中文 README，但仓库中存在 README_zh_CN.md
+	util.Lang = "zh_CN"
+	requested := newTestReadmeServer(t, map[string]string{"README_zh_CN.md": "# 简体中文 README", "README.md": "# Default README"})
+	ret := getTestPackageREADME(t, "readme-probe", Readme{"default": "README.md"})
+	if "README_zh_CN.md,README_zh_CN.md" != strings.Join(*requested, ",") || !strings.Contains(ret, "简体中文 README") {
+		t.Fatalf("expected probed Simplified Chinese README, got %v: %s", *requested, ret)
+	}
+
+	// 探测结果被缓存
+	*requested = nil
+	if readme := probeLocalizedReadme("https://github.com/siyuan-note/readme-probe@6286912c381ef3f83e455d06ba4d369c498238dc", Readme{"default": "README.md"}); "README_zh_CN.md" != readme || 0 != len(*requested) {
+		t.Fatalf("expected cached probe result, got [%s] %v", readme, *requested)
+	}
+
+	// 也支持 README.{lang}.md
+	util.Lang = "ja_JP"
+	requested = newTestReadmeServer(t, map[string]string{"README.ja_JP.md": "# 日本語 README", "README.md": "# Default README"})
+	ret = getTestPackageREADME(t, "readme-probe-dot", nil)
+	if "README_ja_JP.md,README.ja_JP.md,README.ja_JP.md" != strings.Join(*requested, ",") || !strings.Contains(ret, "日本語 README") {
+		t.Fatalf("expected probed Japanese README, got %v: %s", *requested, ret)
+	}
+
+	// 没有按约定命名的 README 时回退到默认
+	util.Lang = "zh_CN"
+	requested = newTestReadmeServer(t, map[string]string{"README.md": "# Default README"})
+	ret = getTestPackageREADME(t, "readme-probe-none", Readme{"default": "README.md"})
+	if "README_zh_CN.md,README.zh_CN.md,README.md" != strings.Join(*requested, ",") || !strings.Contains(ret, "Default README") {
+		t.Fatalf("expected default README, got %v: %s", *requested, ret)
+	}
+
+	// manifest 声明了当前语言时不探测
+	requested = newTestReadmeServer(t, map[string]string{"README_cn.md": "# 声明的 README"})
+	ret = getTestPackageREADME(t, "readme-probe-declared", Readme{"default": "README.md", "zh_CN": "README_cn.md"})
+	if "README_cn.md" != strings.Join(*requested, ",") || !strings.Contains(ret, "声明的 README") {
+		t.Fatalf("expected declared README without probing, got %v: %s", *requested, ret)
+	}
+}
+
+func TestREADMEImageFallback(t *testing.T) {
+	ret, err := renderREADME("https://github.com/siyuan-note/siyuan", []byte("![preview](images/preview.png)"))
+	if nil != err {
+		t.Fatalf("render README failed: %s", err)
+	}
+	if !strings.Contains(ret, `loading="lazy"`) {
+		t.Fatalf("expected lazy loading image, got %s", ret)
+	}
+	if !strings.Contains(ret, "onerror=") || !strings.Contains(ret, "https://raw.githubusercontent.com/siyuan-note/siyuan/HEAD/images/preview.png") {
+		t.Fatalf("expected raw fallback on image, got %s", ret)
+	}
+
+	ret = renderHTMLREADME("https://github.com/siyuan-note/siyuan", []byte(`<p><img src="https://example.com/a.png" onerror="alert(1)"></p>`))
+	if !strings.Contains(ret, `loading="lazy"`) || strings.Contains(ret, "onerror") {
+		t.Fatalf("expected lazy loading image without fallback, got %s", ret)
+	}
+
+	SetREADMEImageFallback(false)
+	t.Cleanup(func() { SetREADMEImageFallback(true) })
+	ret, _ = renderREADME("https://github.com/siyuan-note/siyuan", []byte("![preview](images/preview.png)"))
+	if strings.Contains(ret, "loading=") || strings.Contains(ret, "onerror=") {
+		t.Fatalf("expected no fallback attributes, got %s", ret)
+	}
+}
+
+func TestREADMELinkBaseNonGitHub(t *testing.T) {
+	if linkBase := readmeLinkBase("https://gitea.example.com/owner/repo/"); "https://gitea.example.com/owner/repo" != linkBase {
+		t.Fatalf("unexpected link base [%s]", linkBase)
+	}
+	if linkBase := readmeLinkBase("not a url"); "" != linkBase {
+		t.Fatalf("expected empty link base, got [%s]", linkBase)
+	}
+
+	ret, err := renderREADME("https://gitlab.example.com/owner/repo", []byte("[guide](docs/guide.md)"))
+	if nil != err {
+		t.Fatalf("render README failed: %s", err)
+	}
+	if !strings.Contains(ret, `href="https://gitlab.example.com/owner/repo/docs/guide.md"`) || strings.Contains(ret, "jsdelivr") {
+		t.Fatalf("unexpected link in README rendered from non-GitHub repo: %s", ret)
+	}
+
+	ret = renderHTMLREADME("not a url", []byte(`<p><a href="docs/guide.md">guide</a></p>`))
+	if !strings.Contains(ret, `href="docs/guide.md"`) {
+		t.Fatalf("expected relative link to be kept, got %s", ret)
+	}
+}
+
+func TestJsDelivrToRawURL(t *testing.T) {
+	cases := map[string]string{
+		"https://cdn.jsdelivr.net/gh/siyuan-note/siyuan/images/a.png":      "https://raw.githubusercontent.com/siyuan-note/siyuan/HEAD/images/a.png",
+		"https://cdn.jsdelivr.net/gh/siyuan-note/siyuan@v3.0.0/a.png":      "https://raw.githubusercontent.com/siyuan-note/siyuan/v3.0.0/a.png",
+		"https://cdn.jsdelivr.net/gh/siyuan-note/siyuan":                   "",
+		"https://example.com/a.png":                                        "",
+		"https://cdn.jsdelivr.net/gh/siyuan-note/siyuan/a.png');alert(1);": "",
+	}
+	for src, expected := range cases {
+		if got := jsDelivrToRawURL(src); expected != got {
+			t.Fatalf("convert [%s] expected [%s], got [%s]", src, expected, got)
+		}
+	}
+}
+
+func TestGetPackageREADMEMemCache(t *testing.T) {
+	requested := newTestReadmeServer(t, map[string]string{"README.md": "# Cached README"})
+	readme := Readme{"default": "README.md"}
+	first := getTestPackageREADME(t, "readme-mem-cache", readme)
+	if !strings.Contains(first, "Cached README") || 1 != len(*requested) {
+		t.Fatalf("expected README to be fetched once, got %v: %s", *requested, first)
+	}
+
+	// 删除磁盘缓存后仍然命中内存缓存
+	if err := os.RemoveAll(filepath.Join(util.TempDir, "bazaar", "readme")); nil != err {
+		t.Fatalf("remove README disk cache failed: %s", err)
+	}
+	if second := getTestPackageREADME(t, "readme-mem-cache", readme); first != second || 1 != len(*requested) {
+		t.Fatalf("expected cached README without network fetch, got %v: %s", *requested, second)
+	}
+
+	// 显式刷新后重新下载
+	InvalidatePackageREADME("https://github.com/siyuan-note/readme-mem-cache", "6286912c381ef3f83e455d06ba4d369c498238dc", "plugins")
+	if third := getTestPackageREADME(t, "readme-mem-cache", readme); first != third || 2 != len(*requested) {
+		t.Fatalf("expected README to be fetched again after refresh, got %v: %s", *requested, third)
+	}
+}
+
+func TestSetBazaarCacheDir(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "bazaar-cache")
+	if err := SetBazaarCacheDir(cacheDir); nil != err {
+		t.Fatalf("set bazaar cache dir failed: %s", err)
+	}
+	t.Cleanup(func() { SetBazaarCacheDir("") })
+
+	newTestReadmeServer(t, map[string]string{"README.md": "# Relocated README"})
+	if ret := getTestPackageREADME(t, "readme-cache-dir", Readme{"default": "README.md"}); !strings.Contains(ret, "Relocated README") {
+		t.Fatalf("unexpected README %s", ret)
+	}
+	entries, err := os.ReadDir(filepath.Join(cacheDir, "readme"))
+	if nil != err || 1 != len(entries) {
+		t.Fatalf("expected README to be cached in [%s], got %v: %v", cacheDir, entries, err)
+	}
+
+	// 不可写的目录不会被采用
+	file := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(file, nil, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if err = SetBazaarCacheDir(filepath.Join(file, "cache")); nil == err {
+		t.Fatalf("expected error for unwritable cache dir")
+	}
+	if cacheDir != getBazaarCacheDir() {
+		t.Fatalf("expected cache dir to stay [%s], got [%s]", cacheDir, getBazaarCacheDir())
+	}
+
+	SetBazaarCacheDir("")
+	if expected := filepath.Join(util.TempDir, "bazaar"); expected != getBazaarCacheDir() {
+		t.Fatalf("expected default cache dir [%s], got [%s]", expected, getBazaarCacheDir())
+	}
+}
+
+func TestREADMEDiskCacheTTL(t *testing.T) {
+	setTestTempDir(t)
+	expired := time.Now().Add(-readmeDiskCacheTTL - time.Hour)
+
+	// 过期的磁盘缓存不会被读取
+	cacheREADME("expired", "<p>expired</p>")
+	readmeMemCache.Flush()
+	if err := os.Chtimes(readmeCachePath("expired"), expired, expired); nil != err {
+		t.Fatalf("change README cache time failed: %s", err)
+	}
+	if _, ok := getCachedREADME("expired"); ok {
+		t.Fatalf("expected expired README cache to be ignored")
+	}
+	if gulu.File.IsExist(readmeCachePath("expired")) {
+		t.Fatalf("expected expired README cache to be removed")
+	}
+
+	// 写入新缓存时清理过期的缓存文件，比如包更新后旧版本的缓存
+	cacheREADME("stale", "<p>stale</p>")
+	if err := os.Chtimes(readmeCachePath("stale"), expired, expired); nil != err {
+		t.Fatalf("change README cache time failed: %s", err)
+	}
+	readmeDiskCachePruneLock.Lock()
+	readmeDiskCachePruneTime = time.Time{}
+	readmeDiskCachePruneLock.Unlock()
+	cacheREADME("fresh", "<p>fresh</p>")
+	if gulu.File.IsExist(readmeCachePath("stale")) || !gulu.File.IsExist(readmeCachePath("fresh")) {
+		t.Fatalf("expected only expired README cache files to be pruned")
+	}
+	readmeMemCache.Flush()
+	if ret, ok := getCachedREADME("fresh"); !ok || "<p>fresh</p>" != ret {
+		t.Fatalf("expected fresh README cache to be read from disk, got [%s]", ret)
+	}
+}
+
+func TestGetPackageREADMECachePerLanguage(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	requested := newTestReadmeServer(t, map[string]string{
+		"README.md":       "# English README",
+		"README_zh_CN.md": "# 中文 README",
+	})
+	readme := Readme{"default": "README.md", "zh_CN": "README_zh_CN.md"}
+
+	util.Lang = "en_US"
+	if ret := getTestPackageREADME(t, "readme-cache", readme); !strings.Contains(ret, "English README") {
+		t.Fatalf("expected English README, got %s", ret)
+	}
+	util.Lang = "zh_CN"
+	if ret := getTestPackageREADME(t, "readme-cache", readme); !strings.Contains(ret, "中文 README") {
+		t.Fatalf("expected Chinese README, got %s", ret)
+	}
+	if 2 != len(*requested) {
+		t.Fatalf("expected 2 requests, got %v", *requested)
+	}
+
+	// 再次获取时命中各自语言的缓存
+	util.Lang = "en_US"
+	if ret := getTestPackageREADME(t, "readme-cache", readme); !strings.Contains(ret, "English README") {
+		t.Fatalf("expected cached English README, got %s", ret)
+	}
+	util.Lang = "zh_CN"
+	if ret := getTestPackageREADME(t, "readme-cache", readme); !strings.Contains(ret, "中文 README") {
+		t.Fatalf("expected cached Chinese README, got %s", ret)
+	}
+	if 2 != len(*requested) {
+		t.Fatalf("expected READMEs to be served from cache, got %v", *requested)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(util.TempDir, "bazaar", "readme"))
+	if nil != err || 2 != len(entries) {
+		t.Fatalf("expected 2 distinct cache entries, got %d: %v", len(entries), err)
+	}
+}
+
+func TestDecodeREADME(t *testing.T) {
+	// UTF-16LE 带 BOM
+	data, err := decodeREADME([]byte{0xFF, 0xFE, '#', 0, ' ', 0, 'T', 0, 'i', 0})
+	if nil != err || "# Ti" != string(data) {
+		t.Fatalf("decode UTF-16LE failed: %v, %q", err, data)
+	}
+
+	// 未配对的代理项
+	data, err = decodeREADME([]byte{0xFF, 0xFE, 0x00, 0xD8, '#', 0, ' ', 0, 'T', 0})
+	if nil == err {
+		t.Fatalf("expected decode error for malformed UTF-16, got %q", data)
+	}
+
+	// 误带 BOM 的 UTF-8
+	data, err = decodeREADME(append([]byte{0xFE, 0xFF}, []byte("# 标题\n")...))
+	if nil != err || "# 标题\n" != string(data) {
+		t.Fatalf("expected UTF-8 fallback, got %v, %q", err, data)
+	}
+
+	// 通过 HTTP 下载时响应被嗅探为 text/plain; charset=utf-16le，需要拿到原始字节再解码
+	newTestReadmeServer(t, map[string]string{"README.md": string([]byte{0xFF, 0xFE, '#', 0, ' ', 0, 'T', 0, 'i', 0, 't', 0, 'l', 0, 'e', 0, '\n', 0})})
+	ret := getTestPackageREADME(t, "readme-utf16le", Readme{"default": "README.md"})
+	if !strings.Contains(ret, ">Title</h1>") || strings.ContainsRune(ret, '\ufeff') || strings.ContainsRune(ret, '�') {
+		t.Fatalf("expected UTF-16LE README to be decoded, got %s", ret)
+	}
+
+	requested := newTestReadmeServer(t, map[string]string{"README.md": string([]byte{0xFF, 0xFE, 0x00, 0xDC, 'A', 0x00})})
+	ret = getTestPackageREADME(t, "readme-utf16", Readme{"default": "README.md"})
+	if 1 != len(*requested) || !strings.Contains(ret, "Decode bazaar package's README.md(README.md) failed") || strings.ContainsRune(ret, '�') {
+		t.Fatalf("expected clear decode error, got %s", ret)
+	}
+}
+
+func TestGetPackageREADMETruncate(t *testing.T) {
+	// 缩小 README 上限，避免在 -race 下渲染 2MB 的 README 超时
+	SetMaxREADMESize(64 * 1024)
+	SetRenderREADMETimeout(time.Minute)
+	t.Cleanup(func() {
+		SetMaxREADMESize(2 * 1024 * 1024)
+		SetRenderREADMETimeout(5 * time.Second)
+	})
+
+	var buf strings.Builder
+	for i := 0; buf.Len() < 128*1024; i++ {
+		fmt.Fprintf(&buf, "Paragraph %d of a very long README.\n\n", i)
+	}
+	readme := buf.String()
+
+	newTestReadmeServer(t, map[string]string{"README.md": readme})
+	ret := getTestPackageREADME(t, "readme-huge", Readme{"default": "README.md"})
+	if len(ret) >= len(readme) {
+		t.Fatalf("expected truncated README, got %d bytes", len(ret))
+	}
+	if !strings.Contains(ret, "https://github.com/siyuan-note/readme-huge/blob/6286912c381ef3f83e455d06ba4d369c498238dc/README.md") || !strings.Contains(ret, "View full README on GitHub") {
+		t.Fatalf("expected link to full README")
+	}
+	if strings.Contains(ret, "Paragraph 3000 ") {
+		t.Fatalf("expected tail of README to be truncated")
+	}
+}
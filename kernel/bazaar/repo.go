@@ -0,0 +1,246 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	gcache "github.com/patrickmn/go-cache"
+	"github.com/siyuan-note/httpclient"
+	"github.com/siyuan-note/logging"
+	"golang.org/x/time/rate"
+)
+
+// NormalizeRepoURL 将仓库地址规范化为小写形式，GitHub 仓库为 owner/repo，GitLab 和 Gitee 仓库带有托管平台，
+// 比如 https://github.com/Owner/Repo.git/ 规范化为 owner/repo，https://gitlab.com/Owner/Repo 规范化为 gitlab.com/owner/repo。
+func NormalizeRepoURL(repoURL string) (normalized string, ok bool) {
+	host, owner, name, ok := parseRepoOwnerName(repoURL)
+	if !ok {
+		return "", false
+	}
+
+	normalized = strings.ToLower(owner + "/" + name)
+	if "github.com" != host {
+		normalized = host + "/" + normalized
+	}
+	return
+}
+
+// normalizeGitHubRepoURL 和 NormalizeRepoURL 相同，但只接受 GitHub 仓库，用于调用 GitHub API 等只支持 GitHub 的场景。
+func normalizeGitHubRepoURL(repoURL string) (normalized string, ok bool) {
+	if host, _, _, parsed := parseRepoOwnerName(repoURL); !parsed || "github.com" != host {
+		return "", false
+	}
+	return NormalizeRepoURL(repoURL)
+}
+
+// normalizedRepoURL 返回规范化仓库地址对应的完整地址。
+func normalizedRepoURL(normalized string) string {
+	if 2 == strings.Count(normalized, "/") {
+		return "https://" + normalized
+	}
+	return "https://github.com/" + normalized
+}
+
+func isValidRepoNamePart(part string) bool {
+	if "" == part || "." == part || ".." == part {
+		return false
+	}
+	for _, r := range part {
+		if !('a' <= r && 'z' >= r) && !('0' <= r && '9' >= r) && '-' != r && '_' != r && '.' != r {
+			return false
+		}
+	}
+	return true
+}
+
+const packageDeepLinkPrefix = "siyuan://bazaar/"
+
+var ErrInvalidDeepLink = errors.New("invalid package deep link")
+
+// PackageDeepLink 返回打开集市包详情的链接，比如 siyuan://bazaar/plugins/owner/repo，包类型或者仓库地址无效时返回空。
+func PackageDeepLink(packageType, repoURL string) string {
+	if !gulu.Str.Contains(packageType, packageTypes) {
+		return ""
+	}
+	normalized, ok := NormalizeRepoURL(repoURL)
+	if !ok {
+		return ""
+	}
+	return packageDeepLinkPrefix + packageType + "/" + normalized
+}
+
+// ParsePackageDeepLink 解析 PackageDeepLink 生成的链接，返回包类型和规范化的仓库地址 owner/repo。
+func ParsePackageDeepLink(uri string) (packageType, repoURL string, err error) {
+	if !strings.HasPrefix(uri, packageDeepLinkPrefix) {
+		err = fmt.Errorf("%w [%s]", ErrInvalidDeepLink, uri)
+		return
+	}
+
+	packageType, repoURL, _ = strings.Cut(strings.TrimPrefix(uri, packageDeepLinkPrefix), "/")
+	if !gulu.Str.Contains(packageType, packageTypes) {
+		err = fmt.Errorf("%w [%s]: %w", ErrInvalidDeepLink, uri, ErrInvalidPackageType)
+		packageType, repoURL = "", ""
+		return
+	}
+	normalized, ok := NormalizeRepoURL(repoURL)
+	if !ok {
+		err = fmt.Errorf("%w [%s]", ErrInvalidDeepLink, uri)
+		packageType, repoURL = "", ""
+		return
+	}
+	repoURL = normalized
+	return
+}
+
+// repoHosts 支持检查更新和解析 README 链接的代码托管平台
+var repoHosts = []string{"github.com", "gitlab.com", "gitee.com"}
+
+// parseRepoOwnerName 解析仓库地址中的托管平台、所有者和仓库名，支持 GitHub、GitLab 和 Gitee，
+// 比如 https://gitlab.com/Owner/Repo.git 解析为 gitlab.com、Owner、Repo，没有托管平台的 owner/repo 视为 GitHub 仓库。
+func parseRepoOwnerName(repoURL string) (host, owner, name string, ok bool) {
+	repo := strings.TrimSpace(repoURL)
+	for _, prefix := range []string{"https://", "http://", "www."} {
+		if strings.HasPrefix(strings.ToLower(repo), prefix) {
+			repo = repo[len(prefix):]
+		}
+	}
+
+	host = "github.com"
+	for _, repoHost := range repoHosts {
+		if strings.HasPrefix(strings.ToLower(repo), repoHost+"/") {
+			host, repo = repoHost, repo[len(repoHost)+1:]
+			break
+		}
+	}
+	repo = strings.TrimSuffix(repo, "/")
+	repo = strings.TrimSuffix(repo, ".git")
+
+	parts := strings.Split(repo, "/")
+	if 2 != len(parts) || !isValidRepoNamePart(strings.ToLower(parts[0])) || !isValidRepoNamePart(strings.ToLower(parts[1])) {
+		return "", "", "", false
+	}
+	return host, parts[0], parts[1], true
+}
+
+func isSameRepo(repoURL1, repoURL2 string) bool {
+	host1, owner1, name1, ok1 := parseRepoOwnerName(repoURL1)
+	host2, owner2, name2, ok2 := parseRepoOwnerName(repoURL2)
+	return ok1 && ok2 && host1 == host2 && strings.EqualFold(owner1, owner2) && strings.EqualFold(name1, name2)
+}
+
+// lookupREADMERepo 查找 README 对应的集市仓库，返回仓库转移后集市索引中的地址，获取 README 时不会请求 GitHub API。
+func lookupREADMERepo(packageType, repoURL string) (repo *StageRepo, canonicalURL string) {
+	repo = lookupStageRepoCanonical(packageType, repoURL, false)
+	if nil == repo {
+		return
+	}
+	canonicalURL = stageRepoURL(repo, repoURL)
+	return
+}
+
+// repoWebURL 返回仓库的网页地址，repoPath 形如 owner/repo 或者 gitlab.com/owner/repo，保留托管平台和原始大小写。
+func repoWebURL(repoPath string) string {
+	host, owner, name, ok := parseRepoOwnerName(repoPath)
+	if !ok {
+		return "https://github.com/" + repoPath
+	}
+	return "https://" + host + "/" + owner + "/" + name
+}
+
+// stageRepoURL 返回集市索引中仓库的完整地址，索引中的地址没有托管平台时沿用 repoURL 的托管平台。
+func stageRepoURL(repo *StageRepo, repoURL string) string {
+	stagePath := strings.Split(repo.URL, "@")[0]
+	host, owner, name, ok := parseRepoOwnerName(stagePath)
+	if !ok {
+		return repoURL
+	}
+	if 1 == strings.Count(stagePath, "/") {
+		if originalHost, _, _, originalOK := parseRepoOwnerName(repoURL); originalOK {
+			host = originalHost
+		}
+	}
+	return "https://" + host + "/" + owner + "/" + name
+}
+
+type Contributor struct {
+	Login         string `json:"login"`
+	AvatarURL     string `json:"avatarURL"`
+	Contributions int    `json:"contributions"`
+}
+
+// ErrUnsupportedRepoHost 表示仓库不在 GitHub 上，无法获取贡献者等信息。
+var ErrUnsupportedRepoHost = errors.New("unsupported repo host")
+
+var (
+	githubAPIServer  = "https://api.github.com"
+	githubAPILimiter = rate.NewLimiter(rate.Every(time.Second), 5) // 所有 GitHub API 请求共享，避免触发 GitHub 的速率限制
+
+	packageContributorsCache = gcache.New(24*time.Hour, 6*time.Hour) // [owner/repo][]Contributor
+)
+
+// GetPackageContributors 获取集市包仓库的贡献者列表，结果按仓库缓存。
+//
+// 非 GitHub 仓库返回空列表和 ErrUnsupportedRepoHost。
+func GetPackageContributors(repoURL string) (ret []Contributor, err error) {
+	ret = []Contributor{}
+	repo, ok := normalizeGitHubRepoURL(repoURL)
+	if !ok {
+		err = fmt.Errorf("%w [%s]", ErrUnsupportedRepoHost, repoURL)
+		return
+	}
+
+	if cached, found := packageContributorsCache.Get(repo); found {
+		ret = cached.([]Contributor)
+		return
+	}
+
+	if err = githubAPILimiter.Wait(context.Background()); nil != err {
+		return
+	}
+
+	var result []*struct {
+		Login         string `json:"login"`
+		AvatarURL     string `json:"avatar_url"`
+		Contributions int    `json:"contributions"`
+	}
+	u := githubAPIServer + "/repos/" + repo + "/contributors?per_page=100"
+	resp, err := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(&result).Get(u)
+	if nil != err {
+		logging.LogErrorf("get contributors [%s] failed: %s", u, err)
+		return
+	}
+	if 200 != resp.StatusCode {
+		logging.LogErrorf("get contributors [%s] failed: %d", u, resp.StatusCode)
+		err = fmt.Errorf("get contributors of [%s] failed: %s", repo, resp.Status)
+		return
+	}
+
+	for _, contributor := range result {
+		if nil == contributor || "" == contributor.Login {
+			continue
+		}
+		ret = append(ret, Contributor{Login: contributor.Login, AvatarURL: contributor.AvatarURL, Contributions: contributor.Contributions})
+	}
+	packageContributorsCache.SetDefault(repo, ret)
+	return
+}
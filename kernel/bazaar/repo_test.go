@@ -0,0 +1,227 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStageRepoURL(t *testing.T) {
+	repo := &StageRepo{URL: "New-Owner/plugin@6286912c381ef3f83e455d06ba4d369c498238dc"}
+	if u := stageRepoURL(repo, "https://github.com/old-owner/plugin"); "https://github.com/New-Owner/plugin" != u {
+		t.Fatalf("unexpected GitHub repo URL [%s]", u)
+	}
+	if u := stageRepoURL(repo, "https://gitlab.com/old-owner/plugin"); "https://gitlab.com/New-Owner/plugin" != u {
+		t.Fatalf("expected GitLab host to be kept, got [%s]", u)
+	}
+	repo.URL = "gitee.com/owner/plugin@6286912c381ef3f83e455d06ba4d369c498238dc"
+	if u := stageRepoURL(repo, "https://github.com/owner/plugin"); "https://gitee.com/owner/plugin" != u {
+		t.Fatalf("expected stage host to be used, got [%s]", u)
+	}
+}
+
+func TestRepoWebURL(t *testing.T) {
+	for repoPath, expected := range map[string]string{
+		"Owner/Repo":            "https://github.com/Owner/Repo",
+		"gitlab.com/Owner/Repo": "https://gitlab.com/Owner/Repo",
+		"gitee.com/owner/repo":  "https://gitee.com/owner/repo",
+	} {
+		if u := repoWebURL(repoPath); expected != u {
+			t.Fatalf("expected [%s] for [%s], got [%s]", expected, repoPath, u)
+		}
+	}
+
+	// 集市列表中的仓库地址保留托管平台
+	setTestStageIndex("widgets", &StageIndex{Repos: []*StageRepo{
+		{URL: "gitlab.com/Owner/widget@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "widget"}},
+	}})
+	t.Cleanup(func() { setTestStageIndex("widgets", nil) })
+	t.Cleanup(flushPackageCache)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/widget.json") {
+			w.Write([]byte(`{"name":"widget","version":"1.0.0"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	setTestBazaarOSSServer(t, server.URL)
+	setTestBazaarStatServer(t, server.URL)
+
+	widgets := Widgets()
+	if 1 != len(widgets) || "https://gitlab.com/Owner/widget" != widgets[0].RepoURL {
+		t.Fatalf("expected GitLab repo URL, got %+v", widgets)
+	}
+}
+
+func TestNormalizeRepoURL(t *testing.T) {
+	cases := []struct {
+		url        string
+		normalized string
+		ok         bool
+	}{
+		{"https://github.com/siyuan-note/siyuan", "siyuan-note/siyuan", true},
+		{"https://github.com/Owner/Repo.git/", "owner/repo", true},
+		{"http://github.com/Owner/Repo/", "owner/repo", true},
+		{"https://www.github.com/88250/Comfortably-Numb", "88250/comfortably-numb", true},
+		{"github.com/owner/repo.name", "owner/repo.name", true},
+		{"  Owner/Repo_1  ", "owner/repo_1", true},
+		{"owner/repo.git", "owner/repo", true},
+		{"", "", false},
+		{"https://github.com/", "", false},
+		{"https://github.com/owner", "", false},
+		{"https://github.com/owner/repo/tree/main", "", false},
+		{"https://gitlab.example.com/owner/repo", "", false},
+		{"https://gitlab.com/Owner/Repo.git", "gitlab.com/owner/repo", true},
+		{"gitee.com/owner/repo/", "gitee.com/owner/repo", true},
+		{"https://github.com/owner/../repo", "", false},
+		{"owner/repo@6286912c", "", false},
+		{"owner/re po", "", false},
+	}
+	for _, c := range cases {
+		normalized, ok := NormalizeRepoURL(c.url)
+		if c.normalized != normalized || c.ok != ok {
+			t.Fatalf("normalize [%s] expected [%s, %v], got [%s, %v]", c.url, c.normalized, c.ok, normalized, ok)
+		}
+	}
+}
+
+func TestPackageDeepLink(t *testing.T) {
+	for _, packageType := range packageTypes {
+		link := PackageDeepLink(packageType, "https://github.com/Siyuan-Note/Sample.git")
+		if "siyuan://bazaar/"+packageType+"/siyuan-note/sample" != link {
+			t.Fatalf("unexpected deep link [%s]", link)
+		}
+		parsedType, repoURL, err := ParsePackageDeepLink(link)
+		if nil != err || packageType != parsedType || "siyuan-note/sample" != repoURL {
+			t.Fatalf("parse deep link [%s] got [%s, %s]: %v", link, parsedType, repoURL, err)
+		}
+		if PackageDeepLink(parsedType, repoURL) != link {
+			t.Fatalf("expected deep link [%s] to round trip", link)
+		}
+	}
+
+	link := PackageDeepLink("themes", "https://gitlab.com/Owner/Sample")
+	if packageType, repoURL, err := ParsePackageDeepLink(link); nil != err || "themes" != packageType || "gitlab.com/owner/sample" != repoURL {
+		t.Fatalf("parse GitLab deep link [%s] got [%s, %s]: %v", link, packageType, repoURL, err)
+	}
+
+	if link := PackageDeepLink("emojis", "siyuan-note/sample"); "" != link {
+		t.Fatalf("expected no deep link for invalid package type, got [%s]", link)
+	}
+	if link := PackageDeepLink("plugins", "siyuan-note"); "" != link {
+		t.Fatalf("expected no deep link for invalid repo, got [%s]", link)
+	}
+
+	for _, uri := range []string{
+		"",
+		"https://github.com/siyuan-note/sample",
+		"siyuan://blocks/20240101000000-abcdefg",
+		"siyuan://bazaar/plugins",
+		"siyuan://bazaar/emojis/siyuan-note/sample",
+		"siyuan://bazaar/plugins/siyuan-note/sample/extra",
+	} {
+		if packageType, repoURL, err := ParsePackageDeepLink(uri); !errors.Is(err, ErrInvalidDeepLink) || "" != packageType || "" != repoURL {
+			t.Fatalf("expected invalid deep link [%s], got [%s, %s]: %v", uri, packageType, repoURL, err)
+		}
+	}
+}
+
+func TestParseRepoOwnerName(t *testing.T) {
+	cases := []struct {
+		url, host, owner, name string
+	}{
+		{"https://github.com/Owner/Repo", "github.com", "Owner", "Repo"},
+		{"owner/repo", "github.com", "owner", "repo"},
+		{"https://gitlab.com/owner/repo.git", "gitlab.com", "owner", "repo"},
+		{"https://gitee.com/owner/repo/", "gitee.com", "owner", "repo"},
+	}
+	for _, c := range cases {
+		if host, owner, name, ok := parseRepoOwnerName(c.url); !ok || c.host != host || c.owner != owner || c.name != name {
+			t.Fatalf("unexpected result for [%s]: [%s, %s, %s, %v]", c.url, host, owner, name, ok)
+		}
+	}
+	for _, u := range []string{"", "https://gitlab.com/group/subgroup/repo", "https://example.com/owner/repo", "https://gitee.com/owner/../repo"} {
+		if _, _, _, ok := parseRepoOwnerName(u); ok {
+			t.Fatalf("expected [%s] to be rejected", u)
+		}
+	}
+
+	if !isSameRepo("https://gitlab.com/Owner/Repo", "https://gitlab.com/owner/repo.git") || isSameRepo("https://gitlab.com/owner/repo", "https://gitee.com/owner/repo") || isSameRepo("https://gitee.com/owner/repo", "owner/repo") {
+		t.Fatalf("unexpected repo comparison across hosts")
+	}
+
+	installed := &Plugin{Package: &Package{URL: "https://gitee.com/owner/repo", Name: "repo", Author: "owner", Version: "1.0.0"}}
+	latest := &Plugin{Package: &Package{URL: "https://gitee.com/Owner/Repo", Name: "repo", Author: "owner", Version: "1.1.0", RepoHash: "6286912c381ef3f83e455d06ba4d369c498238dc"}}
+	if !isOutdatedPlugin(installed, []*Plugin{latest}, "") {
+		t.Fatalf("expected Gitee package to be outdated")
+	}
+
+	linkBases := map[string]string{
+		"https://gitlab.com/owner/repo":         "https://gitlab.com/owner/repo/-/raw/HEAD",
+		"https://gitee.com/owner/repo@v1.0.0":   "https://gitee.com/owner/repo/raw/v1.0.0",
+		"https://github.com/owner/repo@v1.0.0":  "https://cdn.jsdelivr.net/gh/owner/repo@v1.0.0",
+		"https://gitlab.com/group/sub/repo.git": "https://gitlab.com/group/sub/repo.git",
+	}
+	for repoURL, expected := range linkBases {
+		if linkBase := readmeLinkBase(repoURL); expected != linkBase {
+			t.Fatalf("expected link base [%s] for [%s], got [%s]", expected, repoURL, linkBase)
+		}
+	}
+}
+
+func TestGetPackageContributors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if "/repos/siyuan-note/contributors/contributors" != r.URL.Path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{"login": "88250", "avatar_url": "https://avatars.githubusercontent.com/u/873584", "contributions": 100},
+			{"login": "Vanessa219", "avatar_url": "https://avatars.githubusercontent.com/u/970828", "contributions": 50},
+			{"login": "zxhd863943427", "avatar_url": "https://avatars.githubusercontent.com/u/48776895", "contributions": 5}
+		]`))
+	}))
+	defer server.Close()
+
+	setTestGitHubAPIServer(t, server.URL)
+
+	for i := 0; i < 2; i++ {
+		contributors, err := GetPackageContributors("https://github.com/siyuan-note/contributors")
+		if nil != err {
+			t.Fatalf("get contributors failed: %s", err)
+		}
+		if 3 != len(contributors) || "Vanessa219" != contributors[1].Login || "https://avatars.githubusercontent.com/u/970828" != contributors[1].AvatarURL {
+			t.Fatalf("unexpected contributors %+v", contributors)
+		}
+	}
+	if 1 != requests {
+		t.Fatalf("expected contributors to be cached, got %d requests", requests)
+	}
+
+	contributors, err := GetPackageContributors("https://gitlab.com/siyuan-note/contributors")
+	if !errors.Is(err, ErrUnsupportedRepoHost) || nil == contributors || 0 != len(contributors) {
+		t.Fatalf("expected empty list for non-GitHub repo, got %v, %v", contributors, err)
+	}
+}
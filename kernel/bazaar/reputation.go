@@ -0,0 +1,165 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/siyuan-note/logging"
+)
+
+// futureUpdatedLogged 记录已经打印过日志的未来更新时间，避免每次格式化都打印
+var futureUpdatedLogged = sync.Map{}
+
+// parseUpdated 解析集市包的更新时间（RFC3339 或者日期等格式），更新时间在未来时按当前时间处理。
+func parseUpdated(updated string) (ret time.Time, ok bool) {
+	ret, err := dateparse.ParseIn(updated, time.Now().Location())
+	if nil != err {
+		return
+	}
+
+	// 作者时钟偏差或者时区错误会导致更新时间在未来，按当前时间处理
+	if now := time.Now(); ret.After(now) {
+		if _, logged := futureUpdatedLogged.LoadOrStore(updated, true); !logged {
+			logging.LogWarnf("bazaar package updated time [%s] is in the future, clamped to now", updated)
+		}
+		ret = now.In(ret.Location())
+	}
+	return ret, true
+}
+
+func formatUpdated(updated string) (ret string) {
+	if t, ok := parseUpdated(updated); ok {
+		ret = t.Format("2006-01-02")
+	} else {
+		if strings.Contains(updated, "T") {
+			ret = updated[:strings.Index(updated, "T")]
+		} else {
+			ret = strings.ReplaceAll(strings.ReplaceAll(updated, "T", ""), "Z", "")
+		}
+	}
+	return
+}
+
+// FreshnessDays 返回距离最后更新过去的天数，更新时间在未来时返回 0，无法解析时返回 -1。
+func (repo *StageRepo) FreshnessDays(now time.Time) int {
+	if nil == repo {
+		return -1
+	}
+
+	updated, err := dateparse.ParseIn(repo.Updated, now.Location())
+	if nil != err {
+		return -1
+	}
+	if updated.After(now) {
+		return 0
+	}
+	return int(now.Sub(updated).Hours() / 24)
+}
+
+// Freshness 集市包的新鲜度，界面根据它标记长期未更新的包。
+type Freshness string
+
+const (
+	FreshnessFresh     Freshness = "fresh"
+	FreshnessAging     Freshness = "aging"
+	FreshnessStale     Freshness = "stale"
+	FreshnessAbandoned Freshness = "abandoned"
+	FreshnessUnknown   Freshness = "unknown" // 更新时间无法解析
+)
+
+// FreshnessThresholds 新鲜度分级的天数阈值，距离最后更新的天数达到阈值时进入对应级别。
+type FreshnessThresholds struct {
+	Aging     int `json:"aging"`
+	Stale     int `json:"stale"`
+	Abandoned int `json:"abandoned"`
+}
+
+var (
+	freshnessThresholds     = FreshnessThresholds{Aging: 90, Stale: 365, Abandoned: 730}
+	freshnessThresholdsLock = sync.Mutex{}
+)
+
+// SetFreshnessThresholds 设置新鲜度分级的天数阈值，默认为 90、365 和 730 天。
+func SetFreshnessThresholds(thresholds FreshnessThresholds) {
+	freshnessThresholdsLock.Lock()
+	defer freshnessThresholdsLock.Unlock()
+	freshnessThresholds = thresholds
+}
+
+// Freshness 根据距离最后更新的天数返回新鲜度。
+func (repo *StageRepo) Freshness(now time.Time) Freshness {
+	days := repo.FreshnessDays(now)
+	if 0 > days {
+		return FreshnessUnknown
+	}
+
+	freshnessThresholdsLock.Lock()
+	thresholds := freshnessThresholds
+	freshnessThresholdsLock.Unlock()
+	switch {
+	case days >= thresholds.Abandoned:
+		return FreshnessAbandoned
+	case days >= thresholds.Stale:
+		return FreshnessStale
+	case days >= thresholds.Aging:
+		return FreshnessAging
+	}
+	return FreshnessFresh
+}
+
+type ReputationScore struct {
+	Score     float64 `json:"score"`     // 综合得分 0-100
+	Stars     float64 `json:"stars"`     // 星标得分 0-1
+	Downloads float64 `json:"downloads"` // 下载量得分 0-1
+	Issues    float64 `json:"issues"`    // 未关闭问题占比得分 0-1，越少越高
+	Recency   float64 `json:"recency"`   // 更新时间得分 0-1，越近越高
+}
+
+const (
+	reputationStarsWeight     = 0.3
+	reputationDownloadsWeight = 0.3
+	reputationIssuesWeight    = 0.15
+	reputationRecencyWeight   = 0.25
+)
+
+// ComputeReputation 根据星标、下载量、未关闭问题占比和更新时间计算集市包的综合口碑得分。
+func ComputeReputation(repo *StageRepo, downloads int) (ret ReputationScore) {
+	if nil == repo {
+		return
+	}
+
+	ret.Stars = clamp01(math.Log10(float64(1+max(repo.Stars, 0))) / 3)    // 1000 星满分
+	ret.Downloads = clamp01(math.Log10(float64(1+max(downloads, 0))) / 4) // 10000 次下载满分
+	ret.Issues = 1 - clamp01(float64(max(repo.OpenIssues, 0))/float64(1+max(repo.Stars, 0)))
+	if updated, err := time.ParseInLocation("2006-01-02", formatUpdated(repo.Updated), time.Now().Location()); nil == err {
+		days := time.Since(updated).Hours() / 24
+		ret.Recency = clamp01(1 - (days-30)/(730-30)) // 30 天内满分，两年以上不得分
+	}
+
+	score := ret.Stars*reputationStarsWeight + ret.Downloads*reputationDownloadsWeight + ret.Issues*reputationIssuesWeight + ret.Recency*reputationRecencyWeight
+	ret.Score = math.Round(clamp01(score)*10000) / 100
+	return
+}
+
+func clamp01(f float64) float64 {
+	return math.Max(0, math.Min(1, f))
+}
@@ -0,0 +1,88 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeReputation(t *testing.T) {
+	popular := &StageRepo{Stars: 800, OpenIssues: 3, Updated: time.Now().AddDate(0, 0, -3).Format(time.RFC3339)}
+	stale := &StageRepo{Stars: 2, OpenIssues: 5, Updated: time.Now().AddDate(-3, 0, 0).Format(time.RFC3339)}
+
+	popularScore := ComputeReputation(popular, 5000)
+	staleScore := ComputeReputation(stale, 10)
+	if popularScore.Score <= staleScore.Score {
+		t.Fatalf("expected popular package [%+v] to score higher than stale package [%+v]", popularScore, staleScore)
+	}
+	if 0 > staleScore.Score || 100 < popularScore.Score {
+		t.Fatalf("scores out of range [%f, %f]", staleScore.Score, popularScore.Score)
+	}
+	if 1 != popularScore.Recency || 0 != staleScore.Recency {
+		t.Fatalf("unexpected recency [%f, %f]", popularScore.Recency, staleScore.Recency)
+	}
+
+	if score := ComputeReputation(&StageRepo{Updated: "invalid"}, 0); 0 != score.Recency || 0 > score.Score {
+		t.Fatalf("unexpected score for invalid updated time %+v", score)
+	}
+}
+
+func TestStageRepoFreshness(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		updated   string
+		days      int
+		freshness Freshness
+	}{
+		{"2024-05-20T08:00:00Z", 12, FreshnessFresh},
+		{"2024-01-01T00:00:00Z", 152, FreshnessAging},
+		{"2023-03-01", 458, FreshnessStale},
+		{"2021-06-01T00:00:00Z", 1096, FreshnessAbandoned},
+		{"2024-07-01T00:00:00Z", 0, FreshnessFresh},
+		{"not a time", -1, FreshnessUnknown},
+		{"", -1, FreshnessUnknown},
+	}
+	for _, c := range cases {
+		repo := &StageRepo{Updated: c.updated}
+		if days := repo.FreshnessDays(now); c.days != days {
+			t.Fatalf("expected [%d] days for [%s], got [%d]", c.days, c.updated, days)
+		}
+		if freshness := repo.Freshness(now); c.freshness != freshness {
+			t.Fatalf("expected [%s] for [%s], got [%s]", c.freshness, c.updated, freshness)
+		}
+	}
+
+	SetFreshnessThresholds(FreshnessThresholds{Aging: 7, Stale: 30, Abandoned: 180})
+	t.Cleanup(func() { SetFreshnessThresholds(FreshnessThresholds{Aging: 90, Stale: 365, Abandoned: 730}) })
+	if freshness := (&StageRepo{Updated: "2024-05-20T08:00:00Z"}).Freshness(now); FreshnessAging != freshness {
+		t.Fatalf("expected aging with custom thresholds, got [%s]", freshness)
+	}
+	if freshness := (&StageRepo{Updated: "2024-01-01T00:00:00Z"}).Freshness(now); FreshnessStale != freshness {
+		t.Fatalf("expected stale with custom thresholds, got [%s]", freshness)
+	}
+}
+
+func TestFormatUpdatedInFuture(t *testing.T) {
+	future := time.Now().UTC().Add(2 * time.Hour)
+	if formatted := formatUpdated(future.Format(time.RFC3339)); time.Now().UTC().Format("2006-01-02") != formatted {
+		t.Fatalf("expected future updated time to be clamped to today, got [%s]", formatted)
+	}
+	if formatted := formatUpdated("2024-05-18T08:00:00Z"); "2024-05-18" != formatted {
+		t.Fatalf("expected past updated time to be kept, got [%s]", formatted)
+	}
+}
@@ -0,0 +1,472 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/logging"
+	"golang.org/x/mod/semver"
+)
+
+// FeaturedPackages 返回编辑推荐的集市包，按推荐排序升序排列。
+func FeaturedPackages(packageType string) (ret []*StageRepo, err error) {
+	ret = []*StageRepo{}
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+
+	for _, repo := range stageIndex.Repos {
+		if repo.Featured {
+			ret = append(ret, repo)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].FeaturedRank < ret[j].FeaturedRank })
+	return
+}
+
+// RecommendPackages 根据已安装的集市包推荐同类型的其他集市包，最多返回 limit 个，limit 不大于 0 时不限制。
+//
+// 按照与已安装包共同的关键字和作者数量排序，数量相同时按口碑排序；没有安装任何包时返回口碑最高的包。
+func RecommendPackages(packageType string, limit int) (ret []*StageRepo, err error) {
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+
+	var installed []*Package
+	for _, pkg := range installedPackages(packageType) {
+		installed = append(installed, pkg)
+	}
+	ret = recommendPackages(installed, stageIndex, getBazaarIndex(), limit)
+	return
+}
+
+func recommendPackages(installed []*Package, stageIndex *StageIndex, bazaarIndex map[string]*bazaarPackage, limit int) (ret []*StageRepo) {
+	ret = []*StageRepo{}
+	if nil == stageIndex {
+		return
+	}
+
+	keywords, authors := map[string]bool{}, map[string]bool{}
+	for _, pkg := range installed {
+		for _, keyword := range pkg.Keywords {
+			if keyword = strings.ToLower(strings.TrimSpace(keyword)); "" != keyword {
+				keywords[keyword] = true
+			}
+		}
+		if "" != pkg.Author {
+			authors[pkg.Author] = true
+		}
+	}
+
+	type candidate struct {
+		repo       *StageRepo
+		overlap    int
+		reputation float64
+	}
+	var candidates []*candidate
+	for _, repo := range stageIndex.Repos {
+		if nil == repo.Package || repo.Package.Deprecated || isUnsupportedAppVersion(repo.Package.MinAppVersion, currentAppVersion) || isExcludedPrerelease(repo.Package.Version) {
+			continue
+		}
+		if isInstalledStageRepo(repo, installed) {
+			continue
+		}
+
+		overlap := 0
+		for _, keyword := range repo.Package.Keywords {
+			if keywords[strings.ToLower(strings.TrimSpace(keyword))] {
+				overlap++
+			}
+		}
+		if authors[repo.Package.Author] {
+			overlap++
+		}
+		if 0 < len(installed) && 1 > overlap {
+			continue
+		}
+
+		downloads := 0
+		if pkg := bazaarIndex[strings.Split(repo.URL, "@")[0]]; nil != pkg {
+			downloads = pkg.Downloads
+		}
+		candidates = append(candidates, &candidate{repo: repo, overlap: overlap, reputation: ComputeReputation(repo, downloads).Score})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].overlap != candidates[j].overlap {
+			return candidates[i].overlap > candidates[j].overlap
+		}
+		return candidates[i].reputation > candidates[j].reputation
+	})
+	for _, c := range candidates {
+		if 0 < limit && limit <= len(ret) {
+			break
+		}
+		ret = append(ret, c.repo)
+	}
+	return
+}
+
+func isInstalledStageRepo(repo *StageRepo, installed []*Package) bool {
+	for _, pkg := range installed {
+		if isSameRepo(repo.Package.URL, pkg.URL) || isSameRepo(strings.Split(repo.URL, "@")[0], pkg.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	includePrereleases     bool
+	includePrereleasesLock = sync.Mutex{}
+)
+
+// SetIncludePrereleases 设置集市列表和更新检查是否包含预发布版本（比如 1.0.0-rc.1）的包，默认不包含。
+func SetIncludePrereleases(include bool) {
+	includePrereleasesLock.Lock()
+	defer includePrereleasesLock.Unlock()
+
+	if includePrereleases == include {
+		return
+	}
+	includePrereleases = include
+	flushPackageCache() // 已缓存的列表项是按照之前的设置过滤的
+}
+
+func isIncludePrereleases() bool {
+	includePrereleasesLock.Lock()
+	defer includePrereleasesLock.Unlock()
+	return includePrereleases
+}
+
+var (
+	hideArchived     bool
+	hideArchivedLock = sync.Mutex{}
+)
+
+// SetHideArchived 设置集市列表是否隐藏仓库已归档的包，默认显示并通过 Archived 字段标记。
+func SetHideArchived(hide bool) {
+	hideArchivedLock.Lock()
+	defer hideArchivedLock.Unlock()
+
+	if hideArchived == hide {
+		return
+	}
+	hideArchived = hide
+	flushPackageCache()
+}
+
+func isHideArchived() bool {
+	hideArchivedLock.Lock()
+	defer hideArchivedLock.Unlock()
+	return hideArchived
+}
+
+// visibleStageRepos 返回集市列表中需要展示的仓库，设置了隐藏已归档的包时过滤掉已归档的仓库。
+func visibleStageRepos(repos []*StageRepo) (ret []*StageRepo) {
+	if !isHideArchived() {
+		return repos
+	}
+
+	for _, repo := range repos {
+		if !repo.Archived {
+			ret = append(ret, repo)
+		}
+	}
+	return
+}
+
+func isExcludedPrerelease(version string) bool {
+	return "" != semver.Prerelease("v"+version) && !isIncludePrereleases()
+}
+
+// IndexConsistency 集市索引和下载量索引的一致性检查结果。
+type IndexConsistency struct {
+	PackageType      string   `json:"packageType"`
+	StagePackages    int      `json:"stagePackages"`
+	MissingDownloads []string `json:"missingDownloads"` // 在集市索引中但不在下载量索引中的仓库
+	Consistent       bool     `json:"consistent"`
+}
+
+// CheckIndexConsistency 检查集市索引中的包是否都在下载量索引中。
+//
+// 两个索引来自不同的服务，快照不一致时列表中的下载量会对不上，用于排查“下载量不对”之类的反馈。
+func CheckIndexConsistency(packageType string) (ret *IndexConsistency, err error) {
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+
+	ret = checkIndexConsistency(packageType, stageIndex, getBazaarIndex())
+	if !ret.Consistent {
+		logging.LogWarnf("bazaar index is out of sync with stage index [%s]: %d of %d packages missing download counts, e.g. %s",
+			packageType, len(ret.MissingDownloads), ret.StagePackages, ret.MissingDownloads[0])
+	}
+	return
+}
+
+func checkIndexConsistency(packageType string, stageIndex *StageIndex, bazaarIndex map[string]*bazaarPackage) (ret *IndexConsistency) {
+	ret = &IndexConsistency{PackageType: packageType, MissingDownloads: []string{}}
+	if nil != stageIndex {
+		for _, repo := range stageIndex.Repos {
+			ret.StagePackages++
+			repoURL := strings.Split(repo.URL, "@")[0]
+			if _, ok := bazaarIndex[repoURL]; !ok {
+				ret.MissingDownloads = append(ret.MissingDownloads, repoURL)
+			}
+		}
+	}
+	sort.Strings(ret.MissingDownloads)
+	ret.Consistent = 1 > len(ret.MissingDownloads)
+	return
+}
+
+// SortStagePackages 按 stars（星标）、downloads（下载量）、updated（更新时间）降序或者 name（名称）升序排列仓库，
+// 主键相同时按名称排列，保证结果稳定。更新时间无法解析的包排在最后。
+func SortStagePackages(repos []*StageRepo, by string) {
+	names := map[*StageRepo]string{}
+	for _, repo := range repos {
+		names[repo] = strings.ToLower(stageRepoPreferredName(repo))
+	}
+	byName := func(i, j int) bool {
+		if names[repos[i]] != names[repos[j]] {
+			return names[repos[i]] < names[repos[j]]
+		}
+		return repos[i].URL < repos[j].URL
+	}
+
+	var compare func(i, j int) int
+	switch by {
+	case "stars":
+		compare = func(i, j int) int { return repos[j].Stars - repos[i].Stars }
+	case "downloads":
+		bazaarIndex := getBazaarIndex()
+		downloads := func(repo *StageRepo) int {
+			if pkg := bazaarIndex[strings.Split(repo.URL, "@")[0]]; nil != pkg {
+				return pkg.Downloads
+			}
+			return 0
+		}
+		compare = func(i, j int) int { return downloads(repos[j]) - downloads(repos[i]) }
+	case "updated":
+		updated := map[*StageRepo]time.Time{}
+		for _, repo := range repos {
+			updated[repo], _ = parseUpdated(repo.Updated)
+		}
+		compare = func(i, j int) int { return updated[repos[j]].Compare(updated[repos[i]]) }
+	}
+
+	sort.SliceStable(repos, func(i, j int) bool {
+		if nil != compare {
+			if c := compare(i, j); 0 != c {
+				return 0 > c
+			}
+		}
+		return byName(i, j)
+	})
+}
+
+// stageRepoPreferredName 返回仓库中包的显示名称，包没有名称时使用仓库名。
+func stageRepoPreferredName(repo *StageRepo) string {
+	name := path.Base(strings.Split(repo.URL, "@")[0])
+	if nil == repo.Package {
+		return name
+	}
+	if "" != repo.Package.Name {
+		name = repo.Package.Name
+	}
+	return GetPreferredName(&Package{Name: name, DisplayName: repo.Package.DisplayName})
+}
+
+// SearchStageIndex 在集市索引中搜索包，query 按空白分隔为多个词，每个词都需要（忽略大小写）出现在包的名称、描述或关键字中。
+//
+// 名称匹配的词越多排序越靠前，其次是关键字匹配，只有描述匹配的包排在最后。query 为空时返回所有包。
+func SearchStageIndex(pkgType, query string) (ret []*StageRepo, err error) {
+	stageIndex, err := getStageIndex(pkgType)
+	if nil != err {
+		return
+	}
+	ret = searchStageRepos(stageIndex, query)
+	return
+}
+
+func searchStageRepos(stageIndex *StageIndex, query string) (ret []*StageRepo) {
+	ret = []*StageRepo{}
+	if nil == stageIndex {
+		return
+	}
+
+	terms := strings.Fields(strings.ToLower(query))
+	if 1 > len(terms) {
+		ret = append(ret, stageIndex.Repos...)
+		return
+	}
+
+	type match struct {
+		repo                  *StageRepo
+		nameHits, keywordHits int
+	}
+	var matches []*match
+	for _, repo := range stageIndex.Repos {
+		if nil == repo || nil == repo.Package {
+			continue
+		}
+
+		name := strings.ToLower(stageRepoPreferredName(repo))
+		desc := strings.ToLower(getPreferredDesc(repo.Package.Description))
+		keywords := strings.ToLower(strings.Join(repo.Package.Keywords, "\n"))
+
+		m := &match{repo: repo}
+		for _, term := range terms {
+			inName, inKeywords := strings.Contains(name, term), strings.Contains(keywords, term)
+			if !inName && !inKeywords && !strings.Contains(desc, term) {
+				m = nil
+				break
+			}
+			if inName {
+				m.nameHits++
+			}
+			if inKeywords {
+				m.keywordHits++
+			}
+		}
+		if nil != m {
+			matches = append(matches, m)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].nameHits != matches[j].nameHits {
+			return matches[i].nameHits > matches[j].nameHits
+		}
+		return matches[i].keywordHits > matches[j].keywordHits
+	})
+	for _, m := range matches {
+		ret = append(ret, m.repo)
+	}
+	return
+}
+
+// FindDuplicateDisplayNames 按当前界面语言解析集市索引中所有包的显示名称，返回显示名称相同的包 [显示名称][]*StageRepo，
+// 界面可以据此区分同名的包（比如在名称后面附上作者）。
+func FindDuplicateDisplayNames(packageType string) (ret map[string][]*StageRepo, err error) {
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+	ret = findDuplicateDisplayNames(stageIndex)
+	return
+}
+
+func findDuplicateDisplayNames(stageIndex *StageIndex) (ret map[string][]*StageRepo) {
+	ret = map[string][]*StageRepo{}
+	if nil == stageIndex {
+		return
+	}
+
+	for _, repo := range stageIndex.Repos {
+		if nil == repo.Package {
+			continue
+		}
+		name := strings.TrimSpace(GetPreferredName(&Package{Name: repo.Package.Name, DisplayName: repo.Package.DisplayName}))
+		if "" == name {
+			continue
+		}
+		ret[name] = append(ret[name], repo)
+	}
+	for name, repos := range ret {
+		if 2 > len(repos) {
+			delete(ret, name)
+		}
+	}
+	return
+}
+
+// NameMismatch 已安装包清单中的名称和集市中同一仓库的名称不一致，此时检查更新会匹配不到集市中的包。
+type NameMismatch struct {
+	DirName       string `json:"dirName"`
+	RepoURL       string `json:"repoURL"`
+	InstalledName string `json:"installedName"`
+	BazaarName    string `json:"bazaarName"`
+}
+
+// FindNameMismatches 查找已安装包中清单名称和集市名称（按仓库地址匹配）不一致的包，用于排查“检测不到更新”之类的反馈。
+func FindNameMismatches(packageType string) (ret []NameMismatch, err error) {
+	if "" == packageInstallDir(packageType) {
+		err = fmt.Errorf("invalid package type [%s]", packageType)
+		return
+	}
+
+	ret = findNameMismatches(installedPackages(packageType), bazaarPackages(packageType))
+	for _, mismatch := range ret {
+		logging.LogWarnf("installed %s [%s] name [%s] mismatches bazaar name [%s] of repo [%s]",
+			packageType, mismatch.DirName, mismatch.InstalledName, mismatch.BazaarName, mismatch.RepoURL)
+	}
+	return
+}
+
+// bazaarPackages 返回集市中指定类型的包。
+func bazaarPackages(packageType string) (ret []*Package) {
+	switch packageType {
+	case "plugins":
+		for _, plugin := range Plugins(currentFrontend()) {
+			ret = append(ret, plugin.Package)
+		}
+	case "widgets":
+		for _, widget := range Widgets() {
+			ret = append(ret, widget.Package)
+		}
+	case "templates":
+		for _, template := range Templates() {
+			ret = append(ret, template.Package)
+		}
+	case "themes":
+		for _, theme := range Themes() {
+			ret = append(ret, theme.Package)
+		}
+	case "icons":
+		for _, icon := range Icons() {
+			ret = append(ret, icon.Package)
+		}
+	}
+	return
+}
+
+func findNameMismatches(installed map[string]*Package, bazaarPkgs []*Package) (ret []NameMismatch) {
+	ret = []NameMismatch{}
+	for dirName, pkg := range installed {
+		for _, bazaarPkg := range bazaarPkgs {
+			if !isSameRepo(pkg.URL, bazaarPkg.URL) {
+				continue
+			}
+			if pkg.Name != bazaarPkg.Name {
+				ret = append(ret, NameMismatch{DirName: dirName, RepoURL: bazaarPkg.URL, InstalledName: pkg.Name, BazaarName: bazaarPkg.Name})
+			}
+			break
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DirName < ret[j].DirName })
+	return
+}
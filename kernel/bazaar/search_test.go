@@ -0,0 +1,274 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestRecommendPackages(t *testing.T) {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/installed@" + repoHash, Stars: 10, Package: &StagePackage{Author: "a", URL: "https://github.com/siyuan-note/installed", Version: "1.0.0", Keywords: []string{"dark", "minimal"}}},
+		{URL: "siyuan-note/popular@" + repoHash, Stars: 1000, Package: &StagePackage{Author: "b", URL: "https://github.com/siyuan-note/popular", Version: "1.0.0", Keywords: []string{"colorful"}}},
+		{URL: "siyuan-note/one@" + repoHash, Stars: 100, Package: &StagePackage{Author: "c", URL: "https://github.com/siyuan-note/one", Version: "1.0.0", Keywords: []string{"Dark"}}},
+		{URL: "siyuan-note/two@" + repoHash, Stars: 1, Package: &StagePackage{Author: "d", URL: "https://github.com/siyuan-note/two", Version: "1.0.0", Keywords: []string{"dark", "minimal"}}},
+	}}
+	installed := []*Package{{Author: "a", URL: "https://github.com/siyuan-note/installed", Version: "1.0.0", Keywords: []string{"dark", "minimal"}}}
+
+	ret := recommendPackages(installed, stageIndex, map[string]*bazaarPackage{}, 10)
+	if 2 != len(ret) || "siyuan-note/two@"+repoHash != ret[0].URL || "siyuan-note/one@"+repoHash != ret[1].URL {
+		t.Fatalf("unexpected recommendations %v", stageRepoURLs(ret))
+	}
+	if ret = recommendPackages(installed, stageIndex, map[string]*bazaarPackage{}, 1); 1 != len(ret) || "siyuan-note/two@"+repoHash != ret[0].URL {
+		t.Fatalf("expected limited recommendations, got %v", stageRepoURLs(ret))
+	}
+
+	// 冷启动时按口碑推荐
+	ret = recommendPackages(nil, stageIndex, map[string]*bazaarPackage{}, 2)
+	if 2 != len(ret) || "siyuan-note/popular@"+repoHash != ret[0].URL || "siyuan-note/one@"+repoHash != ret[1].URL {
+		t.Fatalf("unexpected cold-start recommendations %v", stageRepoURLs(ret))
+	}
+}
+
+func TestFeaturedPackages(t *testing.T) {
+	setTestStageIndex("themes", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/normal@6286912c381ef3f83e455d06ba4d369c498238dc"},
+		{URL: "siyuan-note/second@6286912c381ef3f83e455d06ba4d369c498238dc", Featured: true, FeaturedRank: 2},
+		{URL: "siyuan-note/first@6286912c381ef3f83e455d06ba4d369c498238dc", Featured: true, FeaturedRank: 1},
+	}})
+
+	featured, err := FeaturedPackages("themes")
+	if nil != err {
+		t.Fatalf("get featured packages failed: %s", err)
+	}
+	if 2 != len(featured) {
+		t.Fatalf("expected 2 featured packages, got %d", len(featured))
+	}
+	if !strings.HasPrefix(featured[0].URL, "siyuan-note/first@") || !strings.HasPrefix(featured[1].URL, "siyuan-note/second@") {
+		t.Fatalf("unexpected featured order [%s, %s]", featured[0].URL, featured[1].URL)
+	}
+}
+
+func TestVisibleStageRepos(t *testing.T) {
+	repos := []*StageRepo{
+		{URL: "siyuan-note/active@6286912c381ef3f83e455d06ba4d369c498238dc"},
+		{URL: "siyuan-note/archived@6286912c381ef3f83e455d06ba4d369c498238dc", Archived: true},
+	}
+	if visible := visibleStageRepos(repos); 2 != len(visible) {
+		t.Fatalf("expected archived repos to be shown by default, got %d repos", len(visible))
+	}
+
+	SetHideArchived(true)
+	t.Cleanup(func() { SetHideArchived(false) })
+	if visible := visibleStageRepos(repos); 1 != len(visible) || "siyuan-note/active@6286912c381ef3f83e455d06ba4d369c498238dc" != visible[0].URL {
+		t.Fatalf("expected only active repo, got %v", visible)
+	}
+}
+
+func TestIncludePrereleases(t *testing.T) {
+	t.Cleanup(func() { SetIncludePrereleases(false) })
+
+	installed := &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.0.0"}
+	latest := &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0-rc.1"}
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/a@6286912c381ef3f83e455d06ba4d369c498238dc", Size: 1024, Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0-rc.1"}},
+	}}
+
+	SetIncludePrereleases(false)
+	if !disallowDisplayBazaarPackage(latest) {
+		t.Fatalf("expected prerelease to be hidden")
+	}
+	if isOutdatedPackage(installed, latest) {
+		t.Fatalf("expected prerelease not to be an update")
+	}
+	if estimate := estimateUpdateSize([]*Package{installed}, stageIndex); 0 != estimate.Count {
+		t.Fatalf("expected no update, got %+v", estimate)
+	}
+
+	SetIncludePrereleases(true)
+	if disallowDisplayBazaarPackage(latest) {
+		t.Fatalf("expected prerelease to be shown")
+	}
+	if !isOutdatedPackage(installed, latest) {
+		t.Fatalf("expected prerelease to be an update")
+	}
+	if estimate := estimateUpdateSize([]*Package{installed}, stageIndex); 1 != estimate.Count {
+		t.Fatalf("expected one update, got %+v", estimate)
+	}
+
+	stable := &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0"}
+	SetIncludePrereleases(false)
+	if disallowDisplayBazaarPackage(stable) || !isOutdatedPackage(installed, stable) {
+		t.Fatalf("expected stable version to be unaffected")
+	}
+}
+
+func TestSearchStageRepos(t *testing.T) {
+	setTestLang(t, "en_US")
+
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/calendar-view@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "calendar-view", Description: Description{"default": "Show documents in a Calendar"}}},
+		{URL: "siyuan-note/daily-notes@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "daily-notes", Description: Description{"default": "Daily notes with a calendar sidebar"}}},
+		{URL: "siyuan-note/todo@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "todo", DisplayName: DisplayName{"default": "Calendar Todo"}, Keywords: []string{"tasks"}}},
+		{URL: "siyuan-note/kanban@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "kanban", Keywords: []string{"Calendar"}}},
+		{URL: "siyuan-note/broken@6286912c381ef3f83e455d06ba4d369c498238dc"},
+	}}
+
+	if ret := searchStageRepos(stageIndex, "  "); len(stageIndex.Repos) != len(ret) {
+		t.Fatalf("expected all repos for empty query, got %d", len(ret))
+	}
+
+	ret := searchStageRepos(stageIndex, "CALENDAR")
+	var names []string
+	for _, repo := range ret {
+		names = append(names, repo.Package.Name)
+	}
+	if "calendar-view,todo,kanban,daily-notes" != strings.Join(names, ",") {
+		t.Fatalf("unexpected search result order %v", names)
+	}
+
+	// 多个词需要全部匹配
+	if ret = searchStageRepos(stageIndex, "calendar tasks"); 1 != len(ret) || "todo" != ret[0].Package.Name {
+		t.Fatalf("expected only todo to match all terms, got %d repos", len(ret))
+	}
+	if ret = searchStageRepos(stageIndex, "calendar nothing"); 0 != len(ret) {
+		t.Fatalf("expected no repos to match, got %d", len(ret))
+	}
+}
+
+func TestSortStagePackages(t *testing.T) {
+	setTestLang(t, "en_US")
+
+	setTestBazaarIndex(map[string]*bazaarPackage{
+		"siyuan-note/alpha": {Name: "alpha", Downloads: 10},
+		"siyuan-note/beta":  {Name: "beta", Downloads: 30},
+		"siyuan-note/gamma": {Name: "gamma", Downloads: 10},
+	})
+	defer setTestBazaarIndex(map[string]*bazaarPackage{})
+
+	newRepos := func() []*StageRepo {
+		return []*StageRepo{
+			{URL: "siyuan-note/gamma@6286912c381ef3f83e455d06ba4d369c498238dc", Stars: 5, Updated: "2024-03-01", Package: &StagePackage{Name: "gamma"}},
+			{URL: "siyuan-note/delta@6286912c381ef3f83e455d06ba4d369c498238dc", Stars: 1, Updated: "not a date", Package: &StagePackage{Name: "delta"}},
+			{URL: "siyuan-note/beta@6286912c381ef3f83e455d06ba4d369c498238dc", Stars: 5, Updated: "2024-03-02T08:00:00Z", Package: &StagePackage{Name: "beta", DisplayName: DisplayName{"default": "Zeta"}}},
+			{URL: "siyuan-note/alpha@6286912c381ef3f83e455d06ba4d369c498238dc", Stars: 9, Updated: "2024-03-01", Package: &StagePackage{Name: "alpha"}},
+		}
+	}
+
+	// 主键相同时按显示名称排列，无法解析的更新时间排在最后
+	for by, expected := range map[string]string{
+		"stars":     "alpha,gamma,beta,delta",
+		"downloads": "beta,alpha,gamma,delta",
+		"updated":   "beta,alpha,gamma,delta",
+		"name":      "alpha,delta,gamma,beta",
+		"unknown":   "alpha,delta,gamma,beta",
+	} {
+		repos := newRepos()
+		SortStagePackages(repos, by)
+		var names []string
+		for _, repo := range repos {
+			names = append(names, repo.Package.Name)
+		}
+		if expected != strings.Join(names, ",") {
+			t.Fatalf("unexpected order by [%s]: %v", by, names)
+		}
+	}
+}
+
+func TestFindDuplicateDisplayNames(t *testing.T) {
+	setTestLang(t, util.Lang)
+
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "alice/note-helper@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "note-helper", DisplayName: DisplayName{"default": "Note Helper", "zh_CN": "笔记助手"}}},
+		{URL: "bob/siyuan-helper@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "siyuan-helper", DisplayName: DisplayName{"default": "SiYuan Helper", "zh_CN": "笔记助手"}}},
+		{URL: "carol/other@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Name: "other"}},
+		{URL: "dave/broken@6286912c381ef3f83e455d06ba4d369c498238dc"},
+	}}
+
+	util.Lang = "zh_CN"
+	duplicates := findDuplicateDisplayNames(stageIndex)
+	if 1 != len(duplicates) || 2 != len(duplicates["笔记助手"]) {
+		t.Fatalf("expected packages to share display name, got %v", duplicates)
+	}
+	if "alice/note-helper" != strings.Split(duplicates["笔记助手"][0].URL, "@")[0] || "bob/siyuan-helper" != strings.Split(duplicates["笔记助手"][1].URL, "@")[0] {
+		t.Fatalf("unexpected duplicate packages %v", duplicates["笔记助手"])
+	}
+
+	// 英文界面下名称不同
+	util.Lang = "en_US"
+	if duplicates = findDuplicateDisplayNames(stageIndex); 0 != len(duplicates) {
+		t.Fatalf("expected no duplicate display names, got %v", duplicates)
+	}
+}
+
+func TestFindNameMismatches(t *testing.T) {
+	installed := map[string]*Package{
+		"renamed-plugin": {Name: "renamed-plugin", URL: "https://github.com/siyuan-note/renamed-plugin"},
+		"same-plugin":    {Name: "same-plugin", URL: "https://github.com/siyuan-note/same-plugin"},
+		"local-plugin":   {Name: "local-plugin", URL: "https://github.com/siyuan-note/local-plugin"},
+	}
+	bazaarPkgs := []*Package{
+		{Name: "new-name-plugin", URL: "https://github.com/Siyuan-Note/renamed-plugin/"},
+		{Name: "same-plugin", URL: "https://github.com/siyuan-note/same-plugin"},
+	}
+
+	mismatches := findNameMismatches(installed, bazaarPkgs)
+	if 1 != len(mismatches) {
+		t.Fatalf("expected 1 name mismatch, got %+v", mismatches)
+	}
+	if mismatch := mismatches[0]; "renamed-plugin" != mismatch.DirName || "renamed-plugin" != mismatch.InstalledName || "new-name-plugin" != mismatch.BazaarName {
+		t.Fatalf("unexpected name mismatch %+v", mismatch)
+	}
+
+	// 名称不一致时检查更新匹配不到集市中的包
+	installed["renamed-plugin"].Version, bazaarPkgs[0].Version = "1.0.0", "1.1.0"
+	if isOutdatedPackage(installed["renamed-plugin"], bazaarPkgs[0]) {
+		t.Fatalf("expected name mismatch to hide the update")
+	}
+
+	if _, err := FindNameMismatches("unknown"); nil == err {
+		t.Fatalf("expected error for invalid package type")
+	}
+}
+
+func TestCheckIndexConsistency(t *testing.T) {
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/a@" + repoHash},
+		{URL: "siyuan-note/b@" + repoHash},
+		{URL: "siyuan-note/c@" + repoHash},
+	}}
+
+	ret := checkIndexConsistency("plugins", stageIndex, map[string]*bazaarPackage{
+		"siyuan-note/a": {Name: "a", Downloads: 10},
+		"siyuan-note/x": {Name: "x", Downloads: 1},
+	})
+	if ret.Consistent || 3 != ret.StagePackages || "siyuan-note/b,siyuan-note/c" != strings.Join(ret.MissingDownloads, ",") {
+		t.Fatalf("expected missing packages to be reported, got %+v", ret)
+	}
+
+	ret = checkIndexConsistency("plugins", stageIndex, map[string]*bazaarPackage{
+		"siyuan-note/a": {Name: "a"}, "siyuan-note/b": {Name: "b"}, "siyuan-note/c": {Name: "c"},
+	})
+	if !ret.Consistent || 0 != len(ret.MissingDownloads) {
+		t.Fatalf("expected indexes to be consistent, got %+v", ret)
+	}
+}
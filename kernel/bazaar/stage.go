@@ -0,0 +1,530 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/andybalholm/brotli"
+	"github.com/imroc/req/v3"
+	gcache "github.com/patrickmn/go-cache"
+	"github.com/siyuan-note/httpclient"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+// MergeStageIndexes 合并多个集市索引，比如公共集市和组织内部的私有集市。
+//
+// 按规范化后的仓库地址去重，后面的索引覆盖前面索引中的同一仓库，但保留该仓库第一次出现的位置。
+func MergeStageIndexes(indexes ...*StageIndex) (ret *StageIndex) {
+	ret = &StageIndex{Repos: []*StageRepo{}}
+	positions := map[string]int{}
+	for _, index := range indexes {
+		if nil == index {
+			continue
+		}
+
+		for _, repo := range index.Repos {
+			if nil == repo {
+				continue
+			}
+
+			key := strings.Split(repo.URL, "@")[0]
+			if normalized, ok := NormalizeRepoURL(key); ok {
+				key = normalized
+			}
+			if pos, ok := positions[key]; ok {
+				ret.Repos[pos] = repo
+				continue
+			}
+			positions[key] = len(ret.Repos)
+			ret.Repos = append(ret.Repos, repo)
+		}
+	}
+	return
+}
+
+var (
+	onlineCheckURLs     []string
+	onlineCheckURLsLock = sync.Mutex{}
+)
+
+// SetOnlineCheckURLs 设置检查集市是否可访问时探测的地址，传入空列表时恢复为默认的集市相关地址。
+func SetOnlineCheckURLs(urls []string) {
+	onlineCheckURLsLock.Lock()
+	defer onlineCheckURLsLock.Unlock()
+	onlineCheckURLs = urls
+}
+
+func getOnlineCheckURLs() []string {
+	onlineCheckURLsLock.Lock()
+	defer onlineCheckURLsLock.Unlock()
+
+	if 0 < len(onlineCheckURLs) {
+		return onlineCheckURLs
+	}
+	return []string{util.BazaarOSSServer, util.BazaarStatServer, "https://cdn.jsdelivr.net"}
+}
+
+// IsBazaarOnline 并发探测集市相关地址，任意一个可访问即认为集市可访问。
+//
+// 某些网络环境下仅个别地址被屏蔽，只探测一个地址的话会误报离线。
+func IsBazaarOnline() bool {
+	urls := getOnlineCheckURLs()
+	results := make(chan bool, len(urls))
+	for _, u := range urls {
+		go func(checkURL string) {
+			results <- util.IsOnline(checkURL, false)
+		}(u)
+	}
+
+	for range urls {
+		if <-results {
+			return true
+		}
+	}
+	return false
+}
+
+var cachedStageIndex = map[string]*StageIndex{}
+var cachedStageRepos = map[string]map[string]*StageRepo{} // [pkgType][规范化的仓库地址]*StageRepo
+var stageIndexCacheTime int64
+var stageIndexLock = sync.Mutex{}
+
+var (
+	stageIndexCacheTTL     = time.Hour
+	stageIndexCacheTTLLock = sync.Mutex{}
+)
+
+// SetStageIndexCacheTTL 设置集市索引和下载量索引的缓存有效期，默认为 1 小时，不大于 0 时不缓存，每次都重新获取。
+func SetStageIndexCacheTTL(ttl time.Duration) {
+	stageIndexCacheTTLLock.Lock()
+	defer stageIndexCacheTTLLock.Unlock()
+	stageIndexCacheTTL = ttl
+}
+
+// GetStageIndexCacheTTL 返回集市索引和下载量索引的缓存有效期。
+func GetStageIndexCacheTTL() time.Duration {
+	stageIndexCacheTTLLock.Lock()
+	defer stageIndexCacheTTLLock.Unlock()
+	return stageIndexCacheTTL
+}
+
+// isIndexCacheValid 判断在 cacheTime（Unix 秒）缓存的索引是否仍在有效期内。
+func isIndexCacheValid(cacheTime int64) bool {
+	ttl := GetStageIndexCacheTTL()
+	if 0 >= ttl {
+		return false
+	}
+	return ttl >= time.Duration(time.Now().Unix()-cacheTime)*time.Second
+}
+
+// packageTypes 集市包类型，和集市索引文件名一致
+var packageTypes = []string{"plugins", "themes", "icons", "templates", "widgets"}
+
+var ErrInvalidPackageType = errors.New("invalid package type")
+
+// GetStageIndex 返回集市索引的副本，没有缓存时获取，调用方修改返回值不会影响缓存。
+func GetStageIndex(packageType string) (ret *StageIndex, err error) {
+	if !gulu.Str.Contains(packageType, packageTypes) {
+		err = fmt.Errorf("%w [%s]", ErrInvalidPackageType, packageType)
+		return
+	}
+
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		err = fmt.Errorf("get community stage index [%s] failed: %w", packageType, err)
+		return
+	}
+	if nil == stageIndex {
+		err = fmt.Errorf("get community stage index [%s] failed", packageType)
+		return
+	}
+
+	// 通过 JSON 深拷贝，仓库中的包元数据也不会被修改
+	data, err := gulu.JSON.MarshalJSON(stageIndex)
+	if nil != err {
+		return
+	}
+	ret = &StageIndex{}
+	err = gulu.JSON.UnmarshalJSON(data, ret)
+	return
+}
+
+var stageIndexRefreshTimes = map[string]time.Time{} // [pkgType]最近一次开始获取集市索引的时间
+
+// getRhyResult 获取集市版本信息，测试时替换
+var getRhyResult = util.GetRhyResult
+
+func getStageIndex(pkgType string) (ret *StageIndex, err error) {
+	stageIndexLock.Lock()
+	if isIndexCacheValid(stageIndexCacheTime) && nil != cachedStageIndex[pkgType] {
+		ret = cachedStageIndex[pkgType]
+		stageIndexLock.Unlock()
+		return
+	}
+	stageIndexLock.Unlock()
+
+	// 额外的集市索引在锁外获取，私有集市响应慢时不会阻塞其他读取已缓存索引的调用
+	extras := fetchStageSources(pkgType)
+
+	stageIndexLock.Lock()
+	defer stageIndexLock.Unlock()
+	if isIndexCacheValid(stageIndexCacheTime) && nil != cachedStageIndex[pkgType] {
+		ret = cachedStageIndex[pkgType]
+		return
+	}
+	return loadStageIndex(pkgType, false, extras)
+}
+
+// ForceRefreshStageIndex 忽略缓存重新获取集市索引，pkgType 为空时刷新所有类型，作者刚发布的更新不需要等缓存过期就能看到。
+//
+// 并发调用时，等待锁期间如果其他调用已经开始并完成了刷新，直接使用刷新结果，不会重复请求。
+func ForceRefreshStageIndex(pkgType string) (err error) {
+	pkgTypes := []string{pkgType}
+	if "" == pkgType {
+		pkgTypes = packageTypes
+	}
+
+	requestTime := time.Now()
+	extras := map[string][]*StageIndex{}
+	for _, t := range pkgTypes {
+		extras[t] = fetchStageSources(t)
+	}
+
+	stageIndexLock.Lock()
+	defer stageIndexLock.Unlock()
+	forceRhy := true
+	for _, t := range pkgTypes {
+		if stageIndexRefreshTimes[t].After(requestTime) {
+			continue
+		}
+
+		// 集市索引的版本由版本信息中的 bazaar 哈希决定，同时刷新版本信息才能获取到最新的索引
+		if _, err = loadStageIndex(t, forceRhy, extras[t]); nil != err {
+			return fmt.Errorf("refresh community stage index [%s] failed: %w", t, err)
+		}
+		forceRhy = false
+	}
+	return
+}
+
+// loadStageIndex 获取集市索引，合并 extras 中的额外集市索引后缓存，调用方需要持有 stageIndexLock。
+//
+// 获取失败时返回错误并保留之前缓存的索引，不会用空索引覆盖缓存。
+func loadStageIndex(pkgType string, forceRhy bool, extras []*StageIndex) (ret *StageIndex, err error) {
+	start := time.Now()
+	rhyRet, err := getRhyResult(forceRhy)
+	if nil != err {
+		return
+	}
+
+	bazaarHash, _ := rhyRet["bazaar"].(string)
+	if "" == bazaarHash {
+		err = errors.New("bazaar hash is empty")
+		return
+	}
+	u := util.BazaarOSSServer + "/bazaar@" + bazaarHash + "/stage/" + pkgType + ".json"
+	if ret, err = fetchValidStageIndex(u); nil != err {
+		ret = nil
+		return
+	}
+
+	ret = mergeStageSources(ret, extras)
+	stageIndexCacheTime = start.Unix()
+	stageIndexRefreshTimes[pkgType] = start
+	setCachedStageIndex(pkgType, ret)
+	return
+}
+
+// setCachedStageIndex 缓存集市索引并同步构建按仓库地址查找的索引，调用方需要持有 stageIndexLock。
+func setCachedStageIndex(pkgType string, stageIndex *StageIndex) {
+	if nil == stageIndex {
+		delete(cachedStageIndex, pkgType)
+		delete(cachedStageRepos, pkgType)
+		return
+	}
+
+	repos := make(map[string]*StageRepo, len(stageIndex.Repos))
+	for _, repo := range stageIndex.Repos {
+		if nil != repo {
+			repos[stageRepoKey(repo.URL)] = repo
+		}
+	}
+	cachedStageIndex[pkgType] = stageIndex
+	cachedStageRepos[pkgType] = repos
+}
+
+func stageRepoKey(repoURL string) string {
+	if idx := strings.LastIndex(repoURL, "@"); 0 < idx {
+		repoURL = repoURL[:idx]
+	}
+	if normalized, ok := NormalizeRepoURL(repoURL); ok {
+		return normalized
+	}
+	return strings.ToLower(repoURL)
+}
+
+// GetStageRepo 根据仓库地址获取集市索引中的仓库，仓库转移后也可以通过原地址找到，不存在时返回 nil。
+func GetStageRepo(pkgType, repoURL string) *StageRepo {
+	if _, err := getStageIndex(pkgType); nil != err {
+		return nil
+	}
+	return lookupStageRepoCanonical(pkgType, repoURL, true)
+}
+
+// lookupStageRepoCanonical 在已缓存的集市索引中查找仓库，找不到时按仓库转移后的地址再查找一次。
+//
+// 包从旧地址安装后仓库被转移，集市索引中只有新地址，此时 README 等信息需要通过新地址获取。
+// online 为 false 时只使用别名和已缓存的转移结果，不会请求 GitHub API。
+func lookupStageRepoCanonical(pkgType, repoURL string, online bool) *StageRepo {
+	if repo := lookupStageRepo(pkgType, repoURL); nil != repo {
+		return repo
+	}
+
+	var canonical string
+	if online {
+		canonical = canonicalRepo(repoURL)
+	} else {
+		canonical, _ = cachedCanonicalRepo(repoURL)
+	}
+	if "" == canonical || stageRepoKey(repoURL) == canonical {
+		return nil
+	}
+	return lookupStageRepo(pkgType, canonical)
+}
+
+var (
+	repoAliases     = map[string]string{} // [规范化的原仓库地址]规范化的新仓库地址
+	repoAliasesLock = sync.Mutex{}
+
+	canonicalRepoCache = gcache.New(24*time.Hour, 6*time.Hour) // [规范化的仓库地址]规范化的仓库地址
+)
+
+// AddRepoAlias 添加仓库别名，仓库转移后通过原地址查找集市索引时使用新地址。
+func AddRepoAlias(oldRepoURL, newRepoURL string) {
+	oldRepo, ok1 := NormalizeRepoURL(oldRepoURL)
+	newRepo, ok2 := NormalizeRepoURL(newRepoURL)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	repoAliasesLock.Lock()
+	defer repoAliasesLock.Unlock()
+	repoAliases[oldRepo] = newRepo
+}
+
+// cachedCanonicalRepo 返回别名或者已缓存的仓库转移后的规范化地址，不会发起网络请求，都没有时 found 为 false、ret 为规范化的 repoURL。
+func cachedCanonicalRepo(repoURL string) (ret string, found bool) {
+	repo, ok := NormalizeRepoURL(strings.Split(repoURL, "@")[0])
+	if !ok {
+		return
+	}
+
+	repoAliasesLock.Lock()
+	alias := repoAliases[repo]
+	repoAliasesLock.Unlock()
+	if "" != alias {
+		return alias, true
+	}
+
+	if cached, cachedOK := canonicalRepoCache.Get(repo); cachedOK {
+		return cached.(string), true
+	}
+	return repo, false
+}
+
+// canonicalRepo 返回仓库转移后的规范化地址。
+//
+// 优先使用 AddRepoAlias 添加的别名，否则通过 GitHub API 获取（转移后的仓库会重定向到新仓库），结果按仓库缓存。
+func canonicalRepo(repoURL string) (ret string) {
+	ret, found := cachedCanonicalRepo(repoURL)
+	if "" == ret || found {
+		return
+	}
+	repo := ret
+	if _, ok := normalizeGitHubRepoURL(repo); !ok {
+		return
+	}
+
+	if err := githubAPILimiter.Wait(context.Background()); nil != err {
+		return repo
+	}
+
+	result := &struct {
+		FullName string `json:"full_name"`
+	}{}
+	u := githubAPIServer + "/repos/" + repo
+	resp, err := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(result).Get(u)
+	if nil != err {
+		// 网络错误时不缓存，下次再获取
+		logging.LogWarnf("get repo [%s] failed: %s", u, err)
+		return repo
+	}
+
+	ret = repo
+	if 200 == resp.StatusCode {
+		if fullName, fullNameOK := NormalizeRepoURL(result.FullName); fullNameOK {
+			ret = fullName
+		}
+	}
+	if ret != repo {
+		logging.LogInfof("repo [%s] has been transferred to [%s]", repo, ret)
+	}
+	canonicalRepoCache.SetDefault(repo, ret)
+	return
+}
+
+// lookupStageRepo 在已缓存的集市索引中查找仓库，不会发起网络请求。
+func lookupStageRepo(pkgType, repoURL string) *StageRepo {
+	stageIndexLock.Lock()
+	defer stageIndexLock.Unlock()
+	return cachedStageRepos[pkgType][stageRepoKey(repoURL)]
+}
+
+var (
+	stageSources     = map[string][]string{} // [pkgType][]url
+	stageSourcesLock = sync.Mutex{}
+)
+
+// AddStageSource 添加额外的集市索引地址（比如组织内部的私有集市），获取后和默认集市索引合并。
+func AddStageSource(pkgType, u string) {
+	stageSourcesLock.Lock()
+	defer stageSourcesLock.Unlock()
+
+	if gulu.Str.Contains(u, stageSources[pkgType]) {
+		return
+	}
+	stageSources[pkgType] = append(stageSources[pkgType], u)
+}
+
+// fetchStageSources 获取额外的集市索引，获取失败的索引会被跳过，不影响默认集市。
+//
+// 会发起网络请求，调用方不要持有 stageIndexLock。
+func fetchStageSources(pkgType string) (ret []*StageIndex) {
+	stageSourcesLock.Lock()
+	sources := append([]string{}, stageSources[pkgType]...)
+	stageSourcesLock.Unlock()
+
+	for _, source := range sources {
+		index, err := fetchValidStageIndex(source)
+		if nil != err {
+			logging.LogWarnf("get stage index from extra source [%s] failed: %s", source, err)
+			continue
+		}
+		ret = append(ret, index)
+	}
+	return
+}
+
+// mergeStageSources 将额外的集市索引合并到 stageIndex 后面，没有额外的集市索引时原样返回 stageIndex。
+func mergeStageSources(stageIndex *StageIndex, extras []*StageIndex) *StageIndex {
+	if 1 > len(extras) {
+		return stageIndex
+	}
+	return MergeStageIndexes(append([]*StageIndex{stageIndex}, extras...)...)
+}
+
+var ErrInvalidStageIndex = errors.New("invalid community stage index")
+
+// fetchValidStageIndex 获取集市索引并校验，校验失败时重试一次。
+//
+// OSS 偶尔会返回可以解析但内容不完整的旧对象，如果直接缓存的话一个小时内集市列表都会不完整。
+func fetchValidStageIndex(u string) (ret *StageIndex, err error) {
+	for i := 0; i < 2; i++ {
+		if ret, err = fetchStageIndex(u); nil != err {
+			return
+		}
+		if err = validateStageIndex(ret); nil == err {
+			return
+		}
+		logging.LogWarnf("validate community stage index [%s] failed: %s", u, err)
+	}
+	return
+}
+
+func validateStageIndex(stageIndex *StageIndex) error {
+	if nil == stageIndex || 1 > len(stageIndex.Repos) {
+		return fmt.Errorf("%w: no repos", ErrInvalidStageIndex)
+	}
+	for i, repo := range stageIndex.Repos {
+		if nil == repo || nil == repo.Package || !strings.Contains(repo.URL, "@") {
+			return fmt.Errorf("%w: invalid repo at [%d]", ErrInvalidStageIndex, i)
+		}
+	}
+	return nil
+}
+
+func fetchStageIndex(u string) (ret *StageIndex, err error) {
+	stageIndex := &StageIndex{}
+	resp, err := getCompressedJSON(u, stageIndex)
+	if nil != err {
+		logging.LogErrorf("get community stage index [%s] failed: %s", u, err)
+		return
+	}
+	if 200 != resp.StatusCode {
+		logging.LogErrorf("get community stage index [%s] failed: %d", u, resp.StatusCode)
+		err = errors.New("get community stage index failed: " + resp.Status)
+		return
+	}
+	ret = stageIndex
+	return
+}
+
+// getCompressedJSON 请求索引 JSON 并解析到 v。
+//
+// 显式声明支持 gzip 和 brotli 压缩，较大的集市索引可以明显减少传输量。显式设置 Accept-Encoding 后底层不会自动解压，这里按 Content-Encoding 自行解压。
+func getCompressedJSON(u string, v interface{}) (resp *req.Response, err error) {
+	resp, err = bazaarRequest(httpclient.NewBrowserRequest()).SetHeader("Accept-Encoding", "gzip, br").Get(u)
+	if nil != err || 200 != resp.StatusCode {
+		return
+	}
+
+	data, err := decodeContentEncoding(resp.GetHeader("Content-Encoding"), resp.Bytes())
+	if nil != err {
+		return
+	}
+	err = gulu.JSON.UnmarshalJSON(data, v)
+	return
+}
+
+func decodeContentEncoding(encoding string, data []byte) (ret []byte, err error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		if reader, err = gzip.NewReader(bytes.NewReader(data)); nil != err {
+			return
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(data))
+	default:
+		err = fmt.Errorf("unsupported content encoding [%s]", encoding)
+		return
+	}
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,481 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestGetStageIndex(t *testing.T) {
+	setTestStageIndex("widgets", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/widget-sample@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "0.1.0", Keywords: []string{"sample"}}},
+	}})
+	defer setTestStageIndex("widgets", nil)
+
+	stageIndex, err := GetStageIndex("widgets")
+	if nil != err || 1 != len(stageIndex.Repos) {
+		t.Fatalf("get stage index failed: %v", err)
+	}
+	stageIndex.Repos[0].Package.Version = "9.9.9"
+	stageIndex.Repos[0].Package.Keywords[0] = "mutated"
+	stageIndex.Repos = append(stageIndex.Repos, &StageRepo{URL: "siyuan-note/injected@6286912c381ef3f83e455d06ba4d369c498238dc"})
+
+	cached, _ := getStageIndex("widgets")
+	if 1 != len(cached.Repos) || "0.1.0" != cached.Repos[0].Package.Version || "sample" != cached.Repos[0].Package.Keywords[0] {
+		t.Fatalf("expected cached stage index to be untouched, got %+v", cached.Repos[0].Package)
+	}
+
+	if _, err = GetStageIndex("extensions"); !errors.Is(err, ErrInvalidPackageType) {
+		t.Fatalf("expected invalid package type error, got %v", err)
+	}
+
+	// 获取失败时返回错误，不返回空索引
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	setTestBazaarOSSServer(t, server.URL)
+	rhyResult := getRhyResult
+	getRhyResult = func(bool) (map[string]interface{}, error) {
+		return map[string]interface{}{"bazaar": "failing-test"}, nil
+	}
+	defer func() { getRhyResult = rhyResult }()
+	setTestStageIndex("widgets", nil)
+	if stageIndex, err = GetStageIndex("widgets"); nil == err || nil != stageIndex {
+		t.Fatalf("expected error for failing stage index, got %v", stageIndex)
+	}
+}
+
+func TestForceRefreshStageIndex(t *testing.T) {
+	requests, failing := atomic.Int32{}, atomic.Bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"repos":[{"url":"siyuan-note/refresh-test@6286912c381ef3f83e455d06ba4d369c498238dc","package":{"version":"0.1.0"}}]}`))
+	}))
+	defer server.Close()
+
+	rhyResult := getRhyResult
+	setTestBazaarOSSServer(t, server.URL)
+	getRhyResult = func(bool) (map[string]interface{}, error) {
+		return map[string]interface{}{"bazaar": "refresh-test"}, nil
+	}
+	defer func() {
+		getRhyResult = rhyResult
+		setTestStageIndex("plugins", nil)
+	}()
+
+	setTestStageIndex("plugins", &StageIndex{})
+	if stageIndex, err := getStageIndex("plugins"); nil != err || 0 != len(stageIndex.Repos) || 0 != requests.Load() {
+		t.Fatalf("expected cached stage index, got %d requests: %v", requests.Load(), err)
+	}
+
+	if err := ForceRefreshStageIndex("plugins"); nil != err {
+		t.Fatalf("force refresh stage index failed: %s", err)
+	}
+	if stageIndex, err := getStageIndex("plugins"); nil != err || 1 != len(stageIndex.Repos) || 1 != requests.Load() {
+		t.Fatalf("expected refreshed stage index after 1 request, got %d requests: %v", requests.Load(), err)
+	}
+
+	// 并发刷新时只请求一次
+	requests.Store(0)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			if err := ForceRefreshStageIndex("plugins"); nil != err {
+				t.Errorf("force refresh stage index failed: %s", err)
+			}
+		}()
+	}
+	waitGroup.Wait()
+	if n := requests.Load(); 1 > n || 8 <= n {
+		t.Fatalf("expected concurrent refreshes to be coalesced, got %d requests", n)
+	}
+
+	// 获取失败时返回错误并保留之前的缓存
+	failing.Store(true)
+	if err := ForceRefreshStageIndex("plugins"); nil == err {
+		t.Fatalf("expected refresh error for failing server")
+	}
+	if stageIndex, err := getStageIndex("plugins"); nil != err || 1 != len(stageIndex.Repos) {
+		t.Fatalf("expected previous stage index to be kept, got %v", err)
+	}
+}
+
+func TestStageIndexCacheTTL(t *testing.T) {
+	stageRequests, statRequests := atomic.Int32{}, atomic.Int32{}
+	ossServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stageRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"repos":[{"url":"siyuan-note/ttl-test@6286912c381ef3f83e455d06ba4d369c498238dc","package":{"version":"0.1.0"}}]}`))
+	}))
+	defer ossServer.Close()
+	statServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"siyuan-note/ttl-test": {"name": "ttl-test", "downloads": 1}}`))
+	}))
+	defer statServer.Close()
+
+	rhyResult := getRhyResult
+	setTestBazaarOSSServer(t, ossServer.URL)
+	setTestBazaarStatServer(t, statServer.URL)
+	getRhyResult = func(bool) (map[string]interface{}, error) {
+		return map[string]interface{}{"bazaar": "ttl-test"}, nil
+	}
+	defer func() {
+		getRhyResult = rhyResult
+		SetStageIndexCacheTTL(time.Hour)
+		setTestStageIndex("plugins", nil)
+		setTestBazaarIndex(map[string]*bazaarPackage{})
+	}()
+
+	SetStageIndexCacheTTL(time.Second)
+	if time.Second != GetStageIndexCacheTTL() {
+		t.Fatalf("expected cache TTL [1s], got [%s]", GetStageIndexCacheTTL())
+	}
+	setTestStageIndex("plugins", &StageIndex{})
+	setTestBazaarIndex(map[string]*bazaarPackage{})
+	if stageIndex, _ := getStageIndex("plugins"); 0 != len(stageIndex.Repos) || 0 != stageRequests.Load() {
+		t.Fatalf("expected cached stage index, got %d requests", stageRequests.Load())
+	}
+	if getBazaarIndex(); 0 != statRequests.Load() {
+		t.Fatalf("expected cached bazaar index, got %d requests", statRequests.Load())
+	}
+
+	// 模拟缓存过期
+	stageIndexLock.Lock()
+	stageIndexCacheTime -= 2
+	stageIndexLock.Unlock()
+	bazaarIndexLock.Lock()
+	bazaarIndexCacheTime -= 2
+	bazaarIndexLock.Unlock()
+	if stageIndex, _ := getStageIndex("plugins"); 1 != len(stageIndex.Repos) || 1 != stageRequests.Load() {
+		t.Fatalf("expected stage index to be refetched after expiry, got %d requests", stageRequests.Load())
+	}
+	if bazaarIndex := getBazaarIndex(); 1 != len(bazaarIndex) || 1 != statRequests.Load() {
+		t.Fatalf("expected bazaar index to be refetched after expiry, got %d requests", statRequests.Load())
+	}
+
+	// 有效期不大于 0 时不缓存
+	SetStageIndexCacheTTL(0)
+	getStageIndex("plugins")
+	getBazaarIndex()
+	if 2 != stageRequests.Load() || 2 != statRequests.Load() {
+		t.Fatalf("expected caching to be disabled, got %d stage and %d stat requests", stageRequests.Load(), statRequests.Load())
+	}
+}
+
+func TestFetchCompressedStageIndex(t *testing.T) {
+	const index = `{"repos":[{"url":"siyuan-note/plugin-sample@6286912c381ef3f83e455d06ba4d369c498238dc","stars":10,"package":{"author":"siyuan","version":"0.1.0"}}]}`
+	var acceptEncodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncodings = append(acceptEncodings, r.Header.Get("Accept-Encoding"))
+		buf := &bytes.Buffer{}
+		switch r.URL.Path {
+		case "/gzip.json":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(buf)
+			zw.Write([]byte(index))
+			zw.Close()
+		case "/br.json":
+			w.Header().Set("Content-Encoding", "br")
+			bw := brotli.NewWriter(buf)
+			bw.Write([]byte(index))
+			bw.Close()
+		default:
+			buf.WriteString(index)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	plain, err := fetchStageIndex(server.URL + "/plain.json")
+	if nil != err {
+		t.Fatalf("fetch plain stage index failed: %s", err)
+	}
+	for _, name := range []string{"gzip", "br"} {
+		decoded, fetchErr := fetchStageIndex(server.URL + "/" + name + ".json")
+		if nil != fetchErr {
+			t.Fatalf("fetch %s stage index failed: %s", name, fetchErr)
+		}
+		if 1 != len(decoded.Repos) || plain.Repos[0].URL != decoded.Repos[0].URL || plain.Repos[0].Stars != decoded.Repos[0].Stars ||
+			plain.Repos[0].Package.Version != decoded.Repos[0].Package.Version {
+			t.Fatalf("%s stage index decoded differently %+v", name, decoded.Repos)
+		}
+	}
+	for _, acceptEncoding := range acceptEncodings {
+		if "gzip, br" != acceptEncoding {
+			t.Fatalf("unexpected Accept-Encoding [%s]", acceptEncoding)
+		}
+	}
+}
+
+func TestFetchValidStageIndex(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if "/valid-on-retry.json" == r.URL.Path && 1 < requests {
+			w.Write([]byte(`{"repos":[{"url":"siyuan-note/test@6286912c381ef3f83e455d06ba4d369c498238dc","package":{"version":"1.0.0"}}]}`))
+			return
+		}
+		w.Write([]byte(`{"repos":[]}`))
+	}))
+	defer server.Close()
+
+	if _, err := fetchValidStageIndex(server.URL + "/empty.json"); !errors.Is(err, ErrInvalidStageIndex) {
+		t.Fatalf("expected invalid stage index error, got %v", err)
+	}
+	if 2 != requests {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+
+	requests = 0
+	stageIndex, err := fetchValidStageIndex(server.URL + "/valid-on-retry.json")
+	if nil != err {
+		t.Fatalf("fetch stage index failed: %s", err)
+	}
+	if 2 != requests || 1 != len(stageIndex.Repos) {
+		t.Fatalf("expected a valid stage index after retry, got %d requests and %d repos", requests, len(stageIndex.Repos))
+	}
+}
+
+func TestIsBazaarOnline(t *testing.T) {
+	t.Cleanup(func() { SetOnlineCheckURLs(nil) })
+
+	offline := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	offline.Close()
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer online.Close()
+
+	SetOnlineCheckURLs([]string{offline.URL, online.URL})
+	if !IsBazaarOnline() {
+		t.Fatalf("expected bazaar to be online when a secondary host is reachable")
+	}
+
+	SetOnlineCheckURLs(nil)
+	if urls := getOnlineCheckURLs(); 1 > len(urls) || util.BazaarOSSServer != urls[0] {
+		t.Fatalf("expected default check URLs, got %v", urls)
+	}
+}
+
+func TestMergeStageIndexes(t *testing.T) {
+	public := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/a@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "1.0.0"}},
+		{URL: "siyuan-note/b@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "1.0.0"}},
+	}}
+	private := &StageIndex{Repos: []*StageRepo{
+		{URL: "Siyuan-Note/A@c9f9e4e7f2b1c1d3a0e5f6a7b8c9d0e1f2a3b4c5", Package: &StagePackage{Version: "1.1.0"}},
+		{URL: "internal/c@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "0.1.0"}},
+	}}
+
+	merged := MergeStageIndexes(public, nil, private)
+	if 3 != len(merged.Repos) {
+		t.Fatalf("expected 3 repos, got %d", len(merged.Repos))
+	}
+	if "1.1.0" != merged.Repos[0].Package.Version || "Siyuan-Note/A@c9f9e4e7f2b1c1d3a0e5f6a7b8c9d0e1f2a3b4c5" != merged.Repos[0].URL {
+		t.Fatalf("expected private repo to override public one in place, got %+v", merged.Repos[0])
+	}
+	if "siyuan-note/b@6286912c381ef3f83e455d06ba4d369c498238dc" != merged.Repos[1].URL || "internal/c@6286912c381ef3f83e455d06ba4d369c498238dc" != merged.Repos[2].URL {
+		t.Fatalf("expected public first then private order, got [%s, %s]", merged.Repos[1].URL, merged.Repos[2].URL)
+	}
+
+	// 调换顺序即可让公共集市优先
+	if merged = MergeStageIndexes(private, public); "1.0.0" != merged.Repos[0].Package.Version {
+		t.Fatalf("expected public repo to win when merged last, got %+v", merged.Repos[0])
+	}
+	if 2 != len(public.Repos) || 2 != len(private.Repos) {
+		t.Fatalf("expected input indexes to be left untouched")
+	}
+}
+
+func TestAddStageSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/private.json" != r.URL.Path {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"repos":[{"url":"internal/private@6286912c381ef3f83e455d06ba4d369c498238dc","package":{"version":"0.1.0"}}]}`))
+	}))
+	defer server.Close()
+	defer func() {
+		stageSourcesLock.Lock()
+		delete(stageSources, "plugins")
+		stageSourcesLock.Unlock()
+	}()
+
+	AddStageSource("plugins", server.URL+"/broken.json")
+	AddStageSource("plugins", server.URL+"/private.json")
+	AddStageSource("plugins", server.URL+"/private.json")
+
+	public := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/public@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "1.0.0"}},
+	}}
+	merged := mergeStageSources(public, fetchStageSources("plugins"))
+	if 2 != len(merged.Repos) {
+		t.Fatalf("expected 2 repos, got %d", len(merged.Repos))
+	}
+	if "siyuan-note/public@6286912c381ef3f83e455d06ba4d369c498238dc" != merged.Repos[0].URL || "internal/private@6286912c381ef3f83e455d06ba4d369c498238dc" != merged.Repos[1].URL {
+		t.Fatalf("unexpected merged repos [%s, %s]", merged.Repos[0].URL, merged.Repos[1].URL)
+	}
+
+	if merged = mergeStageSources(public, fetchStageSources("themes")); public != merged {
+		t.Fatalf("expected stage index without extra sources to be returned as is")
+	}
+}
+
+func TestStageSourcesFetchedOutsideLock(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	sourceServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"repos":[{"url":"internal/private@6286912c381ef3f83e455d06ba4d369c498238dc","package":{"version":"0.1.0"}}]}`))
+	}))
+	defer sourceServer.Close()
+	ossServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"repos":[{"url":"siyuan-note/public@6286912c381ef3f83e455d06ba4d369c498238dc","package":{"version":"1.0.0"}}]}`))
+	}))
+	defer ossServer.Close()
+
+	rhyResult := getRhyResult
+	setTestBazaarOSSServer(t, ossServer.URL)
+	getRhyResult = func(bool) (map[string]interface{}, error) {
+		return map[string]interface{}{"bazaar": "source-test"}, nil
+	}
+	AddStageSource("plugins", sourceServer.URL+"/private.json")
+	setTestStageIndex("plugins", nil)
+	setTestStageIndex("widgets", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/widget-sample@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "0.1.0"}},
+	}})
+	defer func() {
+		getRhyResult = rhyResult
+		stageSourcesLock.Lock()
+		delete(stageSources, "plugins")
+		stageSourcesLock.Unlock()
+		setTestStageIndex("plugins", nil)
+		setTestStageIndex("widgets", nil)
+	}()
+
+	result := make(chan *StageIndex, 1)
+	go func() {
+		stageIndex, _ := getStageIndex("plugins")
+		result <- stageIndex
+	}()
+
+	// 获取额外的集市索引期间，读取已缓存的索引不会被阻塞
+	<-started
+	found := make(chan *StageRepo, 1)
+	go func() { found <- lookupStageRepo("widgets", "https://github.com/siyuan-note/widget-sample") }()
+	select {
+	case repo := <-found:
+		if nil == repo {
+			t.Fatalf("expected cached widget repo")
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("expected cached stage index lookup not to wait for extra sources")
+	}
+
+	close(release)
+	if stageIndex := <-result; nil == stageIndex || 2 != len(stageIndex.Repos) {
+		t.Fatalf("expected merged stage index, got %+v", stageIndex)
+	}
+}
+
+func newTestLargeStageIndex(count int) *StageIndex {
+	stageIndex := &StageIndex{}
+	for i := 0; i < count; i++ {
+		stageIndex.Repos = append(stageIndex.Repos, &StageRepo{
+			URL:     fmt.Sprintf("siyuan-note/package-%d@6286912c381ef3f83e455d06ba4d369c498238dc", i),
+			Package: &StagePackage{Version: "1.0.0"},
+		})
+	}
+	return stageIndex
+}
+
+func TestGetStageRepo(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(apiServer.Close)
+	setTestGitHubAPIServer(t, apiServer.URL)
+
+	setTestStageIndex("plugins", newTestLargeStageIndex(100))
+
+	repo := GetStageRepo("plugins", "https://github.com/Siyuan-Note/Package-42")
+	if nil == repo || "siyuan-note/package-42@6286912c381ef3f83e455d06ba4d369c498238dc" != repo.URL {
+		t.Fatalf("unexpected repo %+v", repo)
+	}
+	if repo = GetStageRepo("plugins", "siyuan-note/package-100"); nil != repo {
+		t.Fatalf("expected no repo, got %+v", repo)
+	}
+
+	// 刷新后保持一致
+	setTestStageIndex("plugins", &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/package-100@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Version: "1.0.0"}},
+	}})
+	if nil == GetStageRepo("plugins", "siyuan-note/package-100") || nil != GetStageRepo("plugins", "siyuan-note/package-42") {
+		t.Fatalf("expected lookup index to be rebuilt on refresh")
+	}
+}
+
+func BenchmarkStageRepoLinearScan(b *testing.B) {
+	stageIndex := newTestLargeStageIndex(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, repo := range stageIndex.Repos {
+			if isSameRepo(strings.Split(repo.URL, "@")[0], "https://github.com/siyuan-note/package-4999") {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkStageRepoMapLookup(b *testing.B) {
+	setTestStageIndex("plugins", newTestLargeStageIndex(5000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if nil == lookupStageRepo("plugins", "https://github.com/siyuan-note/package-4999") {
+			b.Fatalf("repo not found")
+		}
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/88250/go-humanize"
 	"github.com/panjf2000/ants/v2"
 	"github.com/siyuan-note/httpclient"
 	"github.com/siyuan-note/logging"
@@ -38,6 +37,7 @@ type Template struct {
 func Templates() (templates []*Template) {
 	templates = []*Template{}
 
+	generation := getPackageCacheGeneration()
 	stageIndex, err := getStageIndex("templates")
 	if nil != err {
 		return
@@ -51,7 +51,7 @@ func Templates() (templates []*Template) {
 		repo := arg.(*StageRepo)
 		repoURL := repo.URL
 
-		if pkg, found := packageCache.Get(repoURL); found {
+		if pkg, found := packageCache.Get(packageCacheKey("templates", repoURL)); found {
 			lock.Lock()
 			templates = append(templates, pkg.(*Template))
 			lock.Unlock()
@@ -59,8 +59,8 @@ func Templates() (templates []*Template) {
 		}
 
 		template := &Template{}
-		innerU := util.BazaarOSSServer + "/package/" + repoURL + "/template.json"
-		innerResp, innerErr := httpclient.NewBrowserRequest().SetSuccessResult(template).Get(innerU)
+		innerU := packageURL(repoURL, "template.json")
+		innerResp, innerErr := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(template).Get(innerU)
 		if nil != innerErr {
 			logging.LogErrorf("get community template [%s] failed: %s", repoURL, innerErr)
 			return
@@ -76,35 +76,40 @@ func Templates() (templates []*Template) {
 
 		template.URL = strings.TrimSuffix(template.URL, "/")
 		repoURLHash := strings.Split(repoURL, "@")
-		template.RepoURL = "https://github.com/" + repoURLHash[0]
+		template.RepoURL = repoWebURL(repoURLHash[0])
 		template.RepoHash = repoURLHash[1]
-		template.PreviewURL = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageslim"
-		template.PreviewURLThumb = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageView2/2/w/436/h/232"
-		template.IconURL = util.BazaarOSSServer + "/package/" + repoURL + "/icon.png"
+		template.PreviewURL = packageURL(repoURL, "preview.png?imageslim")
+		template.PreviewURLThumb = packageURL(repoURL, "preview.png?imageView2/2/w/436/h/232")
+		template.ScreenshotURLs, template.ScreenshotURLThumbs = getScreenshotURLs(template.Package, packageURL(repoURL), true)
+		template.IconURL = packageURL(repoURL, "icon.png")
 		template.Funding = repo.Package.Funding
-		template.PreferredFunding = getPreferredFunding(template.Funding)
-		template.PreferredName = GetPreferredName(template.Package)
-		template.PreferredDesc = getPreferredDesc(template.Description)
+		if 0 == len(template.Previews) {
+			template.Previews = repo.Package.Previews
+		}
+		template.ResolvePreferred()
 		template.Updated = repo.Updated
 		template.Stars = repo.Stars
 		template.OpenIssues = repo.OpenIssues
+		template.Featured = repo.Featured
+		template.Archived = repo.Archived
+		template.FeaturedRank = repo.FeaturedRank
+		template.License = repo.Package.License
+		template.Deprecated, template.Replacement = getDeprecation(repo.Package)
 		template.Size = repo.Size
-		template.HSize = humanize.BytesCustomCeil(uint64(template.Size), 2)
 		template.InstallSize = repo.InstallSize
-		template.HInstallSize = humanize.BytesCustomCeil(uint64(template.InstallSize), 2)
-		packageInstallSizeCache.SetDefault(template.RepoURL, template.InstallSize)
-		template.HUpdated = formatUpdated(template.Updated)
+		cacheStageInstallSize(template.RepoURL, template.RepoHash, template.InstallSize)
 		pkg := bazaarIndex[strings.Split(repoURL, "@")[0]]
 		if nil != pkg {
 			template.Downloads = pkg.Downloads
 		}
+		template.ComputeHumanSizes()
 		lock.Lock()
 		templates = append(templates, template)
 		lock.Unlock()
 
-		packageCache.SetDefault(repoURL, template)
+		setPackageCache(packageCacheKey("templates", repoURL), template, generation)
 	})
-	for _, repo := range stageIndex.Repos {
+	for _, repo := range visibleStageRepos(stageIndex.Repos) {
 		waitGroup.Add(1)
 		p.Invoke(repo)
 	}
@@ -132,6 +137,7 @@ func InstalledTemplates() (ret []*Template) {
 	}
 
 	bazaarTemplates := Templates()
+	stageIndex, _ := getStageIndex("templates")
 
 	for _, templateDir := range templateDirs {
 		if !util.IsDirRegularOrSymlink(templateDir) {
@@ -150,16 +156,15 @@ func InstalledTemplates() (ret []*Template) {
 		template.RepoURL = template.URL
 		template.PreviewURL = "/templates/" + dirName + "/preview.png"
 		template.PreviewURLThumb = "/templates/" + dirName + "/preview.png"
+		template.ScreenshotURLs, template.ScreenshotURLThumbs = getScreenshotURLs(template.Package, "/templates/"+dirName, false)
 		template.IconURL = "/templates/" + dirName + "/icon.png"
-		template.PreferredFunding = getPreferredFunding(template.Funding)
-		template.PreferredName = GetPreferredName(template.Package)
-		template.PreferredDesc = getPreferredDesc(template.Description)
+		template.ResolvePreferred()
 		info, statErr := os.Stat(filepath.Join(installPath, "README.md"))
 		if nil != statErr {
 			logging.LogWarnf("stat install theme README.md failed: %s", statErr)
 			continue
 		}
-		template.HInstallDate = info.ModTime().Format("2006-01-02")
+		template.InstallDate = info.ModTime().UnixMilli()
 		if installSize, ok := packageInstallSizeCache.Get(template.RepoURL); ok {
 			template.InstallSize = installSize.(int64)
 		} else {
@@ -167,7 +172,7 @@ func InstalledTemplates() (ret []*Template) {
 			template.InstallSize = is
 			packageInstallSizeCache.SetDefault(template.RepoURL, is)
 		}
-		template.HInstallSize = humanize.BytesCustomCeil(uint64(template.InstallSize), 2)
+		template.ComputeHumanSizes()
 		readmeFilename := getPreferredReadme(template.Readme)
 		readme, readErr := os.ReadFile(filepath.Join(installPath, readmeFilename))
 		if nil != readErr {
@@ -177,18 +182,19 @@ func InstalledTemplates() (ret []*Template) {
 
 		template.PreferredReadme, _ = renderREADME(template.URL, readme)
 		template.Outdated = isOutdatedTemplate(template, bazaarTemplates)
+		if !template.Outdated {
+			template.UpdateBlockedByAppVersion = updateBlockedByAppVersion(template.Package, stageIndex)
+		}
+		template.Deprecated, template.Replacement = getInstalledDeprecation("templates", template.Package)
 		ret = append(ret, template)
 	}
 	return
 }
 
+// InstallTemplate 安装模板，目录名使用 CanonicalInstallDir 的返回值，installPath 只决定安装到哪个目录下，为空时使用默认的模板目录。
 func InstallTemplate(repoURL, repoHash, installPath string, systemID string) error {
-	repoURLHash := repoURL + "@" + repoHash
-	data, err := downloadPackage(repoURLHash, true, systemID)
-	if nil != err {
-		return err
-	}
-	return installPackage(data, installPath, repoURLHash)
+	_, err := installBazaarPackage("templates", repoURL, repoHash, installPath, systemID, false)
+	return err
 }
 
 func UninstallTemplate(installPath string) error {
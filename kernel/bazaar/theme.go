@@ -23,7 +23,7 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/88250/go-humanize"
+	"github.com/88250/gulu"
 	ants "github.com/panjf2000/ants/v2"
 	"github.com/siyuan-note/httpclient"
 	"github.com/siyuan-note/logging"
@@ -36,9 +36,46 @@ type Theme struct {
 	Modes []string `json:"modes"`
 }
 
+// ThemeModes 返回主题支持的外观模式（dark 和/或 light），没有声明有效模式时视为两者都支持。
+func ThemeModes(theme *Theme) (ret []string) {
+	if ret = DeclaredThemeModes(theme); 1 > len(ret) {
+		ret = []string{"light", "dark"}
+	}
+	return
+}
+
+// DeclaredThemeModes 返回主题声明的有效外观模式（dark 和/或 light），没有声明时返回空。
+//
+// 加载已安装主题时使用，没有声明外观模式的主题不会出现在外观设置的主题列表中。
+func DeclaredThemeModes(theme *Theme) (ret []string) {
+	if nil == theme {
+		return
+	}
+	for _, mode := range theme.Modes {
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if ("dark" == mode || "light" == mode) && !gulu.Str.Contains(mode, ret) {
+			ret = append(ret, mode)
+		}
+	}
+	return
+}
+
+// FilterThemesByMode 过滤出支持外观模式 mode（dark 或 light）的主题。
+func FilterThemesByMode(themes []*Theme, mode string) (ret []*Theme) {
+	ret = []*Theme{}
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	for _, theme := range themes {
+		if gulu.Str.Contains(mode, ThemeModes(theme)) {
+			ret = append(ret, theme)
+		}
+	}
+	return
+}
+
 func Themes() (ret []*Theme) {
 	ret = []*Theme{}
 
+	generation := getPackageCacheGeneration()
 	stageIndex, err := getStageIndex("themes")
 	if nil != err {
 		return
@@ -52,7 +89,7 @@ func Themes() (ret []*Theme) {
 		repo := arg.(*StageRepo)
 		repoURL := repo.URL
 
-		if pkg, found := packageCache.Get(repoURL); found {
+		if pkg, found := packageCache.Get(packageCacheKey("themes", repoURL)); found {
 			lock.Lock()
 			ret = append(ret, pkg.(*Theme))
 			lock.Unlock()
@@ -60,8 +97,8 @@ func Themes() (ret []*Theme) {
 		}
 
 		theme := &Theme{}
-		innerU := util.BazaarOSSServer + "/package/" + repoURL + "/theme.json"
-		innerResp, innerErr := httpclient.NewBrowserRequest().SetSuccessResult(theme).Get(innerU)
+		innerU := packageURL(repoURL, "theme.json")
+		innerResp, innerErr := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(theme).Get(innerU)
 		if nil != innerErr {
 			logging.LogErrorf("get bazaar package [%s] failed: %s", innerU, innerErr)
 			return
@@ -77,35 +114,40 @@ func Themes() (ret []*Theme) {
 
 		theme.URL = strings.TrimSuffix(theme.URL, "/")
 		repoURLHash := strings.Split(repoURL, "@")
-		theme.RepoURL = "https://github.com/" + repoURLHash[0]
+		theme.RepoURL = repoWebURL(repoURLHash[0])
 		theme.RepoHash = repoURLHash[1]
-		theme.PreviewURL = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageslim"
-		theme.PreviewURLThumb = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageView2/2/w/436/h/232"
-		theme.IconURL = util.BazaarOSSServer + "/package/" + repoURL + "/icon.png"
+		theme.PreviewURL = packageURL(repoURL, "preview.png?imageslim")
+		theme.PreviewURLThumb = packageURL(repoURL, "preview.png?imageView2/2/w/436/h/232")
+		theme.ScreenshotURLs, theme.ScreenshotURLThumbs = getScreenshotURLs(theme.Package, packageURL(repoURL), true)
+		theme.IconURL = packageURL(repoURL, "icon.png")
 		theme.Funding = repo.Package.Funding
-		theme.PreferredFunding = getPreferredFunding(theme.Funding)
-		theme.PreferredName = GetPreferredName(theme.Package)
-		theme.PreferredDesc = getPreferredDesc(theme.Description)
+		if 0 == len(theme.Previews) {
+			theme.Previews = repo.Package.Previews
+		}
+		theme.ResolvePreferred()
 		theme.Updated = repo.Updated
 		theme.Stars = repo.Stars
 		theme.OpenIssues = repo.OpenIssues
+		theme.Featured = repo.Featured
+		theme.Archived = repo.Archived
+		theme.FeaturedRank = repo.FeaturedRank
+		theme.License = repo.Package.License
+		theme.Deprecated, theme.Replacement = getDeprecation(repo.Package)
 		theme.Size = repo.Size
-		theme.HSize = humanize.BytesCustomCeil(uint64(theme.Size), 2)
 		theme.InstallSize = repo.InstallSize
-		theme.HInstallSize = humanize.BytesCustomCeil(uint64(theme.InstallSize), 2)
-		packageInstallSizeCache.SetDefault(theme.RepoURL, theme.InstallSize)
-		theme.HUpdated = formatUpdated(theme.Updated)
+		cacheStageInstallSize(theme.RepoURL, theme.RepoHash, theme.InstallSize)
 		pkg := bazaarIndex[strings.Split(repoURL, "@")[0]]
 		if nil != pkg {
 			theme.Downloads = pkg.Downloads
 		}
+		theme.ComputeHumanSizes()
 		lock.Lock()
 		ret = append(ret, theme)
 		lock.Unlock()
 
-		packageCache.SetDefault(repoURL, theme)
+		setPackageCache(packageCacheKey("themes", repoURL), theme, generation)
 	})
-	for _, repo := range stageIndex.Repos {
+	for _, repo := range visibleStageRepos(stageIndex.Repos) {
 		waitGroup.Add(1)
 		p.Invoke(repo)
 	}
@@ -130,6 +172,7 @@ func InstalledThemes() (ret []*Theme) {
 	}
 
 	bazaarThemes := Themes()
+	stageIndex, _ := getStageIndex("themes")
 
 	for _, themeDir := range themeDirs {
 		if !util.IsDirRegularOrSymlink(themeDir) {
@@ -151,16 +194,15 @@ func InstalledThemes() (ret []*Theme) {
 		theme.RepoURL = theme.URL
 		theme.PreviewURL = "/appearance/themes/" + dirName + "/preview.png"
 		theme.PreviewURLThumb = "/appearance/themes/" + dirName + "/preview.png"
+		theme.ScreenshotURLs, theme.ScreenshotURLThumbs = getScreenshotURLs(theme.Package, "/appearance/themes/"+dirName, false)
 		theme.IconURL = "/appearance/themes/" + dirName + "/icon.png"
-		theme.PreferredFunding = getPreferredFunding(theme.Funding)
-		theme.PreferredName = GetPreferredName(theme.Package)
-		theme.PreferredDesc = getPreferredDesc(theme.Description)
+		theme.ResolvePreferred()
 		info, statErr := os.Stat(filepath.Join(installPath, "README.md"))
 		if nil != statErr {
 			logging.LogWarnf("stat install theme README.md failed: %s", statErr)
 			continue
 		}
-		theme.HInstallDate = info.ModTime().Format("2006-01-02")
+		theme.InstallDate = info.ModTime().UnixMilli()
 		if installSize, ok := packageInstallSizeCache.Get(theme.RepoURL); ok {
 			theme.InstallSize = installSize.(int64)
 		} else {
@@ -168,7 +210,7 @@ func InstalledThemes() (ret []*Theme) {
 			theme.InstallSize = is
 			packageInstallSizeCache.SetDefault(theme.RepoURL, is)
 		}
-		theme.HInstallSize = humanize.BytesCustomCeil(uint64(theme.InstallSize), 2)
+		theme.ComputeHumanSizes()
 		readmeFilename := getPreferredReadme(theme.Readme)
 		readme, readErr := os.ReadFile(filepath.Join(installPath, readmeFilename))
 		if nil != readErr {
@@ -178,6 +220,10 @@ func InstalledThemes() (ret []*Theme) {
 
 		theme.PreferredReadme, _ = renderREADME(theme.URL, readme)
 		theme.Outdated = isOutdatedTheme(theme, bazaarThemes)
+		if !theme.Outdated {
+			theme.UpdateBlockedByAppVersion = updateBlockedByAppVersion(theme.Package, stageIndex)
+		}
+		theme.Deprecated, theme.Replacement = getInstalledDeprecation("themes", theme.Package)
 		ret = append(ret, theme)
 	}
 	return
@@ -187,13 +233,10 @@ func isBuiltInTheme(dirName string) bool {
 	return "daylight" == dirName || "midnight" == dirName
 }
 
+// InstallTheme 安装主题，目录名使用 CanonicalInstallDir 的返回值，installPath 只决定安装到哪个目录下，为空时使用默认的主题目录。
 func InstallTheme(repoURL, repoHash, installPath string, systemID string) error {
-	repoURLHash := repoURL + "@" + repoHash
-	data, err := downloadPackage(repoURLHash, true, systemID)
-	if nil != err {
-		return err
-	}
-	return installPackage(data, installPath, repoURLHash)
+	_, err := installBazaarPackage("themes", repoURL, repoHash, installPath, systemID, false)
+	return err
 }
 
 func UninstallTheme(installPath string) error {
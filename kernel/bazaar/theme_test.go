@@ -0,0 +1,57 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestThemeModes(t *testing.T) {
+	dark := &Theme{Package: &Package{Name: "dark"}, Modes: []string{"dark"}}
+	both := &Theme{Package: &Package{Name: "both"}, Modes: []string{"light", "Dark"}}
+	unspecified := &Theme{Package: &Package{Name: "unspecified"}}
+
+	if modes := ThemeModes(dark); "dark" != strings.Join(modes, ",") {
+		t.Fatalf("expected dark-only theme, got %v", modes)
+	}
+	if modes := ThemeModes(both); "light,dark" != strings.Join(modes, ",") {
+		t.Fatalf("expected both modes, got %v", modes)
+	}
+	if modes := ThemeModes(unspecified); "light,dark" != strings.Join(modes, ",") {
+		t.Fatalf("expected both modes for unspecified theme, got %v", modes)
+	}
+
+	// 加载已安装主题时只使用声明的模式，没有声明的主题不加入外观设置的主题列表
+	if modes := DeclaredThemeModes(both); "light,dark" != strings.Join(modes, ",") {
+		t.Fatalf("expected declared modes, got %v", modes)
+	}
+	if modes := DeclaredThemeModes(unspecified); 0 != len(modes) {
+		t.Fatalf("expected no declared modes for unspecified theme, got %v", modes)
+	}
+
+	themes := []*Theme{dark, both, unspecified}
+	if ret := FilterThemesByMode(themes, "dark"); 3 != len(ret) {
+		t.Fatalf("expected all themes to support dark mode, got %d", len(ret))
+	}
+	if ret := FilterThemesByMode(themes, "light"); 2 != len(ret) || "both" != ret[0].Name || "unspecified" != ret[1].Name {
+		t.Fatalf("unexpected light themes %+v", ret)
+	}
+	if ret := FilterThemesByMode(themes, "sepia"); 0 != len(ret) {
+		t.Fatalf("expected no themes for unknown mode, got %d", len(ret))
+	}
+}
@@ -0,0 +1,93 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrUntrustedAuthor 表示集市包的作者不在信任列表中。
+var ErrUntrustedAuthor = errors.New("untrusted package author")
+
+var (
+	trustedAuthors     = map[string]bool{}
+	trustedAuthorsLock = sync.Mutex{}
+)
+
+// SetTrustedAuthors 设置信任的集市包作者（仓库所有者，不区分大小写），设置后仅允许安装这些仓库所有者的包，为空时允许所有作者。
+//
+// 包清单中的 author 由作者自行填写，可以随意冒充，所以只根据仓库地址中的所有者判断。
+func SetTrustedAuthors(authors []string) {
+	trustedAuthorsLock.Lock()
+	defer trustedAuthorsLock.Unlock()
+
+	trustedAuthors = map[string]bool{}
+	for _, author := range authors {
+		if author = strings.ToLower(strings.TrimSpace(author)); "" != author {
+			trustedAuthors[author] = true
+		}
+	}
+}
+
+// IsTrustedAuthor 判断集市包的仓库所有者是否在信任列表中，未设置信任列表时总是返回 true。
+func IsTrustedAuthor(repoURL string) bool {
+	trustedAuthorsLock.Lock()
+	defer trustedAuthorsLock.Unlock()
+
+	if 1 > len(trustedAuthors) {
+		return true
+	}
+	if _, owner, _, ok := parseRepoOwnerName(repoURL); ok {
+		return trustedAuthors[strings.ToLower(owner)]
+	}
+	return false
+}
+
+// FilterByTrustedAuthors 过滤出信任作者的集市包，未设置信任列表时返回所有包。
+func FilterByTrustedAuthors(repos []*StageRepo) (ret []*StageRepo) {
+	ret = []*StageRepo{}
+	for _, repo := range repos {
+		if IsTrustedAuthor(strings.Split(repo.URL, "@")[0]) {
+			ret = append(ret, repo)
+		}
+	}
+	return
+}
+
+// LicenseUnknown 表示未声明许可证的集市包，可以放在 FilterByLicense 的 allowed 中以包含这些包。
+const LicenseUnknown = "unknown"
+
+// FilterByLicense 过滤出许可证在 allowed 中的集市包，SPDX 标识符比较时不区分大小写。
+func FilterByLicense(repos []*StageRepo, allowed []string) (ret []*StageRepo) {
+	ret = []*StageRepo{}
+	for _, repo := range repos {
+		license := LicenseUnknown
+		if nil != repo.Package && "" != strings.TrimSpace(repo.Package.License) {
+			license = strings.TrimSpace(repo.Package.License)
+		}
+
+		for _, a := range allowed {
+			if strings.EqualFold(license, strings.TrimSpace(a)) {
+				ret = append(ret, repo)
+				break
+			}
+		}
+	}
+	return
+}
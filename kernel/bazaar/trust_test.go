@@ -0,0 +1,97 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrustedAuthors(t *testing.T) {
+	t.Cleanup(func() { SetTrustedAuthors(nil) })
+
+	const repoHash = "6286912c381ef3f83e455d06ba4d369c498238dc"
+	repos := []*StageRepo{
+		{URL: "siyuan-note/official@" + repoHash, Package: &StagePackage{Author: "SiYuan"}},
+		{URL: "someone/plugin@" + repoHash, Package: &StagePackage{Author: "Vetted"}},
+		{URL: "stranger/plugin@" + repoHash, Package: &StagePackage{Author: "stranger"}},
+	}
+
+	// 未设置信任列表时允许所有作者
+	SetTrustedAuthors(nil)
+	if !IsTrustedAuthor("https://github.com/stranger/plugin") || 3 != len(FilterByTrustedAuthors(repos)) {
+		t.Fatalf("expected all authors to be trusted when the list is unset")
+	}
+
+	SetTrustedAuthors([]string{" Siyuan-Note ", "vetted"})
+	if !IsTrustedAuthor("https://github.com/Siyuan-Note/official") {
+		t.Fatalf("expected repo owner to be trusted")
+	}
+	if !IsTrustedAuthor("https://gitlab.com/vetted/plugin") {
+		t.Fatalf("expected GitLab repo owner to be trusted")
+	}
+	// 包清单中的作者可以冒充，只认仓库所有者
+	if IsTrustedAuthor("https://github.com/someone/plugin") {
+		t.Fatalf("expected repo with a trusted manifest author to be untrusted")
+	}
+	if ret := FilterByTrustedAuthors(repos); 1 != len(ret) || "siyuan-note/official@"+repoHash != ret[0].URL {
+		t.Fatalf("unexpected trusted repos %v", stageRepoURLs(ret))
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+	setTestBazaarOSSServer(t, server.URL)
+	_, err := InstallPlugin("https://github.com/stranger/plugin", repoHash, filepath.Join(t.TempDir(), "plugin"), "")
+	if !errors.Is(err, ErrUntrustedAuthor) || 0 != requests {
+		t.Fatalf("expected untrusted author error without download, got %v and %d requests", err, requests)
+	}
+}
+
+func TestFilterByLicense(t *testing.T) {
+	repos := []*StageRepo{
+		{URL: "siyuan-note/mit@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{License: "MIT"}},
+		{URL: "siyuan-note/agpl@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{License: "AGPL-3.0"}},
+		{URL: "siyuan-note/apache@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{License: "Apache-2.0"}},
+		{URL: "siyuan-note/none@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{}},
+	}
+	urls := func(repos []*StageRepo) (ret []string) {
+		for _, repo := range repos {
+			ret = append(ret, strings.Split(repo.URL, "@")[0])
+		}
+		return
+	}
+
+	if ret := urls(FilterByLicense(repos, []string{"MIT"})); 1 != len(ret) || "siyuan-note/mit" != ret[0] {
+		t.Fatalf("expected MIT package only, got %v", ret)
+	}
+	if ret := urls(FilterByLicense(repos, []string{"mit", "AGPL-3.0"})); 2 != len(ret) || "siyuan-note/agpl" != ret[1] {
+		t.Fatalf("expected MIT and AGPL packages, got %v", ret)
+	}
+	if ret := urls(FilterByLicense(repos, []string{"AGPL-3.0", LicenseUnknown})); 2 != len(ret) || "siyuan-note/none" != ret[1] {
+		t.Fatalf("expected AGPL and unknown license packages, got %v", ret)
+	}
+	if ret := FilterByLicense(repos, nil); 0 != len(ret) {
+		t.Fatalf("expected no packages, got %d", len(ret))
+	}
+}
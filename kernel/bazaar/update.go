@@ -0,0 +1,251 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/88250/go-humanize"
+	"golang.org/x/mod/semver"
+)
+
+type UpdateSizeEstimate struct {
+	Count   int    `json:"count"`
+	Size    int64  `json:"size"`
+	HSize   string `json:"hSize"`
+	Partial bool   `json:"partial"` // 存在大小未知的集市包，估算结果偏小
+}
+
+// EstimateUpdateSize 估算更新指定类型所有过期集市包需要下载的大小。
+func EstimateUpdateSize(packageType string) (ret *UpdateSizeEstimate, err error) {
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+
+	var installed []*Package
+	for _, pkg := range installedPackages(packageType) {
+		installed = append(installed, pkg)
+	}
+	ret = estimateUpdateSize(installed, stageIndex)
+	return
+}
+
+func estimateUpdateSize(installed []*Package, stageIndex *StageIndex) (ret *UpdateSizeEstimate) {
+	ret = &UpdateSizeEstimate{}
+	for _, pkg := range installed {
+		repo := getLatestStageRepo(pkg, stageIndex)
+		if nil == repo || isExcludedPrerelease(repo.Package.Version) || 0 <= semver.Compare("v"+pkg.Version, "v"+repo.Package.Version) {
+			continue
+		}
+
+		ret.Count++
+		if 1 > repo.Size {
+			ret.Partial = true
+			continue
+		}
+		ret.Size += repo.Size
+	}
+	ret.HSize = humanize.BytesCustomCeil(uint64(ret.Size), 2)
+	return
+}
+
+// PendingAppUpdateForPackages 返回已安装但最新版本需要更高思源版本才能更新的集市包。
+//
+// 返回的包中 Version 为已安装版本，MinAppVersion 为最新版本要求的最低思源版本。
+func PendingAppUpdateForPackages(packageType string) (ret []*Package, err error) {
+	stageIndex, err := getStageIndex(packageType)
+	if nil != err {
+		return
+	}
+
+	var installed []*Package
+	for _, pkg := range installedPackages(packageType) {
+		installed = append(installed, pkg)
+	}
+	ret = pendingAppUpdateForPackages(installed, stageIndex)
+	return
+}
+
+func pendingAppUpdateForPackages(installed []*Package, stageIndex *StageIndex) (ret []*Package) {
+	ret = []*Package{}
+	for _, pkg := range installed {
+		minAppVersion := updateBlockedByAppVersion(pkg, stageIndex)
+		if "" == minAppVersion {
+			continue
+		}
+
+		pending := *pkg
+		pending.MinAppVersion = minAppVersion
+		ret = append(ret, &pending)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].URL < ret[j].URL })
+	return
+}
+
+// updateBlockedByAppVersion 返回已安装包的最新版本要求的最低思源版本，最新版本不比已安装版本新或者当前思源版本满足要求时返回空。
+//
+// 集市列表会过滤掉当前思源版本不支持的包，所以这类更新不会被检测为过期，需要通过索引中最新版本的 minAppVersion 判断。
+func updateBlockedByAppVersion(pkg *Package, stageIndex *StageIndex) string {
+	repo := getLatestStageRepo(pkg, stageIndex)
+	if nil == repo || isExcludedPrerelease(repo.Package.Version) || 0 <= semver.Compare("v"+pkg.Version, "v"+repo.Package.Version) {
+		return ""
+	}
+	if !isUnsupportedAppVersion(repo.Package.MinAppVersion, currentAppVersion) {
+		return ""
+	}
+	return repo.Package.MinAppVersion
+}
+
+// RequiredAppVersion 返回更新这些集市包所需的最低思源版本，即其中最高的 minAppVersion。
+func RequiredAppVersion(pkgs []*Package) (ret string) {
+	for _, pkg := range pkgs {
+		if "" == ret || 0 < semver.Compare("v"+pkg.MinAppVersion, "v"+ret) {
+			ret = pkg.MinAppVersion
+		}
+	}
+	return
+}
+
+func isOutdatedTheme(theme *Theme, bazaarThemes []*Theme) bool {
+	for _, pkg := range bazaarThemes {
+		if isOutdatedPackage(theme.Package, pkg.Package) {
+			theme.RepoHash = pkg.RepoHash
+			theme.UpdateSeverity = UpdateSeverity(theme.Version, pkg.Version)
+			theme.PlatformDropped = isPlatformDropped(theme.Package, pkg.Package, "")
+			return true
+		}
+		if isAheadPackage(theme.Package, pkg.Package) {
+			theme.Ahead = true
+			return false
+		}
+	}
+	return false
+}
+
+func isOutdatedIcon(icon *Icon, bazaarIcons []*Icon) bool {
+	for _, pkg := range bazaarIcons {
+		if isOutdatedPackage(icon.Package, pkg.Package) {
+			icon.RepoHash = pkg.RepoHash
+			icon.UpdateSeverity = UpdateSeverity(icon.Version, pkg.Version)
+			icon.PlatformDropped = isPlatformDropped(icon.Package, pkg.Package, "")
+			return true
+		}
+		if isAheadPackage(icon.Package, pkg.Package) {
+			icon.Ahead = true
+			return false
+		}
+	}
+	return false
+}
+
+func isOutdatedPlugin(plugin *Plugin, bazaarPlugins []*Plugin, frontend string) bool {
+	for _, pkg := range bazaarPlugins {
+		if isOutdatedPackage(plugin.Package, pkg.Package) {
+			plugin.RepoHash = pkg.RepoHash
+			plugin.UpdateSeverity = UpdateSeverity(plugin.Version, pkg.Version)
+			plugin.PlatformDropped = isPlatformDropped(plugin.Package, pkg.Package, frontend)
+			return true
+		}
+		if isAheadPackage(plugin.Package, pkg.Package) {
+			plugin.Ahead = true
+			return false
+		}
+	}
+	return false
+}
+
+func isOutdatedWidget(widget *Widget, bazaarWidgets []*Widget) bool {
+	for _, pkg := range bazaarWidgets {
+		if isOutdatedPackage(widget.Package, pkg.Package) {
+			widget.RepoHash = pkg.RepoHash
+			widget.UpdateSeverity = UpdateSeverity(widget.Version, pkg.Version)
+			widget.PlatformDropped = isPlatformDropped(widget.Package, pkg.Package, "")
+			return true
+		}
+		if isAheadPackage(widget.Package, pkg.Package) {
+			widget.Ahead = true
+			return false
+		}
+	}
+	return false
+}
+
+func isOutdatedTemplate(template *Template, bazaarTemplates []*Template) bool {
+	for _, pkg := range bazaarTemplates {
+		if isOutdatedPackage(template.Package, pkg.Package) {
+			template.RepoHash = pkg.RepoHash
+			template.UpdateSeverity = UpdateSeverity(template.Version, pkg.Version)
+			template.PlatformDropped = isPlatformDropped(template.Package, pkg.Package, "")
+			return true
+		}
+		if isAheadPackage(template.Package, pkg.Package) {
+			template.Ahead = true
+			return false
+		}
+	}
+	return false
+}
+
+type Severity string
+
+const (
+	SeverityNone    Severity = "none"
+	SeverityPatch   Severity = "patch"
+	SeverityMinor   Severity = "minor"
+	SeverityMajor   Severity = "major" // 可能包含不兼容的变更，批量更新时需要用户确认
+	SeverityUnknown Severity = "unknown"
+)
+
+// UpdateSeverity 比较语义化版本号，返回从 installed 更新到 latest 的级别，版本号无效时返回 SeverityUnknown。
+func UpdateSeverity(installed, latest string) Severity {
+	installed, latest = "v"+strings.TrimPrefix(installed, "v"), "v"+strings.TrimPrefix(latest, "v")
+	if !semver.IsValid(installed) || !semver.IsValid(latest) {
+		return SeverityUnknown
+	}
+
+	if 0 <= semver.Compare(installed, latest) {
+		return SeverityNone
+	}
+	if semver.Major(installed) != semver.Major(latest) {
+		return SeverityMajor
+	}
+	if semver.MajorMinor(installed) != semver.MajorMinor(latest) {
+		return SeverityMinor
+	}
+	return SeverityPatch
+}
+
+// isPlatformDropped 判断已安装版本支持当前平台，但最新版本声明的 backends/frontends 不再支持，frontend 为空时使用当前运行环境对应的前端。
+func isPlatformDropped(installed, latest *Package, frontend string) bool {
+	if "" == frontend {
+		frontend = currentFrontend()
+	}
+	return isCompatiblePlatform(installed.Backends, installed.Frontends, frontend) && !isCompatiblePlatform(latest.Backends, latest.Frontends, frontend)
+}
+
+func isOutdatedPackage(installed, latest *Package) bool {
+	return isSameRepo(installed.URL, latest.URL) && installed.Name == latest.Name && installed.Author == latest.Author &&
+		!isExcludedPrerelease(latest.Version) && 0 > semver.Compare("v"+installed.Version, "v"+latest.Version)
+}
+
+// isAheadPackage 判断已安装的版本是否比集市上发布的版本还新，比如开发者在本地提升了版本号。
+func isAheadPackage(installed, latest *Package) bool {
+	return isSameRepo(installed.URL, latest.URL) && installed.Name == latest.Name && installed.Author == latest.Author &&
+		0 < semver.Compare("v"+installed.Version, "v"+latest.Version)
+}
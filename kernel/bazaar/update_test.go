@@ -0,0 +1,162 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"testing"
+)
+
+func TestEstimateUpdateSize(t *testing.T) {
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/a@6286912c381ef3f83e455d06ba4d369c498238dc", Size: 1024, Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0"}},
+		{URL: "siyuan-note/b@6286912c381ef3f83e455d06ba4d369c498238dc", Size: 2048, Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/b", Version: "2.0.0"}},
+		{URL: "siyuan-note/c@6286912c381ef3f83e455d06ba4d369c498238dc", Size: 4096, Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/c", Version: "1.0.0"}},
+		{URL: "siyuan-note/d@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/d", Version: "1.0.1"}},
+	}}
+	installed := []*Package{
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.0.0"},
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/b", Version: "1.9.9"},
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/c", Version: "1.0.0"},
+	}
+
+	estimate := estimateUpdateSize(installed, stageIndex)
+	if 2 != estimate.Count || 3072 != estimate.Size || estimate.Partial {
+		t.Fatalf("unexpected estimate %+v", estimate)
+	}
+	if "" == estimate.HSize {
+		t.Fatalf("expected human readable size")
+	}
+
+	installed = append(installed, &Package{Author: "siyuan", URL: "https://github.com/siyuan-note/d", Version: "1.0.0"})
+	estimate = estimateUpdateSize(installed, stageIndex)
+	if 3 != estimate.Count || 3072 != estimate.Size || !estimate.Partial {
+		t.Fatalf("expected partial estimate, got %+v", estimate)
+	}
+}
+
+func TestAheadPackage(t *testing.T) {
+	latest := &Plugin{Package: &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0", RepoHash: "6286912c381ef3f83e455d06ba4d369c498238dc"}}
+
+	ahead := &Plugin{Package: &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.2.0"}}
+	if isOutdatedPlugin(ahead, []*Plugin{latest}, "") || !ahead.Ahead {
+		t.Fatalf("expected installed version to be ahead, got [outdated=%v, ahead=%v]", ahead.Outdated, ahead.Ahead)
+	}
+
+	same := &Plugin{Package: &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0"}}
+	if isOutdatedPlugin(same, []*Plugin{latest}, "") || same.Ahead {
+		t.Fatalf("expected same version to be neither outdated nor ahead")
+	}
+
+	behind := &Plugin{Package: &Package{Name: "a", Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.0.0"}}
+	if !isOutdatedPlugin(behind, []*Plugin{latest}, "") || behind.Ahead {
+		t.Fatalf("expected older version to be outdated and not ahead")
+	}
+
+	other := &Plugin{Package: &Package{Name: "b", Author: "siyuan", URL: "https://github.com/siyuan-note/b", Version: "9.0.0"}}
+	if isOutdatedPlugin(other, []*Plugin{latest}, "") || other.Ahead {
+		t.Fatalf("expected a different package not to be compared")
+	}
+}
+
+func TestPendingAppUpdateForPackages(t *testing.T) {
+	setTestAppVersion(t, "3.0.0")
+
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/a@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0", MinAppVersion: "3.1.0"}},
+		{URL: "siyuan-note/b@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/b", Version: "2.0.0", MinAppVersion: "3.2.1"}},
+		{URL: "siyuan-note/c@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/c", Version: "1.0.1", MinAppVersion: "2.9.0"}},
+		{URL: "siyuan-note/d@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/d", Version: "1.0.0", MinAppVersion: "3.10.0"}},
+		{URL: "siyuan-note/e@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/e", Version: "1.2.0", MinAppVersion: "3.10.0"}},
+	}}
+	installed := []*Package{
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.0.0", MinAppVersion: "2.9.0"},
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/b", Version: "1.9.9", MinAppVersion: "2.9.0"},
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/c", Version: "1.0.0"}, // 可直接更新
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/d", Version: "1.0.0"}, // 已是最新
+		{Author: "siyuan", URL: "https://github.com/siyuan-note/e", Version: "1.1.0"},
+	}
+
+	pending := pendingAppUpdateForPackages(installed, stageIndex)
+	if 3 != len(pending) {
+		t.Fatalf("expected 3 pending packages, got %d", len(pending))
+	}
+	for i, expected := range []string{"3.1.0", "3.2.1", "3.10.0"} {
+		if expected != pending[i].MinAppVersion {
+			t.Fatalf("expected min app version [%s] for [%s], got [%s]", expected, pending[i].URL, pending[i].MinAppVersion)
+		}
+	}
+	if "1.0.0" != pending[0].Version || "2.9.0" != installed[0].MinAppVersion {
+		t.Fatalf("expected installed packages to be left untouched")
+	}
+	if required := RequiredAppVersion(pending); "3.10.0" != required {
+		t.Fatalf("expected required app version [3.10.0], got [%s]", required)
+	}
+	if required := RequiredAppVersion(nil); "" != required {
+		t.Fatalf("expected no required app version, got [%s]", required)
+	}
+}
+
+func TestUpdateBlockedByAppVersion(t *testing.T) {
+	setTestAppVersion(t, "3.0.0")
+
+	stageIndex := &StageIndex{Repos: []*StageRepo{
+		{URL: "siyuan-note/a@6286912c381ef3f83e455d06ba4d369c498238dc", Package: &StagePackage{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0", MinAppVersion: "3.5.0"}},
+	}}
+	installed := &Package{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.0.0", MinAppVersion: "2.9.0"}
+
+	// 最新版本提升了 minAppVersion，集市列表中不显示该版本，不会被检测为过期
+	latest := &Package{Author: "siyuan", URL: "https://github.com/siyuan-note/a", Version: "1.1.0", MinAppVersion: "3.5.0"}
+	if !disallowDisplayBazaarPackage(latest) {
+		t.Fatalf("expected latest version to be hidden from bazaar")
+	}
+	if blocked := updateBlockedByAppVersion(installed, stageIndex); "3.5.0" != blocked {
+		t.Fatalf("expected update to be blocked by app version [3.5.0], got [%s]", blocked)
+	}
+
+	currentAppVersion = "3.5.0"
+	if blocked := updateBlockedByAppVersion(installed, stageIndex); "" != blocked {
+		t.Fatalf("expected update not to be blocked, got [%s]", blocked)
+	}
+
+	installed.Version = "1.1.0"
+	currentAppVersion = "3.0.0"
+	if blocked := updateBlockedByAppVersion(installed, stageIndex); "" != blocked {
+		t.Fatalf("expected up-to-date package not to be blocked, got [%s]", blocked)
+	}
+}
+
+func TestUpdateSeverity(t *testing.T) {
+	cases := []struct {
+		installed, latest string
+		severity          Severity
+	}{
+		{"1.9.9", "2.0.0", SeverityMajor},
+		{"1.2", "1.3", SeverityMinor},
+		{"1.2.0", "1.3.0", SeverityMinor},
+		{"1.2.3", "1.2.4", SeverityPatch},
+		{"1.2.3-rc.1", "1.2.3", SeverityPatch},
+		{"1.2.3", "1.2.3", SeverityNone},
+		{"2.0.0", "1.9.9", SeverityNone},
+		{"1.2.3", "latest", SeverityUnknown},
+		{"", "1.0.0", SeverityUnknown},
+	}
+	for _, c := range cases {
+		if severity := UpdateSeverity(c.installed, c.latest); c.severity != severity {
+			t.Fatalf("expected severity [%s] for [%s -> %s], got [%s]", c.severity, c.installed, c.latest, severity)
+		}
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/88250/go-humanize"
 	ants "github.com/panjf2000/ants/v2"
 	"github.com/siyuan-note/httpclient"
 	"github.com/siyuan-note/logging"
@@ -32,11 +31,34 @@ import (
 
 type Widget struct {
 	*Package
+	Width  int `json:"width"`  // 挂件块的默认宽度（像素），可选
+	Height int `json:"height"` // 挂件块的默认高度（像素），可选
+}
+
+const (
+	defaultWidgetWidth  = 300 // 和浏览器 iframe 的默认宽度一致
+	defaultWidgetHeight = 150 // 和浏览器 iframe 的默认高度一致
+)
+
+// GetWidgetDimensions 返回挂件块的默认宽高，清单中没有声明或者声明无效时使用默认值，用于预览时预先设置 iframe 的大小。
+func GetWidgetDimensions(widget *Widget) (width, height int) {
+	width, height = defaultWidgetWidth, defaultWidgetHeight
+	if nil == widget {
+		return
+	}
+	if 0 < widget.Width {
+		width = widget.Width
+	}
+	if 0 < widget.Height {
+		height = widget.Height
+	}
+	return
 }
 
 func Widgets() (widgets []*Widget) {
 	widgets = []*Widget{}
 
+	generation := getPackageCacheGeneration()
 	stageIndex, err := getStageIndex("widgets")
 	if nil != err {
 		return
@@ -51,7 +73,7 @@ func Widgets() (widgets []*Widget) {
 		repo := arg.(*StageRepo)
 		repoURL := repo.URL
 
-		if pkg, found := packageCache.Get(repoURL); found {
+		if pkg, found := packageCache.Get(packageCacheKey("widgets", repoURL)); found {
 			lock.Lock()
 			widgets = append(widgets, pkg.(*Widget))
 			lock.Unlock()
@@ -59,8 +81,8 @@ func Widgets() (widgets []*Widget) {
 		}
 
 		widget := &Widget{}
-		innerU := util.BazaarOSSServer + "/package/" + repoURL + "/widget.json"
-		innerResp, innerErr := httpclient.NewBrowserRequest().SetSuccessResult(widget).Get(innerU)
+		innerU := packageURL(repoURL, "widget.json")
+		innerResp, innerErr := bazaarRequest(httpclient.NewBrowserRequest()).SetSuccessResult(widget).Get(innerU)
 		if nil != innerErr {
 			logging.LogErrorf("get bazaar package [%s] failed: %s", repoURL, innerErr)
 			return
@@ -76,35 +98,40 @@ func Widgets() (widgets []*Widget) {
 
 		widget.URL = strings.TrimSuffix(widget.URL, "/")
 		repoURLHash := strings.Split(repoURL, "@")
-		widget.RepoURL = "https://github.com/" + repoURLHash[0]
+		widget.RepoURL = repoWebURL(repoURLHash[0])
 		widget.RepoHash = repoURLHash[1]
-		widget.PreviewURL = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageslim"
-		widget.PreviewURLThumb = util.BazaarOSSServer + "/package/" + repoURL + "/preview.png?imageView2/2/w/436/h/232"
-		widget.IconURL = util.BazaarOSSServer + "/package/" + repoURL + "/icon.png"
+		widget.PreviewURL = packageURL(repoURL, "preview.png?imageslim")
+		widget.PreviewURLThumb = packageURL(repoURL, "preview.png?imageView2/2/w/436/h/232")
+		widget.ScreenshotURLs, widget.ScreenshotURLThumbs = getScreenshotURLs(widget.Package, packageURL(repoURL), true)
+		widget.IconURL = packageURL(repoURL, "icon.png")
 		widget.Funding = repo.Package.Funding
-		widget.PreferredFunding = getPreferredFunding(widget.Funding)
-		widget.PreferredName = GetPreferredName(widget.Package)
-		widget.PreferredDesc = getPreferredDesc(widget.Description)
+		if 0 == len(widget.Previews) {
+			widget.Previews = repo.Package.Previews
+		}
+		widget.ResolvePreferred()
 		widget.Updated = repo.Updated
 		widget.Stars = repo.Stars
 		widget.OpenIssues = repo.OpenIssues
+		widget.Featured = repo.Featured
+		widget.Archived = repo.Archived
+		widget.FeaturedRank = repo.FeaturedRank
+		widget.License = repo.Package.License
+		widget.Deprecated, widget.Replacement = getDeprecation(repo.Package)
 		widget.Size = repo.Size
-		widget.HSize = humanize.BytesCustomCeil(uint64(widget.Size), 2)
 		widget.InstallSize = repo.InstallSize
-		widget.HInstallSize = humanize.BytesCustomCeil(uint64(widget.InstallSize), 2)
-		packageInstallSizeCache.SetDefault(widget.RepoURL, widget.InstallSize)
-		widget.HUpdated = formatUpdated(widget.Updated)
+		cacheStageInstallSize(widget.RepoURL, widget.RepoHash, widget.InstallSize)
 		pkg := bazaarIndex[strings.Split(repoURL, "@")[0]]
 		if nil != pkg {
 			widget.Downloads = pkg.Downloads
 		}
+		widget.ComputeHumanSizes()
 		lock.Lock()
 		widgets = append(widgets, widget)
 		lock.Unlock()
 
-		packageCache.SetDefault(repoURL, widget)
+		setPackageCache(packageCacheKey("widgets", repoURL), widget, generation)
 	})
-	for _, repo := range stageIndex.Repos {
+	for _, repo := range visibleStageRepos(stageIndex.Repos) {
 		waitGroup.Add(1)
 		p.Invoke(repo)
 	}
@@ -130,6 +157,7 @@ func InstalledWidgets() (ret []*Widget) {
 	}
 
 	bazaarWidgets := Widgets()
+	stageIndex, _ := getStageIndex("widgets")
 
 	for _, widgetDir := range widgetDirs {
 		if !util.IsDirRegularOrSymlink(widgetDir) {
@@ -148,16 +176,15 @@ func InstalledWidgets() (ret []*Widget) {
 		widget.RepoURL = widget.URL
 		widget.PreviewURL = "/widgets/" + dirName + "/preview.png"
 		widget.PreviewURLThumb = "/widgets/" + dirName + "/preview.png"
+		widget.ScreenshotURLs, widget.ScreenshotURLThumbs = getScreenshotURLs(widget.Package, "/widgets/"+dirName, false)
 		widget.IconURL = "/widgets/" + dirName + "/icon.png"
-		widget.PreferredFunding = getPreferredFunding(widget.Funding)
-		widget.PreferredName = GetPreferredName(widget.Package)
-		widget.PreferredDesc = getPreferredDesc(widget.Description)
+		widget.ResolvePreferred()
 		info, statErr := os.Stat(filepath.Join(installPath, "README.md"))
 		if nil != statErr {
 			logging.LogWarnf("stat install theme README.md failed: %s", statErr)
 			continue
 		}
-		widget.HInstallDate = info.ModTime().Format("2006-01-02")
+		widget.InstallDate = info.ModTime().UnixMilli()
 		if installSize, ok := packageInstallSizeCache.Get(widget.RepoURL); ok {
 			widget.InstallSize = installSize.(int64)
 		} else {
@@ -165,7 +192,7 @@ func InstalledWidgets() (ret []*Widget) {
 			widget.InstallSize = is
 			packageInstallSizeCache.SetDefault(widget.RepoURL, is)
 		}
-		widget.HInstallSize = humanize.BytesCustomCeil(uint64(widget.InstallSize), 2)
+		widget.ComputeHumanSizes()
 		readmeFilename := getPreferredReadme(widget.Readme)
 		readme, readErr := os.ReadFile(filepath.Join(installPath, readmeFilename))
 		if nil != readErr {
@@ -175,18 +202,19 @@ func InstalledWidgets() (ret []*Widget) {
 
 		widget.PreferredReadme, _ = renderREADME(widget.URL, readme)
 		widget.Outdated = isOutdatedWidget(widget, bazaarWidgets)
+		if !widget.Outdated {
+			widget.UpdateBlockedByAppVersion = updateBlockedByAppVersion(widget.Package, stageIndex)
+		}
+		widget.Deprecated, widget.Replacement = getInstalledDeprecation("widgets", widget.Package)
 		ret = append(ret, widget)
 	}
 	return
 }
 
+// InstallWidget 安装挂件，目录名使用 CanonicalInstallDir 的返回值，installPath 只决定安装到哪个目录下，为空时使用默认的挂件目录。
 func InstallWidget(repoURL, repoHash, installPath string, systemID string) error {
-	repoURLHash := repoURL + "@" + repoHash
-	data, err := downloadPackage(repoURLHash, true, systemID)
-	if nil != err {
-		return err
-	}
-	return installPackage(data, installPath, repoURLHash)
+	_, err := installBazaarPackage("widgets", repoURL, repoHash, installPath, systemID, false)
+	return err
 }
 
 func UninstallWidget(installPath string) error {
@@ -0,0 +1,60 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bazaar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+func TestWidgetDimensions(t *testing.T) {
+	setTestDataDir(t)
+	manifests := map[string]string{
+		"sized":   `{"name":"sized","version":"1.0.0","width":640,"height":480}`,
+		"default": `{"name":"default","version":"1.0.0"}`,
+		"invalid": `{"name":"invalid","version":"1.0.0","width":-1,"height":0}`,
+	}
+	for name, manifest := range manifests {
+		dir := filepath.Join(util.DataDir, "widgets", name)
+		if err := os.MkdirAll(dir, 0755); nil != err {
+			t.Fatalf("mkdir [%s] failed: %s", dir, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "widget.json"), []byte(manifest), 0644); nil != err {
+			t.Fatalf("write widget.json failed: %s", err)
+		}
+	}
+
+	widget, err := WidgetJSON("sized")
+	if nil != err {
+		t.Fatalf("read widget.json failed: %s", err)
+	}
+	if width, height := GetWidgetDimensions(widget); 640 != width || 480 != height {
+		t.Fatalf("expected declared dimensions, got [%d, %d]", width, height)
+	}
+
+	for _, name := range []string{"default", "invalid"} {
+		if widget, err = WidgetJSON(name); nil != err {
+			t.Fatalf("read widget.json failed: %s", err)
+		}
+		if width, height := GetWidgetDimensions(widget); defaultWidgetWidth != width || defaultWidgetHeight != height {
+			t.Fatalf("expected default dimensions for [%s], got [%d, %d]", name, width, height)
+		}
+	}
+}
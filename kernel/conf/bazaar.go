@@ -19,11 +19,40 @@ package conf
 type Bazaar struct {
 	Trust         bool `json:"trust"`
 	PetalDisabled bool `json:"petalDisabled"`
+
+	TrustedAuthors             []string         `json:"trustedAuthors"`             // 信任的集市包作者（仓库所有者），为空时允许所有作者
+	HideArchived               bool             `json:"hideArchived"`               // 集市列表是否隐藏仓库已归档的包
+	IncludePrereleases         bool             `json:"includePrereleases"`         // 集市列表和更新检查是否包含预发布版本
+	PreferEnglishMetadata      bool             `json:"preferEnglishMetadata"`      // 是否总是优先使用集市包的英文名称、描述和 README
+	MaxReadmeSize              int              `json:"maxReadmeSize"`              // 渲染 README 的最大字节数
+	ReadmePatternProbe         bool             `json:"readmePatternProbe"`         // 是否按 README_{lang}.md 等约定探测本地化 README
+	DisableReadmeImageFallback bool             `json:"disableReadmeImageFallback"` // 是否关闭 README 图片的懒加载和加载失败回退
+	Freshness                  *BazaarFreshness `json:"freshness"`                  // 新鲜度分级的天数阈值
+	OnlineCheckURLs            []string         `json:"onlineCheckURLs"`            // 检查集市是否可访问时探测的地址，为空时使用默认地址
+	StageIndexCacheTTL         int              `json:"stageIndexCacheTTL"`         // 集市索引的缓存有效期，单位秒，小于 0 时不缓存
+	CacheDir                   string           `json:"cacheDir"`                   // 集市缓存文件的根目录，为空时使用临时目录
+}
+
+type BazaarFreshness struct {
+	Aging     int `json:"aging"`
+	Stale     int `json:"stale"`
+	Abandoned int `json:"abandoned"`
 }
 
 func NewBazaar() *Bazaar {
 	return &Bazaar{
-		Trust:         false,
-		PetalDisabled: false,
+		Trust:              false,
+		PetalDisabled:      false,
+		MaxReadmeSize:      2 * 1024 * 1024,
+		Freshness:          NewBazaarFreshness(),
+		StageIndexCacheTTL: 60 * 60,
+	}
+}
+
+func NewBazaarFreshness() *BazaarFreshness {
+	return &BazaarFreshness{
+		Aging:     90,
+		Stale:     365,
+		Abandoned: 730,
 	}
 }
@@ -16,6 +16,8 @@
 
 package conf
 
+import "time"
+
 type User struct {
 	UserId                          string       `json:"userId"`
 	UserName                        string       `json:"userName"`
@@ -51,3 +53,32 @@ type UserTitle struct {
 func (user *User) GetCloudRepoAvailableSize() int64 {
 	return int64(user.UserSiYuanRepoSize - user.UserSiYuanAssetSize)
 }
+
+// ProExpireTime 返回订阅过期时间，未设置时 ok 为 false。
+//
+// 服务端通常返回毫秒时间戳，但部分接口返回的是秒，这里根据数量级判断：小于 1e11 的视为秒（1e11 毫秒是 1973 年）。
+func (user *User) ProExpireTime() (ret time.Time, ok bool) {
+	expireTime := user.UserSiYuanProExpireTime
+	if 0 >= expireTime {
+		return
+	}
+
+	if 1e11 > expireTime {
+		return time.Unix(int64(expireTime), 0), true
+	}
+	return time.UnixMilli(int64(expireTime)), true
+}
+
+// AssetQuotaUsageRatio 返回资源文件已用空间占云端存储空间的比例，范围 0-1，未设置云端存储空间时返回 0。
+func (user *User) AssetQuotaUsageRatio() float64 {
+	if 0 >= user.UserSiYuanRepoSize {
+		return 0
+	}
+
+	return max(0, min(1, user.UserSiYuanAssetSize/user.UserSiYuanRepoSize))
+}
+
+// NearAssetQuota 判断资源文件已用空间比例是否达到 threshold，用于安装较大的集市包（比如图标）前提醒用户。
+func (user *User) NearAssetQuota(threshold float64) bool {
+	return threshold <= user.AssetQuotaUsageRatio()
+}
@@ -0,0 +1,74 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package conf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProExpireTime(t *testing.T) {
+	expected := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	user := &User{UserSiYuanProExpireTime: float64(expected.UnixMilli())}
+	if expireTime, ok := user.ProExpireTime(); !ok || !expected.Equal(expireTime) {
+		t.Fatalf("expected [%s] from milliseconds, got [%s, %v]", expected, expireTime, ok)
+	}
+
+	user.UserSiYuanProExpireTime = float64(expected.Unix())
+	if expireTime, ok := user.ProExpireTime(); !ok || !expected.Equal(expireTime) {
+		t.Fatalf("expected [%s] from seconds, got [%s, %v]", expected, expireTime, ok)
+	}
+
+	for _, unset := range []float64{0, -1} {
+		user.UserSiYuanProExpireTime = unset
+		if _, ok := user.ProExpireTime(); ok {
+			t.Fatalf("expected unset expire time for [%v]", unset)
+		}
+	}
+}
+
+func TestAssetQuota(t *testing.T) {
+	user := &User{UserSiYuanRepoSize: 1000, UserSiYuanAssetSize: 500}
+	if ratio := user.AssetQuotaUsageRatio(); 0.5 != ratio {
+		t.Fatalf("expected ratio [0.5], got [%v]", ratio)
+	}
+	if user.NearAssetQuota(0.9) {
+		t.Fatalf("expected under threshold")
+	}
+
+	user.UserSiYuanAssetSize = 900
+	if !user.NearAssetQuota(0.9) {
+		t.Fatalf("expected at threshold, got ratio [%v]", user.AssetQuotaUsageRatio())
+	}
+
+	user.UserSiYuanAssetSize = 1500
+	if ratio := user.AssetQuotaUsageRatio(); 1 != ratio || !user.NearAssetQuota(0.9) {
+		t.Fatalf("expected over quota ratio to be clamped to [1], got [%v]", ratio)
+	}
+
+	// 直接使用资源文件大小，不受可用空间取整的影响
+	user = &User{UserSiYuanRepoSize: 3, UserSiYuanAssetSize: 1.5}
+	if ratio := user.AssetQuotaUsageRatio(); 0.5 != ratio {
+		t.Fatalf("expected ratio [0.5], got [%v]", ratio)
+	}
+
+	user = &User{UserSiYuanAssetSize: 100}
+	if ratio := user.AssetQuotaUsageRatio(); 0 != ratio {
+		t.Fatalf("expected ratio [0] without quota, got [%v]", ratio)
+	}
+}
@@ -28,10 +28,42 @@ import (
 	"github.com/88250/gulu"
 	"github.com/siyuan-note/logging"
 	"github.com/siyuan-note/siyuan/kernel/bazaar"
+	"github.com/siyuan-note/siyuan/kernel/conf"
 	"github.com/siyuan-note/siyuan/kernel/util"
 	"golang.org/x/mod/semver"
 )
 
+// InitBazaar 规范化集市配置并应用到集市模块，加载配置和修改集市设置后调用。
+func InitBazaar() {
+	bazaarConf := Conf.Bazaar
+	if 0 == bazaarConf.MaxReadmeSize {
+		bazaarConf.MaxReadmeSize = conf.NewBazaar().MaxReadmeSize
+	}
+	if nil == bazaarConf.Freshness {
+		bazaarConf.Freshness = conf.NewBazaarFreshness()
+	}
+	if 0 == bazaarConf.StageIndexCacheTTL {
+		bazaarConf.StageIndexCacheTTL = conf.NewBazaar().StageIndexCacheTTL
+	}
+
+	bazaar.SetTrustedAuthors(bazaarConf.TrustedAuthors)
+	bazaar.SetHideArchived(bazaarConf.HideArchived)
+	bazaar.SetIncludePrereleases(bazaarConf.IncludePrereleases)
+	bazaar.SetPreferEnglishMetadata(bazaarConf.PreferEnglishMetadata)
+	bazaar.SetMaxREADMESize(bazaarConf.MaxReadmeSize)
+	bazaar.SetREADMEPatternProbe(bazaarConf.ReadmePatternProbe)
+	bazaar.SetREADMEImageFallback(!bazaarConf.DisableReadmeImageFallback)
+	bazaar.SetFreshnessThresholds(bazaar.FreshnessThresholds{
+		Aging:     bazaarConf.Freshness.Aging,
+		Stale:     bazaarConf.Freshness.Stale,
+		Abandoned: bazaarConf.Freshness.Abandoned,
+	})
+	bazaar.SetOnlineCheckURLs(bazaarConf.OnlineCheckURLs)
+	bazaar.SetStageIndexCacheTTL(time.Duration(bazaarConf.StageIndexCacheTTL) * time.Second)
+	// 缓存目录不可写时保留之前的目录
+	bazaar.SetBazaarCacheDir(bazaarConf.CacheDir)
+}
+
 func BatchUpdateBazaarPackages(frontend string) {
 	plugins, widgets, icons, themes, templates := UpdatedPackages(frontend)
 
@@ -40,11 +72,15 @@ func BatchUpdateBazaarPackages(frontend string) {
 		return
 	}
 
+	if !isBazzarOnline() {
+		return
+	}
+
 	util.PushEndlessProgress(fmt.Sprintf(Conf.language(235), 1, total))
 	defer util.PushClearProgress()
 	count := 1
 	for _, plugin := range plugins {
-		err := bazaar.InstallPlugin(plugin.RepoURL, plugin.RepoHash, filepath.Join(util.DataDir, "plugins", plugin.Name), Conf.System.ID)
+		_, err := bazaar.InstallPlugin(plugin.RepoURL, plugin.RepoHash, "", Conf.System.ID)
 		if nil != err {
 			logging.LogErrorf("update plugin [%s] failed: %s", plugin.Name, err)
 			util.PushErrMsg(fmt.Sprintf(Conf.language(238)), 5000)
@@ -56,7 +92,7 @@ func BatchUpdateBazaarPackages(frontend string) {
 	}
 
 	for _, widget := range widgets {
-		err := bazaar.InstallWidget(widget.RepoURL, widget.RepoHash, filepath.Join(util.DataDir, "widgets", widget.Name), Conf.System.ID)
+		err := bazaar.InstallWidget(widget.RepoURL, widget.RepoHash, "", Conf.System.ID)
 		if nil != err {
 			logging.LogErrorf("update widget [%s] failed: %s", widget.Name, err)
 			util.PushErrMsg(fmt.Sprintf(Conf.language(238)), 5000)
@@ -68,7 +104,7 @@ func BatchUpdateBazaarPackages(frontend string) {
 	}
 
 	for _, icon := range icons {
-		err := bazaar.InstallIcon(icon.RepoURL, icon.RepoHash, filepath.Join(util.IconsPath, icon.Name), Conf.System.ID)
+		err := bazaar.InstallIcon(icon.RepoURL, icon.RepoHash, "", Conf.System.ID)
 		if nil != err {
 			logging.LogErrorf("update icon [%s] failed: %s", icon.Name, err)
 			util.PushErrMsg(fmt.Sprintf(Conf.language(238)), 5000)
@@ -80,7 +116,7 @@ func BatchUpdateBazaarPackages(frontend string) {
 	}
 
 	for _, template := range templates {
-		err := bazaar.InstallTemplate(template.RepoURL, template.RepoHash, filepath.Join(util.DataDir, "templates", template.Name), Conf.System.ID)
+		err := bazaar.InstallTemplate(template.RepoURL, template.RepoHash, "", Conf.System.ID)
 		if nil != err {
 			logging.LogErrorf("update template [%s] failed: %s", template.Name, err)
 			util.PushErrMsg(fmt.Sprintf(Conf.language(238)), 5000)
@@ -92,7 +128,7 @@ func BatchUpdateBazaarPackages(frontend string) {
 	}
 
 	for _, theme := range themes {
-		err := bazaar.InstallTheme(theme.RepoURL, theme.RepoHash, filepath.Join(util.ThemesPath, theme.Name), Conf.System.ID)
+		err := bazaar.InstallTheme(theme.RepoURL, theme.RepoHash, "", Conf.System.ID)
 		if nil != err {
 			logging.LogErrorf("update theme [%s] failed: %s", theme.Name, err)
 			util.PushErrMsg(fmt.Sprintf(Conf.language(238)), 5000)
@@ -114,6 +150,15 @@ func BatchUpdateBazaarPackages(frontend string) {
 	return
 }
 
+// isBazzarOnline 检查集市是否可访问，不可访问时提示用户。
+func isBazzarOnline() (ret bool) {
+	ret = bazaar.IsBazaarOnline()
+	if !ret {
+		util.PushErrMsg(Conf.language(24), 5000)
+	}
+	return
+}
+
 func UpdatedPackages(frontend string) (plugins []*bazaar.Plugin, widgets []*bazaar.Widget, icons []*bazaar.Icon, themes []*bazaar.Theme, templates []*bazaar.Template) {
 	wg := &sync.WaitGroup{}
 	wg.Add(5)
@@ -196,6 +241,10 @@ func GetPackageREADME(repoURL, repoHash, packageType string) (ret string) {
 	return
 }
 
+func InvalidatePackageREADME(repoURL, repoHash, packageType string) {
+	bazaar.InvalidatePackageREADME(repoURL, repoHash, packageType)
+}
+
 func BazaarPlugins(frontend, keyword string) (plugins []*bazaar.Plugin) {
 	plugins = bazaar.Plugins(frontend)
 	plugins = filterPlugins(plugins, keyword)
@@ -234,13 +283,14 @@ func InstalledPlugins(frontend, keyword string) (plugins []*bazaar.Plugin) {
 	return
 }
 
-func InstallBazaarPlugin(repoURL, repoHash, pluginName string) error {
-	installPath := filepath.Join(util.DataDir, "plugins", pluginName)
-	err := bazaar.InstallPlugin(repoURL, repoHash, installPath, Conf.System.ID)
+func InstallBazaarPlugin(repoURL, repoHash, pluginName string) (restartRequired bool, err error) {
+	result, err := bazaar.InstallPlugin(repoURL, repoHash, "", Conf.System.ID)
 	if nil != err {
-		return errors.New(fmt.Sprintf(Conf.Language(46), pluginName, err))
+		err = errors.New(fmt.Sprintf(Conf.Language(46), pluginName, err))
+		return
 	}
-	return nil
+	restartRequired = result.RestartRequired
+	return
 }
 
 func UninstallBazaarPlugin(pluginName, frontend string) error {
@@ -297,8 +347,7 @@ func InstalledWidgets(keyword string) (widgets []*bazaar.Widget) {
 }
 
 func InstallBazaarWidget(repoURL, repoHash, widgetName string) error {
-	installPath := filepath.Join(util.DataDir, "widgets", widgetName)
-	err := bazaar.InstallWidget(repoURL, repoHash, installPath, Conf.System.ID)
+	err := bazaar.InstallWidget(repoURL, repoHash, "", Conf.System.ID)
 	if nil != err {
 		return errors.New(fmt.Sprintf(Conf.Language(46), widgetName, err))
 	}
@@ -352,12 +401,12 @@ func InstalledIcons(keyword string) (icons []*bazaar.Icon) {
 }
 
 func InstallBazaarIcon(repoURL, repoHash, iconName string) error {
-	installPath := filepath.Join(util.IconsPath, iconName)
-	err := bazaar.InstallIcon(repoURL, repoHash, installPath, Conf.System.ID)
+	err := bazaar.InstallIcon(repoURL, repoHash, "", Conf.System.ID)
 	if nil != err {
 		return errors.New(fmt.Sprintf(Conf.Language(46), iconName, err))
 	}
-	Conf.Appearance.Icon = iconName
+	// 安装目录名由集市统一决定，安装后再获取实际的目录名用于外观配置
+	Conf.Appearance.Icon = bazaar.CanonicalInstallDir("icons", repoURL)
 	Conf.Save()
 	InitAppearance()
 	return nil
@@ -416,18 +465,20 @@ func InstalledThemes(keyword string) (ret []*bazaar.Theme) {
 func InstallBazaarTheme(repoURL, repoHash, themeName string, mode int, update bool) error {
 	closeThemeWatchers()
 
-	installPath := filepath.Join(util.ThemesPath, themeName)
-	err := bazaar.InstallTheme(repoURL, repoHash, installPath, Conf.System.ID)
+	err := bazaar.InstallTheme(repoURL, repoHash, "", Conf.System.ID)
 	if nil != err {
 		return errors.New(fmt.Sprintf(Conf.Language(46), themeName, err))
 	}
+	// 安装目录名由集市统一决定，安装后再获取实际的目录名用于外观配置
+	dirName := bazaar.CanonicalInstallDir("themes", repoURL)
+	installPath := filepath.Join(util.ThemesPath, dirName)
 
 	if !update {
 		// 更新主题后不需要对该主题进行切换 https://github.com/siyuan-note/siyuan/issues/4966
 		if 0 == mode {
-			Conf.Appearance.ThemeLight = themeName
+			Conf.Appearance.ThemeLight = dirName
 		} else {
-			Conf.Appearance.ThemeDark = themeName
+			Conf.Appearance.ThemeDark = dirName
 		}
 		Conf.Appearance.Mode = mode
 		Conf.Appearance.ThemeJS = gulu.File.IsExist(filepath.Join(installPath, "theme.js"))
@@ -483,8 +534,7 @@ func InstalledTemplates(keyword string) (templates []*bazaar.Template) {
 }
 
 func InstallBazaarTemplate(repoURL, repoHash, templateName string) error {
-	installPath := filepath.Join(util.DataDir, "templates", templateName)
-	err := bazaar.InstallTemplate(repoURL, repoHash, installPath, Conf.System.ID)
+	err := bazaar.InstallTemplate(repoURL, repoHash, "", Conf.System.ID)
 	if nil != err {
 		return errors.New(fmt.Sprintf(Conf.Language(46), templateName, err))
 	}
@@ -510,18 +560,22 @@ func matchPackage(keywords []string, pkg *bazaar.Package) bool {
 	}
 
 	for _, keyword := range keywords {
-		if strings.Contains(strings.ToLower(pkg.DisplayName.Default), keyword) ||
-			strings.Contains(strings.ToLower(pkg.DisplayName.ZhCN), keyword) ||
-			strings.Contains(strings.ToLower(pkg.DisplayName.ZhCHT), keyword) ||
-			strings.Contains(strings.ToLower(pkg.DisplayName.EnUS), keyword) ||
-			strings.Contains(strings.ToLower(pkg.Description.Default), keyword) ||
-			strings.Contains(strings.ToLower(pkg.Description.ZhCN), keyword) ||
-			strings.Contains(strings.ToLower(pkg.Description.ZhCHT), keyword) ||
-			strings.Contains(strings.ToLower(pkg.Description.EnUS), keyword) ||
-			strings.Contains(strings.ToLower(path.Base(pkg.RepoURL)), keyword) {
+		if strings.Contains(strings.ToLower(path.Base(pkg.RepoURL)), keyword) {
 			return true
 		}
 
+		// 名称和描述按语言存储，匹配任意一种语言即可
+		for _, name := range pkg.DisplayName {
+			if strings.Contains(strings.ToLower(name), keyword) {
+				return true
+			}
+		}
+		for _, desc := range pkg.Description {
+			if strings.Contains(strings.ToLower(desc), keyword) {
+				return true
+			}
+		}
+
 		for _, pkgKeyword := range pkg.Keywords {
 			if strings.Contains(strings.ToLower(pkgKeyword), keyword) {
 				return true
@@ -0,0 +1,144 @@
+// SiYuan - Refactor your thinking
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/bazaar"
+	"github.com/siyuan-note/siyuan/kernel/conf"
+	"github.com/siyuan-note/siyuan/kernel/util"
+)
+
+// 测试日志写入临时目录，避免在源码目录中生成 logging.log
+func TestMain(m *testing.M) {
+	logDir, err := os.MkdirTemp("", "model-test-")
+	if nil != err {
+		panic(err)
+	}
+	logging.SetLogPath(filepath.Join(logDir, "logging.log"))
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+// 包名和仓库名不同时，安装、列出、加载和卸载都使用包名作为目录名
+func TestBazaarPluginNameDiffersFromRepo(t *testing.T) {
+	dataDir, tempDir, ossServer, appConf := util.DataDir, util.TempDir, util.BazaarOSSServer, Conf
+	util.DataDir, util.TempDir = t.TempDir(), t.TempDir()
+	Conf = &AppConf{Lang: "en_US", System: &conf.System{}, Bazaar: &conf.Bazaar{Trust: true}, m: &sync.Mutex{}}
+	t.Cleanup(func() {
+		util.DataDir, util.TempDir, util.BazaarOSSServer, Conf = dataDir, tempDir, ossServer, appConf
+	})
+	// 列出已安装插件时会检查更新，通过不可用的代理让云端请求立即失败，本地的集市 OSS 地址不走代理
+	t.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+
+	const repoURL = "https://github.com/siyuan-note/plugin-repo"
+	buf := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(buf)
+	for name, content := range map[string]string{
+		"plugin-repo-main/plugin.json": `{"name":"my-plugin","url":"` + repoURL + `","version":"1.0.0","backends":["all"],"frontends":["all"]}`,
+		"plugin-repo-main/index.js":    "console.log('my-plugin')",
+		"plugin-repo-main/README.md":   "# My Plugin",
+	} {
+		w, err := zipWriter.Create(name)
+		if nil != err {
+			t.Fatalf("create zip entry failed: %s", err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zipWriter.Close(); nil != err {
+		t.Fatalf("close zip failed: %s", err)
+	}
+	data := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+	util.BazaarOSSServer = server.URL
+
+	if _, err := InstallBazaarPlugin(repoURL, "0000000000000000000000000000000000000001", "my-plugin"); nil != err {
+		t.Fatalf("install plugin failed: %s", err)
+	}
+	installPath := filepath.Join(util.DataDir, "plugins", "my-plugin")
+	if !gulu.File.IsDir(installPath) {
+		t.Fatalf("expected plugin to be installed into [%s]", installPath)
+	}
+
+	plugins := InstalledPlugins("desktop", "")
+	if 1 != len(plugins) || "my-plugin" != plugins[0].Name {
+		t.Fatalf("expected installed plugin [my-plugin], got %v", plugins)
+	}
+
+	if _, err := SetPetalEnabled("my-plugin", true, "desktop"); nil != err {
+		t.Fatalf("enable plugin failed: %s", err)
+	}
+	petals := LoadPetals("desktop")
+	if 1 != len(petals) || "my-plugin" != petals[0].Name || "console.log('my-plugin')" != petals[0].JS {
+		t.Fatalf("expected loaded plugin [my-plugin], got %v", petals)
+	}
+
+	if err := UninstallBazaarPlugin("my-plugin", "desktop"); nil != err {
+		t.Fatalf("uninstall plugin failed: %s", err)
+	}
+	if gulu.File.IsExist(installPath) {
+		t.Fatalf("expected plugin to be uninstalled")
+	}
+	if petals = LoadPetals("desktop"); 0 != len(petals) {
+		t.Fatalf("expected no loaded plugins, got %v", petals)
+	}
+}
+
+func TestInitBazaar(t *testing.T) {
+	appConf := Conf
+	Conf = &AppConf{Bazaar: &conf.Bazaar{TrustedAuthors: []string{"Siyuan-Note"}, StageIndexCacheTTL: -1}, m: &sync.Mutex{}}
+	t.Cleanup(func() {
+		Conf = &AppConf{Bazaar: conf.NewBazaar(), m: &sync.Mutex{}}
+		InitBazaar()
+		Conf = appConf
+	})
+
+	InitBazaar()
+	if !bazaar.IsTrustedAuthor("https://github.com/siyuan-note/plugin") || bazaar.IsTrustedAuthor("https://github.com/someone/plugin") {
+		t.Fatalf("expected trusted authors to be applied")
+	}
+	if 0 <= bazaar.GetStageIndexCacheTTL() {
+		t.Fatalf("expected stage index cache to be disabled, got %s", bazaar.GetStageIndexCacheTTL())
+	}
+	// 旧配置中没有的设置使用默认值
+	if defaults := conf.NewBazaar(); defaults.MaxReadmeSize != Conf.Bazaar.MaxReadmeSize || nil == Conf.Bazaar.Freshness || 90 != Conf.Bazaar.Freshness.Aging {
+		t.Fatalf("expected missing settings to be filled with defaults, got %+v", Conf.Bazaar)
+	}
+
+	Conf.Bazaar = conf.NewBazaar()
+	InitBazaar()
+	if !bazaar.IsTrustedAuthor("https://github.com/someone/plugin") || time.Hour != bazaar.GetStageIndexCacheTTL() {
+		t.Fatalf("expected default settings to be applied")
+	}
+}
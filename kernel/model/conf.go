@@ -38,6 +38,7 @@ import (
 	"github.com/siyuan-note/eventbus"
 	"github.com/siyuan-note/filelock"
 	"github.com/siyuan-note/logging"
+	"github.com/siyuan-note/siyuan/kernel/bazaar"
 	"github.com/siyuan-note/siyuan/kernel/conf"
 	"github.com/siyuan-note/siyuan/kernel/sql"
 	"github.com/siyuan-note/siyuan/kernel/treenode"
@@ -354,6 +355,7 @@ func InitConf() {
 	if nil == Conf.Bazaar {
 		Conf.Bazaar = conf.NewBazaar()
 	}
+	InitBazaar()
 
 	if nil == Conf.Repo {
 		Conf.Repo = conf.NewRepo()
@@ -618,6 +620,7 @@ func Close(force, setCurrentWorkspace bool, execInstallPkg int) (exitCode int) {
 		}
 	}
 
+	bazaar.WaitPackageDownloads(3 * time.Second)
 	Conf.Close()
 	sql.CloseDatabase()
 	treenode.SaveBlockTree(false)
@@ -94,7 +94,7 @@ func LoadPetals(frontend string) (ret []*Petal) {
 		}
 
 		_, petal.DisplayName, petal.Incompatible = bazaar.ParseInstalledPlugin(petal.Name, frontend)
-		if !petal.Enabled || petal.Incompatible {
+		if !petal.Enabled || petal.Incompatible || !bazaar.IsPackageEnabled("plugins", petal.Name) {
 			continue
 		}
 
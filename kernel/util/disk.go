@@ -33,3 +33,16 @@ func NeedWarnDiskUsage(dataSize int64) bool {
 	logging.LogInfof("disk usage [total=%s, used=%s, free=%s]", humanize.BytesCustomCeil(usage.Total, 2), humanize.BytesCustomCeil(usage.Used, 2), humanize.BytesCustomCeil(usage.Free, 2))
 	return usage.Free < uint64(dataSize*2)
 }
+
+// DiskInodesFree 返回 path 所在文件系统的可用 inode 数量，操作系统不提供 inode 信息（比如 Windows）时 ok 为 false。
+func DiskInodesFree(path string) (free uint64, ok bool) {
+	usage, err := disk.Usage(path)
+	if nil != err {
+		logging.LogWarnf("get disk usage of [%s] failed: %s", path, err)
+		return
+	}
+	if 0 == usage.InodesTotal {
+		return
+	}
+	return usage.InodesFree, true
+}
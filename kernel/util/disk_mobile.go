@@ -21,3 +21,7 @@ package util
 func NeedWarnDiskUsage(dataSize int64) bool {
 	return false
 }
+
+func DiskInodesFree(path string) (free uint64, ok bool) {
+	return
+}
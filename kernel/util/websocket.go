@@ -255,6 +255,21 @@ func PushDownloadProgress(id string, percent float32) {
 	PushEvent(evt)
 }
 
+// PushDownloadProgressWithRate 推送下载进度，同时推送平滑后的下载速度（字节/秒）和预计剩余秒数，eta 小于 0 表示无法估算，此时不推送剩余时间。
+func PushDownloadProgressWithRate(id string, percent float32, speed, eta int64) {
+	evt := NewCmdResult("downloadProgress", 0, PushModeBroadcast)
+	data := map[string]interface{}{
+		"id":      id,
+		"percent": percent,
+		"speed":   speed,
+	}
+	if 0 <= eta {
+		data["eta"] = eta
+	}
+	evt.Data = data
+	PushEvent(evt)
+}
+
 func PushEvent(event *Result) {
 	msg := event.Bytes()
 	mode := event.PushMode